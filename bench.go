@@ -0,0 +1,154 @@
+package kcp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const benchChunk = 32768 // bytes per Write of RunBench
+
+// RunEchoServer writes back whatever the sessions of l read, each until it fails. It
+// returns the error of Accept, once l is closed.
+func RunEchoServer(l *Listener) error {
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return err
+		}
+		go echo(s)
+	}
+}
+
+// echo writes back what s reads until either fails, then closes s
+func echo(s *UDPSession) {
+	defer s.Close()
+	buf := make([]byte, 65536)
+	for {
+		n, err := s.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := s.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// Report is the outcome of RunBench. The fields, their JSON names and the lines of
+// String are stable, so reports of different releases compare. Durations are in
+// nanoseconds in JSON.
+type Report struct {
+	Remote     string        `json:"remote"`
+	Bytes      int64         `json:"bytes"` // echoed back and verified
+	Duration   time.Duration `json:"duration_ns"`
+	Throughput float64       `json:"throughput_bytes_per_sec"` // of Bytes
+
+	// round trips measured from the acknowledgements, see SessionStats.RTT
+	RTTSamples uint64        `json:"rtt_samples"`
+	RTTMin     time.Duration `json:"rtt_min_ns"`
+	RTTAvg     time.Duration `json:"rtt_avg_ns"`
+	RTTP99     time.Duration `json:"rtt_p99_ns"`
+	RTTMax     time.Duration `json:"rtt_max_ns"`
+
+	// data segments sent, see TrafficStats
+	Segments         uint64  `json:"segments"`
+	RetransSegments  uint64  `json:"retrans_segments"`
+	LostSegments     uint64  `json:"lost_segments"`
+	SpuriousSegments uint64  `json:"spurious_segments"`
+	RetransRatio     float64 `json:"retrans_ratio"` // retransmissions per new segment
+	LossRatio        float64 `json:"loss_ratio"`    // retransmissions after the rto per new segment
+
+	Error string `json:"error,omitempty"` // why the run stopped early
+}
+
+// String formats the report as text, one measurement per line
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "remote: %v\n", r.Remote)
+	fmt.Fprintf(&b, "bytes: %v\n", r.Bytes)
+	fmt.Fprintf(&b, "duration: %v\n", r.Duration)
+	fmt.Fprintf(&b, "throughput: %.0f B/s\n", r.Throughput)
+	fmt.Fprintf(&b, "rtt: min %v avg %v p99 %v max %v, %v samples\n", r.RTTMin, r.RTTAvg, r.RTTP99, r.RTTMax, r.RTTSamples)
+	fmt.Fprintf(&b, "segments: %v sent, %v retransmitted, %v lost, %v spurious\n",
+		r.Segments, r.RetransSegments, r.LostSegments, r.SpuriousSegments)
+	fmt.Fprintf(&b, "retransmit ratio: %.4f\n", r.RetransRatio)
+	fmt.Fprintf(&b, "loss ratio: %.4f\n", r.LossRatio)
+	if r.Error != "" {
+		fmt.Fprintf(&b, "error: %v\n", r.Error)
+	}
+	return b.String()
+}
+
+// RunBench writes size bytes to s, an echo server of RunEchoServer at the other end,
+// and reads them back, verifying them. The report takes the statistics of the whole
+// session, so s is best new. Without a read deadline on s, a lost peer blocks it
+// until the session detects the dead link; closing s ends it too.
+func RunBench(s *UDPSession, size int64) Report {
+	start := time.Now()
+	werr := make(chan error, 1)
+	go func() {
+		buf := make([]byte, benchChunk)
+		for off := int64(0); off < size; off += int64(len(buf)) {
+			if size-off < int64(len(buf)) {
+				buf = buf[:size-off]
+			}
+			benchPattern(buf, off)
+			if _, err := s.Write(buf); err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- nil
+	}()
+
+	var err error
+	var got int64
+	buf := make([]byte, 65536)
+	want := make([]byte, len(buf))
+	for got < size && err == nil {
+		var n int
+		if n, err = s.Read(buf); n > 0 {
+			benchPattern(want[:n], got)
+			if !bytes.Equal(buf[:n], want[:n]) {
+				err = errors.Errorf("kcp: echo differs at byte %v", got)
+				break
+			}
+			got += int64(n)
+		}
+	}
+	if got == size {
+		err = <-werr
+	}
+
+	r := Report{Remote: s.RemoteAddr().String(), Bytes: got, Duration: time.Since(start)}
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Bytes) / r.Duration.Seconds()
+	}
+	st := s.Stats()
+	r.RTTSamples, r.RTTMin, r.RTTAvg, r.RTTP99, r.RTTMax = st.RTT.Count, st.RTT.Min, st.RTT.Avg, st.RTT.P99, st.RTT.Max
+	r.Segments, r.RetransSegments = st.Sent.Segments, st.Sent.RetransSegments
+	r.LostSegments, r.SpuriousSegments = st.Sent.Lost, st.Sent.Spurious
+	if r.Segments > 0 {
+		r.RetransRatio = float64(r.RetransSegments) / float64(r.Segments)
+		r.LossRatio = float64(r.LostSegments) / float64(r.Segments)
+	}
+	switch {
+	case err == io.EOF:
+		r.Error = "kcp: the session closed"
+	case err != nil:
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// benchPattern fills buf with the bytes of RunBench at offset off of the stream
+func benchPattern(buf []byte, off int64) {
+	for i := range buf {
+		buf[i] = byte((off + int64(i)) % 251)
+	}
+}
@@ -0,0 +1,114 @@
+package kcp
+
+import "sync/atomic"
+
+// memoryBudget caps the memory held by a group of connections, see Listener.SetMemoryBudget.
+// The windows a connection advertises are committed along with the bytes it holds,
+// as the peers may fill them at any time.
+type memoryBudget struct {
+	limit     int64 // 0 for no limit
+	held      int64 // bytes held by all connections
+	committed int64 // bytes held plus the advertised windows of all connections
+	active    int64 // connections with committed bytes
+}
+
+// limits returns the fair share of a connection with committed bytes and what
+// the others leave of the budget, or false if there's no limit
+func (b *memoryBudget) limits(committed int64) (share, free int64, limited bool) {
+	limit := atomic.LoadInt64(&b.limit)
+	if limit <= 0 {
+		return 0, 0, false
+	}
+	active := atomic.LoadInt64(&b.active)
+	if committed == 0 {
+		active++
+	}
+	if active < 1 {
+		active = 1
+	}
+	return limit / active, limit - (atomic.LoadInt64(&b.committed) - committed), true
+}
+
+// commit accounts a connection now holding held and committing committed bytes,
+// instead of oldHeld and oldCommitted
+func (b *memoryBudget) commit(oldHeld, oldCommitted, held, committed int64) {
+	atomic.AddInt64(&b.held, held-oldHeld)
+	atomic.AddInt64(&b.committed, committed-oldCommitted)
+	if oldCommitted == 0 && committed > 0 {
+		atomic.AddInt64(&b.active, 1)
+	} else if oldCommitted > 0 && committed == 0 {
+		atomic.AddInt64(&b.active, -1)
+	}
+}
+
+// account updates the memory budget of the connection and caps the window it
+// advertises, c.mu must be held
+func (c *KCPConn) account() {
+	if c.budget == nil || c.isClosed {
+		return
+	}
+	held := int64(c.kcp.nsegs)*mtuLimit + atomic.LoadInt64(&c.sockbytes)
+	share, free, limited := c.budget.limits(c.committed)
+
+	wnd := int32(-1) // on top of the received segments
+	if limited {
+		// a connection below its share may always hold IKCP_WND_RCV segments, so newcomers aren't starved
+		room := free - held
+		if min := int64(IKCP_WND_RCV*mtuLimit) - held; room < min {
+			room = min
+		}
+		if room > share-held {
+			room = share - held
+		}
+		wnd = int32(room / mtuLimit)
+		if wnd < 1 && c.kcp.PeekSize() < 0 { // a segment at a time, unless the application is behind
+			wnd = 1
+		} else if wnd < 0 {
+			wnd = 0
+		}
+	}
+	if c.holdLimit > 0 {
+		segs := c.holdLimit / int(c.kcp.mss)
+		if segs < 1 {
+			segs = 1
+		}
+		room := int32(segs - len(c.kcp.rcv_queue) - len(c.kcp.rcv_buf))
+		if room < 0 {
+			room = 0
+		}
+		if wnd < 0 || room < wnd {
+			wnd = room
+		}
+	}
+	closed := c.kcp.wnd_unused() == 0
+	c.kcp.rcv_cap = -1
+	if wnd >= 0 { // segments arriving before the next update use up the window
+		c.kcp.rcv_cap = wnd + int32(len(c.kcp.rcv_queue)+len(c.kcp.rcv_buf))
+	}
+	if closed && c.kcp.wnd_unused() > 0 {
+		c.kcp.probe |= IKCP_ASK_TELL // the window reopens
+	}
+
+	committed := held + int64(c.kcp.wnd_unused())*mtuLimit
+	c.budget.commit(c.held, c.committed, held, committed)
+	c.held, c.committed = held, committed
+
+	squeezed := limited && held > share
+	if c.squeezed && !squeezed {
+		c.notifyWriteEvent()
+	} else if !c.squeezed && squeezed {
+		if c.onEvent != nil {
+			c.onEvent(EventRateLimited)
+		}
+		c.softError(SoftRateLimited, 0, "writes wait for the memory budget")
+	}
+	c.squeezed = squeezed
+}
+
+// unaccount removes a closed connection from the budget, c.mu must be held
+func (c *KCPConn) unaccount() {
+	if c.budget != nil {
+		c.budget.commit(c.held, c.committed, 0, 0)
+		c.held, c.committed = 0, 0
+	}
+}
@@ -0,0 +1,49 @@
+//go:build kcpchaos
+// +build kcpchaos
+
+package kcp
+
+import (
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// chaosEnabled tells whether the chaos hooks are built in, with the kcpchaos build tag
+const chaosEnabled = true
+
+// chaos perturbs every connection of the process, to shake out rare bugs in soak
+// tests, see setChaos
+var chaos struct {
+	updateDelay int64  // the updater sleeps up to it before a round, a time.Duration
+	retransmit  uint64 // the chance flush sends a segment in flight again, float64 bits
+	jitter      uint32 // ms currentMs runs ahead, up to
+}
+
+// setChaos makes the updater sleep up to updateDelay before every round of updates,
+// flush send segments in flight again with a chance of retransmit, and currentMs run
+// ahead by up to jitter, all at random; zeros disable them
+func setChaos(updateDelay time.Duration, retransmit float64, jitter time.Duration) {
+	atomic.StoreInt64(&chaos.updateDelay, int64(updateDelay))
+	atomic.StoreUint64(&chaos.retransmit, math.Float64bits(retransmit))
+	atomic.StoreUint32(&chaos.jitter, uint32(jitter/time.Millisecond))
+}
+
+func chaosDelay() {
+	if d := atomic.LoadInt64(&chaos.updateDelay); d > 0 {
+		time.Sleep(time.Duration(rand.Int63n(d)))
+	}
+}
+
+func chaosRetransmit() bool {
+	p := math.Float64frombits(atomic.LoadUint64(&chaos.retransmit))
+	return p > 0 && rand.Float64() < p
+}
+
+func chaosJitter() uint32 {
+	if j := atomic.LoadUint32(&chaos.jitter); j > 0 {
+		return uint32(rand.Int63n(int64(j)))
+	}
+	return 0
+}
@@ -0,0 +1,19 @@
+//go:build !kcpchaos
+// +build !kcpchaos
+
+package kcp
+
+import "time"
+
+// chaosEnabled tells whether the chaos hooks are built in, with the kcpchaos build tag
+const chaosEnabled = false
+
+// the hooks are empty and inlined away without the kcpchaos build tag, see chaos.go
+
+func setChaos(updateDelay time.Duration, retransmit float64, jitter time.Duration) {}
+
+func chaosDelay() {}
+
+func chaosRetransmit() bool { return false }
+
+func chaosJitter() uint32 { return 0 }
@@ -0,0 +1,257 @@
+// Command kcpdump decodes captured kcp datagrams, given as hex, one per line, or as
+// the UDP payloads of a pcap file.
+//
+//	kcpdump -crypt aes -key 00112233... -fec < datagrams.txt
+//	kcpdump -pcap capture.pcap -port 4000
+//	kcpdump -layout
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/xtaci/kcp-go"
+)
+
+var ciphers = map[string]func(key []byte) (kcp.BlockCrypt, error){
+	"aes":      kcp.NewAESBlockCrypt,
+	"salsa20":  kcp.NewSalsa20BlockCrypt,
+	"blowfish": kcp.NewBlowfishBlockCrypt,
+	"twofish":  kcp.NewTwofishBlockCrypt,
+	"cast5":    kcp.NewCast5BlockCrypt,
+	"3des":     kcp.NewTripleDESBlockCrypt,
+	"tea":      kcp.NewTEABlockCrypt,
+	"xtea":     kcp.NewXTEABlockCrypt,
+	"xor":      kcp.NewSimpleXORBlockCrypt,
+	"none":     kcp.NewNoneBlockCrypt,
+}
+
+var commands = map[uint8]string{
+	kcp.IKCP_CMD_PUSH:  "push",
+	kcp.IKCP_CMD_ACK:   "ack",
+	kcp.IKCP_CMD_WASK:  "wask",
+	kcp.IKCP_CMD_WINS:  "wins",
+	kcp.IKCP_CMD_HELLO: "hello",
+	kcp.IKCP_CMD_CLOSE: "close",
+	kcp.IKCP_CMD_REKEY: "rekey",
+	kcp.IKCP_CMD_PING:  "ping",
+}
+
+func main() {
+	cipher := flag.String("crypt", "", "cipher of the packets: aes, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, none, empty for unencrypted")
+	key := flag.String("key", "", "key of the cipher, hex")
+	fec := flag.Bool("fec", false, "packets have a FEC header")
+	pcap := flag.String("pcap", "", "read the UDP payloads of a pcap file instead of hex from stdin")
+	port := flag.Int("port", 0, "with -pcap, only datagrams from or to this port")
+	data := flag.Bool("data", false, "print the data of segments, hex")
+	layout := flag.Bool("layout", false, "print the wire format and exit")
+	flag.Parse()
+
+	if *layout {
+		fmt.Print(kcp.WireFormat())
+		return
+	}
+	var block kcp.BlockCrypt
+	if *cipher != "" {
+		newBlock, ok := ciphers[*cipher]
+		if !ok {
+			log.Fatalf("unknown cipher %q", *cipher)
+		}
+		k, err := hex.DecodeString(*key)
+		if err != nil {
+			log.Fatal("key: ", err)
+		}
+		if block, err = newBlock(k); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	n := 0
+	dump := func(datagram []byte) {
+		n++
+		info, err := kcp.DecodePacketForDebug(block, *fec, datagram)
+		if err != nil {
+			fmt.Printf("#%v %v bytes: %v\n", n, len(datagram), err)
+			return
+		}
+		fmt.Printf("#%v %v bytes:%v\n", n, len(datagram), format(info))
+		for _, seg := range info.Segments {
+			name, ok := commands[seg.Cmd]
+			if !ok {
+				name = fmt.Sprint(seg.Cmd)
+			}
+			fmt.Printf("  conv=%v cmd=%v frg=%v wnd=%v ts=%v sn=%v una=%v len=%v\n",
+				seg.Conv, name, seg.Frg, seg.Wnd, seg.Ts, seg.Sn, seg.Una, seg.Len)
+			if *data && len(seg.Data) > 0 {
+				fmt.Printf("    %x\n", seg.Data)
+			}
+		}
+	}
+
+	var err error
+	if *pcap != "" {
+		err = readPcap(*pcap, *port, dump)
+	} else {
+		err = readHex(os.Stdin, dump)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// format lists the properties of a decoded datagram
+func format(info *kcp.PacketInfo) string {
+	var s string
+	flags := []struct {
+		set  bool
+		name string
+	}{
+		{info.Encrypted, "encrypted"},
+		{info.Compact, "compact"},
+		{info.Tokened, "tokened"},
+		{info.Checksummed, "checksummed"},
+	}
+	for _, f := range flags {
+		if f.set {
+			s += " " + f.name
+		}
+	}
+	if info.Padding > 0 {
+		s += fmt.Sprintf(" padding=%v", info.Padding)
+	}
+	if info.FEC {
+		kind := "data"
+		if info.FECParity {
+			kind = "parity"
+		}
+		s += fmt.Sprintf(" fec seqid=%v %v", info.FECSeqID, kind)
+	}
+	return s
+}
+
+// readHex hands the datagrams of r, hex one per line, to dump, blanks and lines
+// starting with # are skipped
+func readHex(r io.Reader, dump func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.Join(strings.Fields(scanner.Text()), "")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		datagram, err := hex.DecodeString(line)
+		if err != nil {
+			return err
+		}
+		dump(datagram)
+	}
+	return scanner.Err()
+}
+
+// link types of pcap files
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+// readPcap hands the UDP payloads of a pcap file to dump, from or to port unless it's 0
+func readPcap(path string, port int, dump func([]byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	var order binary.ByteOrder
+	switch magic := binary.LittleEndian.Uint32(header[:]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond and nanosecond timestamps
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("not a pcap file, magic %#x", magic)
+	}
+	link := order.Uint32(header[20:])
+
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		frame := make([]byte, order.Uint32(record[8:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return err
+		}
+		if payload, ok := udpPayload(link, frame, port); ok {
+			dump(payload)
+		}
+	}
+}
+
+// udpPayload returns the payload of a captured frame of a UDP datagram
+func udpPayload(link uint32, frame []byte, port int) ([]byte, bool) {
+	var skip int
+	switch link {
+	case linkNull:
+		skip = 4
+	case linkEthernet:
+		skip = 14
+		if len(frame) >= 18 && binary.BigEndian.Uint16(frame[12:]) == 0x8100 { // VLAN tag
+			skip = 18
+		}
+	case linkRaw:
+	case linkLinuxSLL:
+		skip = 16
+	default:
+		return nil, false
+	}
+	if len(frame) < skip+1 {
+		return nil, false
+	}
+	ip := frame[skip:]
+
+	var udp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0f) * 4
+		if len(ip) < ihl || ihl < 20 || ip[9] != 17 { // 17 is UDP
+			return nil, false
+		}
+		udp = ip[ihl:]
+	case 6:
+		if len(ip) < 40 || ip[6] != 17 { // without extension headers
+			return nil, false
+		}
+		udp = ip[40:]
+	default:
+		return nil, false
+	}
+	if len(udp) < 8 {
+		return nil, false
+	}
+	src, dst := int(binary.BigEndian.Uint16(udp)), int(binary.BigEndian.Uint16(udp[2:]))
+	if port != 0 && src != port && dst != port {
+		return nil, false
+	}
+	size := int(binary.BigEndian.Uint16(udp[4:]))
+	if size < 8 || size > len(udp) { // truncated by the snapshot length
+		return nil, false
+	}
+	return udp[8:size], true
+}
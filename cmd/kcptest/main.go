@@ -0,0 +1,138 @@
+// Command kcptest measures a path with an echo server and a client writing through
+// it, and prints the report of the client, text or JSON.
+//
+//	kcptest server -l :4000 -key secret -mode fast
+//	kcptest client -r host:4000 -key secret -mode fast -size 10485760 -json
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const salt = "kcp-go" // of the key derivation, the one of kcptun
+
+// modes are the nodelay, interval, resend and nc of SetNoDelay
+var modes = map[string][4]int{
+	"normal": {0, 40, 2, 1},
+	"fast":   {0, 30, 2, 1},
+	"fast2":  {1, 20, 2, 1},
+	"fast3":  {1, 10, 2, 1},
+}
+
+// options are the flags both ends share
+type options struct {
+	flags          *flag.FlagSet
+	key, mode      string
+	ds, ps         int
+	sndwnd, rcvwnd int
+	mtu            int
+
+	block kcp.BlockCrypt    // of key, nil without
+	cfg   kcp.SessionConfig // of the flags
+}
+
+func newOptions(name string) *options {
+	o := &options{flags: flag.NewFlagSet(name, flag.ExitOnError)}
+	o.flags.StringVar(&o.key, "key", "", "pre-shared key, AES-256 of its PBKDF2, empty for unencrypted")
+	o.flags.StringVar(&o.mode, "mode", "fast", "normal, fast, fast2 or fast3")
+	o.flags.IntVar(&o.ds, "ds", 0, "FEC data shards")
+	o.flags.IntVar(&o.ps, "ps", 0, "FEC parity shards")
+	o.flags.IntVar(&o.sndwnd, "sndwnd", 1024, "send window, segments")
+	o.flags.IntVar(&o.rcvwnd, "rcvwnd", 1024, "receive window, segments")
+	o.flags.IntVar(&o.mtu, "mtu", kcp.IKCP_MTU_DEF, "mtu of the datagrams")
+	return o
+}
+
+// parse parses args and sets up the cipher and the session configuration
+func (o *options) parse(args []string) {
+	o.flags.Parse(args)
+	mode, ok := modes[o.mode]
+	if !ok {
+		log.Fatalf("unknown mode %q", o.mode)
+	}
+	if o.key != "" {
+		key := pbkdf2.Key([]byte(o.key), []byte(salt), 4096, 32, sha1.New)
+		o.block, _ = kcp.NewAESBlockCrypt(key)
+	}
+	o.cfg = kcp.DefaultSessionConfig()
+	o.cfg.Mtu = o.mtu
+	o.cfg.SndWnd, o.cfg.RcvWnd = o.sndwnd, o.rcvwnd
+	o.cfg.NoDelay, o.cfg.Interval, o.cfg.Resend, o.cfg.NoCongestion = mode[0], mode[1], mode[2], mode[3]
+	o.cfg.StreamMode = true
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "server":
+		server(os.Args[2:])
+	case "client":
+		client(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	log.Fatal("usage: kcptest server -l addr [flags] | kcptest client -r addr [flags], -h for the flags")
+}
+
+func server(args []string) {
+	o := newOptions("server")
+	laddr := o.flags.String("l", ":4000", "address to listen on")
+	o.parse(args)
+
+	l, err := kcp.ListenWithOptions(*laddr, o.block, o.ds, o.ps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := l.SetSessionConfig(o.cfg); err != nil {
+		log.Fatal("configuration: ", err)
+	}
+	log.Printf("echoing on %v", l.Addr())
+	log.Fatal(kcp.RunEchoServer(l))
+}
+
+func client(args []string) {
+	o := newOptions("client")
+	raddr := o.flags.String("r", "127.0.0.1:4000", "address of the server")
+	size := o.flags.Int64("size", 10<<20, "bytes to echo")
+	timeout := o.flags.Duration("timeout", time.Minute, "longest the run takes")
+	asJSON := o.flags.Bool("json", false, "print the report as JSON")
+	o.parse(args)
+
+	s, err := kcp.DialWithOptions(*raddr, o.block, o.ds, o.ps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+	cfg := &o.cfg
+	s.SetMtu(cfg.Mtu)
+	s.SetWindowSize(cfg.SndWnd, cfg.RcvWnd)
+	s.SetNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion)
+	s.SetStreamMode(cfg.StreamMode)
+	s.SetDeadline(time.Now().Add(*timeout))
+
+	report := kcp.RunBench(s, *size)
+	if *asJSON {
+		out, _ := json.MarshalIndent(&report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Print(report.String())
+	}
+	if report.Error != "" {
+		os.Exit(1)
+	}
+}
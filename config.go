@@ -0,0 +1,255 @@
+package kcp
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SessionConfig is the complete configuration of a session, the listener applies it
+// to new sessions before their first packet is processed, see
+// Listener.SetSessionConfig. Start from DefaultSessionConfig, the zero value isn't
+// valid. The fields follow the setters of UDPSession.
+type SessionConfig struct {
+	Mtu             int           // datagram mtu, see SetMtu
+	SndWnd, RcvWnd  int           // window sizes in segments, see SetWindowSize
+	NoDelay         int           // see SetNoDelay
+	Interval        int           // update interval in ms, see SetNoDelay
+	Resend          int           // fast resend, see SetNoDelay
+	NoCongestion    int           // 1 disables the congestion window, see SetNoDelay
+	StreamMode      bool          // see SetStreamMode
+	ACKNoDelay      bool          // see SetACKNoDelay
+	Retries         int           // see SetRetries
+	DeadLinkTime    time.Duration // see SetDeadLinkTime
+	MaxRetransmit   time.Duration // see SetMaxRetransmitDuration
+	Backoff         float64       // see SetBackoff
+	BackoffLinear   bool          // see SetBackoff
+	RecoveryBurst   int           // see SetRecoveryBurst
+	KeepAlive       int           // seconds, see SetKeepAlive
+	DeadLinkMode    int           // see SetDeadLinkMode
+	DeadLinkTimeout time.Duration // see SetDeadLinkMode
+	SuspendBuffer   int           // see SetDeadLinkMode
+	TxQueueLen      int           // see SetTxQueueLen
+	WriteDelay      time.Duration // see SetWriteDelay
+	MtuFallback     bool          // see SetMtuFallback
+}
+
+// DefaultSessionConfig returns the configuration sessions start with
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		Mtu:          IKCP_MTU_DEF,
+		SndWnd:       defaultWndSize,
+		RcvWnd:       defaultWndSize,
+		Interval:     IKCP_INTERVAL,
+		Retries:      IKCP_DEADLINK,
+		DeadLinkTime: IKCP_DEADTIME * time.Millisecond,
+		KeepAlive:    int(defaultKeepAliveInterval / time.Second),
+		TxQueueLen:   txQueueLimit,
+		MtuFallback:  true,
+	}
+}
+
+// validate checks the configuration for sessions with headerSize bytes of headers
+// and padding, it fails for what the setters would reject
+func (cfg *SessionConfig) validate(headerSize int) error {
+	switch {
+	case cfg.Mtu > mtuLimit || cfg.Mtu-headerSize < IKCP_MTU_MIN,
+		cfg.SndWnd <= 0 || cfg.RcvWnd <= 0,
+		cfg.NoDelay < 0 || cfg.Interval < 0 || cfg.Resend < 0 || cfg.NoCongestion < 0,
+		cfg.Retries <= 0 || cfg.DeadLinkTime < 0 || cfg.DeadLinkTime/time.Millisecond > math.MaxInt32,
+		cfg.MaxRetransmit < 0 || cfg.MaxRetransmit/time.Millisecond > math.MaxInt32,
+		cfg.Backoff < 0 || cfg.Backoff > 0 && !cfg.BackoffLinear && cfg.Backoff < 1,
+		cfg.RecoveryBurst < 0,
+		cfg.KeepAlive < 0,
+		cfg.DeadLinkMode < DeadLinkIgnore || cfg.DeadLinkMode > DeadLinkSuspend,
+		cfg.DeadLinkTimeout < 0 || cfg.SuspendBuffer < 0,
+		cfg.TxQueueLen <= 0,
+		cfg.WriteDelay < 0:
+		return errors.New(errInvalidOperation)
+	}
+	return nil
+}
+
+// configure applies a validated configuration to a new session
+func (s *UDPSession) configure(cfg *SessionConfig) {
+	s.SetMtu(cfg.Mtu)
+	s.SetWindowSize(cfg.SndWnd, cfg.RcvWnd)
+	s.SetNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion)
+	s.SetStreamMode(cfg.StreamMode)
+	s.SetACKNoDelay(cfg.ACKNoDelay)
+	s.SetRetries(cfg.Retries)
+	s.SetDeadLinkTime(cfg.DeadLinkTime)
+	s.SetMaxRetransmitDuration(cfg.MaxRetransmit)
+	s.SetBackoff(cfg.Backoff, cfg.BackoffLinear)
+	s.SetRecoveryBurst(cfg.RecoveryBurst)
+	s.SetKeepAlive(cfg.KeepAlive)
+	s.SetDeadLinkMode(cfg.DeadLinkMode, cfg.DeadLinkTimeout, cfg.SuspendBuffer)
+	s.SetTxQueueLen(cfg.TxQueueLen)
+	s.SetWriteDelay(cfg.WriteDelay)
+	s.SetMtuFallback(cfg.MtuFallback)
+}
+
+// SetSessionConfig sets the configuration of the sessions accepted afterwards, they
+// are configured before their first packet is processed, so the first segments they
+// send already follow it. Setting a session after Accept races with the packets
+// arriving before. It fails for an invalid configuration, or an mtu without room for
+// the headers and the padding.
+func (l *Listener) SetSessionConfig(cfg SessionConfig) error {
+	headerSize := l.headerSize
+	if padding := int(atomic.LoadInt32(&l.padding)); padding > 0 {
+		headerSize += padding + padLenSize
+	}
+	if err := cfg.validate(headerSize); err != nil {
+		return err
+	}
+	if err := strictLate(atomic.LoadInt32(&l.served) != 0, "Listener.SetSessionConfig"); err != nil {
+		return err
+	}
+	l.config.Store(&cfg)
+	return nil
+}
+
+// SessionConfigSnapshot is what a session runs with, see UDPSession.Config: the
+// settings of the SessionConfig fields, and what the negotiation with the peer, the
+// mtu fallback and the fast resend tuning made of them, along with the packet format
+// and the rate limit. The fields and their JSON names are stable, so the snapshots of
+// a fleet compare. Durations are in nanoseconds in JSON.
+type SessionConfigSnapshot struct {
+	Mtu         int  `json:"mtu"`          // datagram mtu, lowered by the mtu fallback, see SetMtu
+	WireMtu     int  `json:"wire_mtu"`     // the largest datagram sent, within the mtu of the peer
+	PeerMtu     int  `json:"peer_mtu"`     // announced by the peer, 0 if unknown, see PeerMtu
+	MSS         int  `json:"mss"`          // data of a segment, see EffectiveMSS
+	MtuFallback bool `json:"mtu_fallback"` // see SetMtuFallback
+
+	SndWnd           int           `json:"snd_wnd"`            // see SetWindowSize
+	RcvWnd           int           `json:"rcv_wnd"`            // see SetWindowSize
+	RmtWnd           int           `json:"rmt_wnd"`            // the window the peer advertised last
+	NoDelay          int           `json:"nodelay"`            // see SetNoDelay
+	Interval         time.Duration `json:"interval_ns"`        // update interval, see SetNoDelay and SetInterval
+	Resend           int           `json:"resend"`             // fast resend threshold, as tuned
+	FastResendTuning bool          `json:"fast_resend_tuning"` // see SetFastResendTuning
+	NoCongestion     int           `json:"no_congestion"`      // 1 without the congestion window
+	StreamMode       bool          `json:"stream_mode"`        // see SetStreamMode
+	ACKNoDelay       bool          `json:"ack_nodelay"`        // see SetACKNoDelay
+	WriteDelay       time.Duration `json:"write_delay_ns"`     // see SetWriteDelay
+	TxQueueLen       int           `json:"tx_queue_len"`       // see SetTxQueueLen
+
+	Retries         int           `json:"retries"`              // see SetRetries
+	DeadLinkTime    time.Duration `json:"dead_link_time_ns"`    // see SetDeadLinkTime
+	MaxRetransmit   time.Duration `json:"max_retransmit_ns"`    // 0 for no bound, see SetMaxRetransmitDuration
+	Backoff         float64       `json:"backoff"`              // 0 for the default, see SetBackoff
+	BackoffLinear   bool          `json:"backoff_linear"`       // see SetBackoff
+	RecoveryBurst   int           `json:"recovery_burst"`       // see SetRecoveryBurst
+	KeepAlive       time.Duration `json:"keepalive_ns"`         // 0 for none, see SetKeepAlive
+	DeadLinkMode    int           `json:"dead_link_mode"`       // see SetDeadLinkMode
+	DeadLinkTimeout time.Duration `json:"dead_link_timeout_ns"` // see SetDeadLinkMode
+	SuspendBuffer   int           `json:"suspend_buffer"`       // see SetDeadLinkMode
+
+	Cipher          string `json:"cipher"`            // like "aes" or "salsa20", "" unencrypted
+	PacketToken     bool   `json:"packet_token"`      // see SetPacketToken
+	CompactNonce    bool   `json:"compact_nonce"`     // negotiated, see SetCompactNonce
+	Checksum        bool   `json:"checksum"`          // negotiated, see SetChecksum
+	HeaderProfile   int    `json:"header_profile"`    // negotiated, HeaderLegacy to HeaderElided, see SetCompactHeader
+	Padding         int    `json:"padding"`           // see SetPadding
+	FixedPacketSize int    `json:"fixed_packet_size"` // see SetFixedPacketSize
+	DataShards      int    `json:"data_shards"`       // FEC, 0 for none
+	ParityShards    int    `json:"parity_shards"`     // FEC, 0 for none
+	Epoch           uint32 `json:"epoch"`             // key epoch of the packets sent, see SetRekey
+
+	PeerVersion uint8 `json:"peer_version"` // protocol version of the peer, 0 if it doesn't negotiate
+	PeerFlags   uint8 `json:"peer_flags"`   // capabilities of the peer
+
+	Rate  int64 `json:"rate"`  // bytes per second of the SessionGroup, 0 for no limit
+	Burst int64 `json:"burst"` // bytes written at once above Rate
+}
+
+// Config returns what the session runs with now, assembled at once, see
+// SessionConfigSnapshot. Every call takes a new copy, the setters, the negotiation and
+// the tuners show in the next one.
+func (s *UDPSession) Config() SessionConfigSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kcp := s.kcp
+	f := s.packetFormat()
+	version, flags := kcp.RemoteHello()
+	_, tokened := s.token.Load().(*packetToken)
+	cfg := SessionConfigSnapshot{
+		Mtu:              s.mtu,
+		WireMtu:          s.wireMtu(),
+		PeerMtu:          s.peerMtu,
+		MSS:              int(kcp.mss),
+		MtuFallback:      !s.pmtu.disabled,
+		SndWnd:           int(kcp.snd_wnd),
+		RcvWnd:           int(kcp.rcv_wnd),
+		RmtWnd:           int(kcp.rmt_wnd),
+		NoDelay:          int(kcp.nodelay),
+		Interval:         time.Duration(kcp.interval) * time.Millisecond,
+		Resend:           int(kcp.fastresend),
+		FastResendTuning: kcp.reorder.tune,
+		StreamMode:       kcp.stream != 0,
+		ACKNoDelay:       s.ackNoDelay,
+		WriteDelay:       s.writeDelay,
+		TxQueueLen:       s.txQueueLen,
+		Retries:          int(kcp.dead_link),
+		DeadLinkTime:     time.Duration(kcp.dead_time) * time.Millisecond,
+		MaxRetransmit:    time.Duration(kcp.dead_age) * time.Millisecond,
+		Backoff:          kcp.backoff,
+		BackoffLinear:    kcp.backoffLinear,
+		RecoveryBurst:    int(kcp.rto_burst),
+		KeepAlive:        s.keepAliveInterval,
+		DeadLinkMode:     s.deadLink,
+		DeadLinkTimeout:  s.deadLinkTimeout,
+		SuspendBuffer:    s.suspendBuffer,
+		Cipher:           cipherName(s.block),
+		PacketToken:      tokened,
+		CompactNonce:     f.Compact,
+		Checksum:         f.Checksummed,
+		HeaderProfile:    f.Header,
+		Padding:          f.Padding,
+		FixedPacketSize:  f.FixedPacketSize,
+		Epoch:            s.rekey.epoch,
+		PeerVersion:      version,
+		PeerFlags:        flags,
+	}
+	if kcp.nocwnd != 0 {
+		cfg.NoCongestion = 1
+	}
+	if s.fec != nil {
+		cfg.DataShards, cfg.ParityShards = s.fec.dataShards, s.fec.parityShards
+	}
+	if s.limit != nil {
+		cfg.Rate, cfg.Burst = int64(s.limit.rate), int64(s.limit.burst)
+	}
+	return cfg
+}
+
+// cipherName returns the name of the cipher of block, "" for nil
+func cipherName(block BlockCrypt) string {
+	switch block.(type) {
+	case nil:
+		return ""
+	case *aesBlockCrypt:
+		return "aes"
+	case *salsa20BlockCrypt:
+		return "salsa20"
+	case *twofishBlockCrypt:
+		return "twofish"
+	case *tripleDESBlockCrypt:
+		return "3des"
+	case *cast5BlockCrypt:
+		return "cast5"
+	case *blowfishBlockCrypt:
+		return "blowfish"
+	case *teaBlockCrypt:
+		return "tea"
+	case *xteaBlockCrypt:
+		return "xtea"
+	case *simpleXORBlockCrypt:
+		return "xor"
+	case *noneBlockCrypt:
+		return "none"
+	}
+	return "custom"
+}
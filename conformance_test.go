@@ -0,0 +1,368 @@
+package kcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// ikcpSegment lays out a segment the way ikcp_encode_seg of the reference C implementation does
+func ikcpSegment(conv uint32, cmd, frg uint8, wnd uint16, ts, sn, una uint32, data []byte) []byte {
+	b := make([]byte, IKCP_OVERHEAD+len(data))
+	binary.LittleEndian.PutUint32(b[0:], conv)
+	b[4] = cmd
+	b[5] = frg
+	binary.LittleEndian.PutUint16(b[6:], wnd)
+	binary.LittleEndian.PutUint32(b[8:], ts)
+	binary.LittleEndian.PutUint32(b[12:], sn)
+	binary.LittleEndian.PutUint32(b[16:], una)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(data)))
+	copy(b[24:], data)
+	return b
+}
+
+// capturedKCP creates a KCP recording every output datagram
+func capturedKCP(conv uint32, outputs *[][]byte) *KCP {
+	return NewKCP(conv, func(buf []byte, size int) {
+		*outputs = append(*outputs, append([]byte(nil), buf[:size]...))
+	})
+}
+
+func pattern(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7) + seed
+	}
+	return b
+}
+
+func expectOutputs(t *testing.T, got, want [][]byte) {
+	if len(got) != len(want) {
+		t.Fatalf("got %v datagrams, want %v", len(got), len(want))
+	}
+	for k := range want {
+		if !bytes.Equal(got[k], want[k]) {
+			t.Fatalf("datagram %v:\n got %x\nwant %x", k, got[k], want[k])
+		}
+	}
+}
+
+// fragmentation of a scripted send pattern, and retransmission on timeout
+func TestConformanceSend(t *testing.T) {
+	var outputs [][]byte
+	kcp := capturedKCP(0x11223344, &outputs)
+	kcp.NoDelay(1, 10, 2, 1)
+	kcp.WndSize(32, 32)
+
+	msg := pattern(3000, 1)
+	kcp.Send(msg)
+	kcp.Send(msg[:10])
+
+	mss := IKCP_MTU_DEF - IKCP_OVERHEAD
+	datagrams := func(ts uint32) [][]byte {
+		return [][]byte{
+			ikcpSegment(0x11223344, IKCP_CMD_PUSH, 2, 32, ts, 0, 0, msg[:mss]),
+			ikcpSegment(0x11223344, IKCP_CMD_PUSH, 1, 32, ts, 1, 0, msg[mss:2*mss]),
+			append(ikcpSegment(0x11223344, IKCP_CMD_PUSH, 0, 32, ts, 2, 0, msg[2*mss:]),
+				ikcpSegment(0x11223344, IKCP_CMD_PUSH, 0, 32, ts, 3, 0, msg[:10])...),
+		}
+	}
+
+	kcp.Update(0)
+	expectOutputs(t, outputs, datagrams(0))
+	outputs = nil
+	kcp.Update(10)
+	expectOutputs(t, outputs, nil)
+	kcp.Update(1000)
+	expectOutputs(t, outputs, datagrams(1000))
+}
+
+// out-of-order and duplicated delivery of fragments
+func TestConformanceReassembly(t *testing.T) {
+	var outputs [][]byte
+	kcp := capturedKCP(7, &outputs)
+	kcp.NoDelay(1, 10, 2, 1)
+	kcp.WndSize(32, 32)
+
+	msg := pattern(2000, 2)
+	mss := IKCP_MTU_DEF - IKCP_OVERHEAD
+	seg0 := ikcpSegment(7, IKCP_CMD_PUSH, 1, 32, 0, 0, 0, msg[:mss])
+	seg1 := ikcpSegment(7, IKCP_CMD_PUSH, 0, 32, 0, 1, 0, msg[mss:])
+	seg2 := ikcpSegment(7, IKCP_CMD_PUSH, 0, 32, 0, 2, 0, msg[:100])
+
+	buf := make([]byte, 65536)
+	kcp.Input(seg2, true)
+	kcp.Update(0)
+	if n := kcp.Recv(buf); n >= 0 {
+		t.Fatal("received out of order", n)
+	}
+	kcp.Input(seg0, true)
+	kcp.Input(seg0, true)
+	kcp.Update(10)
+	if n := kcp.Recv(buf); n >= 0 {
+		t.Fatal("received an incomplete message", n)
+	}
+	outputs = nil
+	kcp.Input(seg1, true)
+	kcp.Update(20)
+
+	if n := kcp.Recv(buf); !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("got %x", buf[:n])
+	}
+	if n := kcp.Recv(buf); !bytes.Equal(buf[:n], msg[:100]) {
+		t.Fatalf("got %x", buf[:n])
+	}
+	if n := kcp.Recv(buf); n >= 0 {
+		t.Fatal("received an extra message", n)
+	}
+
+	// the acknowledgement covers everything
+	if len(outputs) != 1 {
+		t.Fatal("got", len(outputs), "datagrams")
+	}
+	last := outputs[0][len(outputs[0])-IKCP_OVERHEAD:]
+	if last[4] != IKCP_CMD_ACK || binary.LittleEndian.Uint32(last[16:]) != 3 {
+		t.Fatalf("got %x", last)
+	}
+}
+
+// window probing with IKCP_CMD_WASK and IKCP_CMD_WINS
+func TestConformanceProbe(t *testing.T) {
+	var outputs [][]byte
+	kcp := capturedKCP(9, &outputs)
+	kcp.NoDelay(0, 10, 0, 0)
+	kcp.WndSize(32, 32)
+
+	kcp.Update(0)
+	kcp.Input(ikcpSegment(9, IKCP_CMD_WASK, 0, 0, 0, 0, 0, nil), true)
+	kcp.Update(10)
+	expectOutputs(t, outputs, [][]byte{ikcpSegment(9, IKCP_CMD_WINS, 0, 32, 0, 0, 0, nil)})
+}
+
+// compactSegment lays out a segment in the compact header profile, see CapCompactHeader
+func compactSegment(cmd, frg uint8, wnd uint16, ts, sn, una uint32, data []byte) []byte {
+	b := make([]byte, compactOverhead+len(data))
+	b[0] = cmd | compactFlag
+	b[1] = frg
+	binary.LittleEndian.PutUint16(b[2:], wnd)
+	binary.LittleEndian.PutUint16(b[4:], uint16(ts))
+	binary.LittleEndian.PutUint16(b[6:], uint16(sn))
+	binary.LittleEndian.PutUint16(b[8:], uint16(una))
+	binary.LittleEndian.PutUint16(b[10:], uint16(len(data)))
+	copy(b[12:], data)
+	return b
+}
+
+// both compact header profiles past the wrap of the 16 bit fields, against peers which
+// don't accept them, and datagrams mixing the profiles
+func TestConformanceCompactHeader(t *testing.T) {
+	const conv = 0x11223344
+	for _, profile := range []int{HeaderCompact, HeaderElided} {
+		var outputs, acks [][]byte
+		sender := capturedKCP(conv, &outputs)
+		receiver := capturedKCP(conv, &acks)
+		for _, kcp := range []*KCP{sender, receiver} {
+			kcp.NoDelay(1, 10, 2, 1)
+			kcp.WndSize(32, 32)
+			kcp.SetHeaderProfile(profile, profile)
+			kcp.SetMtu(IKCP_MTU_DEF + kcp.HeaderSaving())
+		}
+		var prefix []byte
+		if profile == HeaderCompact {
+			prefix = binary.LittleEndian.AppendUint32(nil, conv)
+		}
+
+		msg := pattern(3000, 3)
+		sender.Send(msg)
+		sender.Send(msg[:10])
+		sender.snd_nxt, sender.snd_una = 0xfffe, 0xfffe // the sn wrap their 16 bits
+		receiver.rcv_nxt, receiver.snd_nxt, receiver.snd_una = 0xfffe, 0xfffe, 0xfffe
+		mss := IKCP_MTU_DEF - IKCP_OVERHEAD + headerSaving(profile)
+		const ts = 70000 // past the wrap of 16 bits
+		want := [][]byte{
+			append(append([]byte(nil), prefix...), compactSegment(IKCP_CMD_PUSH, 2, 32, ts, 0xfffe, 0xfffe, msg[:mss])...),
+			append(append([]byte(nil), prefix...), compactSegment(IKCP_CMD_PUSH, 1, 32, ts, 0xffff, 0xfffe, msg[mss:2*mss])...),
+			append(append(append([]byte(nil), prefix...), compactSegment(IKCP_CMD_PUSH, 0, 32, ts, 0x10000, 0xfffe, msg[2*mss:])...),
+				compactSegment(IKCP_CMD_PUSH, 0, 32, ts, 0x10001, 0xfffe, msg[:10])...),
+		}
+		sender.rcv_nxt = 0xfffe
+		sender.Update(ts)
+		expectOutputs(t, outputs, want)
+		for _, dgram := range outputs {
+			if len(dgram) > IKCP_MTU_DEF {
+				t.Fatal("a datagram of", len(dgram), "bytes")
+			}
+		}
+
+		// legacy only, the datagrams are rejected
+		legacy := NewKCP(conv, func([]byte, int) {})
+		if ret := legacy.Input(outputs[0], true); ret == 0 {
+			t.Fatal("a legacy kcp took a compact datagram")
+		}
+
+		receiver.Update(ts + 5)
+		for _, dgram := range outputs {
+			if ret := receiver.Input(dgram, true); ret != 0 {
+				t.Fatal("input failed", ret)
+			}
+		}
+		buf := make([]byte, 65536)
+		if n := receiver.Recv(buf); !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("profile %v: got %x", profile, buf[:n])
+		}
+		receiver.Update(ts + 15)
+		if len(acks) != 1 {
+			t.Fatal("got", len(acks), "datagrams")
+		}
+		sender.Update(ts + 20)
+		if ret := sender.Input(acks[0], true); ret != 0 || sender.snd_una != 0x10002 || sender.rx_srtt != 20 {
+			t.Fatal("acknowledged", ret, sender.snd_una, sender.rx_srtt)
+		}
+
+		// the legacy segments of the peer are taken, but not within compact datagrams
+		push := ikcpSegment(conv, IKCP_CMD_PUSH, 0, 32, ts, 0x10002, 0xfffe, msg[:20])
+		mixed := append(append([]byte(nil), want[0]...), push...)
+		if ret := receiver.Input(mixed, true); ret != -3 {
+			t.Fatal("a mixed datagram input", ret)
+		}
+		if ret := receiver.Input(push, true); ret != 0 || receiver.rcv_nxt != 0x10003 {
+			t.Fatal("a legacy datagram input", ret, receiver.rcv_nxt)
+		}
+	}
+
+	// a conversation id reading as a compact command isn't elided
+	var outputs [][]byte
+	kcp := capturedKCP(IKCP_CMD_ACK|compactFlag, &outputs)
+	kcp.NoDelay(1, 10, 2, 1)
+	kcp.SetHeaderProfile(HeaderElided, HeaderElided)
+	kcp.Send([]byte{1})
+	kcp.Update(0)
+	if len(outputs) != 1 || binary.LittleEndian.Uint32(outputs[0]) != IKCP_CMD_ACK|compactFlag {
+		t.Fatalf("got %x", outputs)
+	}
+	if kcp.HeaderSaving() != headerSaving(HeaderCompact) {
+		t.Fatal("saving", kcp.HeaderSaving())
+	}
+}
+
+// traces generated from the reference C implementation, see testdata/ikcp
+func TestConformanceTraces(t *testing.T) {
+	traces, _ := filepath.Glob(filepath.Join("testdata", "ikcp", "*.trace"))
+	if len(traces) == 0 {
+		t.Fatal("no ikcp traces, generate them as testdata/ikcp/README.md tells")
+	}
+	for _, path := range traces {
+		replayTrace(t, path)
+	}
+}
+
+// coalesceAcks rewrites the acknowledgements of a datagram of ikcp the way flush sends
+// them, in order of sn and without those the una of the datagram covers, but for the
+// highest. It is the one intended difference to ikcp on the wire.
+func coalesceAcks(dgram []byte) []byte {
+	var acks [][]byte
+	var others []byte
+	var una uint32
+	for p := dgram; len(p) >= IKCP_OVERHEAD; {
+		n := IKCP_OVERHEAD + int(binary.LittleEndian.Uint32(p[20:]))
+		if p[4] == IKCP_CMD_ACK {
+			acks = append(acks, p[:n])
+			una = binary.LittleEndian.Uint32(p[16:])
+		} else {
+			others = append(others, p[:n]...)
+		}
+		p = p[n:]
+	}
+	sn := func(ack []byte) uint32 { return binary.LittleEndian.Uint32(ack[12:]) }
+	sort.SliceStable(acks, func(i, j int) bool { return _itimediff(sn(acks[i]), sn(acks[j])) < 0 })
+	var out []byte
+	for k, ack := range acks {
+		if _itimediff(sn(ack), una) >= 0 || k == len(acks)-1 {
+			out = append(out, ack...)
+		}
+	}
+	return append(out, others...)
+}
+
+func replayTrace(t *testing.T, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var kcp *KCP
+	var outputs [][]byte
+	var receiving bool
+	buf := make([]byte, 65536)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 1<<20), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+		nums := make([]int, len(args))
+		var data []byte
+		for k := range args {
+			if cmd == "send" || cmd == "input" || cmd == "output" || cmd == "recv" {
+				if data, err = hex.DecodeString(args[k]); err != nil {
+					t.Fatalf("%v:%v: %v", path, line, err)
+				}
+			} else if nums[k], err = strconv.Atoi(args[k]); err != nil {
+				t.Fatalf("%v:%v: %v", path, line, err)
+			}
+		}
+
+		if cmd != "output" && len(outputs) > 0 {
+			t.Fatalf("%v:%v: unexpected datagram %x", path, line, outputs[0])
+		}
+		if cmd != "recv" && receiving {
+			if n := kcp.PeekSize(); n >= 0 {
+				t.Fatalf("%v:%v: unexpected message of %v bytes", path, line, n)
+			}
+		}
+		receiving = cmd == "recv"
+
+		switch cmd {
+		case "conv":
+			kcp = capturedKCP(uint32(nums[0]), &outputs)
+		case "nodelay":
+			kcp.NoDelay(nums[0], nums[1], nums[2], nums[3])
+		case "wndsize":
+			kcp.WndSize(nums[0], nums[1])
+		case "send":
+			kcp.Send(data)
+		case "input":
+			kcp.Input(data, true)
+		case "update":
+			kcp.Update(uint32(nums[0]))
+		case "output":
+			if len(outputs) == 0 {
+				t.Fatalf("%v:%v: missing datagram %x", path, line, data)
+			}
+			if data = coalesceAcks(data); !bytes.Equal(outputs[0], data) {
+				t.Fatalf("%v:%v: datagram\n got %x\nwant %x", path, line, outputs[0], data)
+			}
+			outputs = outputs[1:]
+		case "recv":
+			n := kcp.Recv(buf)
+			if n < 0 || !bytes.Equal(buf[:n], data) {
+				t.Fatalf("%v:%v: recv %v, want %x", path, line, n, data)
+			}
+		default:
+			t.Fatalf("%v:%v: unknown event %v", path, line, cmd)
+		}
+	}
+	if len(outputs) > 0 {
+		t.Fatalf("%v: unexpected datagram %x", path, outputs[0])
+	}
+}
@@ -0,0 +1,1134 @@
+package kcp
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KCPConn is a KCP connection independent of the underlying transport, it provides
+// update scheduling, stream Read/Write, deadlines and close semantics.
+// Packets to send are handed to the output function given to NewKCPConn,
+// packets received from the transport are fed in with Input.
+//
+// All methods are safe for concurrent use. Every Write is atomic, data from
+// concurrent Writes never interleaves. Concurrent Reads are serialized, each gets
+// whole messages or the next bytes of the stream. Close may be called from any
+// goroutine, it unblocks pending Reads and Writes.
+type KCPConn struct {
+	sockbytes        int64        // len(sockbuff), first for 64bit atomic alignment
+	lastSend         int64        // since epoch, when packets were last handed to the transport, 0 for never, atomic
+	lastRecv         int64        // since epoch, when a valid packet last arrived, 0 for never, atomic
+	unsent           int64        // bytes written and not sent yet, see UnsentBytes, atomic
+	kcp              *KCP         // the core ARQ
+	rd               atomic.Value // read deadline
+	wd               atomic.Value // write deadline
+	sockbuff         []byte       // kcp receiving is based on packet, I turn it into stream
+	readbuf          []byte       // backing array of sockbuff, reused by the next message
+	bufmu            sync.Mutex   // protects sockbuff, so Read only holds mu while touching kcp
+	die              chan struct{}
+	chReadEvent      chan struct{}
+	chWriteEvent     chan struct{}
+	chHighWriteEvent chan struct{}          // write events for high priority writes
+	highWaiting      int                    // high priority writes waiting for the window, protected by mu
+	txqueue          [][]byte               // packets waiting to be written to the transport
+	txspare          [][]byte               // recycled txqueue backing array
+	txQueueLen       int                    // max packets in txqueue, excess packets are dropped
+	txbusy           bool                   // a goroutine is writing to the transport
+	transmit         func(txqueue [][]byte) // writes packets to the transport, called without mu, it may take packets over and nil them
+	onMessage        func(msg []byte)       // read callback replacing Read, protected by mu
+	msgbuf           []byte                 // reused buffer handed to onMessage
+	msgmu            sync.Mutex             // serializes onMessage calls, so messages stay in order
+	readCalled       bool                   // Read has been used, protected by bufmu
+	ackNoDelay       bool
+	isClosed         bool
+	budget           *memoryBudget   // memory budget shared with other connections, optional
+	limit            *rateLimit      // byte rate of the writes shared with other connections, optional, see SessionGroup
+	held, committed  int64           // bytes accounted to budget, protected by mu
+	squeezed         bool            // over budget, Write waits for the send queues to drain
+	holdLimit        int             // bytes of data received held at most, 0 for no limit, see Listener.SetPreAcceptBuffer
+	onEvent          func(typ int)   // reports Event* of the connection to a listener with mu held, optional
+	txRate, rxRate   ewmaRate        // application payload written and read
+	deadLink         int             // DeadLink* mode
+	deadLinkTimeout  time.Duration   // suspended connections are closed after it, 0 for never
+	suspendBuffer    int             // bytes Write may queue while suspended
+	suspended        time.Time       // when the connection was suspended
+	state            int             // State* of the connection
+	onState          func(state int) // state callback, see UDPSession.SetStateCallback
+	stateq           []int           // state changes waiting for onState
+	statemu          sync.Mutex      // serializes onState calls, so changes are seen in order
+	writeDelay       time.Duration   // small writes are held back for up to it, 0 for none
+	delaybuf         []byte          // writes held back by writeDelay
+	delaylens        []int           // lengths of the writes in delaybuf
+	delayTimer       *time.Timer     // hands the held writes over when writeDelay passed
+	lan              lanState        // see SetLANMode
+	heapIndex        int             // position in the updater heap, -1 out of it, protected by updater.mu
+	closeReason      string          // why the connection was closed
+	ctx              context.Context // cancelled by the close, nil until asked for, see Context
+	cancel           context.CancelCauseFunc
+	closedAt         time.Time       // when the connection was closed
+	lingers          bool            // a local close keeps sending unacknowledged data, see UDPSession.linger
+	lingering        bool            // closed, still sending unacknowledged data
+	chHeard          chan struct{}   // closed by the next valid packet, optional
+	softErrs         chan SoftError  // see SoftErrors, nil until asked for
+	softCounts       [numSoft]uint64 // soft errors per type, protected by mu
+	softDropped      uint64          // soft errors dropped from softErrs, protected by mu
+	limited          int32           // the last Write waited for the rate limit, atomic
+	txCheck          *selfCheck      // checksums written into the stream, protected by mu, see SetStreamChecksum
+	rxCheck          *selfCheck      // checksums verified on reading, protected by bufmu
+	streamMismatch   int32           // the peer announced the stream checksum otherwise, atomic
+	id               uint64          // process wide unique id
+	created          time.Time       // creation time
+	mu               sync.Mutex
+}
+
+// ErrClosed is returned by Write, Flush, Close and the like once the connection is
+// closed, and by Writes waiting for the send window when it closes
+var ErrClosed = errors.New("kcp: use of closed connection")
+
+// CloseError tells why a connection closed, it's the cause of Context. Reads return
+// io.EOF after any close, see Read.
+type CloseError struct {
+	Reason string // why it was closed, like "closed locally" or "dead link"
+	Kind   int    // Closed*
+}
+
+func (e *CloseError) Error() string { return "kcp: " + e.Reason }
+
+// Unwrap makes a CloseError match ErrClosed
+func (e *CloseError) Unwrap() error { return ErrClosed }
+
+// close reasons
+const (
+	closeLocal     = "closed locally"
+	closeDeadLink  = "dead link"
+	closeReplaced  = "replaced by a new conversation"
+	closePeer      = "closed by the peer"
+	closeConvInUse = "conversation id in use by another conversation of the peer"
+)
+
+// lastConnID numbers connections for logging, as convs are neither unique nor unpredictable
+var lastConnID uint64
+
+// NewKCPConn creates a KCP connection over a custom transport, output is called
+// for every packet to send, and must not retain buf after it returns.
+// The connection is updated by the shared updater until it's closed.
+func NewKCPConn(conv uint32, output func(buf []byte)) *KCPConn {
+	c := new(KCPConn)
+	c.init(NewKCP(conv, func(buf []byte, size int) {
+		if size >= IKCP_OVERHEAD {
+			c.queue(buf[:size])
+		}
+	}), func(txqueue [][]byte) {
+		for k := range txqueue {
+			output(txqueue[k])
+		}
+	})
+	updater.addSession(c)
+	return c
+}
+
+// init sets up a connection driving kcp and writing packets with transmit
+func (c *KCPConn) init(kcp *KCP, transmit func(txqueue [][]byte)) {
+	c.id = atomic.AddUint64(&lastConnID, 1)
+	c.created = time.Now()
+	c.die = make(chan struct{})
+	c.chReadEvent = make(chan struct{}, 1)
+	c.chWriteEvent = make(chan struct{}, 1)
+	c.chHighWriteEvent = make(chan struct{}, 1)
+	c.txQueueLen = txQueueLimit
+	c.transmit = transmit
+	c.kcp = kcp
+	c.kcp.WndSize(defaultWndSize, defaultWndSize)
+	c.heapIndex = -1
+}
+
+// Read implements the Conn Read method. Data received before the connection was
+// closed is still returned, then Read returns io.EOF whatever the reason of the close,
+// a Read waiting for data when the connection closes at once. The reason is the cause
+// of Context. Data available is returned even past the read deadline, a timeout error
+// always comes with n == 0, so a frame read in several Reads loses no bytes to a
+// deadline.
+func (c *KCPConn) Read(b []byte) (n int, err error) {
+	return c.read(b, true)
+}
+
+// TryRead is Read without waiting, it fails at once with a timeout error, see
+// net.Error, if no data has arrived
+func (c *KCPConn) TryRead(b []byte) (n int, err error) {
+	return c.read(b, false)
+}
+
+// read is Read, it fails instead of waiting for data unless wait is set
+func (c *KCPConn) read(b []byte, wait bool) (n int, err error) {
+	for {
+		if atomic.LoadInt32(&c.streamMismatch) != 0 {
+			return 0, errors.Wrap(ErrStreamChecksum, "the peer announced the stream checksum otherwise")
+		}
+		c.bufmu.Lock()
+		c.readCalled = true
+		if len(c.sockbuff) > 0 { // copy from buffer
+			n = copy(b, c.sockbuff)
+			c.sockbuff = c.sockbuff[n:]
+			atomic.AddInt64(&c.sockbytes, -int64(n))
+			if len(c.sockbuff) > 0 || c.readable() {
+				c.notifyReadEvent() // pass the wake on, see readable
+			}
+			if c.rxCheck != nil {
+				if n, err = c.rxCheck.strip(b[:n]); n == 0 && err == nil && len(b) > 0 {
+					c.bufmu.Unlock()
+					continue // only checksums
+				}
+			}
+			c.bufmu.Unlock()
+			c.rxRate.add(n, time.Now())
+			return n, err
+		}
+
+		c.mu.Lock()
+		if c.onMessage != nil {
+			c.mu.Unlock()
+			c.bufmu.Unlock()
+			return 0, errors.New(errInvalidOperation)
+		}
+		if n := c.kcp.PeekSize(); n > 0 { // data arrived
+			if len(b) >= n {
+				c.kcp.Recv(b)
+				if c.kcp.PeekSize() > 0 {
+					c.notifyReadEvent()
+				}
+				c.mu.Unlock()
+			} else {
+				// sockbuff is empty here, so its last backing array is free again
+				if cap(c.readbuf) < n {
+					c.readbuf = make([]byte, n)
+				}
+				buf := c.readbuf[:n]
+				c.kcp.Recv(buf)
+				c.notifyReadEvent() // the rest goes to sockbuff
+				c.mu.Unlock()
+				n = copy(b, buf)
+				c.sockbuff = buf[n:] // store remaining bytes into sockbuff for next read
+				atomic.AddInt64(&c.sockbytes, int64(len(c.sockbuff)))
+			}
+			if c.rxCheck != nil {
+				if n, err = c.rxCheck.strip(b[:n]); n == 0 && err == nil && len(b) > 0 {
+					c.bufmu.Unlock()
+					continue // only checksums
+				}
+			}
+			c.bufmu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			c.rxRate.add(n, time.Now())
+			return n, err
+		}
+		closed := c.isClosed
+		c.mu.Unlock()
+		c.bufmu.Unlock()
+
+		// data received before the close has been read
+		if closed {
+			return 0, io.EOF
+		}
+
+		rd, _ := c.rd.Load().(time.Time)
+		if !wait || !rd.IsZero() && time.Now().After(rd) { // timeout
+			return 0, errTimeout{}
+		}
+
+		var timeout *time.Timer
+		var ch <-chan time.Time
+		if !rd.IsZero() {
+			delay := rd.Sub(time.Now())
+			timeout = getTimer(delay)
+			ch = timeout.C
+		}
+
+		// wait for read event or timeout
+		select {
+		case <-c.chReadEvent:
+		case <-ch:
+		case <-c.die:
+		}
+
+		if timeout != nil {
+			putTimer(timeout)
+		}
+	}
+}
+
+// readable reports whether kcp holds a message for Read. A read event wakes one of the
+// waiting readers, so a reader leaving data behind wakes the next one: every reader
+// waits for as long as there's nothing to read, and no longer.
+func (c *KCPConn) readable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kcp.PeekSize() > 0
+}
+
+// timers recycles the timers of Reads and Writes waiting for a deadline
+var timers sync.Pool
+
+func getTimer(d time.Duration) *time.Timer {
+	if t, ok := timers.Get().(*time.Timer); ok {
+		t.Reset(d)
+		return t
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops a timer obtained from getTimer and recycles it
+func putTimer(t *time.Timer) {
+	if !t.Stop() {
+		select { // drain a value the waiter didn't take
+		case <-t.C:
+		default:
+		}
+	}
+	timers.Put(t)
+}
+
+// priorities of WriteWithPriority
+const (
+	PriorityLow  = iota // plain Write
+	PriorityHigh        // ahead of low priority data waiting for the send window
+)
+
+// Write implements the Conn Write method. The data of a Write is queued whole or not
+// at all, chunks beyond the fragments of one message included: n is the bytes queued,
+// so a timeout, of the write deadline, the send window of TryWrite or the rate limit
+// of a SessionGroup, comes with n == 0 and none of b is sent.
+func (c *KCPConn) Write(b []byte) (n int, err error) {
+	return c.WriteWithPriority(b, PriorityLow)
+}
+
+// WriteBuffers writes the slices of v as one Write, without copying them together,
+// in message mode they make one message. v itself is left untouched.
+// net.Buffers.WriteTo only uses writev with the connections of package net,
+// so call WriteBuffers directly.
+func (c *KCPConn) WriteBuffers(v net.Buffers) (n int64, err error) {
+	nn, err := c.write(v, PriorityLow, true, false)
+	return int64(nn), err
+}
+
+// WriteWithPriority writes b with one of two priorities. High priority data is sent
+// ahead of low priority data queued and not sent yet, never in the middle of the data
+// of one Write, and low priority writes leave the window to high priority writes while
+// any is waiting. Data already in the send buffer, being sent or waiting for
+// acknowledgement, is never reordered, so high priority data still waits for it.
+// In stream mode a low priority Write sharing a segment with data already being sent
+// goes along with it.
+func (c *KCPConn) WriteWithPriority(b []byte, prio int) (n int, err error) {
+	return c.write([][]byte{b}, prio, true, false)
+}
+
+// TryWrite is Write without waiting for the send window, it fails at once with a
+// timeout error, see net.Error, and writes nothing if the window is full
+func (c *KCPConn) TryWrite(b []byte) (n int, err error) {
+	return c.write([][]byte{b}, PriorityLow, false, false)
+}
+
+// ErrMessageTooLarge is returned by WriteMessage for a message above MaxMessageSize
+var ErrMessageTooLarge = errors.New("kcp: message too large")
+
+// MaxMessageSize returns the largest message of message mode, 255 fragments of the
+// room for data in a packet after the crypto, FEC and kcp headers. It follows the
+// mtu, SetMtu and the fallback of SetMtuFallback change it. The peer only delivers a
+// message once its receive window holds all the fragments, see SetWindowSize.
+func (c *KCPConn) MaxMessageSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int(c.kcp.mss) * 255
+}
+
+// WriteMessage is Write of one message in message mode, it fails with
+// ErrMessageTooLarge for a message above MaxMessageSize, which Write splits into
+// several messages instead, and with an invalid operation in stream mode.
+func (c *KCPConn) WriteMessage(b []byte) (n int, err error) {
+	return c.write([][]byte{b}, PriorityLow, true, true)
+}
+
+// write is WriteWithPriority of the data gathered from v, it fails instead of waiting
+// for the send window unless wait is set, and for more than one message if whole is set
+func (c *KCPConn) write(v [][]byte, prio int, wait, whole bool) (n int, err error) {
+	if prio != PriorityLow && prio != PriorityHigh {
+		return 0, errors.New(errInvalidOperation)
+	}
+	if prio == PriorityHigh {
+		c.mu.Lock()
+		checked := c.txCheck != nil
+		c.mu.Unlock()
+		if checked { // it would overtake the data the checksums follow
+			return 0, errors.New(errInvalidOperation)
+		}
+	}
+	if c.limit != nil {
+		if err := c.waitLimit(v, wait); err != nil {
+			return 0, err
+		}
+		reserved := messageSize(v)
+		defer func() {
+			if err != nil { // nothing was written, the bytes go back to the bucket
+				c.limit.cancel(reserved)
+			}
+		}()
+	}
+	high := prio == PriorityHigh
+	chWriteEvent := c.chWriteEvent
+	if high {
+		chWriteEvent = c.chHighWriteEvent
+		c.mu.Lock()
+		c.highWaiting++
+		c.mu.Unlock()
+	}
+
+	for {
+		select {
+		case <-c.die:
+			c.leaveHigh(high)
+			return 0, ErrClosed
+		default:
+		}
+
+		wd, _ := c.wd.Load().(time.Time)
+		if !wd.IsZero() {
+			if time.Now().After(wd) { // timeout
+				c.leaveHigh(high)
+				return 0, errTimeout{}
+			}
+		}
+
+		c.mu.Lock()
+		if whole || c.kcp.stream == 0 && strict() {
+			if err := c.checkMessage(v); err != nil {
+				if err == ErrMessageTooLarge {
+					strictFail(strictFragments, "conn %v: message of %v bytes above the %v bytes of one message", c.ID(), messageSize(v), int(c.kcp.mss)*255)
+				}
+				c.mu.Unlock()
+				c.leaveHigh(high)
+				return 0, err
+			}
+		}
+		// high priority data doesn't wait for low priority data queued in kcp
+		waitsnd := c.kcp.WaitSnd()
+		if high {
+			waitsnd = len(c.kcp.snd_buf) + len(c.kcp.snd_queue_hi)
+		}
+		squeezed := c.squeezed && c.kcp.WaitSnd() > 0
+		if waitsnd < c.sndLimit() && (high || c.highWaiting == 0) && !squeezed {
+			if high {
+				c.highWaiting--
+				c.notifyWriteEvent() // the rest of the window may go to low priority writes
+			}
+			// all chunks are queued under one lock, so concurrent Writes never interleave
+			n = 0
+			for k := range v {
+				n += len(v[k])
+			}
+			size := n
+			if c.txCheck != nil {
+				v, size = c.txCheck.insert(v)
+			}
+			if !high && c.holdWrite(v, size) {
+				c.countUnsent()
+				c.mu.Unlock()
+				atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+				c.txRate.add(n, time.Now())
+				return n, nil
+			}
+			max := int(c.kcp.mss) * 255 // the most fragments of one send
+			for left := size; ; left -= max {
+				if left <= max { // in most cases
+					c.kcp.send(v, high)
+					break
+				}
+				var chunk [][]byte
+				chunk, v = splitBuffers(v, max)
+				c.kcp.send(chunk, high)
+			}
+			deferred := c.eventFlush(currentMs())
+			c.uncork()
+			if !deferred.IsZero() {
+				updater.reschedule(c, deferred)
+			}
+			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			c.txRate.add(n, time.Now())
+			return n, nil
+		}
+		if !wait {
+			c.mu.Unlock()
+			c.leaveHigh(high)
+			return 0, errTimeout{}
+		}
+		if c.kcp.trace != nil {
+			c.kcp.trace.windowFull()
+		}
+		c.mu.Unlock()
+
+		var timeout *time.Timer
+		var ch <-chan time.Time
+		if !wd.IsZero() {
+			delay := wd.Sub(time.Now())
+			timeout = getTimer(delay)
+			ch = timeout.C
+		}
+
+		// wait for write event or timeout
+		select {
+		case <-chWriteEvent:
+		case <-ch:
+		case <-c.die:
+		}
+
+		if timeout != nil {
+			putTimer(timeout)
+		}
+	}
+}
+
+// checkMessage fails unless v fits one message, with mu held
+func (c *KCPConn) checkMessage(v [][]byte) error {
+	if c.kcp.stream != 0 {
+		return errors.New(errInvalidOperation)
+	}
+	if messageSize(v) > int(c.kcp.mss)*255 {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// messageSize returns the bytes gathered from v
+func messageSize(v [][]byte) int {
+	size := 0
+	for k := range v {
+		size += len(v[k])
+	}
+	return size
+}
+
+// SetWriteDelay holds back low priority writes smaller than the MSS for up to d, so
+// that they leave together: in stream mode they fill segments, in message mode each
+// stays a message, but the segments share datagrams. Held writes are handed over
+// once d passed since the first one, as soon as they add up to the MSS, when a
+// larger write comes, or on Flush. A held Write has returned already, so write
+// deadlines don't apply to it. A UDPSession sends held writes after Close along with
+// the rest of the data written, a KCPConn discards them, call Flush before.
+// 0 disables the delay, the default, and hands held writes over.
+func (c *KCPConn) SetWriteDelay(d time.Duration) error {
+	if d < 0 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	c.writeDelay = d
+	c.mu.Unlock()
+	if d == 0 {
+		c.flushWrites()
+	}
+	return nil
+}
+
+// Flush hands the writes held back by the write delay over and sends them right
+// away, it fails with ErrClosed once the connection is closed
+func (c *KCPConn) Flush() error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.releaseWrites()
+	c.kcp.current = currentMs()
+	c.kcp.flush()
+	c.uncork()
+	return nil
+}
+
+// holdWrite holds v of n bytes back if the write delay applies, otherwise it hands
+// the held writes over, so they go ahead of v. c.mu must be held.
+func (c *KCPConn) holdWrite(v [][]byte, n int) bool {
+	if c.writeDelay > 0 && len(c.delaybuf)+n < int(c.kcp.mss) {
+		for k := range v {
+			c.delaybuf = append(c.delaybuf, v[k]...)
+		}
+		c.delaylens = append(c.delaylens, n)
+		if len(c.delaylens) == 1 {
+			if c.delayTimer == nil {
+				c.delayTimer = time.AfterFunc(c.writeDelay, c.flushWrites)
+			} else {
+				c.delayTimer.Reset(c.writeDelay)
+			}
+		}
+		return true
+	}
+	c.releaseWrites()
+	return false
+}
+
+// releaseWrites hands the writes held back by the write delay to kcp, c.mu must be held
+func (c *KCPConn) releaseWrites() {
+	if len(c.delaylens) == 0 {
+		return
+	}
+	if c.kcp.stream != 0 {
+		c.kcp.send([][]byte{c.delaybuf}, false)
+	} else {
+		for off, k := 0, 0; k < len(c.delaylens); k++ {
+			c.kcp.send([][]byte{c.delaybuf[off : off+c.delaylens[k]]}, false)
+			off += c.delaylens[k]
+		}
+	}
+	c.delaybuf = c.delaybuf[:0]
+	c.delaylens = c.delaylens[:0]
+	c.delayTimer.Stop()
+}
+
+// flushWrites sends the held writes once the write delay passed, or it was disabled
+func (c *KCPConn) flushWrites() {
+	c.mu.Lock()
+	if c.isClosed || len(c.delaylens) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.releaseWrites()
+	c.kcp.current = currentMs()
+	c.kcp.flush()
+	c.uncork()
+}
+
+// splitBuffers splits v after n bytes
+func splitBuffers(v [][]byte, n int) (head, tail [][]byte) {
+	for k := range v {
+		if n <= len(v[k]) {
+			head = append(v[:k:k], v[k][:n])
+			tail = append([][]byte{v[k][n:]}, v[k+1:]...)
+			return head, tail
+		}
+		n -= len(v[k])
+	}
+	return v, nil
+}
+
+// leaveHigh removes a high priority write leaving without writing from the waiting ones
+func (c *KCPConn) leaveHigh(high bool) {
+	if high {
+		c.mu.Lock()
+		c.highWaiting--
+		c.notifyWriteEvent()
+		c.mu.Unlock()
+	}
+}
+
+// Input feeds a KCP packet received from the transport into the connection
+func (c *KCPConn) Input(data []byte) error {
+	arrival := time.Since(epoch)
+	current := uint32(arrival/time.Millisecond) + chaosJitter()
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.kcp.current, c.kcp.arrival = current, arrival
+	ret := c.kcp.Input(data, true)
+	if ret == 0 {
+		c.heard()
+	}
+	c.inputDone(current)
+	if ret != 0 {
+		atomic.AddUint64(&DefaultSnmp.KCPInErrors, 1)
+		return errors.New(errInvalidPacket)
+	}
+	return nil
+}
+
+// notifyReadable wakes a reader as soon as kcp holds a message, right behind the Input
+// of the packet completing it, ahead of the acks, the rest of the input path and the
+// other packets of a burst, c.mu must be held. The reader waits for c.mu until the
+// packet is done, not for the burst.
+func (c *KCPConn) notifyReadable() {
+	if c.onMessage == nil && c.kcp.PeekSize() > 0 {
+		c.notifyReadEvent()
+	}
+}
+
+// inputDone notifies readers and flushes acks after packets have been input,
+// it must be called with c.mu held and releases it
+func (c *KCPConn) inputDone(current uint32) {
+	deliver := c.onMessage != nil
+	if n := c.kcp.PeekSize(); n > 0 && !deliver {
+		c.notifyReadEvent()
+	}
+	var deferred time.Time
+	if c.ackNoDelay {
+		deferred = c.eventFlush(current)
+	}
+	c.uncork()
+	if !deferred.IsZero() {
+		updater.reschedule(c, deferred)
+	}
+	if deliver {
+		c.deliver()
+	}
+}
+
+// SetReadCallback delivers every complete message to fn instead of Read, fn is called
+// from the input path without holding the connection lock, so it may call Write.
+// msg is only valid until fn returns. It fails once Read has been used, and
+// Read fails while a callback is set; nil removes the callback.
+func (c *KCPConn) SetReadCallback(fn func(msg []byte)) error {
+	c.bufmu.Lock()
+	if c.readCalled || fn != nil && c.rxCheck != nil {
+		c.bufmu.Unlock()
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	c.onMessage = fn
+	c.mu.Unlock()
+	c.bufmu.Unlock()
+
+	if fn != nil { // messages that arrived before the callback
+		c.deliver()
+	}
+	return nil
+}
+
+// deliver hands the received messages to onMessage, c.mu must not be held
+func (c *KCPConn) deliver() {
+	c.msgmu.Lock()
+	defer c.msgmu.Unlock()
+	for {
+		c.mu.Lock()
+		fn := c.onMessage
+		n := c.kcp.PeekSize()
+		if fn == nil || n < 0 {
+			c.mu.Unlock()
+			return
+		}
+		if cap(c.msgbuf) < n {
+			c.msgbuf = make([]byte, n)
+		}
+		msg := c.msgbuf[:n]
+		c.kcp.Recv(msg)
+		c.mu.Unlock()
+
+		atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+		c.rxRate.add(n, time.Now())
+		fn(msg)
+	}
+}
+
+// Close closes the connection. Afterwards Reads return the data received before, then
+// io.EOF, Reads waiting for data return at once. Writes, including
+// those waiting for the send window, fail with ErrClosed, as do Flush and Close again.
+func (c *KCPConn) Close() error {
+	if !c.close(closeLocal) {
+		return ErrClosed
+	}
+	return nil
+}
+
+// close marks the connection closed for reason, it returns false if it was already closed
+func (c *KCPConn) close(reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isClosed {
+		return false
+	}
+	if c.lingers && reason == closeLocal {
+		c.releaseWrites() // sent while lingering, like the rest
+	}
+	close(c.die)
+	c.unaccount()
+	if c.delayTimer != nil {
+		c.delayTimer.Stop()
+	}
+	c.isClosed = true
+	c.closeReason = reason
+	c.closedAt = time.Now()
+	// decided along with isClosed, so the updater never sees a closed connection undecided
+	c.lingering = c.lingers && reason == closeLocal && (c.kcp.WaitSnd() > 0 || c.kcp.close_xmit > 0)
+	c.setState(StateClosed)
+	if c.softErrs != nil {
+		close(c.softErrs)
+	}
+	if c.cancel != nil {
+		c.cancel(c.closeError())
+	}
+	return true
+}
+
+// LastSend returns when packets were last handed to the transport, zero if never,
+// so a request timing out tells a backlog from a silent network. With UnsentBytes
+// and LastRecv it doesn't take the lock of the connection.
+func (c *KCPConn) LastSend() time.Time {
+	return epochTime(atomic.LoadInt64(&c.lastSend))
+}
+
+// LastRecv returns when a valid packet last arrived, zero if never
+func (c *KCPConn) LastRecv() time.Time {
+	return epochTime(atomic.LoadInt64(&c.lastRecv))
+}
+
+// UnsentBytes returns the bytes written and never sent yet: waiting in the send queue
+// for the window, or held back by SetWriteDelay. It follows every write and update.
+func (c *KCPConn) UnsentBytes() int {
+	return int(atomic.LoadInt64(&c.unsent))
+}
+
+// countUnsent updates UnsentBytes, c.mu must be held
+func (c *KCPConn) countUnsent() {
+	atomic.StoreInt64(&c.unsent, int64(c.kcp.snd_bytes+len(c.delaybuf)))
+}
+
+// epochTime returns the time d after epoch, zero for 0
+func epochTime(d int64) time.Time {
+	if d == 0 {
+		return time.Time{}
+	}
+	return epoch.Add(time.Duration(d))
+}
+
+// ID returns a process wide unique id of the connection
+func (c *KCPConn) ID() uint64 {
+	return c.id
+}
+
+// CreatedAt returns the time the connection was created
+func (c *KCPConn) CreatedAt() time.Time {
+	return c.created
+}
+
+// SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
+func (c *KCPConn) SetDeadline(t time.Time) error {
+	c.rd.Store(t)
+	c.wd.Store(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *KCPConn) SetReadDeadline(t time.Time) error {
+	c.rd.Store(t)
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *KCPConn) SetWriteDeadline(t time.Time) error {
+	c.wd.Store(t)
+	return nil
+}
+
+// SetWindowSize set maximum window size, it's safe at any time, the windows
+// apply from the next update. With the compact header they're cut to 32767 segments.
+func (c *KCPConn) SetWindowSize(sndwnd, rcvwnd int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.WndSize(sndwnd, rcvwnd)
+}
+
+// SetMtu sets the maximum transmission unit, from IKCP_MTU_MIN to mtuLimit
+func (c *KCPConn) SetMtu(mtu int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if mtu > mtuLimit || c.kcp.SetMtu(mtu) != 0 {
+		return errors.New(errInvalidOperation)
+	}
+	return nil
+}
+
+// SetStreamMode toggles the stream mode on/off. Data sent already keeps its segments,
+// but it fails while data written in the other mode is queued, as stream mode would
+// join it with the data written next.
+func (c *KCPConn) SetStreamMode(enable bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stream int32
+	if enable {
+		stream = 1
+	}
+	if stream != c.kcp.stream && (len(c.kcp.snd_queue)+len(c.kcp.snd_queue_hi) > 0 || len(c.delaylens) > 0) {
+		return errors.New(errInvalidOperation)
+	}
+	c.kcp.stream = stream
+	return nil
+}
+
+// SetACKNoDelay changes ack flush option, set true to flush ack immediately,
+func (c *KCPConn) SetACKNoDelay(nodelay bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ackNoDelay = nodelay
+}
+
+// SetNoDelay calls nodelay() of kcp, it's safe at any time
+func (c *KCPConn) SetNoDelay(nodelay, interval, resend, nc int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.NoDelay(nodelay, interval, resend, nc)
+}
+
+// SetInterval sets the update interval of kcp, the cadence of flushes, from 1ms to 5s,
+// default to 100ms. Unlike the interval of SetNoDelay, which replaces it again, it
+// goes below 10ms. It's safe at any time and applies right away, a connection waiting
+// for its next update is updated at once.
+func (c *KCPConn) SetInterval(d time.Duration) error {
+	if d <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	ms := d / time.Millisecond
+	if ms < 1 {
+		ms = 1
+	} else if ms > 5000 {
+		ms = 5000
+	}
+	c.mu.Lock()
+	c.kcp.interval = uint32(ms)
+	c.kcp.ts_flush = currentMs()
+	c.mu.Unlock()
+	updater.reschedule(c, time.Now())
+	return nil
+}
+
+// kcpConn returns the connection, for the updater to find UDPSessions by it
+func (c *KCPConn) kcpConn() *KCPConn { return c }
+
+// SetCongestionControl enables or disables the congestion window, default to enabled,
+// see KCP.SetCongestionControl. It's safe at any time, disable it only on links which
+// don't congest, like a private point-to-point link, and enable it again on loss.
+func (c *KCPConn) SetCongestionControl(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.SetCongestionControl(enabled)
+}
+
+// SetRetries sets the transmissions of a segment before the link is considered dead,
+// along with SetDeadLinkTime, see SetDeadLinkMode, default to IKCP_DEADLINK. It's safe at any time, segments in
+// flight count their transmissions so far.
+func (c *KCPConn) SetRetries(n int) error {
+	if n <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.dead_link = uint32(n)
+	return nil
+}
+
+// SetDeadLinkTime sets how long a segment goes unacknowledged since its first
+// transmission before the link is considered dead, along with the transmissions of
+// SetRetries, default to IKCP_DEADTIME ms. Outages shorter than it survive however
+// aggressive the timers, 0 counts transmissions only. It's safe at any time.
+func (c *KCPConn) SetDeadLinkTime(d time.Duration) error {
+	if d < 0 || d/time.Millisecond > math.MaxInt32 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.dead_time = uint32(d / time.Millisecond)
+	return nil
+}
+
+// SetDeadLinkMode sets what the connection does once a segment reached the retry
+// limit, DeadLinkIgnore by default. With DeadLinkSuspend the connection is suspended
+// instead of closed: Writes may queue up to buffer bytes, and it resumes as soon as a
+// valid packet from the peer arrives. A connection suspended for timeout is closed,
+// 0 never closes it.
+func (c *KCPConn) SetDeadLinkMode(mode int, timeout time.Duration, buffer int) error {
+	if mode < DeadLinkIgnore || mode > DeadLinkSuspend || timeout < 0 || buffer < 0 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadLink = mode
+	c.deadLinkTimeout = timeout
+	c.suspendBuffer = buffer
+	return nil
+}
+
+// SetMaxRetransmitDuration bounds how long a segment goes unacknowledged since its
+// first transmission, however many times it was sent, before the link is considered
+// dead, see SetDeadLinkMode: "give up after 15 seconds without progress". The limit of
+// SetRetries and SetDeadLinkTime still applies, the first reached wins, see
+// SessionStats.DeadLink. 0 removes the bound, the default. It's safe at any time.
+func (c *KCPConn) SetMaxRetransmitDuration(d time.Duration) error {
+	if d < 0 || d/time.Millisecond > math.MaxInt32 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kcp.dead_age = uint32(d / time.Millisecond)
+	return nil
+}
+
+// SetBackoff sets how the retransmission timeout grows while a segment is lost,
+// see KCP.SetBackoff. It fails for a factor that would shrink the timeout.
+func (c *KCPConn) SetBackoff(factor float64, linear bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.kcp.SetBackoff(factor, linear) != 0 {
+		return errors.New(errInvalidOperation)
+	}
+	return nil
+}
+
+// SetRecoveryBurst caps the retransmissions by timeout after an rto to burst segments
+// at once, growing by two for every ack like slow start, see KCP.SetRecoveryBurst.
+// 0, the default, disables the cap. It fails for a negative burst.
+func (c *KCPConn) SetRecoveryBurst(burst int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.kcp.SetRecoveryBurst(burst) != 0 {
+		return errors.New(errInvalidOperation)
+	}
+	return nil
+}
+
+// SetTxQueueLen sets the maximum number of packets waiting to be written to the
+// transport, packets beyond the limit are dropped and left to retransmission, default to 8192
+func (c *KCPConn) SetTxQueueLen(n int) error {
+	if n <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.txQueueLen = n
+	return nil
+}
+
+// Capabilities returns the negotiated protocol version and capability flags,
+// version 0 means the peer doesn't negotiate, and the session runs in compatibility mode
+func (c *KCPConn) Capabilities() (version, flags uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	version, flags = c.kcp.RemoteHello()
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	return version, flags & uint8(c.kcp.hello)
+}
+
+// RecvQueueLen returns the number of segments received and not read yet, they are
+// bounded by the receive window, so a slow reader throttles the sender
+func (c *KCPConn) RecvQueueLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kcp.WaitRcv()
+}
+
+// GetConv gets conversation id of a session
+func (c *KCPConn) GetConv() uint32 {
+	return c.kcp.conv
+}
+
+func (c *KCPConn) notifyReadEvent() {
+	select {
+	case c.chReadEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (c *KCPConn) notifyWriteEvent() {
+	select {
+	case c.chHighWriteEvent <- struct{}{}:
+	default:
+	}
+	select {
+	case c.chWriteEvent <- struct{}{}:
+	default:
+	}
+}
+
+// queue copies a packet into txqueue, c.mu must be held
+func (c *KCPConn) queue(buf []byte) {
+	if len(c.txqueue) >= c.txQueueLen { // never block the state machine on a slow transport
+		atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+		strictFail(strictTxDrop, "conn %v: transmit queue of %v packets full", c.ID(), c.txQueueLen)
+		return
+	}
+	pkt := getXmitBuf()[:len(buf)]
+	copy(pkt, buf)
+	c.txqueue = append(c.txqueue, pkt)
+}
+
+// uncork writes the queued packets to the transport, it must be called with c.mu held
+// and releases it. Transport writes happen outside c.mu so a slow transport never
+// blocks Read; while one goroutine is writing, others leave their packets to it.
+func (c *KCPConn) uncork() {
+	c.account()
+	c.countUnsent()
+	notify := len(c.stateq) > 0
+	if c.txbusy {
+		c.mu.Unlock()
+		if notify {
+			c.notifyState()
+		}
+		return
+	}
+
+	c.txbusy = true
+	for len(c.txqueue) > 0 {
+		atomic.StoreInt64(&c.lastSend, int64(time.Since(epoch)))
+		txqueue := c.txqueue
+		c.txqueue = c.txspare
+		c.mu.Unlock()
+
+		c.transmit(txqueue)
+		for k := range txqueue {
+			if txqueue[k] != nil { // not taken over by transmit
+				putXmitBuf(txqueue[k])
+				txqueue[k] = nil
+			}
+		}
+
+		c.mu.Lock()
+		c.txspare = txqueue[:0]
+	}
+	c.txbusy = false
+	c.mu.Unlock()
+	if notify {
+		c.notifyState()
+	}
+}
+
+// update is called by the updater, it returns the delay before the next
+// update, or false if the connection has been closed
+func (c *KCPConn) update() (interval time.Duration, ok bool) {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return 0, false
+	}
+	interval, dead := c.updateKCP()
+	c.uncork()
+	if dead {
+		c.close(closeDeadLink)
+		return 0, false
+	}
+	return interval, true
+}
+
+// updateKCP runs kcp.Update and returns the delay before the next update, and whether
+// the dead link mode wants the connection closed, c.mu must be held
+func (c *KCPConn) updateKCP() (time.Duration, bool) {
+	current := currentMs()
+	if c.kcp.trace != nil {
+		c.kcp.trace.updateTick()
+	}
+	var interval time.Duration
+	if c.lan.enabled {
+		interval = c.updateLAN(current)
+	} else {
+		c.kcp.Update(current)
+		interval = time.Duration(_itimediff(c.kcp.Check(current), current)) * time.Millisecond
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+	}
+	if c.kcp.WaitSnd() < 2*int(c.kcp.snd_wnd) {
+		c.notifyWriteEvent()
+	}
+	return interval, c.checkDeadLink()
+}
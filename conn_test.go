@@ -0,0 +1,1275 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// kcpConnPair connects two KCPConns with an in-memory transport
+func kcpConnPair() (a, b *KCPConn) {
+	a = NewKCPConn(1, func(buf []byte) { b.Input(buf) })
+	b = NewKCPConn(1, func(buf []byte) { a.Input(buf) })
+	return a, b
+}
+
+func TestKCPConn(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.SetStreamMode(true)
+	b.SetStreamMode(true)
+
+	msg := make([]byte, 1<<20)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		for p := msg; len(p) > 0; p = p[65536:] {
+			a.Write(p[:65536])
+		}
+	}()
+
+	got := make([]byte, len(msg))
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// deadline
+	b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := b.Read(got); err == nil {
+		t.Fatal("read without data succeeded")
+	} else if e, ok := err.(interface{ Timeout() bool }); !ok || !e.Timeout() {
+		t.Fatal(err)
+	}
+
+	// close
+	b.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Close()
+	}()
+	if _, err := b.Read(got); err == nil {
+		t.Fatal("read on a closed connection succeeded")
+	}
+	if err := b.Input(make([]byte, IKCP_OVERHEAD)); err == nil {
+		t.Fatal("input on a closed connection succeeded")
+	}
+	if err := b.Close(); err == nil {
+		t.Fatal("closed twice")
+	}
+}
+
+func TestKCPConnReadCallback(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+
+	// messages arriving before the callback is set are delivered too
+	a.Write([]byte("early"))
+	time.Sleep(100 * time.Millisecond)
+
+	if err := b.SetReadCallback(func(msg []byte) {
+		b.Write(msg) // must not deadlock
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 100
+	for i := 0; i < N; i++ {
+		a.Write([]byte{byte(i)})
+	}
+
+	buf := make([]byte, 16)
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := a.Read(buf); err != nil || string(buf[:n]) != "early" {
+		t.Fatal(n, err)
+	}
+	for i := 0; i < N; i++ {
+		n, err := a.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 || buf[0] != byte(i) {
+			t.Fatal("got", buf[:n], "want", i)
+		}
+	}
+
+	if _, err := b.Read(buf); err == nil {
+		t.Fatal("read with a callback set")
+	}
+	if err := a.SetReadCallback(func([]byte) {}); err == nil {
+		t.Fatal("callback set after read")
+	}
+}
+
+// a connection whose output goes nowhere closes once a segment reached the retry limit
+func TestKCPConnDeadLink(t *testing.T) {
+	c := NewKCPConn(1, func([]byte) {})
+	c.SetNoDelay(1, 10, 2, 1)
+	c.SetRetries(3)
+	c.SetDeadLinkTime(0)
+	c.SetDeadLinkMode(DeadLinkClose, 0, 0)
+	c.Write([]byte("anybody there"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		ce, _ := context.Cause(c.Context()).(*CloseError)
+		if err != io.EOF || ce == nil || ce.Kind != ClosedDeadLink {
+			t.Fatal("Read returned", err, ce)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("open after a dead link")
+	}
+	if _, err := c.Write([]byte("again")); err == nil {
+		t.Fatal("write after a dead link")
+	}
+}
+
+// 8 writers and 2 readers on one connection, then a close from another goroutine
+func TestKCPConnConcurrency(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+
+	const writers = 8
+	const readers = 2
+	const msgs = 200
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for seq := 0; seq < msgs; seq++ {
+				msg := make([]byte, 16+(w*msgs+seq)*31%4096)
+				for i := range msg {
+					msg[i] = byte(w + seq + i)
+				}
+				msg[0], msg[1], msg[2] = byte(w), byte(seq), byte(seq>>8)
+				if _, err := a.Write(msg); err != nil {
+					return
+				}
+			}
+		}(w)
+	}
+
+	// every message arrives whole, and each reader sees the messages of a writer in order
+	results := make(chan int, readers)
+	var total int32
+	for r := 0; r < readers; r++ {
+		go func() {
+			last := make([]int, writers)
+			for k := range last {
+				last[k] = -1
+			}
+			buf := make([]byte, 65536)
+			for atomic.LoadInt32(&total) < writers*msgs {
+				b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				n, err := b.Read(buf)
+				if err != nil {
+					continue
+				}
+				w, seq := int(buf[0]), int(buf[1])|int(buf[2])<<8
+				if w >= writers || seq <= last[w] || n != 16+(w*msgs+seq)*31%4096 {
+					t.Error("bad message", w, seq, n)
+					break
+				}
+				for i := 3; i < n; i++ {
+					if buf[i] != byte(w+seq+i) {
+						t.Error("corrupted message", w, seq)
+						break
+					}
+				}
+				last[w] = seq
+				atomic.AddInt32(&total, 1)
+			}
+			results <- 0
+		}()
+	}
+
+	timeout := time.After(30 * time.Second)
+	for r := 0; r < readers; r++ {
+		select {
+		case <-results:
+		case <-timeout:
+			t.Fatal("received", atomic.LoadInt32(&total), "messages")
+		}
+	}
+
+	// Close unblocks concurrent Reads and Writes
+	done := make(chan struct{})
+	for i := 0; i < writers; i++ {
+		go func() {
+			msg := make([]byte, 4096)
+			for {
+				if _, err := b.Write(msg); err != nil {
+					done <- struct{}{}
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < readers; i++ {
+		go func() {
+			b.SetReadDeadline(time.Time{})
+			buf := make([]byte, 65536)
+			for {
+				if _, err := b.Read(buf); err != nil {
+					done <- struct{}{}
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Close()
+	}()
+	for i := 0; i < writers+readers; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked after Close")
+		}
+	}
+}
+
+// kcpConnLink connects two KCPConns with an in-memory link carrying a packet per interval
+func kcpConnLink(interval time.Duration) (a, b *KCPConn) {
+	link := func(dst **KCPConn) func([]byte) {
+		ch := make(chan []byte, 1024)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for pkt := range ch {
+				<-ticker.C
+				if (*dst).Input(pkt) != nil {
+					return
+				}
+			}
+		}()
+		return func(buf []byte) {
+			select {
+			case ch <- append([]byte(nil), buf...):
+			default:
+			}
+		}
+	}
+	a = NewKCPConn(1, link(&b))
+	b = NewKCPConn(1, link(&a))
+	return a, b
+}
+
+// average latency of small messages written with prio while 4 writers saturate the link
+func priorityLatency(t *testing.T, prio int) time.Duration {
+	a, b := kcpConnLink(200 * time.Microsecond)
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 0) // congestion control keeps the bulk data queued
+	b.SetNoDelay(1, 10, 2, 0)
+
+	for i := 0; i < 4; i++ {
+		go func() {
+			bulk := make([]byte, 8192)
+			for {
+				if _, err := a.Write(bulk); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	const pings = 10
+	latency := make(chan time.Duration, pings)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := b.Read(buf)
+			if err != nil {
+				return
+			}
+			if n == 8 {
+				sent := int64(binary.LittleEndian.Uint64(buf))
+				latency <- time.Since(time.Unix(0, sent))
+			}
+		}
+	}()
+
+	var sum time.Duration
+	for i := 0; i < pings; i++ {
+		time.Sleep(20 * time.Millisecond)
+		ping := make([]byte, 8)
+		binary.LittleEndian.PutUint64(ping, uint64(time.Now().UnixNano()))
+		if _, err := a.WriteWithPriority(ping, prio); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case d := <-latency:
+			sum += d
+		case <-time.After(10 * time.Second):
+			t.Fatal("lost ping", i)
+		}
+	}
+	return sum / pings
+}
+
+func TestWriteWithPriority(t *testing.T) {
+	a, _ := kcpConnPair()
+	defer a.Close()
+	if _, err := a.WriteWithPriority([]byte("x"), 2); err == nil {
+		t.Fatal("bad priority accepted")
+	}
+
+	low := priorityLatency(t, PriorityLow)
+	high := priorityLatency(t, PriorityHigh)
+	t.Log("latency under bulk load, low:", low, "high:", high)
+	if high*2 >= low {
+		t.Fatal("high priority is not faster", high, low)
+	}
+}
+
+func TestKCPConnWriteChunks(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.SetStreamMode(true)
+	b.SetStreamMode(true)
+
+	// one send takes at most 255 fragments, a chunk of 256 would be dropped
+	mss := int(a.kcp.mss)
+	for _, size := range []int{255 * mss, 255*mss + 1, 256 * mss, 600 * mss} {
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			n, err := a.Write(msg)
+			if err == nil && n != size {
+				err = fmt.Errorf("wrote %v of %v bytes", n, size)
+			}
+			errc <- err
+		}()
+		got := make([]byte, size)
+		b.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(b, got); err != nil {
+			t.Fatal(size, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal(size, "data mismatch")
+		}
+	}
+}
+
+func TestKCPConnWriteBuffers(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+
+	// a header and a body make one message
+	v := net.Buffers{[]byte("head:"), nil, []byte("body")}
+	if n, err := a.WriteBuffers(v); err != nil || n != 9 {
+		t.Fatal(n, err)
+	}
+	if len(v) != 3 || string(v[0]) != "head:" {
+		t.Fatal("buffers consumed", v)
+	}
+	buf := make([]byte, 1<<20)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "head:body" {
+		t.Fatal(string(buf[:n]), err)
+	}
+
+	// beyond the fragment limit the data is split into several messages, as with Write
+	a.SetStreamMode(true)
+	b.SetStreamMode(true)
+	body := make([]byte, 300*1024)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	want := append([]byte("head:"), body...)
+	go a.WriteBuffers(net.Buffers{want[:5], body[:1000], body[1000:]})
+	if _, err := io.ReadFull(b, buf[:len(want)]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:len(want)], want) {
+		t.Fatal("data mismatch")
+	}
+
+	a.Close()
+	if _, err := a.WriteBuffers(v); err == nil {
+		t.Fatal("write on a closed connection succeeded")
+	}
+}
+
+func TestWriteDelay(t *testing.T) {
+	var pkts int32
+	var a, b *KCPConn
+	a = NewKCPConn(1, func(buf []byte) {
+		atomic.AddInt32(&pkts, 1)
+		b.Input(buf)
+	})
+	b = NewKCPConn(1, func(buf []byte) { a.Input(buf) })
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	if err := a.SetWriteDelay(-1); err == nil {
+		t.Fatal("negative delay accepted")
+	}
+	a.SetWriteDelay(50 * time.Millisecond)
+	buf := make([]byte, 4096)
+	read := func() string {
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// small messages are held, then leave in one datagram and stay messages
+	for i := 0; i < 10; i++ {
+		a.Write([]byte{'0' + byte(i)})
+	}
+	if n := atomic.LoadInt32(&pkts); n != 0 {
+		t.Fatal(n, "datagrams before the delay passed")
+	}
+	for i := 0; i < 10; i++ {
+		if msg := read(); msg != string([]byte{'0' + byte(i)}) {
+			t.Fatal("got", msg)
+		}
+	}
+	if n := atomic.LoadInt32(&pkts); n != 1 {
+		t.Fatal(n, "datagrams for 10 held messages")
+	}
+
+	// Flush sends them right away, and larger writes take the held ones along, first
+	a.Write([]byte("x"))
+	a.Flush()
+	if msg := read(); msg != "x" {
+		t.Fatal("got", msg)
+	}
+	a.Write([]byte("y"))
+	a.Write(bytes.Repeat([]byte("z"), int(a.kcp.mss)))
+	if msg := read(); msg != "y" {
+		t.Fatal("got", msg)
+	}
+	if msg := read(); len(msg) != int(a.kcp.mss) {
+		t.Fatal("got", len(msg), "bytes")
+	}
+
+	// in stream mode they fill one segment
+	a.SetStreamMode(true)
+	b.SetStreamMode(true)
+	for i := 0; i < 10; i++ {
+		a.Write([]byte("abcd"))
+	}
+	if msg := read(); msg != strings.Repeat("abcd", 10) {
+		t.Fatal("got", msg)
+	}
+
+	// Close discards held writes
+	a.Write([]byte("lost"))
+	a.Close()
+	b.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := b.Read(buf); err == nil {
+		t.Fatal("got", string(buf[:n]))
+	}
+}
+
+func TestReadAfterClose(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.Write([]byte("last"))
+	a.Write([]byte("words"))
+	for i := 0; b.RecvQueueLen() < 2; i++ {
+		if i == 100 {
+			t.Fatal("nothing received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// data received before the close is still read, then Read fails
+	b.Close()
+	buf := make([]byte, 16)
+	for _, want := range []string{"last", "words"} {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatal("got", string(buf[:n]))
+		}
+	}
+	if _, err := b.Read(buf); err != io.EOF {
+		t.Fatal("read after a local close:", err)
+	}
+	if _, err := b.Write(buf); err == nil {
+		t.Fatal("write on a closed connection succeeded")
+	}
+}
+
+func TestCloseSemantics(t *testing.T) {
+	// the window of the connection returned is full for both priorities, nothing
+	// acknowledges its data
+	unacked := func() *KCPConn {
+		c := NewKCPConn(1, func([]byte) {})
+		c.SetWindowSize(2, 2)
+		for {
+			if _, err := c.write([][]byte{[]byte("x")}, PriorityHigh, false, false); err != nil {
+				return c
+			}
+		}
+	}
+	// blocked runs op until it blocks, then closes c with reason and returns the error of op
+	blocked := func(t *testing.T, c *KCPConn, reason string, op func() error) error {
+		done := make(chan error, 1)
+		go func() { done <- op() }()
+		select {
+		case err := <-done:
+			t.Fatal("returned without blocking:", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		closed := time.Now()
+		c.close(reason)
+		select {
+		case err := <-done:
+			if d := time.Since(closed); d > 100*time.Millisecond {
+				t.Fatal("returned", d, "after the close")
+			}
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("still blocked after the close")
+		}
+		return nil
+	}
+	// isClose checks a Read ended by the close for reason returned io.EOF, whatever the reason
+	isClose := func(t *testing.T, c *KCPConn, err error, reason string) {
+		if err != io.EOF {
+			t.Fatal("want io.EOF for", reason, "got", err)
+		}
+		ce, _ := context.Cause(c.Context()).(*CloseError)
+		if ce == nil || ce.Reason != reason || !errors.Is(ce, ErrClosed) {
+			t.Fatal("want the cause", reason, "got", ce)
+		}
+	}
+	buf := make([]byte, 16)
+
+	cases := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{"blocked Read", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			err := blocked(t, a, closeLocal, func() error { _, err := a.Read(buf); return err })
+			isClose(t, a, err, closeLocal)
+			if _, err := a.Read(buf); err != io.EOF {
+				t.Fatal("Read after the close:", err)
+			}
+		}},
+		{"blocked Read, dead link", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			err := blocked(t, a, closeDeadLink, func() error { _, err := a.Read(buf); return err })
+			isClose(t, a, err, closeDeadLink)
+		}},
+		{"blocked Read with a deadline", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			a.SetReadDeadline(time.Now().Add(time.Hour))
+			err := blocked(t, a, closeLocal, func() error { _, err := a.Read(buf); return err })
+			isClose(t, a, err, closeLocal)
+		}},
+		{"Read drains, then EOF", func(t *testing.T) {
+			a, b := kcpConnPair()
+			defer b.Close()
+			b.Write([]byte("last"))
+			for i := 0; a.RecvQueueLen() == 0; i++ {
+				if i == 100 {
+					t.Fatal("nothing received")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			a.Close()
+			if n, err := a.Read(buf); err != nil || string(buf[:n]) != "last" {
+				t.Fatal(string(buf[:n]), err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := a.Read(buf); err != io.EOF {
+					t.Fatal("Read after draining:", err)
+				}
+			}
+		}},
+		{"TryRead", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			a.Close()
+			if _, err := a.TryRead(buf); err != io.EOF {
+				t.Fatal(err)
+			}
+		}},
+		{"blocked Write", func(t *testing.T) {
+			c := unacked()
+			err := blocked(t, c, closeLocal, func() error { _, err := c.Write([]byte("x")); return err })
+			if err != ErrClosed {
+				t.Fatal(err)
+			}
+		}},
+		{"blocked high priority Write", func(t *testing.T) {
+			c := unacked()
+			err := blocked(t, c, closeDeadLink, func() error {
+				_, err := c.WriteWithPriority([]byte("x"), PriorityHigh)
+				return err
+			})
+			if err != ErrClosed {
+				t.Fatal(err)
+			}
+		}},
+		{"writes", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			a.Close()
+			writes := map[string]func() error{
+				"Write":         func() error { _, err := a.Write(buf); return err },
+				"TryWrite":      func() error { _, err := a.TryWrite(buf); return err },
+				"WriteMessage":  func() error { _, err := a.WriteMessage(buf); return err },
+				"WriteBuffers":  func() error { _, err := a.WriteBuffers(net.Buffers{buf}); return err },
+				"high priority": func() error { _, err := a.WriteWithPriority(buf, PriorityHigh); return err },
+			}
+			for name, write := range writes {
+				if err := write(); err != ErrClosed {
+					t.Fatal(name, err)
+				}
+			}
+		}},
+		{"Flush, Input and Close", func(t *testing.T) {
+			a, _ := kcpConnPair()
+			a.Close()
+			if err := a.Flush(); err != ErrClosed {
+				t.Fatal("Flush:", err)
+			}
+			if err := a.Input(make([]byte, IKCP_OVERHEAD)); err != ErrClosed {
+				t.Fatal("Input:", err)
+			}
+			if err := a.Close(); err != ErrClosed {
+				t.Fatal("Close:", err)
+			}
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, c.run)
+	}
+}
+
+func TestReadWakeup(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+
+	// readers wait together, bursts of messages arrive in one packet between idle gaps
+	const readers, rounds, gap = 4, 20, 100 * time.Millisecond
+	a.SetWriteDelay(time.Minute)
+	start := time.Now()
+	latencies := make(chan time.Duration, readers*rounds)
+	for i := 0; i < readers; i++ {
+		go func() {
+			buf := make([]byte, 8)
+			for {
+				if _, err := b.Read(buf); err != nil {
+					return
+				}
+				sent := time.Duration(binary.LittleEndian.Uint64(buf))
+				latencies <- time.Since(start) - sent
+				time.Sleep(gap / 2) // busy with the message, the other readers take the next
+			}
+		}()
+	}
+	msg := make([]byte, 8)
+	for i := 0; i < rounds; i++ {
+		time.Sleep(gap)
+		for k := 0; k < readers; k++ {
+			binary.LittleEndian.PutUint64(msg, uint64(time.Since(start)))
+			a.Write(msg)
+		}
+		a.Flush()
+	}
+	var max time.Duration
+	for i := 0; i < readers*rounds; i++ {
+		select {
+		case d := <-latencies:
+			if d > max {
+				max = d
+			}
+		case <-time.After(time.Second):
+			t.Fatal(i, "messages read")
+		}
+	}
+	if max > gap/4 {
+		t.Fatal("read latency up to", max)
+	}
+}
+
+func TestUnsentBytes(t *testing.T) {
+	// nothing acknowledges the data, the congestion window lets one segment go
+	c := NewKCPConn(1, func([]byte) {})
+	defer c.Close()
+	c.SetNoDelay(1, 10, 2, 0)
+	c.SetWindowSize(16, 16)
+	if !c.LastSend().IsZero() || !c.LastRecv().IsZero() || c.UnsentBytes() != 0 {
+		t.Fatal("sent or received before any write")
+	}
+	for updated := false; !updated; time.Sleep(time.Millisecond) { // flushes send from the first update on
+		c.mu.Lock()
+		updated = c.kcp.updated != 0
+		c.mu.Unlock()
+	}
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		c.Write(make([]byte, 100))
+	}
+	if n := c.UnsentBytes(); n != 700 {
+		t.Fatal(n, "bytes unsent")
+	}
+	if last := c.LastSend(); last.Before(start) || last.After(time.Now()) {
+		t.Fatal("last send", last, "started", start)
+	}
+	c.SetWriteDelay(time.Minute)
+	c.Write(make([]byte, 50))
+	if n := c.UnsentBytes(); n != 750 {
+		t.Fatal(n, "bytes unsent with a held write")
+	}
+
+	// all is sent once acknowledged
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.SetWindowSize(2, 2)
+	for i := 0; i < 10; i++ {
+		a.Write(make([]byte, 100))
+	}
+	for i := 0; a.UnsentBytes() > 0 || b.RecvQueueLen() < 10; i++ {
+		if i == 100 {
+			t.Fatal(a.UnsentBytes(), "bytes unsent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.LastRecv().IsZero() || b.LastSend().IsZero() {
+		t.Fatal("acks neither sent nor received")
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	// the link loses the first data packet, then goes down when cut is set
+	var dropped, cut int32
+	var a, b *KCPConn
+	a = NewKCPConn(1, func(buf []byte) {
+		if atomic.LoadInt32(&cut) != 0 || buf[4] == IKCP_CMD_PUSH && atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+			return
+		}
+		b.Input(buf)
+	})
+	b = NewKCPConn(1, func(buf []byte) { a.Input(buf) })
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.SetWindowSize(4, 32)
+
+	var sent, retransmitted, acked, windowFull, ticks int32
+	deadLink := make(chan struct{}, 1)
+	a.SetTrace(&SessionTrace{
+		SegmentSent:          func(sn uint32) { atomic.AddInt32(&sent, 1) },
+		SegmentRetransmitted: func(sn, xmit uint32) { atomic.AddInt32(&retransmitted, 1) },
+		AckReceived:          func(sn uint32, rtt time.Duration) { atomic.AddInt32(&acked, 1) },
+		WindowFull:           func() { atomic.AddInt32(&windowFull, 1) },
+		UpdateTick:           func() { atomic.AddInt32(&ticks, 1) },
+		DeadLink:             func() { deadLink <- struct{}{} },
+	})
+
+	// more messages than the window holds
+	const N = 16
+	go func() {
+		for i := 0; i < N; i++ {
+			a.Write([]byte{byte(i)})
+		}
+	}()
+	buf := make([]byte, 16)
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < N; i++ {
+		if _, err := b.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; atomic.LoadInt32(&acked) < N; i++ {
+		if i == 100 {
+			t.Fatal("acked", atomic.LoadInt32(&acked))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&sent); n != N {
+		t.Fatal("sent", n)
+	}
+	if atomic.LoadInt32(&retransmitted) == 0 || atomic.LoadInt32(&windowFull) == 0 || atomic.LoadInt32(&ticks) == 0 {
+		t.Fatal("retransmitted", retransmitted, "window full", windowFull, "ticks", ticks)
+	}
+
+	a.mu.Lock()
+	a.kcp.dead_link, a.kcp.dead_time = 3, 0
+	a.mu.Unlock()
+	atomic.StoreInt32(&cut, 1)
+	a.Write([]byte("x"))
+	select {
+	case <-deadLink:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dead link")
+	}
+
+	// removed hooks are not called
+	a.SetTrace(nil)
+	a.Write([]byte("y"))
+}
+
+func TestSelfCheck(t *testing.T) {
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetNoDelay(1, 10, 2, 1)
+	b.SetNoDelay(1, 10, 2, 1)
+	a.SetStreamMode(true)
+	a.setSelfCheck(1000)
+	b.setSelfCheck(1000)
+
+	msg := make([]byte, 100*1500)
+	rand.Read(msg)
+	go func() {
+		for p := msg; len(p) > 0; p = p[1500:] {
+			a.Write(p[:1500])
+		}
+	}()
+	got := make([]byte, len(msg))
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// a flipped bit fails the check, and every read after it
+	tx, rx := newSelfCheck(10), newSelfCheck(10)
+	v, size := tx.insert([][]byte{[]byte("0123456789abcdef")})
+	data := bytes.Join(v, nil)
+	if size != len(data) || size != 16+selfCheckSize {
+		t.Fatal("size", size)
+	}
+	data[12] ^= 1
+	if n, err := rx.strip(data[:12]); n != 10 || err != nil {
+		t.Fatal(n, err)
+	}
+	if _, err := rx.strip(data[12:]); err == nil {
+		t.Fatal("corruption not detected")
+	}
+	if _, err := rx.strip([]byte("x")); err == nil {
+		t.Fatal("check passed after a failure")
+	}
+}
+
+var soakBytes = flag.Int64("soak", 0, "bytes TestSoak pushes through, 0 skips it")
+
+// TestSoak pushes data through a lossy, duplicating and reordering in-memory pipe,
+// with the chaos hooks and the self-check on, and asserts it arrives byte exact. It's
+// skipped by default, run it for hours with:
+//
+//	go test -tags kcpchaos -run TestSoak -soak 4000000000 -timeout 0
+func TestSoak(t *testing.T) {
+	if *soakBytes <= 0 {
+		t.Skip("run with -soak")
+	}
+	if !chaosEnabled {
+		t.Log("built without -tags kcpchaos, no chaos")
+	}
+	setChaos(20*time.Millisecond, 0.01, 30*time.Millisecond)
+	defer setChaos(0, 0, 0)
+
+	// every packet may be lost, duplicated or delayed up to 5ms
+	var a, b *KCPConn
+	pipe := func(to **KCPConn) func(buf []byte) {
+		return func(buf []byte) {
+			copies := 1
+			if r := rand.Float64(); r < 0.05 {
+				return
+			} else if r < 0.06 {
+				copies = 2
+			}
+			pkt := append([]byte(nil), buf...)
+			for i := 0; i < copies; i++ {
+				time.AfterFunc(time.Duration(rand.Int63n(int64(5*time.Millisecond))), func() { (*to).Input(pkt) })
+			}
+		}
+	}
+	a = NewKCPConn(1, pipe(&b))
+	b = NewKCPConn(1, pipe(&a))
+	defer a.Close()
+	defer b.Close()
+	for _, c := range []*KCPConn{a, b} {
+		c.SetNoDelay(1, 10, 2, 1)
+		c.SetWindowSize(512, 512)
+		c.SetStreamMode(true)
+		c.setSelfCheck(64 * 1024)
+	}
+
+	// both ends generate the same pseudo random data, Read of math/rand doesn't
+	// depend on how it's cut
+	total := *soakBytes
+	go func() {
+		data := rand.New(rand.NewSource(1))
+		buf := make([]byte, 256*1024)
+		for left := total; left > 0; {
+			n := int64(1 + rand.Intn(len(buf)))
+			if n > left {
+				n = left
+			}
+			data.Read(buf[:n])
+			if _, err := a.Write(buf[:n]); err != nil {
+				return
+			}
+			left -= n
+		}
+	}()
+
+	data := rand.New(rand.NewSource(1))
+	got, want := make([]byte, 256*1024), make([]byte, 256*1024)
+	start := time.Now()
+	for done := int64(0); done < total; {
+		b.SetReadDeadline(time.Now().Add(time.Minute))
+		n, err := b.Read(got)
+		if err != nil {
+			t.Fatalf("at byte %v: %v", done, err)
+		}
+		data.Read(want[:n])
+		if !bytes.Equal(got[:n], want[:n]) {
+			t.Fatalf("data mismatch at byte %v", done)
+		}
+		done += int64(n)
+	}
+	t.Logf("%v bytes in %v", total, time.Since(start))
+}
+
+// congestion control keeps the window small on a clean link with a long delay, the
+// throughput jumps once it's disabled mid-flight, and the flow goes on enabled again
+func TestSetCongestionControl(t *testing.T) {
+	delay := func(to **KCPConn) func(buf []byte) {
+		return func(buf []byte) {
+			pkt := append([]byte(nil), buf...)
+			time.AfterFunc(50*time.Millisecond, func() { (*to).Input(pkt) })
+		}
+	}
+	var a, b *KCPConn
+	a = NewKCPConn(1, delay(&b))
+	b = NewKCPConn(1, delay(&a))
+	defer a.Close()
+	defer b.Close()
+	for _, c := range []*KCPConn{a, b} {
+		c.SetNoDelay(1, 10, 2, 0)
+		c.SetWindowSize(1024, 1024)
+		c.SetStreamMode(true)
+	}
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, err := a.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	var received int64
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := b.Read(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&received, int64(n))
+		}
+	}()
+	measure := func() int64 {
+		start := atomic.LoadInt64(&received)
+		time.Sleep(time.Second)
+		return atomic.LoadInt64(&received) - start
+	}
+
+	on := measure()
+	a.SetCongestionControl(false)
+	off := measure()
+	t.Log("bytes per second with congestion control", on, "without", off)
+	if off < 3*on {
+		t.Fatal("with congestion control", on, "without", off)
+	}
+
+	a.mu.Lock()
+	a.kcp.SetCongestionControl(true)
+	cwnd, inflight := a.kcp.cwnd, a.kcp.snd_nxt-a.kcp.snd_una
+	a.mu.Unlock()
+	if cwnd != inflight || cwnd == 0 {
+		t.Fatal("cwnd", cwnd, "with", inflight, "in flight")
+	}
+	if again := measure(); again == 0 {
+		t.Fatal("stalled with congestion control enabled again")
+	}
+
+	// sessions show the setting in their stats
+	s, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.Stats().Congestion {
+		t.Fatal("congestion control disabled by default")
+	}
+	s.SetCongestionControl(false)
+	if s.Stats().Congestion {
+		t.Fatal("congestion control enabled")
+	}
+	s.SetNoDelay(-1, -1, -1, 0)
+	if !s.Stats().Congestion {
+		t.Fatal("congestion control disabled with nc 0")
+	}
+}
+
+func TestReorderStats(t *testing.T) {
+	for d := uint32(0); d < 1<<20; d = d*5/4 + 1 {
+		if k := reorderBucket(d); d > reorderBound(k) || k > 0 && d <= reorderBound(k-1) {
+			t.Fatal("distance", d, "in bucket", k, "up to", reorderBound(k))
+		}
+	}
+
+	// every 16th datagram is held back behind the next 4
+	var a, b *KCPConn
+	pipe := func(to **KCPConn) func(buf []byte) {
+		var mu sync.Mutex
+		var n, behind int
+		var held []byte
+		return func(buf []byte) {
+			pkt := append([]byte(nil), buf...)
+			var release []byte
+			mu.Lock()
+			if n++; held == nil && n%16 == 0 {
+				held, behind = pkt, 0
+				mu.Unlock()
+				return
+			}
+			if held != nil {
+				if behind++; behind == 4 {
+					release, held = held, nil
+				}
+			}
+			mu.Unlock()
+			(*to).Input(pkt)
+			if release != nil {
+				(*to).Input(release)
+			}
+		}
+	}
+	a = NewKCPConn(1, pipe(&b))
+	b = NewKCPConn(1, pipe(&a))
+	defer a.Close()
+	defer b.Close()
+	for _, c := range []*KCPConn{a, b} {
+		c.SetNoDelay(1, 10, 2, 1)
+		c.SetWindowSize(1024, 1024)
+	}
+	b.SetFastResendTuning(true)
+
+	const N = 2000
+	go func() {
+		msg := make([]byte, 100)
+		for i := 0; i < N; i++ {
+			if _, err := a.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 100)
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < N; i++ {
+		if _, err := b.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.mu.Lock()
+	max, p99 := b.kcp.reorder.stats()
+	late, resend := b.kcp.reorder.late, b.kcp.fastresend
+	b.mu.Unlock()
+	t.Log("max", max, "p99", p99, "late", late, "fast resend", resend)
+	if max < 4 || p99 < 4 || late == 0 || resend != int32(p99)+1 {
+		t.Fatal("max", max, "p99", p99, "late", late, "fast resend", resend)
+	}
+	b.SetFastResendTuning(false)
+	b.mu.Lock()
+	resend = b.kcp.fastresend
+	b.mu.Unlock()
+	if resend != 2 {
+		t.Fatal("fast resend", resend, "without tuning")
+	}
+
+	// sessions show them in their stats
+	s, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 3, 1)
+	if st := s.Stats().Reorder; st != (ReorderStats{FastResend: 3}) {
+		t.Fatalf("%+v", st)
+	}
+}
+
+func TestPartialDeadlines(t *testing.T) {
+	timeout := func(err error) bool {
+		e, ok := err.(interface{ Timeout() bool })
+		return ok && e.Timeout()
+	}
+
+	// a Read past its deadline returns the data there is at every stage
+	a, b := kcpConnPair()
+	defer a.Close()
+	defer b.Close()
+	a.SetStreamMode(true)
+	b.SetStreamMode(true)
+	msg := make([]byte, 3000) // 3 segments
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	arrived := func() {
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			b.mu.Lock()
+			n := 0
+			for k := range b.kcp.rcv_queue {
+				n += len(b.kcp.rcv_queue[k].data)
+			}
+			b.mu.Unlock()
+			if n == len(msg) {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal(n, "bytes arrived")
+			}
+		}
+	}
+	var got []byte
+	buf := make([]byte, 4096)
+	for _, tc := range []struct {
+		name     string
+		setup    func()
+		size     int
+		timeout  bool
+		buffered bool // data left in sockbuff after
+	}{
+		{"nothing arrived", nil, 1000, true, false},
+		{"segment in kcp", func() { a.Write(msg); arrived() }, 1000, false, true},
+		{"rest in sockbuff", nil, 4096, false, false},
+		{"next segment", nil, 4096, false, false},
+		{"last segment", nil, 4096, false, false},
+		{"drained", nil, 4096, true, false},
+	} {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		b.SetReadDeadline(time.Now().Add(-time.Second))
+		n, err := b.Read(buf[:tc.size])
+		got = append(got, buf[:n]...)
+		switch {
+		case tc.timeout && (n != 0 || !timeout(err)):
+			t.Fatal(tc.name, n, err)
+		case !tc.timeout && (n == 0 || err != nil):
+			t.Fatal(tc.name, n, err)
+		}
+		b.bufmu.Lock()
+		buffered := len(b.sockbuff) > 0
+		b.bufmu.Unlock()
+		if buffered != tc.buffered {
+			t.Fatal(tc.name, "buffered", buffered)
+		}
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// a Write timing out has queued nothing, one queueing has queued everything
+	c := NewKCPConn(1, func([]byte) {}) // nothing is acknowledged
+	defer c.Close()
+	limited := NewKCPConn(1, func([]byte) {})
+	defer limited.Close()
+	limited.limit = newRateLimit(1000, 1000)
+	chunk := c.MaxMessageSize()
+	queued := func(c *KCPConn) int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.kcp.WaitSnd()
+	}
+	for _, tc := range []struct {
+		name     string
+		c        *KCPConn
+		deadline time.Duration // from now, 0 for none
+		try      bool
+		size     int
+		want     int
+	}{
+		{"deadline passed", c, -time.Second, false, 100, 0},
+		{"several chunks", c, 0, false, 2*chunk + 1, 2*chunk + 1},
+		{"window full", c, 50 * time.Millisecond, false, 100, 0},
+		{"window full, try", c, 0, true, 100, 0},
+		{"rate limit", limited, 50 * time.Millisecond, false, 4000, 0},
+	} {
+		tc.c.SetWriteDeadline(time.Time{})
+		if tc.deadline != 0 {
+			tc.c.SetWriteDeadline(time.Now().Add(tc.deadline))
+		}
+		waitsnd := queued(tc.c)
+		var n int
+		var err error
+		if tc.try {
+			n, err = tc.c.TryWrite(make([]byte, tc.size))
+		} else {
+			n, err = tc.c.Write(make([]byte, tc.size))
+		}
+		if n != tc.want || (n < tc.size) != timeout(err) {
+			t.Fatal(tc.name, n, err)
+		}
+		if n == 0 && queued(tc.c) != waitsnd {
+			t.Fatal(tc.name, "queued", queued(tc.c)-waitsnd, "segments")
+		}
+	}
+}
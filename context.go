@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"context"
+	"strings"
+)
+
+// closeContext is the reason of a session closed by the context of BindContext
+const closeContext = "closed by the context"
+
+// kinds of close, see CloseError
+const (
+	ClosedLocally   = iota // by Close, CloseWithError or the context of BindContext
+	ClosedByPeer           // the peer closed it, see CloseStatus
+	ClosedDeadLink         // the peer stopped answering, see SetDeadLinkMode
+	ClosedReplaced         // a new conversation took its address over
+	ClosedTransport        // the transport failed, the reason is its error
+	ClosedConvInUse        // the peer has another conversation of the id, see ConvSource
+)
+
+// closeKind returns the kind of a close for reason
+func closeKind(reason string) int {
+	switch {
+	case reason == closeLocal || reason == closeContext:
+		return ClosedLocally
+	case reason == closePeer:
+		return ClosedByPeer
+	case reason == closeReplaced:
+		return ClosedReplaced
+	case reason == closeConvInUse:
+		return ClosedConvInUse
+	case strings.HasPrefix(reason, closeDeadLink):
+		return ClosedDeadLink
+	}
+	return ClosedTransport
+}
+
+// Context returns a context cancelled once the connection closes, context.Cause of it
+// is then the CloseError telling why. Goroutines serving the connection end with it.
+func (c *KCPConn) Context() context.Context {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancelCause(context.Background())
+		if c.isClosed {
+			c.cancel(c.closeError())
+		}
+	}
+	return c.ctx
+}
+
+// closeError returns the CloseError of the close, c.mu must be held
+func (c *KCPConn) closeError() *CloseError {
+	return &CloseError{Reason: c.closeReason, Kind: closeKind(c.closeReason)}
+}
+
+// BindContext closes the session once ctx is done, with the reason "closed by the
+// context", without sending the data not acknowledged yet. Closing the session first
+// releases ctx.
+func (s *UDPSession) BindContext(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.closeWith(closeContext)
+		case <-s.die:
+		}
+	}()
+}
+
+// DialContext is DialWithOptions for a session that closes once ctx is done, see
+// BindContext
+func DialContext(ctx context.Context, raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s, err := DialWithOptions(raddr, block, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	s.BindContext(ctx)
+	return s, nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/des"
 	"crypto/sha1"
+	"sync"
 
 	"golang.org/x/crypto/blowfish"
 	"golang.org/x/crypto/cast5"
@@ -18,11 +19,22 @@ import (
 var (
 	initialVector = []byte{167, 115, 79, 156, 18, 172, 27, 1, 164, 21, 242, 193, 252, 120, 230, 107}
 	saltxor       = `sH3CIVoF#rWLtJo6`
+
+	// cryptBuf holds the CFB scratch tables as *[2 * aes.BlockSize]byte, so that one
+	// BlockCrypt can be shared by concurrent sessions and decryption workers
+	cryptBuf sync.Pool
 )
 
+func init() {
+	cryptBuf.New = func() interface{} {
+		return new([2 * aes.BlockSize]byte)
+	}
+}
+
 // BlockCrypt defines encryption/decryption methods for a given byte slice.
 // Notes on implementing: the data to be encrypted contains a builtin
-// nonce at the first 16 bytes
+// nonce at the first 16 bytes, and the methods may be called from
+// multiple goroutines simultaneously
 type BlockCrypt interface {
 	// Encrypt encrypts the whole block in src into dst.
 	// Dst and src may point at the same memory.
@@ -54,9 +66,7 @@ func (c *salsa20BlockCrypt) Decrypt(dst, src []byte) {
 }
 
 type twofishBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewTwofishBlockCrypt https://en.wikipedia.org/wiki/Twofish
@@ -66,19 +76,15 @@ func NewTwofishBlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, twofish.BlockSize)
-	c.decbuf = make([]byte, 2*twofish.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *twofishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *twofishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *twofishBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *twofishBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type tripleDESBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewTripleDESBlockCrypt https://en.wikipedia.org/wiki/Triple_DES
@@ -88,19 +94,15 @@ func NewTripleDESBlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, des.BlockSize)
-	c.decbuf = make([]byte, 2*des.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *tripleDESBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *tripleDESBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *tripleDESBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *tripleDESBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type cast5BlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewCast5BlockCrypt https://en.wikipedia.org/wiki/CAST-128
@@ -110,19 +112,15 @@ func NewCast5BlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, cast5.BlockSize)
-	c.decbuf = make([]byte, 2*cast5.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *cast5BlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *cast5BlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *cast5BlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *cast5BlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type blowfishBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewBlowfishBlockCrypt https://en.wikipedia.org/wiki/Blowfish_(cipher)
@@ -132,19 +130,15 @@ func NewBlowfishBlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, blowfish.BlockSize)
-	c.decbuf = make([]byte, 2*blowfish.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *blowfishBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *blowfishBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *blowfishBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *blowfishBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type aesBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewAESBlockCrypt https://en.wikipedia.org/wiki/Advanced_Encryption_Standard
@@ -154,19 +148,15 @@ func NewAESBlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, aes.BlockSize)
-	c.decbuf = make([]byte, 2*aes.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *aesBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *aesBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *aesBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *aesBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type teaBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewTEABlockCrypt https://en.wikipedia.org/wiki/Tiny_Encryption_Algorithm
@@ -176,19 +166,15 @@ func NewTEABlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, tea.BlockSize)
-	c.decbuf = make([]byte, 2*tea.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *teaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *teaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *teaBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *teaBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type xteaBlockCrypt struct {
-	encbuf []byte
-	decbuf []byte
-	block  cipher.Block
+	cfbCipher
 }
 
 // NewXTEABlockCrypt https://en.wikipedia.org/wiki/XTEA
@@ -198,14 +184,12 @@ func NewXTEABlockCrypt(key []byte) (BlockCrypt, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.block = block
-	c.encbuf = make([]byte, xtea.BlockSize)
-	c.decbuf = make([]byte, 2*xtea.BlockSize)
+	c.cfbCipher = newCFBCipher(block)
 	return c, nil
 }
 
-func (c *xteaBlockCrypt) Encrypt(dst, src []byte) { encrypt(c.block, dst, src, c.encbuf) }
-func (c *xteaBlockCrypt) Decrypt(dst, src []byte) { decrypt(c.block, dst, src, c.decbuf) }
+func (c *xteaBlockCrypt) Encrypt(dst, src []byte) { c.encrypt(dst, src) }
+func (c *xteaBlockCrypt) Decrypt(dst, src []byte) { c.decrypt(dst, src) }
 
 type simpleXORBlockCrypt struct {
 	xortbl []byte
@@ -231,30 +215,47 @@ func NewNoneBlockCrypt(key []byte) (BlockCrypt, error) {
 func (c *noneBlockCrypt) Encrypt(dst, src []byte) { copy(dst, src) }
 func (c *noneBlockCrypt) Decrypt(dst, src []byte) { copy(dst, src) }
 
+// cfbCipher is a block cipher in the CFB mode of the packets, the keystream of every
+// packet starts with initialVector encrypted, which is computed once
+type cfbCipher struct {
+	block cipher.Block
+	iv    [aes.BlockSize]byte // initialVector encrypted, the first block size bytes
+}
+
+func newCFBCipher(block cipher.Block) cfbCipher {
+	c := cfbCipher{block: block}
+	block.Encrypt(c.iv[:block.BlockSize()], initialVector)
+	return c
+}
+
 // packet encryption with local CFB mode
-func encrypt(block cipher.Block, dst, src, buf []byte) {
-	blocksize := block.BlockSize()
+func (c *cfbCipher) encrypt(dst, src []byte) {
+	buf := cryptBuf.Get().(*[2 * aes.BlockSize]byte)
+	defer cryptBuf.Put(buf)
+	blocksize := c.block.BlockSize()
 	tbl := buf[:blocksize]
-	block.Encrypt(tbl, initialVector)
+	copy(tbl, c.iv[:])
 	n := len(src) / blocksize
 	base := 0
 	for i := 0; i < n; i++ {
 		xorWords(dst[base:], src[base:], tbl)
-		block.Encrypt(tbl, dst[base:])
+		c.block.Encrypt(tbl, dst[base:])
 		base += blocksize
 	}
 	xorBytes(dst[base:], src[base:], tbl)
 }
 
-func decrypt(block cipher.Block, dst, src, buf []byte) {
-	blocksize := block.BlockSize()
+func (c *cfbCipher) decrypt(dst, src []byte) {
+	buf := cryptBuf.Get().(*[2 * aes.BlockSize]byte)
+	defer cryptBuf.Put(buf)
+	blocksize := c.block.BlockSize()
 	tbl := buf[:blocksize]
-	next := buf[blocksize:]
-	block.Encrypt(tbl, initialVector)
+	next := buf[blocksize : 2*blocksize] // xorWords works on len(tbl), which swaps with next
+	copy(tbl, c.iv[:])
 	n := len(src) / blocksize
 	base := 0
 	for i := 0; i < n; i++ {
-		block.Encrypt(next, src[base:])
+		c.block.Encrypt(next, src[base:])
 		xorWords(dst[base:], src[base:], tbl)
 		tbl, next = next, tbl
 		base += blocksize
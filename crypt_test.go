@@ -2,8 +2,10 @@ package kcp
 
 import (
 	"bytes"
+	"crypto/aes"
 	"crypto/rand"
 	"crypto/sha1"
+	"fmt"
 	"io"
 	"testing"
 
@@ -412,3 +414,81 @@ func BenchmarkSalsa20(b *testing.B) {
 		bc.Decrypt(dec, enc)
 	}
 }
+
+// ciphers with blocks smaller than the scratch space must not write beyond dst
+func TestCryptBounds(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bf, _ := NewBlowfishBlockCrypt(pass)
+	xt, _ := NewXTEABlockCrypt(pass[:16])
+	ae, _ := NewAESBlockCrypt(pass)
+	dirty := func() *[2 * aes.BlockSize]byte {
+		buf := new([2 * aes.BlockSize]byte)
+		copy(buf[:], bytes.Repeat([]byte{0xff}, len(buf)))
+		return buf
+	}
+	for _, bc := range []BlockCrypt{bf, xt, ae} {
+		for _, sz := range []int{24, 31, 32, 100, 1400} {
+			data := make([]byte, sz)
+			io.ReadFull(rand.Reader, data)
+			enc := make([]byte, sz+32)
+			cryptBuf.Put(dirty())
+			bc.Encrypt(enc[:sz], data)
+			if !bytes.Equal(enc[sz:], make([]byte, 32)) {
+				t.Fatalf("%T: Encrypt wrote beyond %v bytes", bc, sz)
+			}
+			dec := make([]byte, sz+32)
+			cryptBuf.Put(dirty()) // scratch space left dirty by other ciphers
+			bc.Decrypt(dec[:sz], enc[:sz])
+			if !bytes.Equal(dec[sz:], make([]byte, 32)) {
+				t.Fatalf("%T: Decrypt wrote beyond %v bytes", bc, sz)
+			}
+			if !bytes.Equal(dec[:sz], data) {
+				t.Fatalf("%T: %v bytes not recovered", bc, sz)
+			}
+		}
+	}
+}
+
+// the ciphertexts must never change, or peers of different versions can't talk
+func TestCryptWireFormat(t *testing.T) {
+	pass := pbkdf2.Key([]byte(cryptKey), []byte(cryptSalt), 4096, 32, sha1.New)
+	tests := []struct {
+		name   string
+		new    func([]byte) (BlockCrypt, error)
+		keylen int
+		digest string // sha1 of the ciphertexts of all sizes
+	}{
+		{"AES", NewAESBlockCrypt, 32, "e2c4ce3248c88ec8e09b60d4944f5835163c2d84"},
+		{"TEA", NewTEABlockCrypt, 16, "cd05a3fdd999428235237f72c88c027b4c45400f"},
+		{"SimpleXOR", NewSimpleXORBlockCrypt, 32, "702aeeb42279dbcc092e3ff4a1b1d06249973d85"},
+		{"Blowfish", NewBlowfishBlockCrypt, 32, "d9c83c3207cdd8ba7d946e499349468f53774ee5"},
+		{"Cast5", NewCast5BlockCrypt, 16, "34ec49db3f7ac9748a1bd00aa55da33c76309c42"},
+		{"TripleDES", NewTripleDESBlockCrypt, 24, "97fded1d5f8ecc01cf3f74202eb0605790457335"},
+		{"Twofish", NewTwofishBlockCrypt, 32, "a4136cc589f6dc1cdad74eb481bcec2aedd684d0"},
+		{"XTEA", NewXTEABlockCrypt, 16, "62e7610785d3d59bc04c09532d37e33a8a1d12b9"},
+		{"Salsa20", NewSalsa20BlockCrypt, 32, "c2fd9cd25aac53100f2556b6f28c7b5c2ee4cd69"},
+	}
+	for _, tt := range tests {
+		bc, err := tt.new(pass[:tt.keylen])
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha1.New()
+		for _, sz := range []int{8, 15, 16, 17, 31, 100, 1400} {
+			data := make([]byte, sz)
+			for i := range data {
+				data[i] = byte(i * 31)
+			}
+			plain := append([]byte(nil), data...)
+			bc.Encrypt(data, data)
+			h.Write(data)
+			bc.Decrypt(data, data)
+			if !bytes.Equal(data, plain) {
+				t.Fatalf("%v: %v bytes not recovered", tt.name, sz)
+			}
+		}
+		if digest := fmt.Sprintf("%x", h.Sum(nil)); digest != tt.digest {
+			t.Errorf("%v: ciphertext digest %v, want %v", tt.name, digest, tt.digest)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package kcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+const generationInfo = "kcp-go generation" // HKDF info of the keys of the generations, followed by the generation
+
+// CryptoContext is the key schedule of a pre-shared key, created once and shared by
+// the listeners and the dials of a process, see ListenWithCrypto and DialWithCrypto.
+// The key of generation 0 is the pre-shared key itself, the key of every later one
+// derives from it with HKDF-SHA256, so peers in other processes rotating alike arrive
+// at the same keys. A session keeps the key of the generation it started in, see
+// SetRekey to rotate keys within sessions. The nonces of the packets come from the
+// generator of each session, see NonceDRBG, they derive from no key.
+type CryptoContext struct {
+	mu        sync.Mutex // serializes Rotate
+	key       []byte
+	newCipher func(key []byte) (BlockCrypt, error)
+	token     *packetToken // of WithPacketToken, nil for none
+	gen       uint32       // the first generation, see WithGeneration
+	overlap   time.Duration
+	keys      atomic.Value // *cryptoKeys
+}
+
+// cryptoKeys are the ciphers of a generation, immutable once published
+type cryptoKeys struct {
+	gen   uint32
+	block BlockCrypt
+	prev  BlockCrypt // of the generation before, nil for none
+	until time.Time  // prev opens new conversations until then
+}
+
+// CryptoOption configures a CryptoContext, see NewCryptoContext
+type CryptoOption func(*CryptoContext)
+
+// WithCipher sets the cipher of the keys, NewAESBlockCrypt by default
+func WithCipher(newCipher func(key []byte) (BlockCrypt, error)) CryptoOption {
+	return func(c *CryptoContext) { c.newCipher = newCipher }
+}
+
+// WithPacketToken puts a packet token derived from the pre-shared key on every packet,
+// see SetPacketToken, it stays the same across generations
+func WithPacketToken() CryptoOption {
+	return func(c *CryptoContext) { c.token = newPacketToken(c.key) }
+}
+
+// WithGeneration starts the context at generation gen, for a process joining peers
+// which rotated before
+func WithGeneration(gen uint32) CryptoOption {
+	return func(c *CryptoContext) { c.gen = gen }
+}
+
+// WithRotateOverlap sets how long after Rotate the listeners still accept new
+// conversations under the key of the generation before, for peers rotating later,
+// 30 seconds by default
+func WithRotateOverlap(d time.Duration) CryptoOption {
+	return func(c *CryptoContext) { c.overlap = d }
+}
+
+// NewCryptoContext creates the key schedule of the pre-shared key, it fails if the
+// cipher doesn't take a key of its size
+func NewCryptoContext(key []byte, opts ...CryptoOption) (*CryptoContext, error) {
+	if len(key) == 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	c := &CryptoContext{key: append([]byte(nil), key...), newCipher: NewAESBlockCrypt, overlap: rekeyOverlap}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.newCipher == nil || c.overlap < 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	block, err := c.generationKey(c.gen)
+	if err != nil {
+		return nil, err
+	}
+	c.keys.Store(&cryptoKeys{gen: c.gen, block: block})
+	return c, nil
+}
+
+// generationKey derives the cipher of generation gen
+func (c *CryptoContext) generationKey(gen uint32) (BlockCrypt, error) {
+	if gen == 0 {
+		return c.newCipher(c.key)
+	}
+	info := make([]byte, len(generationInfo)+4)
+	binary.LittleEndian.PutUint32(info[copy(info, generationInfo):], gen)
+	key := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.key, nil, info), key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return c.newCipher(key)
+}
+
+// current returns the ciphers of the current generation
+func (c *CryptoContext) current() *cryptoKeys {
+	return c.keys.Load().(*cryptoKeys)
+}
+
+// Rotate moves to the next generation, at once for all the listeners and dials of the
+// context: sessions started from now on take its key, and the listeners open new
+// conversations under the key before for the overlap still, see WithRotateOverlap.
+// Sessions started before keep their key. The peers must rotate alike.
+func (c *CryptoContext) Rotate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cur := c.current()
+	block, err := c.generationKey(cur.gen + 1)
+	if err != nil {
+		return err
+	}
+	c.keys.Store(&cryptoKeys{gen: cur.gen + 1, block: block, prev: cur.block, until: time.Now().Add(c.overlap)})
+	return nil
+}
+
+// Generation returns the current generation
+func (c *CryptoContext) Generation() uint32 {
+	return c.current().gen
+}
+
+// Block returns the cipher of the current generation
+func (c *CryptoContext) Block() BlockCrypt {
+	return c.current().block
+}
+
+// ListenWithCrypto is ListenWithOptions with the keys of cc, see ServeConnWithCrypto
+func ListenWithCrypto(laddr string, cc *CryptoContext, dataShards, parityShards int) (*Listener, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP")
+	}
+	tuneSocket(conn)
+
+	return ServeConnWithCrypto(cc, dataShards, parityShards, conn)
+}
+
+// ServeConnWithCrypto is ServeConn with the keys of cc: a new conversation is accepted
+// under the key of the current generation, or of the one before for the overlap after
+// Rotate, and its session keeps that key.
+func ServeConnWithCrypto(cc *CryptoContext, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	if cc == nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	l := newListener(cc.Block(), dataShards, parityShards, conn)
+	l.crypto = cc
+	if cc.token != nil {
+		l.token.Store(cc.token)
+	}
+	l.spawn(l.sched.run)
+	l.spawn(l.monitor)
+	return l, nil
+}
+
+// DialWithCrypto is DialWithOptions with the key of the current generation of cc
+func DialWithCrypto(raddr string, cc *CryptoContext, dataShards, parityShards int) (*UDPSession, error) {
+	if cc == nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	s, err := DialWithOptions(raddr, cc.Block(), dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if cc.token != nil {
+		s.token.Store(cc.token)
+		s.mu.Lock()
+		s.updateMtu() // a packet token rules out the compact nonce format
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// sessionBlock returns the cipher of a session created now without a packet, the one of
+// the current generation with a CryptoContext
+func (l *Listener) sessionBlock() BlockCrypt {
+	if l.crypto != nil {
+		return l.crypto.Block()
+	}
+	return l.block
+}
+
+// bindKeys has the packets from addr opened with the key of s, which may be of a
+// generation before the current one, s.mu needn't be held
+func (l *Listener) bindKeys(addr string, s *UDPSession) {
+	if l.crypto != nil {
+		l.epochs.Store(addr, s)
+	}
+}
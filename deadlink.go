@@ -0,0 +1,132 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// dead link modes, what a session does once a segment reached the retry limit, see SetDeadLinkMode
+const (
+	DeadLinkIgnore  = iota // keep retransmitting, the application decides with deadlines, the default
+	DeadLinkClose          // close the session
+	DeadLinkSuspend        // suspend the session until a valid packet from the peer arrives
+)
+
+// limits of the dead link, see DeadLinkStats.Cause
+const (
+	DeadByRetries = 1 + iota // SetRetries along with SetDeadLinkTime
+	DeadByAge                // SetMaxRetransmitDuration
+)
+
+// DeadLinkStats tells the limits of the dead link and how close the session is to them
+type DeadLinkStats struct {
+	Retries       int           // transmissions of a segment, see SetRetries
+	RetriesTime   time.Duration // since the first one, along with Retries, see SetDeadLinkTime
+	MaxRetransmit time.Duration // unacknowledged since the first one, 0 for no bound, see SetMaxRetransmitDuration
+	MaxXmit       int           // most transmissions of a segment in flight
+	OldestAge     time.Duration // since the first transmission of the oldest segment in flight
+	Cause         int           // DeadByRetries or DeadByAge once the link is dead, 0 before
+}
+
+// connection states, see SessionStats.State and SetStateCallback
+const (
+	StateActive    = iota
+	StateSuspended // the link is dead, see DeadLinkSuspend
+	StateClosed
+)
+
+// setState changes the state and queues the change for the state callback, c.mu must be held
+func (c *KCPConn) setState(state int) {
+	c.state = state
+	if c.onState != nil {
+		c.stateq = append(c.stateq, state)
+	}
+}
+
+// checkDeadLink applies the dead link mode after an update, it returns true if the
+// connection has to be closed, c.mu must be held
+func (c *KCPConn) checkDeadLink() bool {
+	switch {
+	case c.deadLink == DeadLinkIgnore || c.kcp.state != 0xFFFFFFFF:
+		return false
+	case c.deadLink == DeadLinkClose:
+		return true
+	case c.state == StateActive:
+		c.setState(StateSuspended)
+		c.suspended = time.Now()
+		c.notifyWriteEvent() // Writes may buffer more now
+		return false
+	}
+	return c.deadLinkTimeout > 0 && time.Since(c.suspended) >= c.deadLinkTimeout
+}
+
+// deadLinkStats returns the limits of the dead link and the segments in flight against
+// them, c.mu must be held
+func (c *KCPConn) deadLinkStats() DeadLinkStats {
+	kcp := c.kcp
+	stats := DeadLinkStats{
+		Retries:       int(kcp.dead_link),
+		RetriesTime:   time.Duration(kcp.dead_time) * time.Millisecond,
+		MaxRetransmit: time.Duration(kcp.dead_age) * time.Millisecond,
+	}
+	if kcp.state == 0xFFFFFFFF {
+		stats.Cause = kcp.dead_cause
+	}
+	for k := range kcp.snd_buf {
+		seg := &kcp.snd_buf[k]
+		if seg.xmit == 0 {
+			continue
+		}
+		if int(seg.xmit) > stats.MaxXmit {
+			stats.MaxXmit = int(seg.xmit)
+		}
+		if age := time.Duration(_itimediff(kcp.current, seg.sendts)) * time.Millisecond; age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
+// heard resumes a suspended connection, as a valid packet arrived, c.mu must be held
+func (c *KCPConn) heard() {
+	atomic.StoreInt64(&c.lastRecv, int64(time.Since(epoch)))
+	if c.chHeard != nil {
+		close(c.chHeard)
+		c.chHeard = nil
+	}
+	if c.state == StateSuspended {
+		c.kcp.resetDeadLink()
+		c.setState(StateActive)
+	}
+}
+
+// sndLimit returns the number of segments Write may queue, c.mu must be held
+func (c *KCPConn) sndLimit() int {
+	limit := int(c.kcp.snd_wnd)
+	if c.state == StateSuspended {
+		if n := c.suspendBuffer / int(c.kcp.mss); n > limit {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// notifyState calls the state callback for the queued state changes in order,
+// without holding c.mu
+func (c *KCPConn) notifyState() {
+	c.statemu.Lock()
+	defer c.statemu.Unlock()
+	for {
+		c.mu.Lock()
+		if len(c.stateq) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		state, fn := c.stateq[0], c.onState
+		c.stateq = c.stateq[1:]
+		c.mu.Unlock()
+		if fn != nil {
+			fn(state)
+		}
+	}
+}
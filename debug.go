@@ -0,0 +1,229 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PacketInfo is a datagram decoded by DecodePacketForDebug
+type PacketInfo struct {
+	Encrypted   bool // it decrypted, and its checksum matched
+	Compact     bool // in the compact nonce format, see CapCompactNonce
+	Tokened     bool // with a packet token, see SetPacketToken
+	Checksummed bool // unencrypted with a CRC-32, see CapChecksum
+	Padding     int  // bytes of padding and their length, see SetPadding
+	FEC         bool // with a FEC header
+	FECSeqID    uint32
+	FECParity   bool          // a FEC parity shard, it carries no segments
+	Header      int           // header profile of the segments, see SetCompactHeader
+	Segments    []SegmentInfo // the kcp segments in the order of the datagram
+}
+
+// SegmentInfo is a kcp segment of a decoded datagram, the fields of its header and its
+// data. Compact segments carry the low 16 bits of Ts, Sn and Una, and Conv is 0 if the
+// datagram left it out.
+type SegmentInfo struct {
+	Conv uint32
+	Cmd  uint8 // IKCP_CMD_PUSH to IKCP_CMD_EXT_MAX
+	Frg  uint8
+	Wnd  uint16
+	Ts   uint32
+	Sn   uint32
+	Una  uint32
+	Len  uint32
+	Data []byte
+}
+
+// DecodePacketForDebug decodes a captured datagram of a session with the block
+// cipher, nil for none, and a FEC header if fec is set, the formats a session may
+// negotiate are tried in turn. datagram is left untouched, the data of the segments
+// points into a copy. It fails for datagrams which don't decrypt, or don't hold whole
+// segments, like the random keep-alive packets.
+func DecodePacketForDebug(block BlockCrypt, fec bool, datagram []byte) (*PacketInfo, error) {
+	if block == nil {
+		data := append([]byte(nil), datagram...)
+		if payload, summed := stripChecksum(data); summed {
+			if info, err := decodePayload(payload, fec); err == nil {
+				info.Checksummed = true
+				return info, nil
+			}
+		}
+		return decodePayload(data, fec)
+	}
+
+	// the random nonce format, the compact one, then with a packet token
+	for _, format := range []struct{ compact, tokened bool }{{false, false}, {true, false}, {false, true}} {
+		data := append([]byte(nil), datagram...)
+		var payload []byte
+		var ok bool
+		switch {
+		case format.compact:
+			payload, ok = decryptCompact(block, data, make([]byte, len(datagram)+nonceSize))
+		case len(data) >= cryptHeaderSize:
+			payload, ok = tryDecrypt(block, format.tokened, data)
+		}
+		if !ok {
+			continue
+		}
+		info, err := decodePayload(payload, fec)
+		if err != nil {
+			unpadded, padded := unpad(payload)
+			if !padded {
+				return nil, err
+			}
+			if info, err = decodePayload(unpadded, fec); err != nil {
+				return nil, err
+			}
+			info.Padding = len(payload) - len(unpadded)
+		}
+		info.Encrypted, info.Compact, info.Tokened = true, format.compact, format.tokened
+		return info, nil
+	}
+	return nil, errors.New("kcp: the datagram doesn't decrypt")
+}
+
+// decodePayload decodes the FEC header and the kcp segments behind the crypto header
+func decodePayload(data []byte, fec bool) (*PacketInfo, error) {
+	info := new(PacketInfo)
+	if fec {
+		if len(data) < fecHeaderSize {
+			return nil, errors.New("kcp: truncated FEC header")
+		}
+		info.FEC = true
+		info.FECSeqID = binary.LittleEndian.Uint32(data)
+		switch binary.LittleEndian.Uint16(data[4:]) {
+		case typeFEC:
+			info.FECParity = true
+			return info, nil
+		case typeData:
+			if len(data) < fecHeaderSizePlus2 {
+				return nil, errors.New("kcp: truncated FEC header")
+			}
+			data = data[fecHeaderSizePlus2:]
+		default:
+			return nil, errors.New("kcp: unknown FEC shard type")
+		}
+	}
+
+	if len(data) == 0 {
+		return nil, errors.New("kcp: no segment")
+	}
+	segs, err := decodeSegments(data)
+	if err != nil { // the compact profiles, with the conversation id first
+		if len(data) > 4 && isCompactCmd(data[4]) {
+			if compact, cerr := decodeCompact(data[4:], binary.LittleEndian.Uint32(data)); cerr == nil {
+				info.Header, info.Segments = HeaderCompact, compact
+				return info, nil
+			}
+		}
+		if compact, cerr := decodeCompact(data, 0); cerr == nil {
+			info.Header, info.Segments = HeaderElided, compact
+			return info, nil
+		}
+		return nil, err
+	}
+	info.Segments = segs
+	return info, nil
+}
+
+// decodeSegments decodes the segments of a datagram in the legacy header profile
+func decodeSegments(data []byte) ([]SegmentInfo, error) {
+	var segs []SegmentInfo
+	for len(data) > 0 {
+		if len(data) < IKCP_OVERHEAD {
+			return nil, errors.New("kcp: truncated segment header")
+		}
+		var seg SegmentInfo
+		data = ikcp_decode32u(data, &seg.Conv)
+		data = ikcp_decode8u(data, &seg.Cmd)
+		data = ikcp_decode8u(data, &seg.Frg)
+		data = ikcp_decode16u(data, &seg.Wnd)
+		data = ikcp_decode32u(data, &seg.Ts)
+		data = ikcp_decode32u(data, &seg.Sn)
+		data = ikcp_decode32u(data, &seg.Una)
+		data = ikcp_decode32u(data, &seg.Len)
+		if seg.Cmd < IKCP_CMD_PUSH || seg.Cmd > IKCP_CMD_EXT_MAX {
+			return nil, errors.Errorf("kcp: unknown command %v", seg.Cmd)
+		}
+		if uint32(len(data)) < seg.Len {
+			return nil, errors.New("kcp: truncated segment data")
+		}
+		seg.Data, data = data[:seg.Len], data[seg.Len:]
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// decodeCompact decodes the segments of a datagram in the compact header profile, behind
+// the conversation id conv
+func decodeCompact(data []byte, conv uint32) ([]SegmentInfo, error) {
+	var segs []SegmentInfo
+	for len(data) > 0 {
+		if len(data) < compactOverhead {
+			return nil, errors.New("kcp: truncated segment header")
+		}
+		if !isCompactCmd(data[0]) {
+			return nil, errors.Errorf("kcp: unknown command %v", data[0])
+		}
+		seg := SegmentInfo{
+			Conv: conv,
+			Cmd:  data[0] &^ compactFlag,
+			Frg:  data[1],
+			Wnd:  binary.LittleEndian.Uint16(data[2:]),
+			Ts:   uint32(binary.LittleEndian.Uint16(data[4:])),
+			Sn:   uint32(binary.LittleEndian.Uint16(data[6:])),
+			Una:  uint32(binary.LittleEndian.Uint16(data[8:])),
+			Len:  uint32(binary.LittleEndian.Uint16(data[10:])),
+		}
+		data = data[compactOverhead:]
+		if uint32(len(data)) < seg.Len {
+			return nil, errors.New("kcp: truncated segment data")
+		}
+		seg.Data, data = data[:seg.Len], data[seg.Len:]
+		segs = append(segs, seg)
+	}
+	return segs, nil
+}
+
+// WireFormat describes the layout of datagrams, generated from the sizes the package uses
+func WireFormat() string {
+	var b strings.Builder
+	field := func(size int, name, desc string) {
+		fmt.Fprintf(&b, "  %3d  %-10s %s\n", size, name, desc)
+	}
+	b.WriteString("encrypted datagram, all integers little endian:\n")
+	field(nonceSize, "nonce", "random, or an 8 byte packet counter in the compact nonce format")
+	field(crcSize, "crc32", "of the rest of the packet, IEEE")
+	b.WriteString("  the packet token replaces the first bytes of the nonce, in clear, the rest is encrypted\n")
+	b.WriteString("FEC header, with FEC:\n")
+	field(4, "seqid", "shard number")
+	field(2, "flag", fmt.Sprintf("%#x for data, %#x for parity", typeData, typeFEC))
+	field(2, "size", "size of the data shard, parity shards go on with parity")
+	b.WriteString("kcp segments, until the end of the packet:\n")
+	field(4, "conv", "conversation id")
+	field(1, "cmd", fmt.Sprintf("%v push, %v ack, %v window probe, %v window size, %v hello, %v close status, %v key epoch, %v keepalive, %v to %v reserved",
+		IKCP_CMD_PUSH, IKCP_CMD_ACK, IKCP_CMD_WASK, IKCP_CMD_WINS, IKCP_CMD_HELLO, IKCP_CMD_CLOSE, IKCP_CMD_REKEY, IKCP_CMD_PING, IKCP_CMD_PING+1, IKCP_CMD_EXT_MAX))
+	field(1, "frg", "fragments left in the message, 0 in stream mode")
+	field(2, "wnd", "free receive window")
+	field(4, "ts", "timestamp, ms")
+	field(4, "sn", "sequence number")
+	field(4, "una", "all segments before are received")
+	field(4, "len", "size of the data")
+	field(0, "data", "len bytes")
+	b.WriteString("kcp segments with the compact header capability, behind the conv of the packet unless elided:\n")
+	field(1, "cmd", fmt.Sprintf("the command above | %#x", compactFlag))
+	field(1, "frg", "the same")
+	field(2, "wnd", "the same")
+	field(2, "ts", "the low 16 bits")
+	field(2, "sn", "the low 16 bits")
+	field(2, "una", "the low 16 bits")
+	field(2, "len", "size of the data")
+	field(0, "data", "len bytes")
+	b.WriteString("trailer:\n")
+	field(padLenSize, "padding", "the count of zeros ahead of it, encrypted, with padding only")
+	field(crcSize, "crc32", "of the packet, unencrypted with the checksum capability only")
+	return b.String()
+}
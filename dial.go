@@ -0,0 +1,288 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// happyEyeballsDelay is the stagger between the addresses of a host, RFC 6555 recommends 150 to 250ms
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialHost is DialAndVerify for a host name with several addresses, in the manner of
+// RFC 6555: it resolves all the IPv6 and IPv4 addresses of the host of raddr, and
+// probes them in turn, IPv6 first and the families interleaved, a new one every 250ms
+// while none answers. The session settles on the first address a valid packet comes
+// from, see RemoteAddr, and ignores the others from then on. An unreachable address
+// delays the dial by 250ms, rather than hanging the session. The addresses probed in
+// vain may see a session start, it ends by the dead link there. The session has a
+// socket of its own, unconnected, and Rebind resolves the host again.
+func DialHost(raddr string, block BlockCrypt, dataShards, parityShards int, timeout time.Duration) (*UDPSession, error) {
+	if timeout <= 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	addrs, err := resolveHost(raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenUDP")
+	}
+	tuneSocket(udpconn)
+	udpconn.SetReadBuffer(clientReadBuffer)
+	h := &hostConn{conn: udpconn, host: raddr}
+
+	s := newUDPSession(ConvSource(), dataShards, parityShards, nil, h, addrs[0], block)
+	if err := s.race(h, addrs, timeout); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Rebind resolves the host of a session of DialHost again, and moves the session to
+// the first address answering, like DialHost: the current address, if the host still
+// has it, or another one, for a DNS failover. The session keeps its socket, so the peer
+// sees it at the same address and conversation, as long as it's reached over the same
+// address family. Rebind waits up to timeout for an answer, and stays at the current
+// address otherwise. It fails for sessions of other dials.
+func (s *UDPSession) Rebind(timeout time.Duration) error {
+	h, ok := s.conn.(*hostConn)
+	if !ok || timeout <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	addrs, err := resolveHost(h.host)
+	if err != nil {
+		return err
+	}
+	peer := h.rebind()
+	if err := s.race(h, addrs, timeout); err != nil {
+		h.restore(peer)
+		return err
+	}
+	if now := h.RemoteAddr(); now.String() != peer.String() {
+		s.mu.Lock()
+		s.softError(SoftAddressMigrated, 0, "moved from %v to %v", peer, now)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// race probes addrs in turn, staggered by happyEyeballsDelay, until one answers
+func (s *UDPSession) race(h *hostConn, addrs []*net.UDPAddr, timeout time.Duration) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	stagger := time.NewTicker(happyEyeballsDelay)
+	defer stagger.Stop()
+	for next := 0; ; {
+		if next < len(addrs) {
+			h.add(addrs[next])
+			next++
+		}
+		// the addresses probed so far are probed again, in case the probe was lost
+		s.mu.Lock()
+		s.kcp.probe |= IKCP_ASK_SEND
+		s.kcp.current = currentMs()
+		s.kcp.flush()
+		s.uncork()
+
+		select {
+		case <-h.chosen():
+			return nil
+		case <-stagger.C:
+		case <-deadline.C:
+			return errTimeout{}
+		case <-s.die:
+			return ErrClosed
+		}
+	}
+}
+
+// resolveHost returns the addresses of the host of raddr, in the order of RFC 6555:
+// IPv6 first, then the families alternate
+func resolveHost(raddr string) ([]*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.SplitHostPort")
+	}
+	port, err := net.DefaultResolver.LookupPort(context.Background(), "udp", service)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.LookupPort")
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.LookupIPAddr")
+	}
+
+	var v6, v4 []*net.UDPAddr
+	for _, ip := range ips {
+		addr := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	addrs := make([]*net.UDPAddr, 0, len(ips))
+	for k := 0; k < len(v6) || k < len(v4); k++ {
+		if k < len(v6) {
+			addrs = append(addrs, v6[k])
+		}
+		if k < len(v4) {
+			addrs = append(addrs, v4[k])
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no address for %v", host)
+	}
+	return addrs, nil
+}
+
+// hostConn is the socket of a session of DialHost. While the session races the
+// addresses of the host, it sends to all of those probed so far and reads from any of
+// them; once one answers, it sends to and reads from that one only. It has no
+// SyscallConn, so GSO doesn't bypass the choice of the address.
+type hostConn struct {
+	conn   *net.UDPConn
+	host   string // as dialed, for Rebind
+	racing int32  // an address is yet to answer
+
+	mu         sync.Mutex
+	candidates []*net.UDPAddr // probed while racing
+	peer       *net.UDPAddr   // the address settled on, nil while racing
+	done       chan struct{}  // closed once an address answers
+}
+
+// add probes one more address of the host
+func (h *hostConn) add(addr *net.UDPAddr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done == nil {
+		h.done = make(chan struct{})
+		atomic.StoreInt32(&h.racing, 1)
+	}
+	h.candidates = append(h.candidates, addr)
+}
+
+// chosen returns a channel closed once an address answered
+func (h *hostConn) chosen() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.done
+}
+
+// heard settles on the address of a valid packet, if it's one probed while racing
+func (h *hostConn) heard(from net.Addr) {
+	if atomic.LoadInt32(&h.racing) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if addr := h.candidate(from); addr != nil && h.peer == nil {
+		h.peer, h.candidates = addr, nil
+		atomic.StoreInt32(&h.racing, 0)
+		close(h.done)
+	}
+}
+
+// rebind starts a new race, it returns the address settled on before
+func (h *hostConn) rebind() *net.UDPAddr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peer := h.peer
+	h.peer, h.candidates, h.done = nil, nil, nil
+	return peer
+}
+
+// restore ends a race nobody answered, back at peer
+func (h *hostConn) restore(peer *net.UDPAddr) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peer == nil {
+		h.peer, h.candidates = peer, nil
+		atomic.StoreInt32(&h.racing, 0)
+	}
+}
+
+// candidate returns the address probed matching from, h.mu must be held
+func (h *hostConn) candidate(from net.Addr) *net.UDPAddr {
+	ua, ok := from.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	for _, addr := range h.candidates {
+		if addr.Port == ua.Port && addr.IP.Equal(ua.IP) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// accepts tells whether a datagram from comes from the address settled on, or from
+// an address probed while racing
+func (h *hostConn) accepts(from net.Addr) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peer == nil {
+		return h.candidate(from) != nil
+	}
+	ua, ok := from.(*net.UDPAddr)
+	return ok && ua.Port == h.peer.Port && ua.IP.Equal(h.peer.IP)
+}
+
+// readPacket is the readPacket of the socket, skipping datagrams of other addresses
+func (h *hostConn) readPacket(buf []byte) (n int, from net.Addr, truncated bool, err error) {
+	for {
+		n, from, truncated, err = readPacket(h.conn, buf)
+		if err != nil || h.accepts(from) {
+			return
+		}
+	}
+}
+
+func (h *hostConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, from, _, err := h.readPacket(buf)
+	return n, from, err
+}
+
+// WriteTo writes b to the address settled on, or to all the addresses probed while
+// racing, addr is ignored
+func (h *hostConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h.mu.Lock()
+	peer, candidates := h.peer, h.candidates
+	h.mu.Unlock()
+	if peer != nil {
+		return h.conn.WriteTo(b, peer)
+	}
+	n, err := len(b), error(nil)
+	for _, addr := range candidates {
+		if _, werr := h.conn.WriteTo(b, addr); werr != nil {
+			n, err = 0, werr
+		}
+	}
+	return n, err
+}
+
+// RemoteAddr returns the address settled on, nil while racing
+func (h *hostConn) RemoteAddr() net.Addr {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.peer == nil {
+		return nil
+	}
+	return h.peer
+}
+
+func (h *hostConn) Close() error                       { return h.conn.Close() }
+func (h *hostConn) LocalAddr() net.Addr                { return h.conn.LocalAddr() }
+func (h *hostConn) SetDeadline(t time.Time) error      { return h.conn.SetDeadline(t) }
+func (h *hostConn) SetReadDeadline(t time.Time) error  { return h.conn.SetReadDeadline(t) }
+func (h *hostConn) SetWriteDeadline(t time.Time) error { return h.conn.SetWriteDeadline(t) }
+func (h *hostConn) SetReadBuffer(bytes int) error      { return h.conn.SetReadBuffer(bytes) }
+func (h *hostConn) SetWriteBuffer(bytes int) error     { return h.conn.SetWriteBuffer(bytes) }
@@ -0,0 +1,66 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// eventBacklog is the number of events waiting for the consumer of Listener.Events
+const eventBacklog = 1024
+
+// session events, see SessionEvent
+const (
+	EventAccepted        = iota // the listener created the session of a new peer, queued for Accept
+	EventClosed                 // the session closed, for any reason but a new conversation
+	EventKicked                 // the session closed as a new conversation took its address over
+	EventRateLimited            // the memory budget of the listener started holding the Writes back
+	EventAddressMigrated        // the session was imported at its address, see Import
+)
+
+// SessionEvent is a change in the lifecycle of a session of a listener, see Events.
+// Every session starts with EventAccepted or EventAddressMigrated, and ends with
+// EventClosed or EventKicked, whatever closes it: the application, the dead link
+// mode, the peer or a new conversation.
+type SessionEvent struct {
+	Type   int       // Event*
+	ID     uint64    // of the session, see KCPConn.ID
+	Conv   uint32    // conversation id
+	Remote net.Addr  // address of the peer
+	Reason string    // why it closed, like "dead link", for EventClosed and EventKicked
+	Time   time.Time // when it happened
+}
+
+// Events returns the lifecycle events of the sessions of the listener, from the first
+// call on. The events are buffered, up to 1024 of them: while the buffer is full, new
+// events are dropped and counted in ListenerStats.EventsDropped, so a slow consumer
+// never stalls the listener. The channel is never closed, as sessions may close after
+// the listener.
+func (l *Listener) Events() <-chan SessionEvent {
+	l.eventsOnce.Do(func() {
+		l.events.Store(make(chan SessionEvent, eventBacklog))
+	})
+	return l.events.Load().(chan SessionEvent)
+}
+
+// emit sends an event of session s, unless nobody asked for events or the buffer is full
+func (l *Listener) emit(typ int, s *UDPSession, reason string) {
+	ch, _ := l.events.Load().(chan SessionEvent)
+	if ch == nil {
+		return
+	}
+	ev := SessionEvent{typ, s.ID(), s.GetConv(), s.remote, reason, time.Now()}
+	select {
+	case ch <- ev:
+	default:
+		atomic.AddUint64(&l.eventsDropped, 1)
+	}
+}
+
+// closeEvent returns the event of a session closed for reason
+func closeEvent(reason string) int {
+	if reason == closeReplaced {
+		return EventKicked
+	}
+	return EventClosed
+}
@@ -0,0 +1,189 @@
+package kcp_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// An echo server, and a client talking to it.
+func Example_echoServer() {
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				io.Copy(s, s)
+			}()
+		}
+	}()
+
+	cli, err := kcp.DialWithOptions(l.Addr().String(), nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(buf))
+	// Output: hello
+}
+
+// A file sent over an encrypted session in stream mode, the receiver checks its digest.
+func Example_fileTransfer() {
+	pass := pbkdf2.Key([]byte("secret"), []byte("salt"), 4096, 32, sha1.New)
+	file := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MB
+	digest := sha1.Sum(file)
+
+	block, _ := kcp.NewAESBlockCrypt(pass)
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan []byte)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+		s.SetStreamMode(true)
+		s.SetWindowSize(512, 512)
+		s.SetNoDelay(1, 20, 2, 1)
+		h := sha1.New()
+		if _, err := io.CopyN(h, s, int64(len(file))); err != nil {
+			log.Fatal(err)
+		}
+		done <- h.Sum(nil)
+	}()
+
+	block, _ = kcp.NewAESBlockCrypt(pass)
+	cli, err := kcp.DialWithOptions(l.Addr().String(), block, 0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(512, 512)
+	cli.SetNoDelay(1, 20, 2, 1)
+	if _, err := io.Copy(cli, bytes.NewReader(file)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("digest matches:", bytes.Equal(<-done, digest[:]))
+	// Output: digest matches: true
+}
+
+// The timeline of one request and its response, from the sending of the request to the
+// acknowledgement of its last segment.
+func ExampleKCPConn_SetTrace() {
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	cli, err := kcp.DialWithOptions(l.Addr().String(), nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Close()
+
+	// hooks run with the session locked, so they only record the events
+	var mu sync.Mutex
+	var timeline []string
+	start := time.Now()
+	event := func(format string, args ...interface{}) {
+		mu.Lock()
+		timeline = append(timeline, fmt.Sprintf("%8v ", time.Since(start).Round(time.Microsecond))+fmt.Sprintf(format, args...))
+		mu.Unlock()
+	}
+	cli.SetTrace(&kcp.SessionTrace{
+		SegmentSent:          func(sn uint32) { event("sent %v", sn) },
+		SegmentRetransmitted: func(sn, xmit uint32) { event("retransmitted %v, transmission %v", sn, xmit) },
+		AckReceived:          func(sn uint32, rtt time.Duration) { event("acked %v, rtt %v", sn, rtt) },
+		WindowFull:           func() { event("window full") },
+		DeadLink:             func() { event("dead link") },
+	})
+
+	request := bytes.Repeat([]byte("x"), 4096)
+	cli.Write(request)
+	event("request written")
+	if _, err := io.ReadFull(cli, request); err != nil {
+		log.Fatal(err)
+	}
+	event("response read")
+	time.Sleep(100 * time.Millisecond) // for the last acknowledgements
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range timeline {
+		fmt.Println(e)
+	}
+}
+
+// Structured logs of the lifecycle of the sessions of a server, one JSON object per event.
+func ExampleListener_Events() {
+	l, err := kcp.ListenWithOptions(":10000", nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+	events := map[int]string{
+		kcp.EventAccepted:        "accepted",
+		kcp.EventClosed:          "closed",
+		kcp.EventKicked:          "kicked",
+		kcp.EventRateLimited:     "rate_limited",
+		kcp.EventAddressMigrated: "address_migrated",
+	}
+	go func() {
+		for ev := range l.Events() {
+			line, _ := json.Marshal(map[string]interface{}{
+				"time":   ev.Time.Format(time.RFC3339Nano),
+				"event":  events[ev.Type],
+				"id":     ev.ID,
+				"conv":   ev.Conv,
+				"remote": ev.Remote.String(),
+				"reason": ev.Reason,
+			})
+			log.Println(string(line))
+		}
+	}()
+
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+	}
+}
@@ -0,0 +1,105 @@
+//go:build !windows
+// +build !windows
+
+package kcp_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// Dump the state of all sessions of a server on SIGUSR1, to find out why a transfer hangs.
+func ExampleUDPSession_DebugState() {
+	l, err := kcp.ListenWithOptions(":10000", nil, 10, 3)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	sessions := make(map[*kcp.UDPSession]bool)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	go func() {
+		for range sigs {
+			mu.Lock()
+			for s := range sessions {
+				state, _ := json.Marshal(s.DebugState())
+				log.Println(s.RemoteAddr(), string(state))
+			}
+			mu.Unlock()
+		}
+	}()
+
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		mu.Lock()
+		sessions[s] = true
+		mu.Unlock()
+		go func() {
+			io.Copy(s, s)
+			s.Close()
+			mu.Lock()
+			delete(sessions, s)
+			mu.Unlock()
+		}()
+	}
+}
+
+// Restart a server without downtime on SIGHUP: the new process inherits the socket as
+// fd 3 and accepts the new sessions, the sessions of the old process drop.
+func ExampleListener_Handoff() {
+	var l *kcp.Listener
+	var err error
+	if os.Getenv("KCP_INHERIT") != "" {
+		l, err = kcp.ListenFD(3, nil, 10, 3)
+	} else {
+		l, err = kcp.ListenWithOptions(":10000", nil, 10, 3)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		<-sigs
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		f, err := l.Handoff(ctx) // the old receiver has exited
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), "KCP_INHERIT=1")
+		cmd.ExtraFiles = []*os.File{f}
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Start(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}()
+
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return // handed over
+		}
+		go func() {
+			io.Copy(s, s)
+			s.Close()
+		}()
+	}
+}
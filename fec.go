@@ -69,7 +69,7 @@ func (fec *FEC) decode(data []byte) fecPacket {
 	pkt.flag = binary.LittleEndian.Uint16(data[4:])
 	pkt.ts = currentMs()
 	// allocate memory & copy
-	buf := xmitBuf.Get().([]byte)[:len(data)-6]
+	buf := getXmitBuf()[:len(data)-6]
 	copy(buf, data[6:])
 	pkt.data = buf
 	return pkt
@@ -100,7 +100,7 @@ func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
 			if now-fec.rx[k].ts < fecExpire {
 				rx = append(rx, fec.rx[k])
 			} else {
-				xmitBuf.Put(fec.rx[k].data)
+				putXmitBuf(fec.rx[k].data)
 			}
 		}
 		fec.rx = rx
@@ -112,7 +112,7 @@ func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
 	insertIdx := 0
 	for i := n; i >= 0; i-- {
 		if pkt.seqid == fec.rx[i].seqid { // de-duplicate
-			xmitBuf.Put(pkt.data)
+			putXmitBuf(pkt.data)
 			return nil
 		} else if pkt.seqid > fec.rx[i].seqid { // insertion
 			insertIdx = i + 1
@@ -177,7 +177,7 @@ func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
 
 		if numDataShard == fec.dataShards { // no lost
 			for i := first; i < first+numshard; i++ { // free
-				xmitBuf.Put(fec.rx[i].data)
+				putXmitBuf(fec.rx[i].data)
 			}
 			copy(fec.rx[first:], fec.rx[first+numshard:])
 			for i := 0; i < numshard; i++ { // dereference
@@ -201,7 +201,7 @@ func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
 			}
 
 			for i := first; i < first+numshard; i++ { // free
-				xmitBuf.Put(fec.rx[i].data)
+				putXmitBuf(fec.rx[i].data)
 			}
 			copy(fec.rx[first:], fec.rx[first+numshard:])
 			for i := 0; i < numshard; i++ { // dereference
@@ -213,7 +213,7 @@ func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
 
 	// keep rxlimit
 	if len(fec.rx) > fec.rxlimit {
-		xmitBuf.Put(fec.rx[0].data) // free
+		putXmitBuf(fec.rx[0].data) // free
 		fec.rx[0].data = nil
 		fec.rx = fec.rx[1:]
 	}
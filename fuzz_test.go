@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package kcp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzHeaderCorruption flips bits in the headers of a datagram, the crypto header and
+// the kcp header behind it, the datagram must be dropped in both modes with integrity:
+// encrypted, and unencrypted with CapChecksum
+func FuzzHeaderCorruption(f *testing.F) {
+	block, _ := NewAESBlockCrypt(bytes.Repeat([]byte{1}, 32))
+	for off := 0; off < cryptHeaderSize+IKCP_OVERHEAD; off += 3 {
+		f.Add(false, uint16(off), byte(1))
+		f.Add(true, uint16(off), byte(0x80))
+	}
+	f.Fuzz(func(t *testing.T, encrypted bool, off uint16, mask byte) {
+		if mask == 0 {
+			return
+		}
+		var rxBlock BlockCrypt
+		headerSize := 0
+		if encrypted {
+			rxBlock, headerSize = block, cryptHeaderSize
+		}
+		data := []byte("payload")
+		seg := Segment{conv: 1, cmd: IKCP_CMD_PUSH, wnd: IKCP_WND_RCV, sn: 7, una: 7, data: data}
+		pkt := make([]byte, headerSize+IKCP_OVERHEAD+len(data), mtuLimit)
+		seg.encode(pkt[headerSize:])
+		copy(pkt[headerSize+IKCP_OVERHEAD:], data)
+		if encrypted {
+			pkt = encodePacket(block, nil, false, 0, new(nonceReader), 0, pkt)
+		} else {
+			pkt = appendChecksum(pkt)
+		}
+
+		pkt[int(off)%(headerSize+IKCP_OVERHEAD)] ^= mask
+		payload, _, ok := decodePacket(rxBlock, nil, false, false, headerSize, pkt, make([]byte, mtuLimit+nonceSize))
+		if ok && !encrypted {
+			_, ok = stripChecksum(payload)
+		}
+		if ok {
+			t.Fatalf("encrypted %v: corrupted byte %v accepted", encrypted, int(off)%(headerSize+IKCP_OVERHEAD))
+		}
+	})
+}
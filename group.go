@@ -0,0 +1,260 @@
+package kcp
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GroupConfig configures the members of a SessionGroup
+type GroupConfig struct {
+	Block                    BlockCrypt    // cipher of the members, nil for none
+	DataShards, ParityShards int           // FEC of the members, see DialWithOptions
+	Session                  SessionConfig // of every member, start from DefaultSessionConfig
+	Rate                     int64         // bytes per second the members write together, 0 for no limit
+	Burst                    int           // bytes written at once above Rate, a tenth of Rate if 0
+}
+
+// SessionGroup dials sessions to a server alike, with the configuration, the rate
+// limit and the accounting of the group. The members are plain sessions, spreading
+// the data over them is up to the application.
+type SessionGroup struct {
+	cfg     GroupConfig
+	limit   *rateLimit // nil without Rate
+	mu      sync.Mutex
+	members []*UDPSession
+	done    GroupStats // counters of the members released already
+	closed  bool
+}
+
+// GroupStats are the counters of all the members of a SessionGroup, those closed
+// included, see SessionGroup.Stats
+type GroupStats struct {
+	Sessions  int           // members open
+	Dialed    uint64        // members dialed so far
+	Short     RejectStats   // see SessionStats
+	Token     RejectStats   // see SessionStats
+	Checksum  RejectStats   // see SessionStats
+	Truncated RejectStats   // see SessionStats
+	Sent      TrafficStats  // data segments sent
+	Received  TrafficStats  // data segments received
+	Buffered  int64         // bytes held in the queues of the open members
+	Throttled time.Duration // Writes of the members waited for the rate limit, in total
+}
+
+// NewSessionGroup returns an empty group, it fails for an invalid configuration
+func NewSessionGroup(cfg *GroupConfig) (*SessionGroup, error) {
+	headerSize := OverheadPerPacket(&PacketFormat{Encrypted: cfg.Block != nil, FEC: cfg.DataShards > 0 && cfg.ParityShards > 0})
+	if cfg.Rate < 0 || cfg.Burst < 0 || cfg.DataShards < 0 || cfg.ParityShards < 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	if err := cfg.Session.validate(headerSize); err != nil {
+		return nil, err
+	}
+	g := &SessionGroup{cfg: *cfg}
+	if cfg.Rate > 0 {
+		burst := cfg.Burst
+		if burst == 0 {
+			burst = int(cfg.Rate / 10)
+		}
+		g.limit = newRateLimit(float64(cfg.Rate), float64(burst))
+	}
+	return g, nil
+}
+
+// Dial connects a new member to raddr, configured by the group
+func (g *SessionGroup) Dial(raddr string) (*UDPSession, error) {
+	g.mu.Lock()
+	closed := g.closed
+	g.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	s, err := DialWithOptions(raddr, g.cfg.Block, g.cfg.DataShards, g.cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	s.configure(&g.cfg.Session)
+	s.mu.Lock()
+	s.limit = g.limit
+	s.mu.Unlock()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed { // closed meanwhile
+		s.Close()
+		return nil, ErrClosed
+	}
+	g.members = append(g.members, s)
+	g.done.Dialed++
+	return s, nil
+}
+
+// Sessions returns the members open
+func (g *SessionGroup) Sessions() []*UDPSession {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var open []*UDPSession
+	for _, s := range g.members {
+		s.mu.Lock()
+		closed := s.state == StateClosed
+		s.mu.Unlock()
+		if !closed {
+			open = append(open, s)
+		}
+	}
+	return open
+}
+
+// Stats returns the counters of the members, the released ones are kept in the
+// totals of the group and forgotten
+func (g *SessionGroup) Stats() GroupStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.done
+	members := g.members[:0]
+	for _, s := range g.members {
+		ss := s.Stats()
+		if atomic.LoadInt32(&s.released) != 0 {
+			g.done.add(&ss)
+		} else {
+			members = append(members, s)
+		}
+		st.add(&ss)
+		if ss.State != StateClosed {
+			st.Sessions++
+			st.Buffered += ss.Buffered
+		}
+	}
+	for i := len(members); i < len(g.members); i++ {
+		g.members[i] = nil
+	}
+	g.members = members
+	if g.limit != nil {
+		st.Throttled = time.Duration(atomic.LoadInt64(&g.limit.waited))
+	}
+	return st
+}
+
+// add counts the counters of a member
+func (st *GroupStats) add(ss *SessionStats) {
+	st.Short.add(ss.Short)
+	st.Token.add(ss.Token)
+	st.Checksum.add(ss.Checksum)
+	st.Truncated.add(ss.Truncated)
+	st.Sent.merge(ss.Sent)
+	st.Received.merge(ss.Received)
+}
+
+// add counts the rejections of another session
+func (r *RejectStats) add(o RejectStats) {
+	r.Count += o.Count
+	if o.Last.After(r.Last) {
+		r.Last = o.Last
+	}
+}
+
+// merge counts the traffic of another session
+func (t *TrafficStats) merge(o TrafficStats) {
+	t.Segments += o.Segments
+	t.Bytes += o.Bytes
+	t.RetransSegments += o.RetransSegments
+	t.RetransBytes += o.RetransBytes
+	t.Spurious += o.Spurious
+	t.Lost += o.Lost
+}
+
+// Close closes the members, Dial fails afterwards
+func (g *SessionGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrClosed
+	}
+	g.closed = true
+	members := append([]*UDPSession(nil), g.members...)
+	g.mu.Unlock()
+	for _, s := range members {
+		s.Close()
+	}
+	return nil
+}
+
+// rateLimit is a token bucket of bytes per second, shared by the members of a
+// SessionGroup
+type rateLimit struct {
+	waited int64 // total time.Duration writes waited for the bucket, first for 64bit atomic alignment
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64 // the most bytes the bucket holds
+	tokens float64 // bytes in the bucket at last, negative once reserved ahead
+	last   time.Time
+}
+
+func newRateLimit(rate, burst float64) *rateLimit {
+	return &rateLimit{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket at now, it returns how long the write of
+// them waits
+func (r *rateLimit) reserve(n int, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dt := now.Sub(r.last); dt > 0 {
+		r.tokens = math.Min(r.burst, r.tokens+dt.Seconds()*r.rate)
+		r.last = now
+	}
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// cancel puts back n bytes reserved for a write that failed
+func (r *rateLimit) cancel(n int) {
+	r.mu.Lock()
+	r.tokens = math.Min(r.burst, r.tokens+float64(n))
+	r.mu.Unlock()
+}
+
+// waitLimit waits until the rate limit lets the bytes of v go, it fails like write for
+// the deadline or the close, or at once unless wait is set
+func (c *KCPConn) waitLimit(v [][]byte, wait bool) error {
+	n := 0
+	for k := range v {
+		n += len(v[k])
+	}
+	delay := c.limit.reserve(n, time.Now())
+	c.throttled(delay > 0)
+	if delay <= 0 {
+		return nil
+	}
+	if !wait {
+		c.limit.cancel(n)
+		return errTimeout{}
+	}
+
+	timer := getTimer(delay)
+	defer putTimer(timer)
+	var deadline <-chan time.Time
+	if wd, _ := c.wd.Load().(time.Time); !wd.IsZero() {
+		t := getTimer(time.Until(wd))
+		defer putTimer(t)
+		deadline = t.C
+	}
+	select {
+	case <-timer.C:
+		atomic.AddInt64(&c.limit.waited, int64(delay))
+		return nil
+	case <-deadline:
+		c.limit.cancel(n)
+		return errTimeout{}
+	case <-c.die:
+		c.limit.cancel(n)
+		return ErrClosed
+	}
+}
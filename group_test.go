@@ -0,0 +1,125 @@
+package kcp
+
+import (
+	"crypto/sha1"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestSessionGroup(t *testing.T) {
+	block, _ := NewAESBlockCrypt(pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New))
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go RunEchoServer(l)
+
+	cfg := GroupConfig{Block: block, Session: DefaultSessionConfig(), Rate: 200 << 10, Burst: 20 << 10}
+	cfg.Session.Interval = 20
+	cfg.Session.StreamMode = true
+	bad := cfg
+	bad.Session.SndWnd = 0
+	if _, err := NewSessionGroup(&bad); err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	g, err := NewSessionGroup(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three members write 300KB together, the rate limit spreads it over 1.4s at least
+	const members, size = 3, 100 << 10
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, members)
+	for i := 0; i < members; i++ {
+		s, err := g.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.kcp.interval != 20 || s.kcp.stream == 0 {
+			t.Fatal("member not configured")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.SetDeadline(time.Now().Add(10 * time.Second))
+			go s.Write(make([]byte, size))
+			_, err := io.ReadFull(s, make([]byte, size))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if elapsed < 1400*time.Millisecond {
+		t.Fatal("300KB written in", elapsed)
+	}
+	st := g.Stats()
+	if st.Sessions != members || st.Dialed != members || st.Sent.Bytes < members*size || st.Received.Bytes < members*size {
+		t.Fatalf("%+v", st)
+	}
+	if st.Throttled == 0 {
+		t.Fatal("no write waited for the rate limit")
+	}
+
+	// the counters of the closed members stay
+	g.Close()
+	if _, err := g.Dial(l.Addr().String()); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if len(g.Sessions()) != 0 {
+		t.Fatal("members left open")
+	}
+	if closed := g.Stats(); closed.Sessions != 0 || closed.Dialed != members || closed.Sent.Bytes < st.Sent.Bytes {
+		t.Fatalf("%+v", closed)
+	}
+}
+
+func TestRateLimitRefund(t *testing.T) {
+	c := NewKCPConn(1, func([]byte) {}) // nothing is acknowledged, the window stays full
+	defer c.Close()
+	c.SetWindowSize(4, 4)
+	c.limit = newRateLimit(1, 1<<20) // no refill to speak of
+	tokens := func() float64 {
+		c.limit.mu.Lock()
+		defer c.limit.mu.Unlock()
+		return c.limit.tokens
+	}
+
+	msg := make([]byte, 1000)
+	for i := 0; ; i++ {
+		if _, err := c.TryWrite(msg); err != nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("the window never filled")
+		}
+	}
+	before := tokens()
+	// the window, the deadline and the close fail the writes after the rate limit
+	if _, err := c.TryWrite(msg); err == nil {
+		t.Fatal("write into a full window succeeded")
+	}
+	c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.Write(msg); err == nil {
+		t.Fatal("write into a full window succeeded")
+	}
+	c.Close()
+	if _, err := c.Write(msg); err != ErrClosed {
+		t.Fatal(err)
+	}
+	if after := tokens(); after < before {
+		t.Fatalf("%v bytes charged for failed writes", before-after)
+	}
+}
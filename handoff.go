@@ -0,0 +1,68 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// File returns a duplicate of the socket of the listener, to hand it to another
+// process, see Handoff. The listener keeps reading the socket meanwhile. It fails for a
+// listener of NewManualListener, and for a socket of ServeConn that has no File method.
+func (l *Listener) File() (*os.File, error) {
+	if l.manual != nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	conn, ok := l.conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New(errInvalidOperation)
+	}
+	f, err := conn.File()
+	if err != nil {
+		return nil, errors.Wrap(err, "File")
+	}
+	return f, nil
+}
+
+// Handoff hands the socket of the listener over to another process, for a restart
+// without downtime: it returns a duplicate of the socket once the listener is closed and
+// its receiver and workers have exited, so that the new process, started with the file
+// after Handoff returns, is the only reader of the socket. Datagrams arriving meanwhile
+// wait in the socket buffer. The sessions of the listener lose their socket and drop.
+// If ctx is done before the goroutines exited, the file is closed and ctx.Err returned.
+func (l *Listener) Handoff(ctx context.Context) (*os.File, error) {
+	f, err := l.File()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.CloseContext(ctx); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// ListenFD serves KCP on the UDP socket of the file descriptor fd, inherited from the
+// process that called Handoff, like ServeConn. The listener takes fd over, it's closed
+// even if ListenFD fails.
+func ListenFD(fd uintptr, block BlockCrypt, dataShards, parityShards int) (*Listener, error) {
+	f := os.NewFile(fd, "kcp")
+	if f == nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	conn, err := net.FilePacketConn(f) // a duplicate
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "net.FilePacketConn")
+	}
+	udpconn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, errors.New(errInvalidOperation)
+	}
+	tuneSocket(udpconn)
+
+	return ServeConn(block, dataShards, parityShards, udpconn)
+}
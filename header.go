@@ -0,0 +1,231 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// header profiles of the segments, see SetHeaderProfile and CapCompactHeader
+const (
+	HeaderLegacy  = iota // the 24 byte header on every segment
+	HeaderCompact        // the 12 byte compact header, behind the conversation id of the datagram
+	HeaderElided         // the 12 byte compact header, without the conversation id
+)
+
+// The compact profile shortens the header of a segment to 12 bytes:
+//
+//	cmd|0x80  frg  wnd(2)  ts(2)  sn(2)  una(2)  len(2)
+//
+// ts, sn and una carry their low 16 bits, the receiver extends them to the value
+// nearest to the one it expects: the ts of an acknowledgement to its clock, the one of
+// data to the last ts of remote, the sn of an acknowledgement and una to snd_una, the
+// sn of data to rcv_nxt. A datagram starts with the conversation id, and with the
+// first segment if it's elided, the command marked with 0x80 tells the layouts from
+// the legacy one. A conversation id whose low byte reads as a compact command is never
+// elided, so the first byte tells a datagram without it from a legacy one.
+const (
+	compactOverhead = 12        // the header of a segment in the compact profile
+	compactFlag     = 0x80      // marks the command of a compact segment
+	compactMaxWnd   = 1<<15 - 1 // the largest window, the sn in flight must extend unambiguously
+)
+
+// isCompactCmd tells whether b is the command of a compact segment
+func isCompactCmd(b byte) bool {
+	return b >= compactFlag|IKCP_CMD_PUSH && b <= compactFlag|IKCP_CMD_EXT_MAX
+}
+
+// extend16 returns the value with the low 16 bits v nearest to ref
+func extend16(ref uint32, v uint16) uint32 {
+	return ref + uint32(int32(int16(v-uint16(ref))))
+}
+
+// headerSaving returns the bytes profile saves on a datagram of one segment, the
+// segment size grows by as much
+func headerSaving(profile int) int {
+	switch profile {
+	case HeaderCompact:
+		return IKCP_OVERHEAD - compactOverhead - 4
+	case HeaderElided:
+		return IKCP_OVERHEAD - compactOverhead
+	}
+	return 0
+}
+
+// SetHeaderProfile sets the most compact header profile accepted from remote, and
+// the one sent, HeaderLegacy to HeaderElided. Legacy datagrams are always accepted,
+// as remote may switch later, compact ones with the conversation id from
+// HeaderCompact on, without it with HeaderElided. Datagrams mixing the profiles are
+// rejected. The compact profile needs windows below 32768 segments, larger ones are
+// cut to compactMaxWnd while it's accepted or sent, and round trips below 32 seconds.
+// It doesn't change the mtu, see HeaderSaving.
+func (kcp *KCP) SetHeaderProfile(accept, send int) {
+	kcp.hdr_accept, kcp.hdr_send = accept, send
+	kcp.clampWnd()
+}
+
+// clampWnd cuts the windows to compactMaxWnd while a compact profile is accepted or sent
+func (kcp *KCP) clampWnd() {
+	if kcp.hdr_accept == HeaderLegacy && kcp.hdr_send == HeaderLegacy {
+		return
+	}
+	if kcp.snd_wnd > compactMaxWnd {
+		kcp.snd_wnd = compactMaxWnd
+	}
+	if kcp.rcv_wnd > compactMaxWnd {
+		kcp.rcv_wnd = compactMaxWnd
+	}
+}
+
+// HeaderSaving returns the bytes the header profile sent saves on a datagram of one
+// segment, by which the mtu of kcp may exceed the one of the datagrams
+func (kcp *KCP) HeaderSaving() int {
+	return headerSaving(kcp.sendProfile())
+}
+
+// sendProfile returns the header profile of the datagrams sent, a conversation id
+// which reads as a compact command isn't elided
+func (kcp *KCP) sendProfile() int {
+	if kcp.hdr_send == HeaderElided && isCompactCmd(byte(kcp.conv)) {
+		return HeaderCompact
+	}
+	return kcp.hdr_send
+}
+
+// out outputs the legacy datagram buffer[:size] in the header profile sent, and returns
+// its size on the wire
+func (kcp *KCP) out(buffer []byte, size int) int {
+	if profile := kcp.sendProfile(); profile != HeaderLegacy {
+		size = compactDatagram(buffer, size, profile == HeaderCompact)
+	}
+	kcp.output(buffer, size)
+	return size
+}
+
+// compactDatagram rewrites the legacy datagram buf[:size] in place into the compact
+// profile, with the conversation id if conv is set, and returns its size
+func compactDatagram(buf []byte, size int, conv bool) int {
+	w := 0
+	if conv { // the one of the first segment stays
+		w = 4
+	}
+	var hdr [compactOverhead]byte
+	for r := 0; r+IKCP_OVERHEAD <= size; {
+		length := int(binary.LittleEndian.Uint32(buf[r+20:]))
+		hdr[0] = buf[r+4] | compactFlag
+		hdr[1] = buf[r+5]
+		copy(hdr[2:4], buf[r+6:r+8])    // wnd
+		copy(hdr[4:6], buf[r+8:r+10])   // the low 16 bits of ts
+		copy(hdr[6:8], buf[r+12:r+14])  // of sn
+		copy(hdr[8:10], buf[r+16:r+18]) // of una
+		binary.LittleEndian.PutUint16(hdr[10:], uint16(length))
+		w += copy(buf[w:], hdr[:])
+		w += copy(buf[w:], buf[r+IKCP_OVERHEAD:r+IKCP_OVERHEAD+length])
+		r += IKCP_OVERHEAD + length
+	}
+	return w
+}
+
+// expand rewrites a datagram of an accepted compact profile into the legacy format,
+// the segments ahead of an invalid one, with the error of Input for it. Other datagrams
+// are returned as they are, the legacy parser rejects compact ones not accepted.
+func (kcp *KCP) expand(data []byte) ([]byte, int) {
+	switch {
+	case kcp.hdr_accept >= HeaderCompact && len(data) > 4 && isCompactCmd(data[4]) && binary.LittleEndian.Uint32(data) == kcp.conv:
+		data = data[4:]
+	case kcp.hdr_accept >= HeaderElided && len(data) > 0 && isCompactCmd(data[0]) && !isCompactCmd(byte(kcp.conv)):
+	default:
+		return data, 0
+	}
+
+	out := kcp.expanded[:0]
+	ret := 0
+	for len(data) > 0 {
+		if len(data) < compactOverhead {
+			ret = -2
+			break
+		}
+		if !isCompactCmd(data[0]) { // a legacy segment amid compact ones
+			atomic.AddUint64(&DefaultSnmp.KCPUnknownCmds, 1)
+			ret = -3
+			break
+		}
+		length := int(binary.LittleEndian.Uint16(data[10:]))
+		if len(data)-compactOverhead < length {
+			ret = -2
+			break
+		}
+		cmd := data[0] &^ compactFlag
+		ts, sn := binary.LittleEndian.Uint16(data[4:]), binary.LittleEndian.Uint16(data[6:])
+		var hdr [IKCP_OVERHEAD]byte
+		p := ikcp_encode32u(hdr[:], kcp.conv)
+		p = ikcp_encode8u(p, cmd)
+		p = ikcp_encode8u(p, data[1])
+		p = ikcp_encode16u(p, binary.LittleEndian.Uint16(data[2:]))
+		if cmd == IKCP_CMD_ACK {
+			p = ikcp_encode32u(p, extend16(kcp.current, ts))
+			p = ikcp_encode32u(p, extend16(kcp.snd_una, sn))
+		} else {
+			p = ikcp_encode32u(p, extend16(kcp.rmt_ts, ts))
+			p = ikcp_encode32u(p, extend16(kcp.rcv_nxt, sn))
+		}
+		p = ikcp_encode32u(p, extend16(kcp.snd_una, binary.LittleEndian.Uint16(data[8:])))
+		ikcp_encode32u(p, uint32(length))
+		out = append(out, hdr[:]...)
+		out = append(out, data[compactOverhead:compactOverhead+length]...)
+		data = data[compactOverhead+length:]
+	}
+	kcp.expanded = out
+	return out, ret
+}
+
+// headerProfile returns the header profile the capabilities flags allow
+func headerProfile(flags uint8) int {
+	switch {
+	case flags&CapCompactHeader == 0:
+		return HeaderLegacy
+	case flags&CapElideConv == 0:
+		return HeaderCompact
+	}
+	return HeaderElided
+}
+
+// SetCompactHeader announces CapCompactHeader to the peer, once both ends announced it
+// the segments carry the 12 byte compact header instead of the 24 byte one: 12 bytes
+// more for data in every packet, and acknowledgements half the size. elideConv
+// announces CapElideConv along, once both ends announced it too the datagrams leave out
+// the conversation id as well, the peer tells the session by the address. The windows
+// are cut to 32767 segments meanwhile. It fails once the session exchanged packets, and for
+// accepted sessions, which follow the Listener.
+func (s *UDPSession) SetCompactHeader(enable, elideConv bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l != nil || s.started() {
+		return errors.New(errInvalidOperation)
+	}
+	s.announce(CapCompactHeader, enable)
+	s.announce(CapElideConv, enable && elideConv)
+	s.negotiate()
+	return nil
+}
+
+// SetCompactHeader lets sessions accepted afterwards use CapCompactHeader, and
+// CapElideConv if elideConv is set, with peers announcing it, see
+// UDPSession.SetCompactHeader
+func (l *Listener) SetCompactHeader(enable, elideConv bool) {
+	switch {
+	case !enable:
+		atomic.StoreInt32(&l.compactHeader, HeaderLegacy)
+	case !elideConv:
+		atomic.StoreInt32(&l.compactHeader, HeaderCompact)
+	default:
+		atomic.StoreInt32(&l.compactHeader, HeaderElided)
+	}
+}
+
+// elided tells whether data, a packet from the address of s, is a compact datagram
+// without the conversation id, which the listener must not take for a new conversation
+func (l *Listener) elided(s *UDPSession, data []byte) bool {
+	return atomic.LoadInt32(&l.compactHeader) == HeaderElided && isCompactCmd(data[0]) && !isCompactCmd(byte(s.kcp.conv))
+}
@@ -2,9 +2,9 @@
 package kcp
 
 import (
-	"container/heap"
 	"encoding/binary"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,15 +16,33 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_HELLO   = 85 // cmd: capability negotiation, an extension of this package
+	IKCP_CMD_CLOSE   = 86 // cmd: close status, an extension of this package
+	IKCP_CMD_REKEY   = 87 // cmd: key epoch change, an extension of this package
+	IKCP_CMD_PING    = 88 // cmd: keepalive of random data the peer skips, an extension of this package
+	IKCP_CMD_EXT_MIN = 85 // cmd: first of the commands reserved for extensions of this package
+	IKCP_CMD_EXT_MAX = 95 // cmd: last of them
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
+	IKCP_ASK_HELLO   = 4  // need to answer IKCP_CMD_HELLO
+	IKCP_HELLO_REPLY = 1  // frg of an answering IKCP_CMD_HELLO
+	IKCP_HELLO_LIMIT = 5  // max announcements without answer
+	IKCP_ASK_CLOSE   = 8  // need to answer IKCP_CMD_CLOSE
+	IKCP_CLOSE_REPLY = 1  // frg of an answering IKCP_CMD_CLOSE
+	IKCP_CLOSE_LIMIT = 5  // max announcements of the close status without answer
+	IKCP_ASK_REKEY   = 16 // need to answer IKCP_CMD_REKEY
+	IKCP_ASK_ALONE   = 32 // end the datagram with IKCP_CMD_WASK, so no data makes it large
+	IKCP_REKEY_REPLY = 1  // frg of an answering IKCP_CMD_REKEY
+	IKCP_REKEY_LIMIT = 5  // max announcements of a key epoch without answer
 	IKCP_WND_SND     = 32
 	IKCP_WND_RCV     = 32
 	IKCP_MTU_DEF     = 1400
+	IKCP_MTU_MIN     = 50
 	IKCP_ACK_FAST    = 3
 	IKCP_INTERVAL    = 100
 	IKCP_OVERHEAD    = 24
 	IKCP_DEADLINK    = 20
+	IKCP_DEADTIME    = 6500 // ms a segment goes unacknowledged before the link is dead, along with IKCP_DEADLINK
 	IKCP_THRESH_INIT = 2
 	IKCP_THRESH_MIN  = 2
 	IKCP_PROBE_INIT  = 7000   // 7 secs to probe window size
@@ -107,6 +125,11 @@ type Segment struct {
 	rto      uint32
 	fastack  uint32
 	xmit     uint32
+	sendts   uint32        // when it was first sent, for the dead link time
+	eow      bool          // ends the data of a Send, segments of another priority may follow
+	bow      bool          // begins the data of a Send
+	dgram    uint32        // size of the smallest datagram the segment was sent in, 0 if not sent yet
+	stamp    time.Duration // since epoch, when its Send was queued or it arrived, 0 if not measured
 	data     []byte
 }
 
@@ -133,20 +156,61 @@ type KCP struct {
 	current, interval, ts_flush, xmit      uint32
 	nodelay, updated                       uint32
 	ts_probe, probe_wait                   uint32
-	dead_link, incr                        uint32
+	dead_link, dead_time, incr             uint32
+	dead_age                               uint32 // ms a segment goes unacknowledged before the link is dead, 0 for no bound
+	dead_cause                             int    // DeadBy* of a dead link
+	hello, rmt_hello                       uint32 // capabilities as version<<8|flags, 0 for disabled or unknown
+	hello_xmit, hello_ts                   uint32 // announcements left and time of the next one
+	hello_mtu, rmt_mtu                     uint32 // datagram mtu<<16|overhead per packet along with hello, 0 for unknown
+	close_xmit, close_ts                   uint32 // the same of the close status
+	close_status, rmt_close                []byte // code and reason of IKCP_CMD_CLOSE, sent and received, nil for none
+	rekey_epoch, rekey_xmit, rekey_ts      uint32 // key epoch announced with IKCP_CMD_REKEY, announcements left, next one
+	rekey_acked, rekey_reply, rmt_epoch    uint32 // epochs answered by remote, to answer, and last announced by remote
+	hdr_accept, hdr_send                   int    // header profiles accepted and sent, see SetHeaderProfile
+	rmt_ts                                 uint32 // the last ts of the data of remote, to extend the compact headers
+	rmt_wins                               uint32 // IKCP_CMD_WINS received, remote answered a window probe
+	foreign                                bool   // remote acknowledged sn never sent, it runs another conversation of the conv
+	expanded                               []byte // the last compact datagram input, in the legacy format
 
 	fastresend     int32
 	nocwnd, stream int32
-
-	snd_queue []Segment
-	rcv_queue []Segment
-	snd_buf   []Segment
-	rcv_buf   []Segment
+	backoff        float64 // rto growth on retransmission by timeout, 0 for the default of nodelay
+	backoffLinear  bool    // backoff adds a multiple of rx_rto instead of multiplying the rto
+	paused         bool    // only acks and probes are sent, with a zero window, see Pause
+	pause_ts       uint32  // when it was paused
+	rto_burst      uint32  // retransmissions by timeout sent at once after an rto, 0 for no cap, see SetRecoveryBurst
+	recovering     bool    // since an rto, until what was in flight then is acknowledged
+	rto_allow      uint32  // retransmissions by timeout left to the recovery
+	rto_until      uint32  // snd_nxt at the rto, the recovery ends once snd_una passes it
+	rto_ts         uint32  // when the recovery started
+	rtos           uint64  // recoveries
+	rto_time       uint64  // ms spent recovering
+
+	snd_queue    []Segment
+	snd_queue_hi []Segment // high priority, sent ahead of snd_queue at Send boundaries
+	snd_midsend  bool      // snd_buf ends in the middle of the data of a Send from snd_queue
+	snd_midhigh  bool      // snd_buf ends in the middle of the data of a Send from snd_queue_hi
+	rcv_cap      int32     // cap of received segments plus the advertised window, set by the owner when short of memory, -1 for none
+	nsegs        int       // segments holding a buffer from xmitBuf
+	snd_bytes    int       // bytes of data in snd_queue and snd_queue_hi
+	packed       []int     // snd_buf indices of the segments in the datagram being filled by flush
+	rcv_queue    []Segment
+	snd_buf      []Segment
+	rcv_buf      []Segment
 
 	acklist ackList
 
 	buffer []byte
 	output Output
+	trace  *SessionTrace // optional event hooks
+
+	arrival      time.Duration // since epoch, when the packets being input arrived, set by the owner
+	txLat, rxLat latencyHist   // from Send to the first transmission, and from arrival to Recv
+	rtt          latencyHist   // round trips measured from the acknowledgements
+	tx, rx       TrafficStats  // data segments sent and received
+	snd_seq      uint64        // sequence numbers taken by the segments sent, in 64 bits, past the wraps of snd_nxt
+	rcv_seq      uint64        // the same of the segments received in order, past the wraps of rcv_nxt
+	reorder      reorderState  // reordering of the data segments received
 }
 
 type ackItem struct {
@@ -156,16 +220,14 @@ type ackItem struct {
 
 type ackList []ackItem
 
-func (l ackList) Len() int            { return len(l) }
-func (l ackList) Less(i, j int) bool  { return l[i].sn < l[j].sn }
-func (l ackList) Swap(i, j int)       { l[i], l[j] = l[j], l[i] }
-func (l *ackList) Push(x interface{}) { *l = append(*l, x.(ackItem)) }
-func (l *ackList) Pop() interface{} {
-	old := *l
-	n := len(old)
-	x := old[n-1]
-	*l = old[0 : n-1]
-	return x
+// sort orders acks by sn, across its wrap, they mostly arrive in order so an
+// insertion sort is cheap and doesn't allocate
+func (l ackList) sort() {
+	for i := 1; i < len(l); i++ {
+		for j := i; j > 0 && _itimediff(l[j].sn, l[j-1].sn) < 0; j-- {
+			l[j], l[j-1] = l[j-1], l[j]
+		}
+	}
 }
 
 // NewKCP create a new kcp control object, 'conv' must equal in two endpoint
@@ -185,20 +247,41 @@ func NewKCP(conv uint32, output Output) *KCP {
 	kcp.ts_flush = IKCP_INTERVAL
 	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.dead_link = IKCP_DEADLINK
+	kcp.dead_time = IKCP_DEADTIME
+	kcp.rcv_cap = -1
 	kcp.output = output
 	return kcp
 }
 
-// newSegment creates a KCP segment
-func (kcp *KCP) newSegment(size int) *Segment {
-	seg := new(Segment)
-	seg.data = xmitBuf.Get().([]byte)[:size]
-	return seg
+// newSegment creates a KCP segment, segments are kept by value in
+// the queues so only the data buffer comes from the pool
+func (kcp *KCP) newSegment(size int) (seg Segment) {
+	seg.data = getXmitBuf()[:size]
+	kcp.nsegs++
+	return
 }
 
 // delSegment recycles a KCP segment
 func (kcp *KCP) delSegment(seg *Segment) {
-	xmitBuf.Put(seg.data)
+	if seg.data != nil {
+		putXmitBuf(seg.data)
+		seg.data = nil
+		kcp.nsegs--
+	}
+}
+
+// remove_front removes the first n segments of q, the remaining segments are
+// moved to the front when they fit, so the backing array is reused
+// instead of sliding forward and reallocating on append
+func remove_front(q []Segment, n int) []Segment {
+	if n > cap(q)/2 {
+		newn := copy(q, q[n:])
+		for k := newn; k < len(q); k++ {
+			q[k] = Segment{} // dereference
+		}
+		return q[:newn]
+	}
+	return q[n:]
 }
 
 // PeekSize checks the size of next message in the recv queue
@@ -242,7 +325,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	var fast_recover bool
-	if len(kcp.rcv_queue) >= int(kcp.rcv_wnd) {
+	if kcp.wnd_unused() == 0 {
 		fast_recover = true
 	}
 
@@ -256,10 +339,13 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 		count++
 		kcp.delSegment(seg)
 		if seg.frg == 0 {
+			if seg.stamp != 0 {
+				kcp.rxLat.add(time.Since(epoch) - seg.stamp)
+			}
 			break
 		}
 	}
-	kcp.rcv_queue = kcp.rcv_queue[count:]
+	kcp.rcv_queue = remove_front(kcp.rcv_queue, count)
 
 	// move available data from rcv_buf -> rcv_queue
 	count = 0
@@ -267,16 +353,17 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 		seg := &kcp.rcv_buf[k]
 		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
 			kcp.rcv_nxt++
+			kcp.rcv_seq++
 			count++
 		} else {
 			break
 		}
 	}
 	kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
-	kcp.rcv_buf = kcp.rcv_buf[count:]
+	kcp.rcv_buf = remove_front(kcp.rcv_buf, count)
 
 	// fast recover
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) && fast_recover {
+	if kcp.wnd_unused() > 0 && fast_recover {
 		// ready to send back IKCP_CMD_WINS in ikcp_flush
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
@@ -286,73 +373,173 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 
 // Send is user/upper level send, returns below zero for error
 func (kcp *KCP) Send(buffer []byte) int {
-	var count int
-	if len(buffer) == 0 {
+	return kcp.send([][]byte{buffer}, false)
+}
+
+// SendHigh is Send with high priority, the data is sent ahead of data queued by Send
+// and not sent yet, but never in the middle of the data of one Send
+func (kcp *KCP) SendHigh(buffer []byte) int {
+	return kcp.send([][]byte{buffer}, true)
+}
+
+// gather reads the data of a Send from one or more slices
+type gather struct {
+	v   [][]byte
+	off int // read offset in v[0]
+	n   int // bytes left
+}
+
+func newGather(v [][]byte) gather {
+	g := gather{v: v}
+	for k := range v {
+		g.n += len(v[k])
+	}
+	return g
+}
+
+// read fills dst from the front of the data
+func (g *gather) read(dst []byte) {
+	g.n -= len(dst)
+	for len(dst) > 0 {
+		n := copy(dst, g.v[0][g.off:])
+		dst = dst[n:]
+		if g.off += n; g.off == len(g.v[0]) {
+			g.v, g.off = g.v[1:], 0
+		}
+	}
+}
+
+// send queues the data of v as if the slices were one buffer, without copying them together first
+func (kcp *KCP) send(v [][]byte, high bool) int {
+	buffer := newGather(v)
+	if buffer.n == 0 {
 		return -1
 	}
 
+	q := &kcp.snd_queue
+	if high {
+		q = &kcp.snd_queue_hi
+	}
+
 	// append to previous segment in streaming mode (if possible)
 	if kcp.stream != 0 {
-		n := len(kcp.snd_queue)
+		n := len(*q)
 		if n > 0 {
-			old := &kcp.snd_queue[n-1]
+			old := &(*q)[n-1]
 			if len(old.data) < int(kcp.mss) {
 				capacity := int(kcp.mss) - len(old.data)
 				extend := capacity
-				if len(buffer) < capacity {
-					extend = len(buffer)
+				if buffer.n < capacity {
+					extend = buffer.n
 				}
 				seg := kcp.newSegment(len(old.data) + extend)
 				seg.frg = 0
+				seg.bow = old.bow
+				seg.stamp = old.stamp
 				copy(seg.data, old.data)
-				copy(seg.data[len(old.data):], buffer)
-				buffer = buffer[extend:]
+				buffer.read(seg.data[len(old.data):])
+				kcp.snd_bytes += extend
+				seg.eow = buffer.n == 0
 				kcp.delSegment(old)
-				kcp.snd_queue[n-1] = *seg
+				(*q)[n-1] = seg
 			}
 		}
 
-		if len(buffer) == 0 {
+		if buffer.n == 0 {
 			return 0
 		}
 	}
 
-	if len(buffer) <= int(kcp.mss) {
+	var ok bool
+	n, size := len(*q), buffer.n
+	if *q, ok = kcp.fragment(*q, &buffer); !ok {
+		return -2
+	}
+	(*q)[n].stamp = time.Since(epoch)
+	kcp.snd_bytes += size
+	return 0
+}
+
+// fragment appends the data of a Send to q in segments of at most mss,
+// it fails if the data needs more than 255 fragments
+func (kcp *KCP) fragment(q []Segment, buffer *gather) ([]Segment, bool) {
+	var count int
+	if buffer.n <= int(kcp.mss) {
 		count = 1
 	} else {
-		count = (len(buffer) + int(kcp.mss) - 1) / int(kcp.mss)
+		count = (buffer.n + int(kcp.mss) - 1) / int(kcp.mss)
 	}
 
 	if count > 255 {
-		return -2
-	}
-
-	if count == 0 {
-		count = 1
+		return q, false
 	}
 
 	for i := 0; i < count; i++ {
 		var size int
-		if len(buffer) > int(kcp.mss) {
+		if buffer.n > int(kcp.mss) {
 			size = int(kcp.mss)
 		} else {
-			size = len(buffer)
+			size = buffer.n
 		}
 		seg := kcp.newSegment(size)
-		copy(seg.data, buffer[:size])
+		buffer.read(seg.data)
 		if kcp.stream == 0 { // message mode
 			seg.frg = uint32(count - i - 1)
 		} else { // stream mode
 			seg.frg = 0
 		}
-		kcp.snd_queue = append(kcp.snd_queue, *seg)
-		buffer = buffer[size:]
+		seg.bow = i == 0
+		seg.eow = i == count-1
+		q = append(q, seg)
 	}
-	return 0
+	return q, true
+}
+
+// refragment splits the queued data of every Send holding segments larger than mss,
+// the rest of a message already partly in snd_buf keeps its fragments, as the
+// receiver counts them from the first one
+func (kcp *KCP) refragment(q []Segment, midsend bool) []Segment {
+	var out []Segment
+	start := 0
+	for k := range q {
+		if !q[k].eow && k < len(q)-1 {
+			continue
+		}
+		group := q[start : k+1]
+		partial := start == 0 && midsend && kcp.stream == 0
+		start = k + 1
+
+		oversized := false
+		for i := range group {
+			oversized = oversized || len(group[i].data) > int(kcp.mss)
+		}
+		if !oversized || partial {
+			out = append(out, group...)
+			continue
+		}
+
+		data := make([][]byte, len(group))
+		for i := range group {
+			data[i] = group[i].data
+		}
+		buffer := newGather(data)
+		if split, ok := kcp.fragment(out, &buffer); ok {
+			split[len(out)].stamp = group[0].stamp
+			split[len(split)-1].eow = group[len(group)-1].eow
+			for i := range group {
+				kcp.delSegment(&group[i])
+			}
+			out = split
+		} else {
+			out = append(out, group...)
+		}
+	}
+	return out
 }
 
 // https://tools.ietf.org/html/rfc6298
 func (kcp *KCP) update_ack(rtt int32) {
+	kcp.rtt.add(time.Duration(rtt) * time.Millisecond)
 	var rto uint32
 	if kcp.rx_srtt == 0 {
 		kcp.rx_srtt = uint32(rtt)
@@ -381,7 +568,9 @@ func (kcp *KCP) shrink_buf() {
 	}
 }
 
-func (kcp *KCP) parse_ack(sn uint32) {
+// parse_ack removes the segment sn from snd_buf, the ack echoes ts of the transmission
+// that arrived: one before the last means the retransmission was spurious
+func (kcp *KCP) parse_ack(sn, ts uint32) {
 	if _itimediff(sn, kcp.snd_una) < 0 || _itimediff(sn, kcp.snd_nxt) >= 0 {
 		return
 	}
@@ -389,6 +578,12 @@ func (kcp *KCP) parse_ack(sn uint32) {
 	for k := range kcp.snd_buf {
 		seg := &kcp.snd_buf[k]
 		if sn == seg.sn {
+			if kcp.trace != nil {
+				kcp.trace.acked(seg.sn, _itimediff(kcp.current, seg.ts))
+			}
+			if seg.xmit > 1 && _itimediff(ts, seg.ts) < 0 {
+				kcp.tx.Spurious++
+			}
 			kcp.delSegment(seg)
 			copy(kcp.snd_buf[k:], kcp.snd_buf[k+1:])
 			kcp.snd_buf[len(kcp.snd_buf)-1] = Segment{}
@@ -421,23 +616,26 @@ func (kcp *KCP) parse_una(una uint32) {
 	for k := range kcp.snd_buf {
 		seg := &kcp.snd_buf[k]
 		if _itimediff(una, seg.sn) > 0 {
+			if kcp.trace != nil {
+				kcp.trace.acked(seg.sn, _itimediff(kcp.current, seg.ts))
+			}
 			kcp.delSegment(seg)
 			count++
 		} else {
 			break
 		}
 	}
-	kcp.snd_buf = kcp.snd_buf[count:]
+	kcp.snd_buf = remove_front(kcp.snd_buf, count)
 }
 
 // ack append
 func (kcp *KCP) ack_push(sn, ts uint32) {
-	heap.Push(&kcp.acklist, ackItem{sn, ts})
+	kcp.acklist = append(kcp.acklist, ackItem{sn, ts})
 }
 
 func (kcp *KCP) parse_data(newseg *Segment) {
 	sn := newseg.sn
-	if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) >= 0 ||
+	if _itimediff(sn, kcp.rcv_limit()) >= 0 ||
 		_itimediff(sn, kcp.rcv_nxt) < 0 {
 		kcp.delSegment(newseg)
 		return
@@ -459,6 +657,10 @@ func (kcp *KCP) parse_data(newseg *Segment) {
 		}
 	}
 
+	kcp.rx.add(!repeat, len(newseg.data))
+	if !repeat && kcp.reorder.add(sn, newseg.ts, kcp.fastresend) && kcp.reorder.tune {
+		kcp.fastresend = kcp.reorder.tuned()
+	}
 	if !repeat {
 		if insert_idx == n+1 {
 			kcp.rcv_buf = append(kcp.rcv_buf, *newseg)
@@ -477,36 +679,52 @@ func (kcp *KCP) parse_data(newseg *Segment) {
 		seg := &kcp.rcv_buf[k]
 		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
 			kcp.rcv_nxt++
+			kcp.rcv_seq++
 			count++
 		} else {
 			break
 		}
 	}
 	kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[:count]...)
-	kcp.rcv_buf = kcp.rcv_buf[count:]
+	kcp.rcv_buf = remove_front(kcp.rcv_buf, count)
 }
 
-// Input when you received a low level packet (eg. UDP packet), call it
+// Input when you received a low level packet (eg. UDP packet), call it.
+// A packet may carry several segments, the segments ahead of an invalid one are
+// still taken. It returns -1 for a foreign conv, -2 for a truncated segment and
+// -3 for an unknown command. Segments with a command reserved for extensions,
+// IKCP_CMD_EXT_MIN to IKCP_CMD_EXT_MAX, which this end doesn't speak are skipped
+// without touching any state, so peers may send extensions it predates; but peers
+// without the reserved range drop the whole packet, so an extension goes in a
+// packet of its own until it's negotiated.
 func (kcp *KCP) Input(data []byte, update_ack bool) int {
 	una := kcp.snd_una
+	data, invalid := kcp.expand(data)
 	if len(data) < IKCP_OVERHEAD {
+		if invalid != 0 {
+			return invalid
+		}
 		return -1
 	}
 
+	// the segments of a datagram ahead of an invalid one are still taken
 	var maxack uint32
 	var flag int
-	for {
+	var ret int
+	for len(data) > 0 {
 		var ts, sn, length, una, conv uint32
 		var wnd uint16
 		var cmd, frg uint8
 
-		if len(data) < int(IKCP_OVERHEAD) {
+		if len(data) < int(IKCP_OVERHEAD) { // a truncated header
+			ret = -2
 			break
 		}
 
 		data = ikcp_decode32u(data, &conv)
 		if conv != kcp.conv {
-			return -1
+			ret = -1
+			break
 		}
 
 		data = ikcp_decode8u(data, &cmd)
@@ -517,15 +735,43 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 		data = ikcp_decode32u(data, &una)
 		data = ikcp_decode32u(data, &length)
 		if len(data) < int(length) {
-			return -2
+			ret = -2
+			break
 		}
 
+		if cmd == IKCP_CMD_PING {
+			data = data[length:]
+			continue
+		}
+		if cmd >= IKCP_CMD_EXT_MIN && cmd <= IKCP_CMD_EXT_MAX && (cmd != IKCP_CMD_HELLO && cmd != IKCP_CMD_CLOSE && cmd != IKCP_CMD_REKEY || kcp.hello == 0) {
+			atomic.AddUint64(&DefaultSnmp.KCPUnknownCmds, 1)
+			data = data[length:]
+			continue
+		}
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
-			return -3
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS && cmd != IKCP_CMD_HELLO && cmd != IKCP_CMD_CLOSE &&
+			cmd != IKCP_CMD_REKEY {
+			atomic.AddUint64(&DefaultSnmp.KCPUnknownCmds, 1)
+			ret = -3
+			break
+		}
+
+		if _itimediff(una, kcp.snd_nxt) > 0 || cmd == IKCP_CMD_ACK && _itimediff(sn, kcp.snd_nxt) >= 0 {
+			// remote acknowledges what was never sent, the owner must not go on
+			kcp.foreign = true
+			ret = -1
+			break
 		}
 
 		kcp.rmt_wnd = uint32(wnd)
+		if cmd == IKCP_CMD_ACK && kcp.hdr_send != HeaderLegacy { // it echoes the low 16 bits sent
+			ts = extend16(kcp.current, uint16(ts))
+		} else if cmd == IKCP_CMD_PUSH {
+			kcp.rmt_ts = ts
+		}
+		if cmd == IKCP_CMD_ACK { // ahead of una, which mostly covers sn too, to tell spurious retransmissions
+			kcp.parse_ack(sn, ts)
+		}
 		kcp.parse_una(una)
 		kcp.shrink_buf()
 
@@ -533,8 +779,9 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 			if update_ack && _itimediff(kcp.current, ts) >= 0 {
 				kcp.update_ack(_itimediff(kcp.current, ts))
 			}
-			kcp.parse_ack(sn)
-			kcp.shrink_buf()
+			if kcp.recovering && kcp.rto_allow < kcp.snd_wnd { // like slow start, the acked segment and one more
+				kcp.rto_allow += 2
+			}
 			if flag == 0 {
 				flag = 1
 				maxack = sn
@@ -542,7 +789,7 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 				maxack = sn
 			}
 		} else if cmd == IKCP_CMD_PUSH {
-			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
+			if _itimediff(sn, kcp.rcv_limit()) < 0 {
 				kcp.ack_push(sn, ts)
 				if _itimediff(sn, kcp.rcv_nxt) >= 0 {
 					seg := kcp.newSegment(int(length))
@@ -553,10 +800,14 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 					seg.ts = ts
 					seg.sn = sn
 					seg.una = una
+					if frg == 0 { // it completes a message
+						seg.stamp = kcp.arrival
+					}
 					copy(seg.data, data[:length])
-					kcp.parse_data(seg)
+					kcp.parse_data(&seg)
 				} else {
 					atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
+					kcp.rx.add(false, int(length))
 				}
 			} else {
 				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
@@ -566,9 +817,37 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 			// tell remote my window size
 			kcp.probe |= IKCP_ASK_TELL
 		} else if cmd == IKCP_CMD_WINS {
-			// do nothing
-		} else {
-			return -3
+			kcp.rmt_wins++
+		} else if cmd == IKCP_CMD_HELLO {
+			if length >= 2 && data[0] != 0 {
+				kcp.rmt_hello = uint32(data[0])<<8 | uint32(data[1])
+				if length >= 6 { // peers of older releases announce the capabilities only
+					kcp.rmt_mtu = uint32(binary.LittleEndian.Uint16(data[2:]))<<16 | uint32(binary.LittleEndian.Uint16(data[4:]))
+				}
+				kcp.hello_xmit = 0
+				if frg != IKCP_HELLO_REPLY {
+					kcp.probe |= IKCP_ASK_HELLO
+				}
+			}
+		} else if cmd == IKCP_CMD_CLOSE {
+			if frg == IKCP_CLOSE_REPLY {
+				kcp.close_xmit = 0
+			} else if length >= 4 {
+				if kcp.rmt_close == nil { // retransmissions carry the same
+					kcp.rmt_close = append([]byte(nil), data[:length]...)
+				}
+				kcp.probe |= IKCP_ASK_CLOSE
+			}
+		} else if cmd == IKCP_CMD_REKEY {
+			if length >= 4 {
+				epoch := binary.LittleEndian.Uint32(data)
+				if frg != IKCP_REKEY_REPLY {
+					kcp.rmt_epoch = epoch // the application answers, once it has the key
+				} else if epoch == kcp.rekey_epoch {
+					kcp.rekey_acked = epoch
+					kcp.rekey_xmit = 0
+				}
+			}
 		}
 
 		data = data[length:]
@@ -577,6 +856,16 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 	if flag != 0 && update_ack {
 		kcp.parse_fastack(maxack)
 	}
+	if ret == 0 {
+		ret = invalid
+	}
+
+	if kcp.recovering && _itimediff(kcp.snd_una, kcp.rto_until) >= 0 {
+		kcp.recovering = false
+		if _itimediff(kcp.current, kcp.rto_ts) > 0 {
+			kcp.rto_time += uint64(_itimediff(kcp.current, kcp.rto_ts))
+		}
+	}
 
 	if _itimediff(kcp.snd_una, una) > 0 {
 		if kcp.cwnd < kcp.rmt_wnd {
@@ -600,14 +889,36 @@ func (kcp *KCP) Input(data []byte, update_ack bool) int {
 		}
 	}
 
-	return 0
+	return ret
 }
 
 func (kcp *KCP) wnd_unused() int32 {
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-		return int32(int(kcp.rcv_wnd) - len(kcp.rcv_queue))
+	wnd := int32(kcp.rcv_wnd) - int32(len(kcp.rcv_queue))
+	if kcp.rcv_cap >= 0 {
+		if room := kcp.rcv_cap - int32(len(kcp.rcv_queue)+len(kcp.rcv_buf)); room < wnd {
+			wnd = room
+		}
 	}
-	return 0
+	if wnd < 0 {
+		return 0
+	}
+	return wnd
+}
+
+// rcv_limit returns the first sequence number beyond the receive window, segments
+// from there on are dropped unacknowledged, so the segments not read yet stay
+// within rcv_wnd, and rcv_cap
+func (kcp *KCP) rcv_limit() uint32 {
+	wnd := int32(kcp.rcv_wnd) - int32(len(kcp.rcv_queue))
+	if kcp.rcv_cap >= 0 {
+		if room := kcp.rcv_cap - int32(len(kcp.rcv_queue)); room < wnd {
+			wnd = room
+		}
+	}
+	if wnd < 0 {
+		wnd = 0
+	}
+	return kcp.rcv_nxt + uint32(wnd)
 }
 
 // flush pending data
@@ -624,23 +935,26 @@ func (kcp *KCP) flush() {
 	seg.conv = kcp.conv
 	seg.cmd = IKCP_CMD_ACK
 	seg.wnd = uint32(kcp.wnd_unused())
+	if kcp.paused {
+		seg.wnd = 0
+	}
 	seg.una = kcp.rcv_nxt
 
 	// flush acknowledges
 	ptr := buffer
-	for kcp.acklist.Len() > 0 {
+	kcp.acklist.sort()
+	for k, ack := range kcp.acklist {
 		size := len(buffer) - len(ptr)
 		if size+IKCP_OVERHEAD > int(kcp.mtu) {
-			kcp.output(buffer, size)
+			kcp.out(buffer, size)
 			ptr = buffer
 		}
-		ack := heap.Pop(&kcp.acklist).(ackItem)
-		if ack.sn >= kcp.rcv_nxt || kcp.acklist.Len() == 0 {
+		if _itimediff(ack.sn, kcp.rcv_nxt) >= 0 || k == len(kcp.acklist)-1 {
 			seg.sn, seg.ts = ack.sn, ack.ts
 			ptr = seg.encode(ptr)
 		}
 	}
-	kcp.acklist = nil
+	kcp.acklist = kcp.acklist[:0]
 
 	// probe window size (if remote window size equals zero)
 	if kcp.rmt_wnd == 0 {
@@ -670,10 +984,14 @@ func (kcp *KCP) flush() {
 		seg.cmd = IKCP_CMD_WASK
 		size := len(buffer) - len(ptr)
 		if size+IKCP_OVERHEAD > int(kcp.mtu) {
-			kcp.output(buffer, size)
+			kcp.out(buffer, size)
 			ptr = buffer
 		}
 		ptr = seg.encode(ptr)
+		if (kcp.probe & IKCP_ASK_ALONE) != 0 {
+			kcp.out(buffer, len(buffer)-len(ptr))
+			ptr = buffer
+		}
 	}
 
 	// flush window probing commands
@@ -681,27 +999,108 @@ func (kcp *KCP) flush() {
 		seg.cmd = IKCP_CMD_WINS
 		size := len(buffer) - len(ptr)
 		if size+IKCP_OVERHEAD > int(kcp.mtu) {
-			kcp.output(buffer, size)
+			kcp.out(buffer, size)
 			ptr = buffer
 		}
 		ptr = seg.encode(ptr)
 	}
 
+	// capability negotiation, in a datagram of its own,
+	// since peers without the extension reject the whole datagram
+	if kcp.hello != 0 {
+		announce := kcp.hello_xmit > 0 && (kcp.hello_ts == 0 || _itimediff(current, kcp.hello_ts) >= 0)
+		if announce || (kcp.probe&IKCP_ASK_HELLO) != 0 {
+			if size := len(buffer) - len(ptr); size > 0 {
+				kcp.out(buffer, size)
+			}
+			hello := seg
+			hello.cmd = IKCP_CMD_HELLO
+			hello.frg = IKCP_HELLO_REPLY
+			if announce {
+				hello.frg = 0
+				kcp.hello_xmit--
+				kcp.hello_ts = current + kcp.rx_rto
+			}
+			ptr = hello.encode(buffer)
+			ptr[0] = byte(kcp.hello >> 8)
+			ptr[1] = byte(kcp.hello)
+			size := 2
+			if kcp.hello_mtu != 0 {
+				binary.LittleEndian.PutUint16(ptr[2:], uint16(kcp.hello_mtu>>16))
+				binary.LittleEndian.PutUint16(ptr[4:], uint16(kcp.hello_mtu))
+				size = 6
+			}
+			binary.LittleEndian.PutUint32(buffer[20:], uint32(size)) // data length
+			kcp.out(buffer, IKCP_OVERHEAD+size)
+			ptr = buffer
+		}
+	}
+
+	// the close status, once all data is acknowledged, so the peer has it all
+	announce := kcp.close_xmit > 0 && kcp.WaitSnd() == 0 && (kcp.close_ts == 0 || _itimediff(current, kcp.close_ts) >= 0)
+	if announce || (kcp.probe&IKCP_ASK_CLOSE) != 0 {
+		closing := seg
+		closing.cmd = IKCP_CMD_CLOSE
+		closing.frg = IKCP_CLOSE_REPLY
+		if announce {
+			closing.frg = 0
+			closing.data = kcp.close_status
+			kcp.close_xmit--
+			kcp.close_ts = current + kcp.rx_rto
+		}
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD+len(closing.data) > int(kcp.mtu) {
+			kcp.out(buffer, size)
+			ptr = buffer
+		}
+		ptr = closing.encode(ptr)
+		ptr = ptr[copy(ptr, closing.data):]
+	}
+
+	// the key epoch, announced until answered, and the answer
+	if kcp.rekey_xmit > 0 && (kcp.rekey_ts == 0 || _itimediff(current, kcp.rekey_ts) >= 0) {
+		kcp.rekey_xmit--
+		kcp.rekey_ts = current + kcp.rx_rto
+		ptr = kcp.flushRekey(buffer, ptr, seg, 0, kcp.rekey_epoch)
+	}
+	if kcp.probe&IKCP_ASK_REKEY != 0 {
+		ptr = kcp.flushRekey(buffer, ptr, seg, IKCP_REKEY_REPLY, kcp.rekey_reply)
+	}
+
 	kcp.probe = 0
 
+	if kcp.paused { // neither data nor retransmissions
+		if size := len(buffer) - len(ptr); size > 0 {
+			kcp.out(buffer, size)
+		}
+		return
+	}
+
 	// calculate window size
 	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
 	if kcp.nocwnd == 0 {
 		cwnd = _imin_(kcp.cwnd, cwnd)
 	}
 
-	// sliding window, controlled by snd_nxt && sna_una+cwnd
-	count := 0
-	for k := range kcp.snd_queue {
-		if _itimediff(kcp.snd_nxt, kcp.snd_una+cwnd) >= 0 {
+	// sliding window, controlled by snd_nxt && sna_una+cwnd,
+	// high priority segments go first unless a Send from snd_queue is half sent
+	count, hcount := 0, 0
+	for _itimediff(kcp.snd_nxt, kcp.snd_una+cwnd) < 0 {
+		var newseg Segment
+		if hcount < len(kcp.snd_queue_hi) && !kcp.snd_midsend {
+			newseg = kcp.snd_queue_hi[hcount]
+			kcp.snd_queue_hi[hcount].data = nil
+			kcp.snd_midhigh = !newseg.eow
+			hcount++
+		} else if count < len(kcp.snd_queue) {
+			newseg = kcp.snd_queue[count]
+			kcp.snd_queue[count].data = nil
+			kcp.snd_midsend = !newseg.eow
+			count++
+		} else {
 			break
 		}
-		newseg := kcp.snd_queue[k]
+		kcp.snd_bytes -= len(newseg.data)
 		newseg.conv = kcp.conv
 		newseg.cmd = IKCP_CMD_PUSH
 		newseg.wnd = seg.wnd
@@ -712,14 +1111,14 @@ func (kcp *KCP) flush() {
 		newseg.rto = kcp.rx_rto
 		kcp.snd_buf = append(kcp.snd_buf, newseg)
 		kcp.snd_nxt++
-		count++
-		kcp.snd_queue[k].data = nil
+		kcp.snd_seq++
 	}
-	kcp.snd_queue = kcp.snd_queue[count:]
+	kcp.snd_queue = remove_front(kcp.snd_queue, count)
+	kcp.snd_queue_hi = remove_front(kcp.snd_queue_hi, hcount)
 
 	// flag pending data
 	hasPending := false
-	if count > 0 {
+	if count+hcount > 0 {
 		hasPending = true
 	}
 
@@ -735,26 +1134,41 @@ func (kcp *KCP) flush() {
 
 	// flush data segments
 	var lostSegs, fastRetransSegs, earlyRetransSegs uint64
+	var now time.Duration // since epoch, taken for the first Send measured
 	for k := range kcp.snd_buf {
 		segment := &kcp.snd_buf[k]
-		needsend := false
+		needsend, first := false, false
 		if segment.xmit == 0 {
-			needsend = true
+			needsend, first = true, true
 			segment.xmit++
+			if segment.stamp != 0 {
+				if now == 0 {
+					now = time.Since(epoch)
+				}
+				kcp.txLat.add(now - segment.stamp)
+				segment.stamp = 0
+			}
 			segment.rto = kcp.rx_rto
 			segment.resendts = current + segment.rto + rtomin
+			segment.sendts = current
+		} else if _itimediff(current, segment.resendts) >= 0 && kcp.recovering && kcp.rto_burst > 0 && kcp.rto_allow == 0 && k > 0 {
+			segment.resendts = current + kcp.interval // the burst is spent until acks come back, the oldest segment keeps its timer
 		} else if _itimediff(current, segment.resendts) >= 0 {
 			needsend = true
 			segment.xmit++
 			kcp.xmit++
-			if kcp.nodelay == 0 {
-				segment.rto += kcp.rx_rto
-			} else {
-				segment.rto += kcp.rx_rto / 2
-			}
+			segment.rto = kcp.backoffRto(segment.rto)
 			segment.resendts = current + segment.rto
 			lost = true
 			lostSegs++
+			if !kcp.recovering {
+				kcp.recovering = true
+				kcp.rto_allow, kcp.rto_until, kcp.rto_ts = kcp.rto_burst, kcp.snd_nxt, current
+				kcp.rtos++
+			}
+			if kcp.rto_allow > 0 {
+				kcp.rto_allow--
+			}
 		} else if segment.fastack >= resent { // fast retransmit
 			lastsend := segment.resendts - segment.rto
 			if _itimediff(current, lastsend) >= int32(kcp.rx_rto/4) {
@@ -775,9 +1189,15 @@ func (kcp *KCP) flush() {
 				change++
 				earlyRetransSegs++
 			}
+		} else if chaosRetransmit() { // spurious, see chaos.go
+			needsend = true
 		}
 
 		if needsend {
+			if kcp.trace != nil {
+				kcp.trace.sent(segment.sn, segment.xmit)
+			}
+			kcp.tx.add(first, len(segment.data))
 			segment.ts = current
 			segment.wnd = seg.wnd
 			segment.una = kcp.rcv_nxt
@@ -786,20 +1206,27 @@ func (kcp *KCP) flush() {
 			need := IKCP_OVERHEAD + len(segment.data)
 
 			if size+need > int(kcp.mtu) {
-				kcp.output(buffer, size)
+				kcp.sent(kcp.out(buffer, size))
 				ptr = buffer
 			}
 
 			ptr = segment.encode(ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
+			kcp.packed = append(kcp.packed, k)
 
-			if segment.xmit >= kcp.dead_link {
-				kcp.state = 0xFFFFFFFF
+			// both the transmissions and the time, so short outages survive aggressive timers
+			if segment.xmit >= kcp.dead_link && _itimediff(current, segment.sendts) >= int32(kcp.dead_time) {
+				kcp.linkDead(DeadByRetries)
 			}
 		}
+		// the age bound holds whether a transmission is due or not
+		if kcp.dead_age > 0 && segment.xmit > 0 && _itimediff(current, segment.sendts) >= int32(kcp.dead_age) {
+			kcp.linkDead(DeadByAge)
+		}
 	}
 
+	kcp.tx.Lost += lostSegs
 	atomic.AddUint64(&DefaultSnmp.RetransSegs, lostSegs+fastRetransSegs+earlyRetransSegs)
 	atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
 	atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
@@ -808,7 +1235,7 @@ func (kcp *KCP) flush() {
 	// flash remain segments
 	size := len(buffer) - len(ptr)
 	if size > 0 {
-		kcp.output(buffer, size)
+		kcp.sent(kcp.out(buffer, size))
 	}
 
 	// update ssthresh
@@ -839,6 +1266,180 @@ func (kcp *KCP) flush() {
 	}
 }
 
+// sent records the size of a datagram for the segments packed into it
+func (kcp *KCP) sent(size int) {
+	for _, k := range kcp.packed {
+		if seg := &kcp.snd_buf[k]; seg.dgram == 0 || uint32(size) < seg.dgram {
+			seg.dgram = uint32(size)
+		}
+	}
+	kcp.packed = kcp.packed[:0]
+}
+
+// resplit splits the segments in flight larger than mss again after the mtu was
+// lowered for a path losing the datagrams of the first one, and numbers them again
+// from snd_una. It's only safe if none of them reached the peer, or nothing is done:
+// the peer answered a window probe without the first one, so every datagram it was
+// sent in was lost, no segment behind snd_una may be acknowledged, as the peer holds
+// it under its number, and the others must have been sent in datagrams no smaller
+// than the smallest of the first one only. In message mode, a message partly
+// acknowledged keeps its fragments, as the receiver counts them from the first one,
+// and a message partly in flight is split along with the rest of it, which all goes
+// back to the queue.
+func (kcp *KCP) resplit() {
+	q := kcp.snd_buf
+	if len(q) == 0 || int(kcp.snd_nxt-kcp.snd_una) != len(q) {
+		return
+	}
+	oversized := false
+	for k := range q {
+		if q[k].xmit > 0 && q[k].dgram < q[0].dgram {
+			return
+		}
+		oversized = oversized || len(q[k].data) > int(kcp.mss)
+	}
+	if !oversized {
+		return
+	}
+
+	end := len(q)
+	var rest *[]Segment // the queue with the rest of the message at the end of snd_buf
+	if kcp.stream == 0 {
+		if kcp.snd_midsend {
+			rest = &kcp.snd_queue
+		} else if kcp.snd_midhigh {
+			rest = &kcp.snd_queue_hi
+		}
+	}
+	if rest != nil {
+		for end > 0 && !q[end-1].eow {
+			end--
+		}
+	}
+	partial := kcp.stream == 0 && !q[0].bow
+	split := kcp.refragment(q[:end:end], partial)
+	if end < len(q) && end == 0 && partial {
+		split = append(split, q...)
+	} else if end < len(q) {
+		n := 0
+		for n < len(*rest) {
+			n++
+			if (*rest)[n-1].eow {
+				break
+			}
+		}
+		msg := kcp.refragment(append(q[end:len(q):len(q)], (*rest)[:n]...), false)
+		for k := range msg {
+			msg[k].xmit, msg[k].fastack, msg[k].dgram = 0, 0, 0
+		}
+		*rest = append(msg, (*rest)[n:]...)
+		kcp.snd_midsend, kcp.snd_midhigh = false, false
+	}
+
+	sn := kcp.snd_una
+	for k := range split {
+		seg := &split[k]
+		seg.conv = kcp.conv
+		seg.cmd = IKCP_CMD_PUSH
+		seg.sn = sn + uint32(k)
+		seg.xmit, seg.fastack, seg.dgram = 0, 0, 0
+	}
+	kcp.snd_buf = split
+	kcp.snd_seq += uint64(int32(sn + uint32(len(split)) - kcp.snd_nxt)) // fewer if data went back to the queue
+	kcp.snd_nxt = sn + uint32(len(split))
+	kcp.countQueued()
+}
+
+// ping outputs a keepalive carrying data in a datagram of its own, the peer skips it
+// like the extensions it doesn't know
+func (kcp *KCP) ping(data []byte) {
+	seg := Segment{conv: kcp.conv, cmd: IKCP_CMD_PING, data: data}
+	ptr := seg.encode(kcp.buffer)
+	copy(ptr, data)
+	kcp.out(kcp.buffer, IKCP_OVERHEAD+len(data))
+}
+
+// seqStats returns the sequence numbers taken so far
+func (kcp *KCP) seqStats() SeqStats {
+	toWrap := 1<<32 - uint64(kcp.snd_nxt)
+	if rcv := 1<<32 - uint64(kcp.rcv_nxt); rcv < toWrap {
+		toWrap = rcv
+	}
+	return SeqStats{kcp.snd_seq, kcp.rcv_seq, toWrap}
+}
+
+// countQueued sets snd_bytes from the send queues
+func (kcp *KCP) countQueued() {
+	kcp.snd_bytes = 0
+	for _, q := range [][]Segment{kcp.snd_queue, kcp.snd_queue_hi} {
+		for k := range q {
+			kcp.snd_bytes += len(q[k].data)
+		}
+	}
+}
+
+// linkDead marks the link dead, for cause DeadByRetries or DeadByAge, the first limit
+// reached is kept
+func (kcp *KCP) linkDead(cause int) {
+	if kcp.state == 0xFFFFFFFF {
+		return
+	}
+	if kcp.trace != nil {
+		kcp.trace.deadLink()
+	}
+	kcp.state = 0xFFFFFFFF
+	kcp.dead_cause = cause
+}
+
+// resetDeadLink clears the dead link state, the segments in flight get the full retry
+// limit and time again
+func (kcp *KCP) resetDeadLink() {
+	kcp.state = 0
+	kcp.dead_cause = 0
+	for k := range kcp.snd_buf {
+		seg := &kcp.snd_buf[k]
+		if seg.xmit > 1 {
+			seg.xmit = 1
+		}
+		if seg.xmit > 0 {
+			seg.sendts = kcp.current
+		}
+	}
+}
+
+// Pause stops sending data and retransmissions at current, acks and probes are still
+// sent, advertising a zero receive window, so the peer stops sending new data without
+// losing the link. The peer is told at the next flush.
+func (kcp *KCP) Pause(current uint32) {
+	if kcp.paused {
+		return
+	}
+	kcp.paused = true
+	kcp.pause_ts = current
+	kcp.probe |= IKCP_ASK_TELL
+}
+
+// Resume sends data again at current after Pause. The segments in flight have their
+// timers moved by the pause, so it neither grows their rto nor counts toward the dead
+// link, and the peer is told the window at the next flush.
+func (kcp *KCP) Resume(current uint32) {
+	if !kcp.paused {
+		return
+	}
+	kcp.paused = false
+	var d uint32
+	if diff := _itimediff(current, kcp.pause_ts); diff > 0 {
+		d = uint32(diff)
+	}
+	for k := range kcp.snd_buf {
+		if seg := &kcp.snd_buf[k]; seg.xmit > 0 {
+			seg.resendts += d
+			seg.sendts += d
+		}
+	}
+	kcp.probe |= IKCP_ASK_TELL
+}
+
 // Update updates state (call it repeatedly, every 10ms-100ms), or you can ask
 // ikcp_check when to call it again (without ikcp_input/_send calling).
 // 'current' - current timestamp in millisec.
@@ -895,8 +1496,12 @@ func (kcp *KCP) Check(current uint32) uint32 {
 
 	tm_flush = _itimediff(ts_flush, current)
 
-	for k := range kcp.snd_buf {
-		seg := &kcp.snd_buf[k]
+	snd_buf := kcp.snd_buf
+	if kcp.paused { // retransmissions wait for Resume
+		snd_buf = nil
+	}
+	for k := range snd_buf {
+		seg := &snd_buf[k]
 		diff := _itimediff(seg.resendts, current)
 		if diff <= 0 {
 			return current
@@ -917,18 +1522,28 @@ func (kcp *KCP) Check(current uint32) uint32 {
 	return current + minimal
 }
 
-// SetMtu changes MTU size, default is 1400
+// SetMtu changes MTU size, default is 1400. Queued data is split again for a
+// smaller MTU, segments already sent keep their size until acknowledged.
 func (kcp *KCP) SetMtu(mtu int) int {
-	if mtu < 50 || mtu < IKCP_OVERHEAD {
+	if mtu < IKCP_MTU_MIN || mtu < IKCP_OVERHEAD {
 		return -1
 	}
-	buffer := make([]byte, (mtu+IKCP_OVERHEAD)*3)
-	if buffer == nil {
-		return -2
-	}
+	shrink := uint32(mtu) < kcp.mtu
 	kcp.mtu = uint32(mtu)
 	kcp.mss = kcp.mtu - IKCP_OVERHEAD
-	kcp.buffer = buffer
+	if shrink {
+		kcp.snd_queue = kcp.refragment(kcp.snd_queue, kcp.snd_midsend)
+		kcp.snd_queue_hi = kcp.refragment(kcp.snd_queue_hi, kcp.snd_midhigh)
+	}
+
+	// room for the largest segment, which may be in flight from a larger MTU
+	size := kcp.mtu
+	for _, q := range [][]Segment{kcp.snd_buf, kcp.snd_queue, kcp.snd_queue_hi} {
+		for k := range q {
+			size = _imax_(size, uint32(IKCP_OVERHEAD+len(q[k].data)))
+		}
+	}
+	kcp.buffer = make([]byte, (size+IKCP_OVERHEAD)*3)
 	return 0
 }
 
@@ -956,15 +1571,80 @@ func (kcp *KCP) NoDelay(nodelay, interval, resend, nc int) int {
 		kcp.interval = uint32(interval)
 	}
 	if resend >= 0 {
-		kcp.fastresend = int32(resend)
+		kcp.reorder.base = int32(resend)
+		kcp.fastresend = kcp.reorder.tuned()
 	}
 	if nc >= 0 {
-		kcp.nocwnd = int32(nc)
+		kcp.SetCongestionControl(nc == 0)
 	}
 	return 0
 }
 
-// WndSize sets maximum window size: sndwnd=32, rcvwnd=32 by default
+// SetCongestionControl enables or disables the congestion window, like nc of NoDelay.
+// It's safe mid-flight: enabled again, the window starts from the segments in flight,
+// so the flow neither bursts nor stalls, and grows in congestion avoidance from there.
+func (kcp *KCP) SetCongestionControl(enabled bool) {
+	if enabled == (kcp.nocwnd == 0) {
+		return
+	}
+	if !enabled {
+		kcp.nocwnd = 1
+		return
+	}
+	kcp.nocwnd = 0
+	kcp.cwnd = _imax_(kcp.snd_nxt-kcp.snd_una, 1)
+	kcp.ssthresh = _imax_(kcp.cwnd, IKCP_THRESH_MIN)
+	kcp.incr = kcp.cwnd * kcp.mss
+}
+
+// SetBackoff sets how the rto of a segment grows on every retransmission by timeout:
+// linear adds factor times the current rto estimate, otherwise the rto is multiplied
+// by factor, 2 for TCP style doubling. The rto never grows beyond IKCP_RTO_MAX.
+// factor 0 restores the default, adding the estimate, or half of it with nodelay.
+// It returns -1 for a factor that would shrink the rto.
+func (kcp *KCP) SetBackoff(factor float64, linear bool) int {
+	if factor < 0 || (factor > 0 && !linear && factor < 1) {
+		return -1
+	}
+	kcp.backoff = factor
+	kcp.backoffLinear = linear
+	return 0
+}
+
+// SetRecoveryBurst caps the retransmissions by timeout after an rto, whatever nc of
+// NoDelay: burst of them are sent at once, and two more for every ack received, like
+// slow start, until everything in flight at the rto is acknowledged. Without the cap,
+// every segment of the window times out together and is resent in one burst, which
+// overflows a small bottleneck queue again. 0, the default, disables the cap.
+func (kcp *KCP) SetRecoveryBurst(burst int) int {
+	if burst < 0 {
+		return -1
+	}
+	kcp.rto_burst = uint32(burst)
+	return 0
+}
+
+// backoffRto returns the rto of a segment after a retransmission by timeout
+func (kcp *KCP) backoffRto(rto uint32) uint32 {
+	next := float64(rto)
+	switch {
+	case kcp.backoff == 0 && kcp.nodelay == 0:
+		next += float64(kcp.rx_rto)
+	case kcp.backoff == 0:
+		next += float64(kcp.rx_rto / 2)
+	case kcp.backoffLinear:
+		next += float64(kcp.rx_rto) * kcp.backoff
+	default:
+		next *= kcp.backoff
+	}
+	if next > IKCP_RTO_MAX {
+		return IKCP_RTO_MAX
+	}
+	return uint32(next)
+}
+
+// WndSize sets maximum window size: sndwnd=32, rcvwnd=32 by default, at most
+// compactMaxWnd with a compact header profile, see SetHeaderProfile
 func (kcp *KCP) WndSize(sndwnd, rcvwnd int) int {
 	if sndwnd > 0 {
 		kcp.snd_wnd = uint32(sndwnd)
@@ -972,10 +1652,112 @@ func (kcp *KCP) WndSize(sndwnd, rcvwnd int) int {
 	if rcvwnd > 0 {
 		kcp.rcv_wnd = uint32(rcvwnd)
 	}
+	kcp.clampWnd()
 	return 0
 }
 
+// SetHello enables capability negotiation with IKCP_CMD_HELLO, version(non-zero)
+// and flags are the local capabilities. The initiating side announces them until
+// answered, the other side only answers.
+func (kcp *KCP) SetHello(version, flags uint8, initiate bool) {
+	kcp.hello = uint32(version)<<8 | uint32(flags)
+	kcp.hello_xmit = 0
+	if initiate {
+		kcp.hello_xmit = IKCP_HELLO_LIMIT
+	}
+}
+
+// SetCloseStatus announces code and reason with IKCP_CMD_CLOSE once all data is
+// acknowledged, until answered, to a peer with the extension. The reason is cut to
+// fit a segment.
+func (kcp *KCP) SetCloseStatus(code uint32, reason string) {
+	status := make([]byte, 4, 4+len(reason))
+	binary.LittleEndian.PutUint32(status, code)
+	status = append(status, reason...)
+	if len(status) > int(kcp.mss) {
+		status = status[:kcp.mss]
+	}
+	kcp.close_status = status
+	kcp.close_xmit = IKCP_CLOSE_LIMIT
+	kcp.close_ts = 0
+}
+
+// RemoteCloseStatus returns the close status announced by remote, ok is false before
+func (kcp *KCP) RemoteCloseStatus() (code uint32, reason string, ok bool) {
+	if kcp.rmt_close == nil {
+		return 0, "", false
+	}
+	return binary.LittleEndian.Uint32(kcp.rmt_close), string(kcp.rmt_close[4:]), true
+}
+
+// SetEpoch announces the key epoch of the packets to come with IKCP_CMD_REKEY until
+// answered, see EpochAnswered
+func (kcp *KCP) SetEpoch(epoch uint32) {
+	kcp.rekey_epoch = epoch
+	kcp.rekey_xmit = IKCP_REKEY_LIMIT
+	kcp.rekey_ts = 0
+}
+
+// EpochAnswered tells whether remote answered the epoch of SetEpoch
+func (kcp *KCP) EpochAnswered() bool {
+	return kcp.rekey_epoch != 0 && kcp.rekey_acked == kcp.rekey_epoch
+}
+
+// RemoteEpoch returns the key epoch announced by remote since the last call, 0 for none
+func (kcp *KCP) RemoteEpoch() uint32 {
+	epoch := kcp.rmt_epoch
+	kcp.rmt_epoch = 0
+	return epoch
+}
+
+// AnswerEpoch answers the announcement of epoch by remote with the next flush
+func (kcp *KCP) AnswerEpoch(epoch uint32) {
+	kcp.rekey_reply = epoch
+	kcp.probe |= IKCP_ASK_REKEY
+}
+
+// flushRekey appends an IKCP_CMD_REKEY of epoch to the datagram being built in buffer,
+// ptr is the rest of buffer, the datagram is output first if it's full
+func (kcp *KCP) flushRekey(buffer, ptr []byte, seg Segment, frg, epoch uint32) []byte {
+	size := len(buffer) - len(ptr)
+	if size+IKCP_OVERHEAD+4 > int(kcp.mtu) {
+		kcp.out(buffer, size)
+		ptr = buffer
+	}
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], epoch)
+	seg.cmd, seg.frg, seg.data = IKCP_CMD_REKEY, frg, data[:]
+	ptr = seg.encode(ptr)
+	return ptr[copy(ptr, seg.data):]
+}
+
+// SetHelloMtu announces the datagram mtu and the overhead per packet of the transport
+// along with the capabilities, so the peer keeps its datagrams within the mtu, 0 for
+// none. Peers of older releases ignore them.
+func (kcp *KCP) SetHelloMtu(mtu, overhead int) {
+	kcp.hello_mtu = 0
+	if mtu > 0 {
+		kcp.hello_mtu = uint32(uint16(mtu))<<16 | uint32(uint16(overhead))
+	}
+}
+
+// RemoteMtu returns the datagram mtu and the overhead per packet announced by remote,
+// mtu is 0 if unknown
+func (kcp *KCP) RemoteMtu() (mtu, overhead int) {
+	return int(kcp.rmt_mtu >> 16), int(uint16(kcp.rmt_mtu))
+}
+
+// RemoteHello returns the capabilities announced by remote, version is 0 if unknown
+func (kcp *KCP) RemoteHello() (version, flags uint8) {
+	return uint8(kcp.rmt_hello >> 8), uint8(kcp.rmt_hello)
+}
+
 // WaitSnd gets how many packet is waiting to be sent
 func (kcp *KCP) WaitSnd() int {
-	return len(kcp.snd_buf) + len(kcp.snd_queue)
+	return len(kcp.snd_buf) + len(kcp.snd_queue) + len(kcp.snd_queue_hi)
+}
+
+// WaitRcv gets how many packet is received and waiting to be read, at most rcv_wnd
+func (kcp *KCP) WaitRcv() int {
+	return len(kcp.rcv_queue) + len(kcp.rcv_buf)
 }
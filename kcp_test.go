@@ -6,6 +6,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -283,3 +285,988 @@ func TestNetwork(t *testing.T) {
 	test(1) // 普通模式，关闭流控等
 	test(2) // 快速模式，所有开关都打开，且关闭流控
 }
+
+func TestHello(t *testing.T) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.SetHello(2, 0x3, true)
+	k1.SetHelloMtu(1400, 52)
+	k2.SetHello(1, 0x1, false)
+	for i := 0; i < 10; i++ {
+		current := uint32(i*100 + 1)
+		k1.Update(current)
+		k2.Update(current)
+		for _, p := range q12 {
+			k2.Input(p, true)
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = nil, nil
+	}
+	if v, f := k1.RemoteHello(); v != 1 || f != 0x1 {
+		t.Fatal("initiator got", v, f)
+	}
+	if v, f := k2.RemoteHello(); v != 2 || f != 0x3 {
+		t.Fatal("responder got", v, f)
+	}
+	if mtu, overhead := k2.RemoteMtu(); mtu != 1400 || overhead != 52 {
+		t.Fatal("responder got mtu", mtu, overhead)
+	}
+	if mtu, _ := k1.RemoteMtu(); mtu != 0 { // k2 announces the capabilities only
+		t.Fatal("initiator got mtu", mtu)
+	}
+
+	// a peer without negotiation skips the announcements, data flows regardless
+	k3 := NewKCP(2, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k4 := NewKCP(2, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k3.SetHello(1, 0, true)
+	k3.Send([]byte("hello"))
+	hellos := 0
+	for i := 0; i < 20; i++ {
+		current := uint32(i*1000 + 1)
+		k3.Update(current)
+		k4.Update(current)
+		for _, p := range q12 {
+			if p[4] == IKCP_CMD_HELLO {
+				hellos++
+				if k4.Input(p, true) != 0 || k4.probe&IKCP_ASK_HELLO != 0 {
+					t.Fatal("peer without negotiation took IKCP_CMD_HELLO")
+				}
+			} else {
+				k4.Input(p, true)
+			}
+		}
+		for _, p := range q21 {
+			k3.Input(p, true)
+		}
+		q12, q21 = nil, nil
+	}
+	if hellos != IKCP_HELLO_LIMIT {
+		t.Fatal("announced", hellos, "times")
+	}
+	if v, _ := k3.RemoteHello(); v != 0 {
+		t.Fatal("legacy peer reported version", v)
+	}
+	buf := make([]byte, 16)
+	if n := k4.Recv(buf); string(buf[:n]) != "hello" {
+		t.Fatal("legacy peer received", buf[:n])
+	}
+}
+
+func TestCloseStatus(t *testing.T) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+	k1.SetHello(1, 0, true)
+	k2.SetHello(1, 0, false)
+	// closes returns the IKCP_CMD_CLOSE segments of a datagram, by frg
+	closes := func(p []byte) (announced, answered int) {
+		for len(p) >= IKCP_OVERHEAD {
+			n := IKCP_OVERHEAD + int(binary.LittleEndian.Uint32(p[20:]))
+			if p[4] == IKCP_CMD_CLOSE && p[5] == IKCP_CLOSE_REPLY {
+				answered++
+			} else if p[4] == IKCP_CMD_CLOSE {
+				announced++
+			}
+			p = p[n:]
+		}
+		return
+	}
+
+	// the status follows the data, the first announcement is lost
+	k1.Send(make([]byte, 3000))
+	k1.SetCloseStatus(42, "shutting down")
+	announced, lost := 0, false
+	for i := 0; i < 100 && k1.close_xmit > 0; i++ {
+		current := uint32(i*10 + 1)
+		k1.Update(current)
+		k2.Update(current)
+		for _, p := range q12 {
+			if n, _ := closes(p); n > 0 {
+				if k2.rcv_nxt != k1.snd_nxt {
+					t.Fatal("close status ahead of the data")
+				}
+				if announced += n; !lost {
+					lost = true
+					continue
+				}
+			}
+			k2.Input(p, true)
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = nil, nil
+	}
+	if code, reason, ok := k2.RemoteCloseStatus(); !ok || code != 42 || reason != "shutting down" {
+		t.Fatal(code, reason, ok)
+	}
+	if k1.close_xmit != 0 || announced != 2 {
+		t.Fatal("announced", announced, "times,", k1.close_xmit, "left")
+	}
+	if _, _, ok := k1.RemoteCloseStatus(); ok {
+		t.Fatal("the answer taken for a status")
+	}
+
+	// a retransmission keeps the first status
+	k1.SetCloseStatus(7, "other")
+	k1.Update(2000)
+	for _, p := range q12 {
+		k2.Input(p, true)
+	}
+	if code, _, _ := k2.RemoteCloseStatus(); code != 42 {
+		t.Fatal("status replaced with", code)
+	}
+}
+
+func TestRekeyExchange(t *testing.T) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+	k1.SetHello(1, 0, true)
+	k2.SetHello(1, 0, false)
+	rekeys := func(p []byte) (n int) {
+		for ; len(p) >= IKCP_OVERHEAD; p = p[IKCP_OVERHEAD+int(binary.LittleEndian.Uint32(p[20:])):] {
+			if p[4] == IKCP_CMD_REKEY {
+				n++
+			}
+		}
+		return
+	}
+
+	// the first announcement is lost, the application of k2 answers the second one
+	k1.SetEpoch(3)
+	announced, lost := 0, false
+	for i := 0; i < 100 && !k1.EpochAnswered(); i++ {
+		current := uint32(i*10 + 1)
+		k1.Update(current)
+		k2.Update(current)
+		for _, p := range q12 {
+			if n := rekeys(p); n > 0 {
+				if announced += n; !lost {
+					lost = true
+					continue
+				}
+			}
+			k2.Input(p, true)
+			if epoch := k2.RemoteEpoch(); epoch != 0 {
+				k2.AnswerEpoch(epoch)
+			}
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = nil, nil
+	}
+	if !k1.EpochAnswered() || k1.rekey_xmit != 0 || announced != 2 {
+		t.Fatal("announced", announced, "times,", k1.rekey_xmit, "left")
+	}
+	if epoch := k1.RemoteEpoch(); epoch != 0 {
+		t.Fatal("the answer taken for an announcement of", epoch)
+	}
+
+	// unanswered, the announcements end
+	k1.SetEpoch(4)
+	announced = 0
+	for i := 0; i < 1000; i++ {
+		k1.Update(uint32(2000 + i*10))
+		for _, p := range q12 {
+			announced += rekeys(p)
+		}
+		q12 = nil
+	}
+	if k1.EpochAnswered() || announced != IKCP_REKEY_LIMIT {
+		t.Fatal("announced", announced, "times")
+	}
+}
+
+// memLink carries datagrams between two KCPs without allocating in steady state
+type memLink struct {
+	pkts [][]byte
+	n    int
+}
+
+func (l *memLink) output(buf []byte, size int) {
+	if l.n == len(l.pkts) {
+		l.pkts = append(l.pkts, make([]byte, 0, mtuLimit))
+	}
+	l.pkts[l.n] = append(l.pkts[l.n][:0], buf[:size]...)
+	l.n++
+}
+
+func (l *memLink) deliver(kcp *KCP) {
+	for _, p := range l.pkts[:l.n] {
+		kcp.Input(p, true)
+	}
+	l.n = 0
+}
+
+// sustained transfer between two KCPs, run with -benchmem
+func BenchmarkTransfer(b *testing.B) {
+	var l12, l21 memLink
+	k1 := NewKCP(1, l12.output)
+	k2 := NewKCP(1, l21.output)
+	for _, k := range []*KCP{k1, k2} {
+		k.NoDelay(1, 10, 2, 1)
+		k.WndSize(1024, 1024)
+	}
+
+	msg := make([]byte, 4096)
+	buf := make([]byte, 65536)
+	nrecv := 0
+	current := uint32(0)
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k1.Send(msg)
+		current += 10
+		k1.Update(current)
+		l12.deliver(k2)
+		k2.Update(current)
+		l21.deliver(k1)
+		for {
+			n := k2.Recv(buf)
+			if n < 0 {
+				break
+			}
+			nrecv += n
+		}
+	}
+	if nrecv != b.N*len(msg) {
+		b.Fatal("received", nrecv, "of", b.N*len(msg))
+	}
+}
+
+// clockRun drives two KCPs for 10s of simulated time from start, losing every 7th packet,
+// it returns the messages received in order and the retransmissions by timeout
+func clockRun(t *testing.T, start uint32) (recvd int, xmit uint32) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+
+	msg := make([]byte, 1000)
+	buf := make([]byte, 2000)
+	sent, npkt := 0, 0
+	current := start
+	for step := 0; step < 1000; step++ {
+		if step%10 == 0 {
+			binary.LittleEndian.PutUint32(msg, uint32(sent))
+			k1.Send(msg)
+			sent++
+		}
+		k1.Update(current)
+		k2.Update(current)
+		for _, p := range q12 {
+			if npkt++; npkt%7 != 0 {
+				k2.Input(p, true)
+			}
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = q12[:0], q21[:0]
+		for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+			if seq := binary.LittleEndian.Uint32(buf); seq != uint32(recvd) {
+				t.Fatalf("start %v: got message %v, want %v", start, seq, recvd)
+			}
+			recvd++
+		}
+		current += 10
+	}
+	if k1.rx_rto > IKCP_RTO_DEF {
+		t.Fatalf("start %v: rto %v", start, k1.rx_rto)
+	}
+	return recvd, k1.xmit
+}
+
+// the state machine only depends on time differences, so it runs
+// across the wrap of the 32bit millisecond clock just like anywhere else
+func TestClockWrap(t *testing.T) {
+	recvd, xmit := clockRun(t, 1000)
+	if recvd < 90 {
+		t.Fatal("received", recvd)
+	}
+	for _, start := range []uint32{1<<32 - 5000, 1<<31 - 5000} {
+		if r, x := clockRun(t, start); r != recvd || x != xmit {
+			t.Fatalf("start %v: received %v with %v retransmissions, want %v with %v", start, r, x, recvd, xmit)
+		}
+	}
+}
+
+// seqRun sends messages of 3 segments between two KCPs numbering their segments from
+// start, with every 7th packet lost and every 5th swapped with the one 2 behind, it
+// returns the messages received in order, the stats of the sender and the segments the
+// receiver saw late by the fast resend threshold
+func seqRun(t *testing.T, start uint32) (recvd int, tx TrafficStats, xmit uint32, late uint64) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+	k1.snd_una, k1.snd_nxt = start, start
+	k2.rcv_nxt = start
+	if st := k1.seqStats(); st.ToWrap != 1<<32-uint64(start) {
+		t.Fatalf("start %v: %+v", start, st)
+	}
+
+	msg := make([]byte, 3*int(k1.mss))
+	buf := make([]byte, len(msg))
+	sent, npkt := 0, 0
+	current := uint32(1000)
+	for step := 0; step < 2000; step++ {
+		if step%2 == 0 {
+			binary.LittleEndian.PutUint32(msg, uint32(sent))
+			k1.Send(msg)
+			sent++
+		}
+		k1.Update(current)
+		k2.Update(current)
+		for k := 0; k < len(q12); k++ {
+			if npkt++; npkt%5 == 0 && k+2 < len(q12) {
+				q12[k], q12[k+2] = q12[k+2], q12[k]
+			}
+			if npkt%7 != 0 {
+				k2.Input(q12[k], true)
+			}
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = q12[:0], q21[:0]
+		for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+			if seq := binary.LittleEndian.Uint32(buf); n != len(msg) || seq != uint32(recvd) {
+				t.Fatalf("start %v: got message %v of %v bytes, want %v", start, seq, n, recvd)
+			}
+			recvd++
+		}
+		current += 10
+	}
+	if st := k2.seqStats(); k1.snd_seq != uint64(k1.snd_nxt-start) || st.Received != uint64(k2.rcv_nxt-start) || st.Received != uint64(3*recvd) {
+		t.Fatalf("start %v: sequence numbers sent %v, received %+v, of %v messages", start, k1.snd_seq, st, recvd)
+	}
+	return recvd, k1.tx, k1.xmit, k2.reorder.late
+}
+
+// sequence numbers only compare by their differences, so a transfer crossing the wrap of
+// the 32bit sn runs just like anywhere else, down to every retransmission
+func TestSeqWrap(t *testing.T) {
+	recvd, tx, xmit, late := seqRun(t, 0)
+	if recvd < 900 || tx.RetransSegments == 0 || late == 0 {
+		t.Fatal("received", recvd, "with", tx.RetransSegments, "retransmissions,", late, "late")
+	}
+	for _, start := range []uint32{1<<32 - 1000, 1<<31 - 1000, 1<<32 - 1} {
+		if r, tx2, x, l := seqRun(t, start); r != recvd || tx2 != tx || x != xmit || l != late {
+			t.Fatalf("start %v: received %v, %+v, %v timeouts, %v late, want %v, %+v, %v, %v",
+				start, r, tx2, x, l, recvd, tx, xmit, late)
+		}
+	}
+
+	// the segments received ahead of the gap at the wrap are all acknowledged
+	for _, start := range []uint32{1000, 1<<32 - 2} {
+		var acks []uint32
+		k := NewKCP(1, func(buf []byte, size int) {
+			for p := buf[:size]; len(p) >= IKCP_OVERHEAD; p = p[IKCP_OVERHEAD:] {
+				acks = append(acks, binary.LittleEndian.Uint32(p[12:]))
+			}
+		})
+		k.rcv_nxt = start
+		k.Update(100)
+		for _, d := range []uint32{5, 1, 3} {
+			seg := Segment{conv: 1, cmd: IKCP_CMD_PUSH, wnd: IKCP_WND_RCV, sn: start + d}
+			buf := make([]byte, IKCP_OVERHEAD)
+			seg.encode(buf)
+			k.Input(buf, true)
+		}
+		k.flush()
+		if len(acks) != 3 || acks[0] != start+1 || acks[1] != start+3 || acks[2] != start+5 {
+			t.Fatalf("start %v: acknowledged %v", start, acks)
+		}
+	}
+}
+
+// high priority data goes ahead of queued data, but never in the middle of a Send
+func TestSendHigh(t *testing.T) {
+	for _, stream := range []int32{0, 1} {
+		var q12, q21 [][]byte
+		k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+		k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+		k1.NoDelay(1, 10, 2, 1)
+		k2.NoDelay(1, 10, 2, 1)
+		k1.WndSize(2, 128)
+		k1.stream, k2.stream = stream, stream
+
+		// a fills its segments, as in stream mode b would share the last one
+		a := bytes.Repeat([]byte("a"), 3*int(k1.mss))
+		b := bytes.Repeat([]byte("b"), 100)
+		k1.Send(a)
+		k1.Update(0) // the first two segments of a are sent
+		k1.Send(b)
+		k1.SendHigh([]byte("HI"))
+
+		var got []byte
+		buf := make([]byte, 8192)
+		for current := uint32(10); current < 1000; current += 10 {
+			for _, p := range q12 {
+				k2.Input(p, true)
+			}
+			for _, p := range q21 {
+				k1.Input(p, true)
+			}
+			q12, q21 = q12[:0], q21[:0]
+			k1.Update(current)
+			k2.Update(current)
+			for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+				got = append(got, buf[:n]...)
+			}
+		}
+		if want := string(a) + "HI" + string(b); string(got) != want {
+			t.Fatalf("stream %v: got %q", stream, got)
+		}
+	}
+}
+
+// shrinking the MTU mid-transfer splits queued data again, segments
+// already sent keep their size and the receiver gets every message whole
+func TestSetMtu(t *testing.T) {
+	for _, stream := range []int32{0, 1} {
+		var q12, q21 [][]byte
+		k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+		k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+		k1.NoDelay(1, 10, 2, 1)
+		k2.NoDelay(1, 10, 2, 1)
+		k1.WndSize(4, 128)
+		k2.WndSize(128, 1024)
+		k1.stream, k2.stream = stream, stream
+		if k1.SetMtu(IKCP_MTU_MIN-1) == 0 {
+			t.Fatal("mtu below IKCP_MTU_MIN accepted")
+		}
+
+		var want []byte
+		for i := 0; i < 8; i++ {
+			msg := bytes.Repeat([]byte{byte(i)}, 5000+i)
+			want = append(want, msg...)
+			k1.Send(msg)
+		}
+		k1.Update(0) // the first fragments are sent with the default MTU
+		k1.SendHigh(bytes.Repeat([]byte("H"), 3000))
+		firstNew := k1.snd_nxt
+		if k1.SetMtu(200) != 0 {
+			t.Fatal("SetMtu failed")
+		}
+
+		var got []byte
+		buf := make([]byte, 65536)
+		for current := uint32(10); current < 10000 && len(got) < len(want)+3000; current += 10 {
+			for _, p := range q12 {
+				for seg := p; len(seg) >= IKCP_OVERHEAD; {
+					length := binary.LittleEndian.Uint32(seg[20:])
+					if sn := binary.LittleEndian.Uint32(seg[12:]); seg[4] == IKCP_CMD_PUSH && _itimediff(sn, firstNew) >= 0 && length > k1.mss {
+						t.Fatalf("stream %v: segment %v of %v bytes after SetMtu", stream, sn, length)
+					}
+					seg = seg[IKCP_OVERHEAD+length:]
+				}
+				k2.Input(p, true)
+			}
+			for _, p := range q21 {
+				k1.Input(p, true)
+			}
+			q12, q21 = q12[:0], q21[:0]
+			k1.Update(current)
+			k2.Update(current)
+			for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+				got = append(got, buf[:n]...)
+			}
+		}
+		if len(got) != len(want)+3000 || !bytes.Equal(bytes.Replace(got, bytes.Repeat([]byte("H"), 3000), nil, 1), want) {
+			t.Fatalf("stream %v: received %v bytes of %v", stream, len(got), len(want)+3000)
+		}
+	}
+}
+
+// the windows stay below 32768 segments with a compact header profile, so the 16 bit sn
+// in flight extend unambiguously
+func TestCompactWindow(t *testing.T) {
+	k := NewKCP(1, func([]byte, int) {})
+	k.WndSize(65535, 65535)
+	k.SetHeaderProfile(HeaderCompact, HeaderLegacy)
+	if k.snd_wnd != compactMaxWnd || k.rcv_wnd != compactMaxWnd {
+		t.Fatal("windows", k.snd_wnd, k.rcv_wnd)
+	}
+	k.WndSize(40000, 100)
+	if k.snd_wnd != compactMaxWnd || k.rcv_wnd != 100 {
+		t.Fatal("windows", k.snd_wnd, k.rcv_wnd)
+	}
+	k.SetHeaderProfile(HeaderLegacy, HeaderLegacy)
+	k.WndSize(40000, 40000)
+	if k.snd_wnd != 40000 || k.rcv_wnd != 40000 {
+		t.Fatal("legacy windows", k.snd_wnd, k.rcv_wnd)
+	}
+
+	// more segments in flight than the compact sn tell apart behind a lost one, those
+	// beyond would be taken for old ones and sent again
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	for _, k := range []*KCP{k1, k2} {
+		k.NoDelay(1, 10, 0, 1)
+		k.WndSize(65535, 65535)
+		k.SetHeaderProfile(HeaderCompact, HeaderCompact)
+	}
+	const msgs = 40000
+	lost := uint16(1) // the sn of the first message after the one opening the window
+	next, pushes := -1, 0
+	buf := make([]byte, 64)
+	for current := uint32(10); current < 100000 && next < msgs; current += 10 {
+		for _, p := range q12 {
+			for seg := p[4:]; len(seg) >= compactOverhead; seg = seg[compactOverhead+int(binary.LittleEndian.Uint16(seg[10:])):] {
+				if seg[0] == compactFlag|IKCP_CMD_PUSH {
+					pushes++
+				}
+			}
+			if current < 1000 && p[4] == compactFlag|IKCP_CMD_PUSH && binary.LittleEndian.Uint16(p[10:]) == lost {
+				continue
+			}
+			k2.Input(p, true)
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = q12[:0], q21[:0]
+		if current == 10 {
+			k1.Send([]byte("open"))
+		}
+		k1.Update(current)
+		k2.Update(current)
+		for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+			if next < 0 {
+				for i := 0; i < msgs; i++ {
+					var msg [8]byte
+					binary.LittleEndian.PutUint64(msg[:], uint64(i))
+					k1.Send(msg[:])
+				}
+			} else if n != 8 || binary.LittleEndian.Uint64(buf) != uint64(next) {
+				t.Fatalf("message %v of %v bytes, want %v", binary.LittleEndian.Uint64(buf), n, next)
+			}
+			next++
+		}
+	}
+	if next != msgs || pushes > msgs+msgs/10 {
+		t.Fatal("received", next, "of", msgs, "in", pushes, "segments")
+	}
+}
+
+// segments in flight are split again for a smaller mtu only if none reached the peer
+func TestResplit(t *testing.T) {
+	setup := func(stream int32) (*KCP, *[][]byte, []byte) {
+		var q [][]byte
+		kcp := NewKCP(1, func(buf []byte, size int) { q = append(q, append([]byte(nil), buf[:size]...)) })
+		kcp.NoDelay(1, 10, 2, 1)
+		kcp.stream = stream
+		var want []byte
+		for i := 0; i < 4; i++ {
+			msg := bytes.Repeat([]byte{byte(i)}, 2*int(kcp.mss)) // datagrams of the full mtu
+			want = append(want, msg...)
+			kcp.Send(msg)
+		}
+		kcp.Update(0)
+		q = q[:0] // lost
+		kcp.SetMtu(600)
+		return kcp, &q, want
+	}
+
+	// the peer holds a segment behind snd_una, or may hold one sent in a smaller datagram
+	kcp, _, _ := setup(0)
+	kcp.Input(ikcpSegment(1, IKCP_CMD_ACK, 0, 128, 0, 2, 0, nil), true)
+	nxt := kcp.snd_nxt
+	if kcp.resplit(); kcp.snd_nxt != nxt || len(kcp.snd_buf[0].data) <= int(kcp.mss) {
+		t.Fatal("split with a segment acknowledged", kcp.snd_nxt, nxt)
+	}
+	kcp, _, _ = setup(0)
+	kcp.snd_buf[3].dgram = 300 // packed alone, the others in datagrams of the full mtu
+	if kcp.resplit(); kcp.snd_nxt != nxt {
+		t.Fatal("split with a segment sent in a small datagram")
+	}
+
+	for _, stream := range []int32{0, 1} {
+		kcp, q12, want := setup(stream)
+		una := kcp.snd_una
+		kcp.resplit()
+		for k := range kcp.snd_buf {
+			if seg := &kcp.snd_buf[k]; seg.sn != una+uint32(k) || len(seg.data) > int(kcp.mss) || seg.xmit != 0 {
+				t.Fatalf("stream %v: segment %v of %v bytes, sn %v", stream, k, len(seg.data), seg.sn)
+			}
+		}
+
+		var q21 [][]byte
+		peer := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+		peer.NoDelay(1, 10, 2, 1)
+		peer.stream = stream
+		var got []byte
+		buf := make([]byte, 65536)
+		for current := uint32(10); current < 10000 && len(got) < len(want); current += 10 {
+			for _, p := range *q12 {
+				peer.Input(p, true)
+			}
+			for _, p := range q21 {
+				kcp.Input(p, true)
+			}
+			*q12, q21 = (*q12)[:0], q21[:0]
+			kcp.Update(current)
+			peer.Update(current)
+			for n := peer.Recv(buf); n > 0; n = peer.Recv(buf) {
+				if stream == 0 && n != 2*(IKCP_MTU_DEF-IKCP_OVERHEAD) {
+					t.Fatalf("stream %v: a message of %v bytes", stream, n)
+				}
+				got = append(got, buf[:n]...)
+			}
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("stream %v: received %v bytes of %v", stream, len(got), len(want))
+		}
+	}
+}
+
+// the retransmissions of a segment whose every transmission is lost follow the backoff
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		factor float64
+		linear bool
+		want   []uint32
+	}{
+		{0, false, []uint32{0, 200, 500, 900, 1400}},      // default with nodelay, adding rto/2
+		{1, true, []uint32{0, 200, 600, 1200, 2000}},      // adding rto
+		{2, false, []uint32{0, 200, 600, 1400, 3000}},     // doubling
+		{10, false, []uint32{0, 200, 2200, 22200, 82200}}, // capped by IKCP_RTO_MAX
+		{1.5, false, []uint32{0, 200, 500, 950, 1630}},    // due at 1625, sent by the next update
+		{0.5, true, []uint32{0, 200, 500, 900, 1400}},     // same as the default
+	}
+	for _, c := range cases {
+		var sent []uint32
+		var current uint32
+		k := NewKCP(1, func(buf []byte, size int) {
+			if buf[4] == IKCP_CMD_PUSH {
+				sent = append(sent, current)
+			}
+		})
+		k.NoDelay(1, 10, 0, 1)
+		if k.SetBackoff(c.factor, c.linear) != 0 {
+			t.Fatal("factor", c.factor, "rejected")
+		}
+		k.Send([]byte("lost"))
+		for ; len(sent) < len(c.want); current += 10 {
+			k.Update(current)
+		}
+		for i := range c.want {
+			if sent[i] != c.want[i] {
+				t.Fatal("factor", c.factor, "linear", c.linear, "sent at", sent, "want", c.want)
+			}
+		}
+	}
+
+	k := NewKCP(1, func(buf []byte, size int) {})
+	if k.SetBackoff(0.5, false) == 0 || k.SetBackoff(-1, true) == 0 {
+		t.Fatal("shrinking backoff accepted")
+	}
+}
+
+// the age bound and the retries compose as whichever is reached first, the age bound
+// trips between transmissions
+func TestMaxRetransmitDuration(t *testing.T) {
+	cases := []struct {
+		retries  uint32
+		maxAge   time.Duration
+		cause    int
+		deadFrom uint32 // ms
+	}{
+		{IKCP_DEADLINK, 1500 * time.Millisecond, DeadByAge, 1500}, // doubling rtos, sent at 1400 and 3000
+		{3, time.Minute, DeadByRetries, 600},                      // the third transmission, sent at 600
+		{3, 0, DeadByRetries, 600},                                // the retries alone
+	}
+	for _, c := range cases {
+		var current uint32
+		conn := new(KCPConn) // not updated by the updater, the test drives the clock
+		conn.init(NewKCP(1, func(buf []byte, size int) {}), func([][]byte) {})
+		k := conn.kcp
+		k.NoDelay(1, 10, 0, 1)
+		k.SetBackoff(2, false)
+		k.dead_link, k.dead_time = c.retries, 0
+		if conn.SetMaxRetransmitDuration(-time.Second) == nil {
+			t.Fatal("negative duration accepted")
+		}
+		conn.SetMaxRetransmitDuration(c.maxAge)
+		k.Send([]byte("lost"))
+		for ; k.state != 0xFFFFFFFF && current < 10000; current += 10 {
+			k.Update(current)
+		}
+		stats := conn.deadLinkStats()
+		if dead := current - 10; dead != c.deadFrom || stats.Cause != c.cause {
+			t.Fatal("dead at", dead, "cause", stats.Cause, "want", c.deadFrom, c.cause)
+		}
+		if stats.MaxRetransmit != c.maxAge || stats.Retries != int(c.retries) || stats.OldestAge != time.Duration(c.deadFrom)*time.Millisecond {
+			t.Fatalf("%+v", stats)
+		}
+		k.resetDeadLink()
+		if stats := conn.deadLinkStats(); stats.Cause != 0 || stats.OldestAge != 0 || stats.MaxXmit != 1 {
+			t.Fatalf("after reset %+v", stats)
+		}
+	}
+}
+
+// bottleneckRun sends for 5s of simulated time over a path of 20ms each way whose
+// bottleneck forwards a packet per ms from a queue of 8, with an outage at 1s for 300ms.
+// The window of 128 segments isn't held back by the congestion window. It returns the
+// bytes received, the rtos of the sender and the ms it spent recovering from them.
+func bottleneckRun(burst int) (recvd int, rtos, recovery uint64) {
+	type packet struct {
+		due  uint32
+		data []byte
+	}
+	var queue [][]byte
+	var wire12, wire21 []packet
+	var current uint32
+	k1 := NewKCP(1, func(buf []byte, size int) {
+		if len(queue) < 8 && (current < 1000 || current >= 1300) {
+			queue = append(queue, append([]byte(nil), buf[:size]...))
+		}
+	})
+	k2 := NewKCP(1, func(buf []byte, size int) {
+		wire21 = append(wire21, packet{current + 20, append([]byte(nil), buf[:size]...)})
+	})
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+	k1.WndSize(128, 128)
+	k2.WndSize(128, 128)
+	if k1.SetRecoveryBurst(burst) != 0 {
+		panic("burst rejected")
+	}
+
+	msg := make([]byte, 1000)
+	buf := make([]byte, 2000)
+	for ; current < 5000; current++ {
+		for k1.WaitSnd() < 256 {
+			k1.Send(msg)
+		}
+		if len(queue) > 0 {
+			wire12 = append(wire12, packet{current + 20, queue[0]})
+			queue = queue[1:]
+		}
+		for ; len(wire12) > 0 && wire12[0].due <= current; wire12 = wire12[1:] {
+			k2.Input(wire12[0].data, true)
+		}
+		for ; len(wire21) > 0 && wire21[0].due <= current; wire21 = wire21[1:] {
+			k1.Input(wire21[0].data, true)
+		}
+		k1.Update(current)
+		k2.Update(current)
+		for n := k2.Recv(buf); n > 0; n = k2.Recv(buf) {
+			recvd += n
+		}
+	}
+	return recvd, k1.rtos, k1.rto_time
+}
+
+// after an rto, the whole window is resent at once and overflows a small bottleneck
+// queue again, capped retransmissions recover sooner and deliver more
+func TestRecoveryBurst(t *testing.T) {
+	recvd, rtos, recovery := bottleneckRun(0)
+	cappedRecvd, cappedRtos, cappedRecovery := bottleneckRun(2)
+	t.Log("uncapped", recvd, "bytes", rtos, "rtos", recovery, "ms recovering")
+	t.Log("capped", cappedRecvd, "bytes", cappedRtos, "rtos", cappedRecovery, "ms recovering")
+	if rtos == 0 || cappedRtos == 0 {
+		t.Fatal("no rto")
+	}
+	if cappedRecvd <= recvd {
+		t.Fatal("capped goodput", cappedRecvd, "uncapped", recvd)
+	}
+	if cappedRecovery/cappedRtos >= recovery/rtos {
+		t.Fatal("capped recovery", cappedRecovery/cappedRtos, "ms uncapped", recovery/rtos, "ms")
+	}
+
+	k := NewKCP(1, func(buf []byte, size int) {})
+	if k.SetRecoveryBurst(-1) == 0 {
+		t.Fatal("negative burst accepted")
+	}
+}
+
+// a receiver whose application reads slowly holds at most rcv_wnd segments, even if
+// the sender ignores the window, and still gets all data in order
+func TestSlowReader(t *testing.T) {
+	var q12, q21 [][]byte
+	k1 := NewKCP(1, func(buf []byte, size int) { q12 = append(q12, append([]byte(nil), buf[:size]...)) })
+	k2 := NewKCP(1, func(buf []byte, size int) { q21 = append(q21, append([]byte(nil), buf[:size]...)) })
+	k1.NoDelay(1, 10, 2, 1)
+	k2.NoDelay(1, 10, 2, 1)
+	k1.WndSize(1024, 1024)
+	k2.WndSize(32, 32)
+
+	const msgs = 300
+	msg := make([]byte, 1000)
+	for i := 0; i < msgs; i++ {
+		binary.LittleEndian.PutUint32(msg, uint32(i))
+		k1.Send(msg)
+	}
+	buf := make([]byte, 2000)
+	recvd, npkt := 0, 0
+	for current := uint32(0); current < 30000 && recvd < msgs; current += 10 {
+		k1.rmt_wnd = 1024 // ignore the window of the receiver
+		k1.Update(current)
+		k2.Update(current)
+		for _, p := range q12 {
+			if npkt++; npkt%5 != 0 {
+				k2.Input(p, true)
+			}
+		}
+		for _, p := range q21 {
+			k1.Input(p, true)
+		}
+		q12, q21 = q12[:0], q21[:0]
+		if n := k2.WaitRcv(); n > 32 {
+			t.Fatal("holding", n, "segments")
+		}
+		if current%100 == 0 { // a message every 100ms
+			if n := k2.Recv(buf); n > 0 {
+				if seq := binary.LittleEndian.Uint32(buf); seq != uint32(recvd) {
+					t.Fatal("got message", seq, "want", recvd)
+				}
+				recvd++
+			}
+		}
+	}
+	if recvd != msgs {
+		t.Fatal("received", recvd, "of", msgs)
+	}
+}
+
+func TestMultiSegmentInput(t *testing.T) {
+	k := NewKCP(1, func(buf []byte, size int) {})
+	k.NoDelay(0, 10, 0, 1)
+	k.Send([]byte("out"))
+	k.Update(0)
+	segment := func(conv, cmd, sn uint32, data string) []byte {
+		seg := Segment{conv: conv, cmd: cmd, wnd: 32, sn: sn, una: 1, data: []byte(data)}
+		buf := make([]byte, IKCP_OVERHEAD)
+		seg.encode(buf)
+		return append(buf, data...)
+	}
+	join := func(segs ...[]byte) (p []byte) {
+		for _, seg := range segs {
+			p = append(p, seg...)
+		}
+		return p
+	}
+	recv := func(want ...string) {
+		buf := make([]byte, 100)
+		for _, w := range want {
+			if n := k.Recv(buf); n < 0 || string(buf[:n]) != w {
+				t.Fatalf("got %q, want %q", buf[:n], w)
+			}
+		}
+		if n := k.Recv(buf); n >= 0 {
+			t.Fatalf("got %q", buf[:n])
+		}
+	}
+
+	// every segment of a datagram is taken
+	p := join(segment(1, IKCP_CMD_ACK, 0, ""),
+		segment(1, IKCP_CMD_PUSH, 0, "a"),
+		segment(1, IKCP_CMD_PUSH, 1, "b"),
+		segment(1, IKCP_CMD_PUSH, 2, "c"))
+	if ret := k.Input(p, true); ret != 0 {
+		t.Fatal("input", ret)
+	}
+	if k.snd_una != 1 || len(k.acklist) != 3 {
+		t.Fatal("snd_una", k.snd_una, "acks", len(k.acklist))
+	}
+	recv("a", "b", "c")
+
+	// the segments ahead of a truncated or foreign one too
+	cases := []struct {
+		tail []byte
+		ret  int
+	}{
+		{segment(1, IKCP_CMD_PUSH, 4, "truncated")[:IKCP_OVERHEAD+2], -2},
+		{segment(1, IKCP_CMD_PUSH, 4, "truncated")[:IKCP_OVERHEAD-4], -2},
+		{segment(2, IKCP_CMD_PUSH, 4, "foreign"), -1},
+		{segment(1, 99, 4, "unknown"), -3},
+	}
+	for i, c := range cases {
+		sn := uint32(3 + i)
+		msg := string(rune('d' + i))
+		if ret := k.Input(join(segment(1, IKCP_CMD_PUSH, sn, msg), c.tail), true); ret != c.ret {
+			t.Fatal("case", i, "input", ret)
+		}
+		if k.rcv_nxt != sn+1 {
+			t.Fatal("case", i, "rcv_nxt", k.rcv_nxt)
+		}
+		recv(msg)
+	}
+}
+
+func TestUnknownCommands(t *testing.T) {
+	segment := func(cmd uint8, sn uint32, data string) []byte {
+		seg := Segment{conv: 1, cmd: uint32(cmd), wnd: 7, sn: sn, una: 0, data: []byte(data)}
+		buf := make([]byte, IKCP_OVERHEAD)
+		seg.encode(buf)
+		return append(buf, data...)
+	}
+	// a kcp with data in flight, out of order data received and acks to send
+	newKCP := func() *KCP {
+		k := NewKCP(1, func(buf []byte, size int) {})
+		k.NoDelay(1, 10, 2, 1)
+		k.Send([]byte("out"))
+		k.Update(0)
+		k.Input(segment(IKCP_CMD_PUSH, 1, "b"), true)
+		return k
+	}
+	// the state Input may change, as DeepEqual tells funcs apart unless nil
+	state := func(k *KCP) KCP {
+		s := *k
+		s.output = nil
+		return s
+	}
+
+	known := map[uint8]bool{IKCP_CMD_PUSH: true, IKCP_CMD_ACK: true, IKCP_CMD_WASK: true, IKCP_CMD_WINS: true}
+	for cmd := 0; cmd < 256; cmd++ {
+		if known[uint8(cmd)] {
+			continue
+		}
+		reserved := cmd >= IKCP_CMD_EXT_MIN && cmd <= IKCP_CMD_EXT_MAX
+		k := newKCP()
+		before := state(k)
+		unknown := atomic.LoadUint64(&DefaultSnmp.KCPUnknownCmds)
+		ret := k.Input(segment(uint8(cmd), 0, "x"), true)
+		if reserved && ret != 0 || !reserved && ret != -3 {
+			t.Fatal("cmd", cmd, "input", ret)
+		}
+		if !reflect.DeepEqual(state(k), before) {
+			t.Fatal("cmd", cmd, "changed the state")
+		}
+		// keepalive pings are known, and skipped
+		if counted := atomic.LoadUint64(&DefaultSnmp.KCPUnknownCmds) != unknown; counted != (cmd != IKCP_CMD_PING) {
+			t.Fatal("cmd", cmd, "counted", counted)
+		}
+
+		// the segments behind a reserved command are taken, not those behind others
+		k = newKCP()
+		k.Input(append(segment(uint8(cmd), 0, "x"), segment(IKCP_CMD_PUSH, 0, "a")...), true)
+		if got := k.rcv_nxt == 2; got != reserved {
+			t.Fatal("cmd", cmd, "rcv_nxt", k.rcv_nxt)
+		}
+	}
+
+	// IKCP_CMD_HELLO is taken once negotiation is enabled
+	k := newKCP()
+	k.SetHello(1, 0, false)
+	if k.Input(segment(IKCP_CMD_HELLO, 0, "\x01\x00"), true) != 0 || k.rmt_hello != 0x100 {
+		t.Fatal("hello not taken, remote", k.rmt_hello)
+	}
+}
@@ -0,0 +1,135 @@
+package kcp
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// lanIdle is the longest a connection in LAN mode sleeps without a timer due, for the
+// housekeeping of keepalives, key rotations and the like
+const lanIdle = time.Second
+
+// lanState is the state of LAN mode, protected by mu, see SetLANMode
+type lanState struct {
+	enabled   bool
+	gap       time.Duration // between flushes at least
+	lastFlush time.Time
+	saved     struct { // the settings LAN mode replaced
+		nodelay, interval, minrto uint32
+		ackNoDelay                bool
+	}
+}
+
+// SetLANMode drives the connection by events only, for links with round trips well
+// below a millisecond, where the update interval dominates the latency. Writes and
+// acknowledgements are flushed at once, the retransmission timeout follows the round
+// trip down to 1ms, and the connection is updated when one of its timers is due, to
+// the microsecond, rather than every interval; an idle connection wakes once a second.
+// minGap keeps the flushes at least that far apart, a flush due earlier waits for the
+// end of the gap, so a burst of small Writes is batched rather than spinning; 0 puts
+// no bound. Disabling it restores the settings of SetNoDelay and SetACKNoDelay. It's
+// safe at any time.
+func (c *KCPConn) SetLANMode(enable bool, minGap time.Duration) error {
+	if minGap < 0 {
+		return errors.New(errInvalidOperation)
+	}
+	c.mu.Lock()
+	lan := &c.lan
+	kcp := c.kcp
+	switch {
+	case enable && !lan.enabled:
+		lan.saved.nodelay, lan.saved.interval, lan.saved.minrto = kcp.nodelay, kcp.interval, kcp.rx_minrto
+		lan.saved.ackNoDelay = c.ackNoDelay
+		kcp.nodelay, kcp.interval, kcp.rx_minrto = 1, 1, 1
+		c.ackNoDelay = true
+	case !enable && lan.enabled:
+		kcp.nodelay, kcp.interval, kcp.rx_minrto = lan.saved.nodelay, lan.saved.interval, lan.saved.minrto
+		c.ackNoDelay = lan.saved.ackNoDelay
+		kcp.ts_flush = currentMs()
+	}
+	lan.enabled, lan.gap = enable, minGap
+	c.mu.Unlock()
+	updater.reschedule(c, time.Now())
+	return nil
+}
+
+// SetLANMode is KCPConn.SetLANMode, sessions of NewManualSession schedule themselves
+// and can't use it
+func (s *UDPSession) SetLANMode(enable bool, minGap time.Duration) error {
+	if s.manual != nil {
+		return errors.New(errInvalidOperation)
+	}
+	return s.KCPConn.SetLANMode(enable, minGap)
+}
+
+// eventFlush flushes kcp at current on a Write or an input, c.mu must be held. In LAN
+// mode within the gap after the last flush, it returns when the updater is to flush
+// instead.
+func (c *KCPConn) eventFlush(current uint32) (deferred time.Time) {
+	if c.lan.enabled && c.lan.gap > 0 {
+		now := time.Now()
+		if next := c.lan.lastFlush.Add(c.lan.gap); now.Before(next) {
+			return next
+		}
+		c.lan.lastFlush = now
+	}
+	c.kcp.current = current
+	c.kcp.flush()
+	return time.Time{}
+}
+
+// updateLAN is updateKCP in LAN mode, it flushes and returns the delay until the
+// earliest timer of kcp is due, c.mu must be held
+func (c *KCPConn) updateLAN(current uint32) time.Duration {
+	now := time.Now()
+	c.kcp.current = current
+	c.kcp.updated = 1 // flush is a no-op before the first update
+	c.kcp.flush()
+	c.lan.lastFlush = now
+
+	delay := lanIdle
+	if due, ok := c.kcp.nextTimer(current); ok {
+		delay = epoch.Add(time.Duration(due) * time.Millisecond).Sub(now)
+	}
+	if delay < c.lan.gap {
+		delay = c.lan.gap
+	}
+	if delay <= 0 { // due within the millisecond flushed
+		delay = time.Millisecond
+	}
+	return delay
+}
+
+// nextTimer returns the kcp time the earliest timer is due at: a retransmission, the
+// bound of SetMaxRetransmitDuration, a window probe, or the announce of the capabilities or of the close status, or false if
+// none is running. Acknowledgements and probes pending are due at once.
+func (kcp *KCP) nextTimer(current uint32) (due uint32, ok bool) {
+	if len(kcp.acklist) > 0 || kcp.probe != 0 {
+		return current, true
+	}
+	earliest := func(ts uint32) {
+		if !ok || _itimediff(ts, due) < 0 {
+			due, ok = ts, true
+		}
+	}
+	if !kcp.paused {
+		for k := range kcp.snd_buf {
+			seg := &kcp.snd_buf[k]
+			earliest(seg.resendts)
+			if kcp.dead_age > 0 && seg.xmit > 0 {
+				earliest(seg.sendts + kcp.dead_age)
+			}
+		}
+	}
+	if kcp.rmt_wnd == 0 && kcp.ts_probe != 0 {
+		earliest(kcp.ts_probe)
+	}
+	if kcp.hello != 0 && kcp.hello_xmit > 0 {
+		earliest(kcp.hello_ts)
+	}
+	if kcp.close_xmit > 0 {
+		earliest(kcp.close_ts)
+	}
+	return due, ok
+}
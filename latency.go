@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"math/bits"
+	"time"
+)
+
+// latencyBuckets of latencyHist, 4 per doubling from 4µs, the last one takes
+// everything from about 30s
+const latencyBuckets = 96
+
+// latencyHist aggregates the latencies of messages, protected by the lock of the connection
+type latencyHist struct {
+	n        uint64
+	sum      time.Duration
+	min, max time.Duration
+	buckets  [latencyBuckets]uint32
+}
+
+// latencyBucket returns the bucket of d: the first 4 are 1µs wide, then every
+// doubling is split in 4 buckets
+func latencyBucket(d time.Duration) int {
+	us := uint64(d / time.Microsecond)
+	if us < 4 {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 3
+	k := shift*4 + int(us>>uint(shift))
+	if k >= latencyBuckets {
+		k = latencyBuckets - 1
+	}
+	return k
+}
+
+// latencyBound returns the upper bound of bucket k
+func latencyBound(k int) time.Duration {
+	if k < 4 {
+		return time.Duration(k+1) * time.Microsecond
+	}
+	shift := uint(k/4 - 1)
+	return time.Duration(k%4+5) << shift * time.Microsecond
+}
+
+func (h *latencyHist) add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.n++
+	h.sum += d
+	h.buckets[latencyBucket(d)]++
+}
+
+func (h *latencyHist) stats() (stats LatencyStats) {
+	if h.n == 0 {
+		return stats
+	}
+	stats.Count = h.n
+	stats.Min, stats.Max = h.min, h.max
+	stats.Avg = h.sum / time.Duration(h.n)
+	rank := h.n - h.n/100 // the p99 is the rank-th smallest latency
+	var seen uint64
+	for k := range h.buckets {
+		if seen += uint64(h.buckets[k]); seen >= rank {
+			stats.P99 = latencyBound(k)
+			break
+		}
+	}
+	if stats.P99 > h.max {
+		stats.P99 = h.max
+	}
+	return stats
+}
+
+// LatencyStats aggregates the time messages spend in one part of a session. P99 is
+// rounded up to a histogram bucket, within 25% of the exact value.
+type LatencyStats struct {
+	Count              uint64 // messages measured
+	Min, Avg, P99, Max time.Duration
+}
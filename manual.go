@@ -0,0 +1,169 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// manualState is the state of a session driven by the application, owned by the
+// goroutine calling Drive and InjectPacket
+type manualState struct {
+	next    time.Time // when Drive has work to do again, protected by the lock of the session
+	scratch []byte    // scratch space of decodePacket
+}
+
+// manualListener is the state of a listener driven by the application, the sessions
+// map of the listener is owned by the goroutine calling Dispatch
+type manualListener struct {
+	scratch []byte // scratch space of openPacket
+	spare   []byte // see openEpochs
+	mu      sync.Mutex
+	dead    []*UDPSession // released sessions to remove from the map, protected by mu
+}
+
+// release queues a released session for removal from the map by Dispatch
+func (m *manualListener) release(s *UDPSession) {
+	m.mu.Lock()
+	m.dead = append(m.dead, s)
+	m.mu.Unlock()
+}
+
+// NewManualSession establishes a client session over conn without any goroutine of its
+// own, for event loops running many sessions. The application calls Drive when it's
+// due, hands the datagrams its socket reader gets from raddr to InjectPacket, and
+// reads and writes with TryRead and TryWrite, which never wait. Packets are written to
+// conn on the goroutine calling these methods, and Close leaves conn open, so sessions
+// may share it.
+func NewManualSession(raddr string, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+
+	s := makeUDPSession(ConvSource(), dataShards, parityShards, nil, conn, udpaddr, block)
+	s.manual = &manualState{scratch: make([]byte, mtuLimit+nonceSize)}
+	return s, nil
+}
+
+// Drive updates a session of NewManualSession or NewManualListener at now, the time
+// of the event loop: the retransmissions, acknowledgements and probes due are sent.
+// It returns when to call it next, calls ahead of it return at once. Once the session
+// is closed and done sending the data written before, Drive fails.
+func (s *UDPSession) Drive(now time.Time) (next time.Time, err error) {
+	m := s.manual
+	if m == nil {
+		return time.Time{}, errors.New(errInvalidOperation)
+	}
+	s.mu.Lock()
+	due := m.next
+	s.mu.Unlock()
+	if now.Before(due) {
+		return due, nil
+	}
+	interval, ok := s.update()
+	if !ok {
+		return time.Time{}, ErrClosed
+	}
+	next = now.Add(interval)
+	s.mu.Lock()
+	m.next = next
+	s.mu.Unlock()
+	return next, nil
+}
+
+// NextUpdate returns when Drive has work to do again for a session driven by the
+// application, so event loops can keep their timers without calling Drive. It's zero
+// before the first Drive, and for sessions the package drives itself.
+func (s *UDPSession) NextUpdate() time.Time {
+	if s.manual == nil {
+		return time.Time{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manual.next
+}
+
+// InjectPacket feeds a datagram from the peer to a session of NewManualSession, the
+// datagram is decrypted in place. It fails if the datagram is rejected, see Stats.
+func (s *UDPSession) InjectPacket(data []byte) error {
+	if s.manual == nil {
+		return errors.New(errInvalidOperation)
+	}
+	if !s.packetInput(data, s.remote, s.manual.scratch) {
+		return errors.New(errInvalidPacket)
+	}
+	return nil
+}
+
+// NewManualListener serves KCP over conn without any goroutine of its own, for event
+// loops running many sessions. The application reads conn and hands every datagram to
+// Dispatch, which creates the sessions of new peers, queued for Accept as usual. The
+// sessions are driven like those of NewManualSession: Drive when they're due, TryRead
+// and TryWrite, and packets are written to conn on the goroutine calling them. Close
+// leaves conn open, and Import fails.
+func NewManualListener(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	l := newListener(block, dataShards, parityShards, conn)
+	l.manual = &manualListener{scratch: make([]byte, mtuLimit+nonceSize)}
+	return l, nil
+}
+
+// Dispatch feeds a datagram from addr to its session of a listener of
+// NewManualListener, the datagram is decrypted in place. Only one goroutine may call
+// it at a time. It fails if the datagram is rejected, see Stats.
+func (l *Listener) Dispatch(addr net.Addr, data []byte) error {
+	m := l.manual
+	if m == nil {
+		return errors.New(errInvalidOperation)
+	}
+	select {
+	case <-l.die:
+		return errors.New(errBrokenPipe)
+	default:
+	}
+
+	m.mu.Lock()
+	dead := m.dead
+	m.dead = nil
+	m.mu.Unlock()
+	for _, s := range dead {
+		l.forget(s)
+	}
+
+	size := len(data)
+	token, _ := l.token.Load().(*packetToken)
+	compact := atomic.LoadInt32(&l.compact) != 0
+	var plain bool
+	if l.block != nil { // ahead of the decryption in place
+		_, plain = plainPacket(data, l.fec != nil)
+	}
+	reason, ok := checkPacket(l.block, token, compact, l.headerSize, data)
+	var summed bool
+	var block BlockCrypt
+	if ok && l.block == nil {
+		if atomic.LoadInt32(&l.checksum) != 0 {
+			data, summed = stripChecksum(data)
+		}
+	} else if ok {
+		padded := l.padded()
+		if data, block, ok = l.openFrom(addr, token != nil, compact, padded, data, m.scratch, &m.spare); !ok {
+			reason = rejectChecksum
+		}
+	}
+	if !ok {
+		l.reject(reason)
+		if s, found := l.sessions[addr.String()]; found {
+			s.rejected(reason, size)
+		} else {
+			l.mismatches.failed(addr, plain, l.block != nil)
+		}
+		return errors.New(errInvalidPacket)
+	}
+	if !l.packetInput(data, addr, size, summed, block) {
+		return errors.New(errInvalidPacket)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	sessionStateVersion = 1 // format of Export
+	errInvalidState     = "invalid session state"
+)
+
+// flags of sessionHeader
+const (
+	stateMidSend    = 1 << iota // kcp.snd_midsend
+	stateMidHigh                // kcp.snd_midhigh
+	stateAckNoDelay             // KCPConn.ackNoDelay
+)
+
+// sessionHeader is the fixed size part of an exported session, it's followed by the
+// segments of snd_buf, snd_queue_hi, snd_queue, rcv_buf and rcv_queue, then by the data
+// received and not read yet
+type sessionHeader struct {
+	Version                      uint8
+	Flags                        uint8
+	DataShards, ParityShards     uint16
+	Conv, SndUna, SndNxt, RcvNxt uint32
+	Mtu                          uint32 // datagram mtu
+	SndWnd, RcvWnd, RmtWnd       uint32
+	Cwnd, Incr, Ssthresh         uint32
+	Srtt, Rttval, Rto, MinRto    uint32
+	NoDelay, Interval            uint32
+	FastResend, NoCwnd, Stream   int32
+	Hello, RmtHello              uint32
+	FECNext                      uint32 // seqid of the next FEC group
+	Counter                      uint64 // packet counter of the compact nonce format
+}
+
+// flags of segmentHeader
+const (
+	segmentEow = 1 << iota // Segment.eow
+	segmentBow             // Segment.bow
+)
+
+// segmentHeader precedes the data of an exported segment
+type segmentHeader struct {
+	Sn, Frg uint32
+	Flags   uint8
+	Len     uint16
+}
+
+// sessionState is a decoded export
+type sessionState struct {
+	sessionHeader
+	queues   [5][]Segment // data points into the export
+	sockbuff []byte
+}
+
+// Export returns the state of the session for Listener.Import, to move it to another
+// process behind the same address: conv, sequence numbers, windows, rtt estimates,
+// negotiated capabilities, and the data queued in both directions.
+// Pending acknowledgements aren't exported, the peer retransmits the segments.
+// Keys, packet tokens and FEC are configured on the importing listener like on this one.
+// The session keeps running, it should be closed and no longer written to. A session
+// past its first key epoch, or announcing the next one, can't be exported, see SetRekey,
+// nor one with SetStreamChecksum.
+func (s *UDPSession) Export() ([]byte, error) {
+	s.bufmu.Lock()
+	defer s.bufmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return nil, ErrClosed
+	}
+	if s.epochKeys() != nil || s.txCheck != nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	s.releaseWrites()
+
+	kcp := s.kcp
+	h := sessionHeader{
+		Version:    sessionStateVersion,
+		Conv:       kcp.conv,
+		SndUna:     kcp.snd_una,
+		SndNxt:     kcp.snd_nxt,
+		RcvNxt:     kcp.rcv_nxt,
+		Mtu:        uint32(s.wireMtu()), // the peer doesn't announce its mtu to the importer
+		SndWnd:     kcp.snd_wnd,
+		RcvWnd:     kcp.rcv_wnd,
+		RmtWnd:     kcp.rmt_wnd,
+		Cwnd:       kcp.cwnd,
+		Incr:       kcp.incr,
+		Ssthresh:   kcp.ssthresh,
+		Srtt:       kcp.rx_srtt,
+		Rttval:     kcp.rx_rttval,
+		Rto:        kcp.rx_rto,
+		MinRto:     kcp.rx_minrto,
+		NoDelay:    kcp.nodelay,
+		Interval:   kcp.interval,
+		FastResend: kcp.fastresend,
+		NoCwnd:     kcp.nocwnd,
+		Stream:     kcp.stream,
+		Hello:      kcp.hello,
+		RmtHello:   kcp.rmt_hello,
+		Counter:    s.counter,
+	}
+	if kcp.snd_midsend {
+		h.Flags |= stateMidSend
+	}
+	if kcp.snd_midhigh {
+		h.Flags |= stateMidHigh
+	}
+	if s.ackNoDelay {
+		h.Flags |= stateAckNoDelay
+	}
+	if s.fec != nil {
+		h.DataShards, h.ParityShards = uint16(s.fec.dataShards), uint16(s.fec.parityShards)
+		// the importer starts a new group, after the one being filled
+		h.FECNext = s.fec.next
+		if s.fecCnt > 0 {
+			h.FECNext += uint32(s.fec.shardSize - s.fecCnt)
+		}
+		if h.FECNext >= s.fec.paws {
+			h.FECNext = 0
+		}
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &h)
+	for _, q := range [][]Segment{kcp.snd_buf, kcp.snd_queue_hi, kcp.snd_queue, kcp.rcv_buf, kcp.rcv_queue} {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(q)))
+		for k := range q {
+			sh := segmentHeader{Sn: q[k].sn, Frg: q[k].frg, Len: uint16(len(q[k].data))}
+			if q[k].eow {
+				sh.Flags |= segmentEow
+			}
+			if q[k].bow {
+				sh.Flags |= segmentBow
+			}
+			binary.Write(&buf, binary.LittleEndian, &sh)
+			buf.Write(q[k].data)
+		}
+	}
+	binary.Write(&buf, binary.LittleEndian, uint32(len(s.sockbuff)))
+	buf.Write(s.sockbuff)
+	return buf.Bytes(), nil
+}
+
+// decodeSessionState parses an export of Export
+func decodeSessionState(b []byte) (*sessionState, error) {
+	st := new(sessionState)
+	r := bytes.NewReader(b)
+	if err := binary.Read(r, binary.LittleEndian, &st.sessionHeader); err != nil {
+		return nil, errors.New(errInvalidState)
+	}
+	if st.Version != sessionStateVersion || st.Mtu > mtuLimit {
+		return nil, errors.New(errInvalidState)
+	}
+
+	// data is sliced from b rather than copied, the session copies it into its buffers
+	data := func(n int) ([]byte, error) {
+		if n > r.Len() {
+			return nil, errors.New(errInvalidState)
+		}
+		off := len(b) - r.Len()
+		r.Seek(int64(n), io.SeekCurrent)
+		return b[off : off+n], nil
+	}
+	for k := range st.queues {
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil || int(count) > r.Len() {
+			return nil, errors.New(errInvalidState)
+		}
+		q := make([]Segment, count)
+		for i := range q {
+			var sh segmentHeader
+			if err := binary.Read(r, binary.LittleEndian, &sh); err != nil || sh.Len > mtuLimit {
+				return nil, errors.New(errInvalidState)
+			}
+			d, err := data(int(sh.Len))
+			if err != nil {
+				return nil, err
+			}
+			q[i] = Segment{sn: sh.Sn, frg: sh.Frg, eow: sh.Flags&segmentEow != 0, bow: sh.Flags&segmentBow != 0, data: d}
+		}
+		st.queues[k] = q
+	}
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, errors.New(errInvalidState)
+	}
+	sockbuff, err := data(int(n))
+	if err != nil || r.Len() != 0 {
+		return nil, errors.New(errInvalidState)
+	}
+	st.sockbuff = sockbuff
+	return st, nil
+}
+
+// restore takes the exported state st over, before the session receives any packet,
+// it fails if the datagram mtu of st leaves no room for a segment
+func (s *UDPSession) restore(st *sessionState) error {
+	s.bufmu.Lock()
+	defer s.bufmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kcp := s.kcp
+	kcp.snd_una, kcp.snd_nxt, kcp.rcv_nxt = st.SndUna, st.SndNxt, st.RcvNxt
+	kcp.snd_wnd, kcp.rcv_wnd, kcp.rmt_wnd = st.SndWnd, st.RcvWnd, st.RmtWnd
+	kcp.cwnd, kcp.incr, kcp.ssthresh = st.Cwnd, st.Incr, st.Ssthresh
+	kcp.rx_srtt, kcp.rx_rttval, kcp.rx_rto, kcp.rx_minrto = st.Srtt, st.Rttval, st.Rto, st.MinRto
+	kcp.nodelay, kcp.interval = st.NoDelay, st.Interval
+	kcp.fastresend, kcp.nocwnd, kcp.stream = st.FastResend, st.NoCwnd, st.Stream
+	kcp.reorder.base = st.FastResend
+	kcp.snd_midsend = st.Flags&stateMidSend != 0
+	kcp.snd_midhigh = st.Flags&stateMidHigh != 0
+	s.ackNoDelay = st.Flags&stateAckNoDelay != 0
+
+	// the capabilities were negotiated already
+	kcp.SetHello(uint8(st.Hello>>8), uint8(st.Hello), false)
+	kcp.rmt_hello = st.RmtHello
+	if st.Hello&CapCompactNonce != 0 {
+		atomic.StoreInt32(&s.acceptCompact, 1)
+	}
+	if st.Hello&CapChecksum != 0 {
+		atomic.StoreInt32(&s.acceptChecksum, 1)
+	}
+	s.counter = st.Counter
+	if s.fec != nil {
+		s.fec.next = st.FECNext
+	}
+
+	// segments of snd_buf are sent again with the first flush
+	queues := []*[]Segment{&kcp.snd_buf, &kcp.snd_queue_hi, &kcp.snd_queue, &kcp.rcv_buf, &kcp.rcv_queue}
+	for k, q := range queues {
+		for _, seg := range st.queues[k] {
+			newseg := kcp.newSegment(len(seg.data))
+			copy(newseg.data, seg.data)
+			newseg.conv = kcp.conv
+			newseg.cmd = IKCP_CMD_PUSH
+			newseg.sn, newseg.frg, newseg.eow, newseg.bow = seg.sn, seg.frg, seg.eow, seg.bow
+			*q = append(*q, newseg)
+		}
+	}
+	kcp.countQueued()
+	if len(st.sockbuff) > 0 {
+		s.sockbuff = append([]byte(nil), st.sockbuff...)
+		atomic.StoreInt64(&s.sockbytes, int64(len(s.sockbuff)))
+	}
+
+	s.mtu = int(st.Mtu)
+	if err := s.updateMtu(); err != nil {
+		return errors.New(errInvalidState)
+	}
+	s.negotiate()
+	s.account()
+	return nil
+}
+
+// importRequest asks the monitor to create a session from an export
+type importRequest struct {
+	state *sessionState
+	addr  net.Addr
+	reply chan importReply
+}
+
+// importReply is the session created for an importRequest, or why there's none
+type importReply struct {
+	s   *UDPSession
+	err error
+}
+
+// Import creates a session of the listener from the state returned by
+// UDPSession.Export in another process, for the peer at addr. The stream goes on
+// where the exported session left it, the listener must be configured like the
+// exporting one. The session isn't queued for Accept. It fails for listeners of
+// NewManualListener, and for a datagram mtu without room for a segment here.
+func (l *Listener) Import(state []byte, addr *net.UDPAddr) (*UDPSession, error) {
+	if l.manual != nil {
+		return nil, errors.New(errInvalidOperation)
+	}
+	st, err := decodeSessionState(state)
+	if err != nil {
+		return nil, err
+	}
+	if l.fec == nil && st.DataShards != 0 ||
+		l.fec != nil && (int(st.DataShards) != l.dataShards || int(st.ParityShards) != l.parityShards) ||
+		int(st.Mtu)-l.headerSize < IKCP_MTU_MIN {
+		return nil, errors.New(errInvalidState)
+	}
+
+	req := importRequest{state: st, addr: addr, reply: make(chan importReply, 1)}
+	select {
+	case l.chImports <- req:
+	case <-l.die:
+		return nil, errors.New(errBrokenPipe)
+	}
+	select {
+	case r := <-req.reply:
+		return r.s, r.err
+	case <-l.die:
+		return nil, errors.New(errBrokenPipe)
+	}
+}
+
+// importSession creates the session of an import request, in the monitor. The session
+// is driven once the state is restored, a failed one is dropped unseen.
+func (l *Listener) importSession(req importRequest) importReply {
+	addr := req.addr.String()
+	if _, ok := l.sessions[addr]; ok {
+		return importReply{err: errors.New(errInvalidOperation)}
+	}
+	s := makeUDPSession(req.state.Conv, l.dataShards, l.parityShards, l, l.conn, req.addr, l.sessionBlock())
+	s.mu.Lock()
+	s.holdLimit = 0 // it's never accepted
+	s.txCheck, s.rxCheck = nil, nil
+	s.mu.Unlock()
+	if err := s.restore(req.state); err != nil {
+		atomic.AddUint64(&DefaultSnmp.PassiveOpens, ^uint64(0))
+		atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+		return importReply{err: err}
+	}
+	updater.addSession(s)
+	l.bindKeys(addr, s)
+	s.mu.Lock()
+	s.softError(SoftAddressMigrated, 0, "imported at %v", addr)
+	s.mu.Unlock()
+	l.mismatches.forget(addr)
+	l.sessions[addr] = s
+	l.emit(EventAddressMigrated, s, "")
+	return importReply{s: s}
+}
@@ -0,0 +1,158 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	mismatchPackets = 8           // datagrams of a peer failing the checks, with none passing, before the diagnosis
+	mismatchPeers   = 64          // addresses without a session a listener diagnoses at a time
+	mismatchWindow  = time.Minute // an address failing for longer without a diagnosis is forgotten
+	mismatchHistory = 8           // diagnoses a listener keeps, see ListenerStats.Mismatches
+)
+
+// Diagnoses of a peer whose datagrams all fail the checks, see SessionStats.Mismatch
+// and ListenerStats.Mismatches
+const (
+	MismatchKey         = "key mismatch"             // both ends encrypt, with different keys or ciphers
+	MismatchUnencrypted = "peer appears unencrypted" // the receiver has a key, the peer sends plain kcp
+	MismatchEncrypted   = "peer appears encrypted"   // the receiver has no key, the peer sends no kcp
+)
+
+// PeerMismatch is an address without a session whose first datagrams all failed the
+// checks of a listener
+type PeerMismatch struct {
+	Addr      net.Addr
+	Diagnosis string    // MismatchKey, MismatchUnencrypted or MismatchEncrypted
+	Time      time.Time // of the diagnosis
+}
+
+// mismatchState diagnoses a misconfigured peer from its first datagrams
+type mismatchState struct {
+	fails     int       // datagrams of the peer failing the checks, while none passed
+	plain     int       // of them, plain kcp packets
+	first     time.Time // of the first failure
+	diagnosis string    // one of the Mismatch diagnoses, once fails reached mismatchPackets
+}
+
+// failed counts a datagram failing the checks of a receiver with a key if encrypted,
+// plain tells it's a plain kcp packet. It returns the diagnosis once it's made.
+func (m *mismatchState) failed(plain, encrypted bool) string {
+	m.fails++
+	if plain {
+		m.plain++
+	}
+	if m.fails != mismatchPackets {
+		return ""
+	}
+	switch {
+	case !encrypted:
+		m.diagnosis = MismatchEncrypted
+	case m.plain*2 >= m.fails:
+		m.diagnosis = MismatchUnencrypted
+	default:
+		m.diagnosis = MismatchKey
+	}
+	return m.diagnosis
+}
+
+// plainPacket returns the conversation of pkt, received by an encrypting end, if it's a
+// plain kcp packet, with a FEC header if fec is set. The command and the size of the
+// first segment tell it from encrypted data.
+func plainPacket(pkt []byte, fec bool) (conv uint32, ok bool) {
+	if fec {
+		if len(pkt) < fecHeaderSizePlus2 || binary.LittleEndian.Uint16(pkt[4:]) != typeData {
+			return 0, false
+		}
+		pkt = pkt[fecHeaderSizePlus2:]
+	}
+	if len(pkt) < IKCP_OVERHEAD || pkt[4] < IKCP_CMD_PUSH || pkt[4] > IKCP_CMD_EXT_MAX {
+		return 0, false
+	}
+	length := binary.LittleEndian.Uint32(pkt[20:])
+	return binary.LittleEndian.Uint32(pkt), uint64(length) <= uint64(len(pkt)-IKCP_OVERHEAD)
+}
+
+// peerFailed counts a datagram of the peer failing the checks, plain tells it's a
+// plain kcp packet of the conversation, s.mu must be held. A valid datagram ends the
+// diagnosis: the ends agree, the failures were noise.
+func (s *UDPSession) peerFailed(plain bool) {
+	if s.mismatch.diagnosis != "" || !s.LastRecv().IsZero() {
+		return
+	}
+	diagnosis := s.mismatch.failed(plain, s.block != nil)
+	if diagnosis == "" {
+		return
+	}
+	strictFail(strictChecksum, "session %v from %v: %v", s.ID(), s.remote, diagnosis)
+	if s.kcp.trace != nil {
+		s.kcp.trace.peerMismatch(diagnosis)
+	}
+}
+
+// mismatched returns the diagnosis of the peer, "" if none or once a datagram of the
+// peer passed the checks, s.mu must be held
+func (s *UDPSession) mismatched() string {
+	if !s.LastRecv().IsZero() {
+		return ""
+	}
+	return s.mismatch.diagnosis
+}
+
+// peerMismatches diagnoses the addresses without a session of a listener, whose
+// datagrams fail the checks
+type peerMismatches struct {
+	mu      sync.Mutex
+	peers   map[string]*mismatchState
+	history []PeerMismatch // the latest diagnoses, oldest first
+}
+
+// failed counts a datagram from addr failing the checks, see mismatchState.failed
+func (p *peerMismatches) failed(addr net.Addr, plain, encrypted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := addr.String()
+	m, ok := p.peers[key]
+	if !ok {
+		now := time.Now()
+		if len(p.peers) >= mismatchPeers {
+			for k, m := range p.peers {
+				if now.Sub(m.first) > mismatchWindow {
+					delete(p.peers, k)
+				}
+			}
+			if len(p.peers) >= mismatchPeers {
+				return
+			}
+		}
+		if p.peers == nil {
+			p.peers = make(map[string]*mismatchState)
+		}
+		m = &mismatchState{first: now}
+		p.peers[key] = m
+	}
+	if diagnosis := m.failed(plain, encrypted); diagnosis != "" {
+		delete(p.peers, key)
+		if len(p.history) == mismatchHistory {
+			p.history = append(p.history[:0], p.history[1:]...)
+		}
+		p.history = append(p.history, PeerMismatch{addr, diagnosis, time.Now()})
+	}
+}
+
+// forget drops the failures of addr, it has a session
+func (p *peerMismatches) forget(addr string) {
+	p.mu.Lock()
+	delete(p.peers, addr)
+	p.mu.Unlock()
+}
+
+// latest returns a copy of the latest diagnoses, oldest first
+func (p *peerMismatches) latest() []PeerMismatch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PeerMismatch(nil), p.history...)
+}
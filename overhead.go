@@ -0,0 +1,91 @@
+package kcp
+
+import "sync/atomic"
+
+// Sizes of the wire format, see WireFormat. They are part of the protocol and stay
+// the same across releases.
+const (
+	CryptHeaderSize        = cryptHeaderSize            // nonce and CRC-32 ahead of an encrypted packet
+	CompactCryptHeaderSize = compactNonceSize + crcSize // the same in the compact nonce format
+	FECHeaderSize          = fecHeaderSizePlus2         // ahead of the segments of a FEC data shard
+	ChecksumSize           = crcSize                    // behind an unencrypted packet with CapChecksum
+	PaddingLengthSize      = padLenSize                 // behind the padding of a padded packet
+	MaxMtu                 = mtuLimit                   // the largest mtu of SetMtu
+)
+
+// PacketFormat is what the datagrams of a session carry besides kcp segments
+type PacketFormat struct {
+	Encrypted       bool // with a BlockCrypt
+	Compact         bool // in the compact nonce format, encrypted without a packet token
+	Checksummed     bool // unencrypted with CapChecksum
+	Padding         int  // the most padding of SetPadding, encrypted only
+	FixedPacketSize int  // every datagram has it with SetFixedPacketSize, encrypted only, 0 for none
+	FEC             bool // with FEC shards
+	Header          int  // header profile of the segments, see SetCompactHeader
+}
+
+// OverheadPerPacket returns the bytes of a datagram of format f taken by its headers,
+// its trailer and the room for padding, everything but the kcp segments
+func OverheadPerPacket(f *PacketFormat) int {
+	var n int
+	if f.Encrypted {
+		n += cryptHeaderSize
+		if f.Compact {
+			n -= nonceSize - compactNonceSize
+		}
+		if f.FixedPacketSize > 0 {
+			n += padLenSize // the padding fills the rest
+		} else if f.Padding > 0 {
+			n += f.Padding + padLenSize
+		}
+	} else if f.Checksummed {
+		n += crcSize
+	}
+	if f.FEC {
+		n += fecHeaderSizePlus2
+	}
+	return n
+}
+
+// EffectiveMSS returns the most data a segment carries in datagrams of format f of
+// mtu bytes, or of f.FixedPacketSize bytes if set, a message of WriteMessage takes up
+// to 255 of them
+func EffectiveMSS(f *PacketFormat, mtu int) int {
+	if f.FixedPacketSize > 0 {
+		mtu = f.FixedPacketSize
+	}
+	return mtu - OverheadPerPacket(f) - IKCP_OVERHEAD + headerSaving(f.Header)
+}
+
+// PacketFormat returns the format of the datagrams the session sends now, the nonce
+// format and the checksum follow the negotiation with the peer
+func (s *UDPSession) PacketFormat() PacketFormat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.packetFormat()
+}
+
+// PeerMtu returns the datagram mtu and the overhead per packet the peer announced with
+// its capabilities, mtu is 0 before, or for peers of older releases. The session sends
+// datagrams up to the smaller of its mtu and the one of the peer, so both ends agree
+// on the segment size, see EffectiveMSS. An overhead differing from the one of
+// PacketFormat may tell the ends are configured differently.
+func (s *UDPSession) PeerMtu() (mtu, overhead int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.RemoteMtu()
+}
+
+// packetFormat is PacketFormat with s.mu held
+func (s *UDPSession) packetFormat() PacketFormat {
+	token, _ := s.token.Load().(*packetToken)
+	return PacketFormat{
+		Encrypted:       s.block != nil,
+		Compact:         s.compact && token == nil,
+		Checksummed:     s.checksum,
+		Padding:         int(atomic.LoadInt32(&s.padding)),
+		FixedPacketSize: int(atomic.LoadInt32(&s.fixedSize)),
+		FEC:             s.fec != nil,
+		Header:          s.kcp.sendProfile(),
+	}
+}
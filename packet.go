@@ -0,0 +1,284 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/crc32"
+)
+
+const (
+	nonceBatch  = 64 * nonceSize // the bytes a nonceReader makes at once
+	nonceReseed = 4096           // batches a nonceReader makes from one seed
+	padLenSize  = 2              // length of the padding of a padded packet, behind it
+)
+
+// NonceDRBG has new sessions draw the random nonces of their encrypted packets from
+// a generator of their own, AES-CTR seeded from crypto/rand and reseeded every 262144
+// nonces, the default. Unset, they read crypto/rand for every 64 nonces.
+var NonceDRBG = true
+
+var zeroBatch [nonceBatch]byte // the plaintext of the keystream of a nonceReader
+
+// nonceReader hands out random nonces from a buffer, so that sealing a packet costs no
+// system call. The buffer is a batch of the keystream of AES-CTR, so every nonce is
+// the cipher of a distinct counter, and no two are the same under one seed; with raw
+// set it's read from crypto/rand instead. Its zero value is ready to use.
+type nonceReader struct {
+	raw     bool          // read crypto/rand, see NonceDRBG
+	source  io.Reader     // of the seeds or the raw nonces, crypto/rand if nil
+	stream  cipher.Stream // the generator, nil until seeded
+	batches int           // made from the seed of stream
+	buf     [nonceBatch]byte
+	left    int // bytes not handed out yet, at the end of buf
+}
+
+// read fills nonce, up to nonceSize bytes, from a nonce of its own
+func (r *nonceReader) read(nonce []byte) {
+	if r.left == 0 {
+		r.refill()
+	}
+	copy(nonce, r.buf[len(r.buf)-r.left:])
+	r.left -= nonceSize
+}
+
+func (r *nonceReader) refill() {
+	src := r.source
+	if src == nil {
+		src = rand.Reader
+	}
+	r.left = len(r.buf)
+	if r.raw {
+		io.ReadFull(src, r.buf[:])
+		return
+	}
+	if r.stream == nil || r.batches == nonceReseed {
+		var seed [32 + aes.BlockSize]byte // an AES-256 key and the first counter
+		io.ReadFull(src, seed[:])
+		block, _ := aes.NewCipher(seed[:32])
+		r.stream = cipher.NewCTR(block, seed[32:])
+		r.batches = 0
+	}
+	r.stream.XORKeyStream(r.buf[:], zeroBatch[:])
+	r.batches++
+}
+
+// encodePacket fills the crypto header of a packet and encrypts it in place, returning
+// the datagram to send. With a packet token the token stays in clear ahead of the
+// ciphertext, in the compact nonce format the first ciphertext block is replaced with
+// counter, random nonces come from nonces otherwise. compact is ignored with a token.
+// A padding above 0 pads the packet with up to padding bytes, pkt must have room for
+// them and their length.
+func encodePacket(block BlockCrypt, token *packetToken, compact bool, counter uint64, nonces *nonceReader, padding int, pkt []byte) []byte {
+	if padding > 0 {
+		pkt = pad(pkt, padding, nonces)
+	}
+	compact = compact && token == nil
+	if compact {
+		compactNonce(pkt[:nonceSize], counter)
+	} else {
+		nonces.read(pkt[:nonceSize])
+	}
+	checksum := crc32.ChecksumIEEE(pkt[cryptHeaderSize:])
+	binary.LittleEndian.PutUint32(pkt[nonceSize:], checksum)
+
+	if token != nil {
+		block.Encrypt(pkt[tokenSize:], pkt[tokenSize:])
+		binary.LittleEndian.PutUint32(pkt, token.sum(pkt))
+	} else {
+		block.Encrypt(pkt, pkt)
+	}
+
+	if compact { // the receiver rebuilds the first ciphertext block from the counter
+		binary.LittleEndian.PutUint64(pkt, counter)
+		n := copy(pkt[compactNonceSize:], pkt[nonceSize:])
+		pkt = pkt[:compactNonceSize+n]
+	}
+	return pkt
+}
+
+// decodePacket verifies a received datagram and returns its payload, the FEC and KCP
+// data behind the crypto header, or the reason to reject it. compact tells the compact
+// nonce format is accepted, padded that packets are padded, headerSize is the size of
+// the crypto and FEC headers in the random nonce format. Encrypted datagrams are
+// decrypted in place, buf is scratch space of mtuLimit+nonceSize bytes for the compact
+// nonce format.
+func decodePacket(block BlockCrypt, token *packetToken, compact, padded bool, headerSize int, data, buf []byte) ([]byte, int, bool) {
+	if reason, ok := checkPacket(block, token, compact, headerSize, data); !ok {
+		return nil, reason, false
+	}
+	if block == nil {
+		return data, 0, true
+	}
+	if payload, ok := openPacket(block, token != nil, compact, padded, data, buf); ok {
+		return payload, 0, true
+	}
+	return nil, rejectChecksum, false
+}
+
+// checkPacket is the part of decodePacket before decryption, which is cheap:
+// the size of the datagram and its packet token
+func checkPacket(block BlockCrypt, token *packetToken, compact bool, headerSize int, data []byte) (int, bool) {
+	if len(data) < minPacketSize(headerSize, compact && token == nil) {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return rejectShort, false
+	}
+	if block != nil && token != nil && !token.verify(data) {
+		atomic.AddUint64(&DefaultSnmp.InTokenErrors, 1)
+		return rejectToken, false
+	}
+	return 0, true
+}
+
+// appendChecksum appends the CRC-32 of an unencrypted packet with CapChecksum,
+// pkt must have room for it
+func appendChecksum(pkt []byte) []byte {
+	n := len(pkt)
+	pkt = pkt[:n+crcSize]
+	binary.LittleEndian.PutUint32(pkt[n:], crc32.ChecksumIEEE(pkt[:n]))
+	return pkt
+}
+
+// stripChecksum removes the CRC-32 behind an unencrypted packet if it matches, summed
+// tells it did. Like the compact nonce format, a packet without it is told apart by the
+// mismatch, and is returned as it is.
+func stripChecksum(data []byte) (payload []byte, summed bool) {
+	n := len(data) - crcSize
+	if n >= 0 && crc32.ChecksumIEEE(data[:n]) == binary.LittleEndian.Uint32(data[n:]) {
+		return data[:n], true
+	}
+	return data, false
+}
+
+// minPacketSize is the size of the smallest valid packet, a compact segment without
+// the conversation id, which is shorter if the compact nonce format is accepted
+func minPacketSize(headerSize int, compact bool) int {
+	if compact {
+		headerSize -= nonceSize - compactNonceSize
+	}
+	return headerSize + compactOverhead
+}
+
+// compactNonce fills the nonce of a packet in the compact nonce format
+func compactNonce(nonce []byte, counter uint64) {
+	binary.LittleEndian.PutUint64(nonce, counter)
+	for k := compactNonceSize; k < nonceSize; k++ {
+		nonce[k] = 0
+	}
+}
+
+// decryptCompact decrypts a packet in the compact nonce format into buf, which must
+// have room for nonceSize-compactNonceSize more bytes than data, the first ciphertext
+// block is rebuilt by encrypting the nonce derived from the counter
+func decryptCompact(block BlockCrypt, data []byte, buf []byte) ([]byte, bool) {
+	if len(data) < compactNonceSize+crcSize {
+		return nil, false
+	}
+	pkt := buf[:nonceSize+len(data)-compactNonceSize]
+	compactNonce(pkt, binary.LittleEndian.Uint64(data))
+	block.Encrypt(pkt[:nonceSize], pkt[:nonceSize])
+	copy(pkt[nonceSize:], data[compactNonceSize:])
+	return tryDecrypt(block, false, pkt)
+}
+
+// decryptPacket decrypts data in place and verifies the checksum, returning
+// the payload behind the crypto header, a tokened packet keeps its token in clear
+func decryptPacket(block BlockCrypt, tokened bool, data []byte) ([]byte, bool) {
+	data, ok := tryDecrypt(block, tokened, data)
+	if !ok {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+	}
+	return data, ok
+}
+
+// tryDecrypt is decryptPacket without counting errors
+func tryDecrypt(block BlockCrypt, tokened bool, data []byte) ([]byte, bool) {
+	if tokened {
+		block.Decrypt(data[tokenSize:], data[tokenSize:])
+	} else {
+		block.Decrypt(data, data)
+	}
+	data = data[nonceSize:]
+	checksum := crc32.ChecksumIEEE(data[crcSize:])
+	if checksum != binary.LittleEndian.Uint32(data) {
+		return nil, false
+	}
+	return data[crcSize:], true
+}
+
+// openPacket decrypts and verifies a packet in place and removes its padding if padded,
+// see unseal
+func openPacket(block BlockCrypt, tokened, compact, padded bool, data, buf []byte) ([]byte, bool) {
+	payload, ok := unseal(block, tokened, compact, data, buf)
+	if ok && padded {
+		if payload, ok = unpad(payload); !ok {
+			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		}
+	}
+	return payload, ok
+}
+
+// pad appends zeros and their count to a packet, up to padding of them: the count is
+// random, so the sizes of datagrams tell little about the data they carry. Encryption
+// turns the zeros into noise.
+func pad(pkt []byte, padding int, nonces *nonceReader) []byte {
+	var rnd [2]byte
+	nonces.read(rnd[:])
+	return padZeros(pkt, int(binary.LittleEndian.Uint16(rnd[:]))%(padding+1))
+}
+
+// padTo pads a packet like pad to exactly size bytes, pkt must have room for them.
+// A packet without room for the count, of segments sized before the nonce format
+// changed, only gets the count.
+func padTo(pkt []byte, size int) []byte {
+	n := size - len(pkt) - padLenSize
+	if n < 0 {
+		n = 0
+	}
+	return padZeros(pkt, n)
+}
+
+// padZeros appends n zeros and their count to a packet
+func padZeros(pkt []byte, n int) []byte {
+	size := len(pkt)
+	pkt = pkt[:size+n+padLenSize]
+	for k := size; k < size+n; k++ {
+		pkt[k] = 0
+	}
+	binary.LittleEndian.PutUint16(pkt[size+n:], uint16(n))
+	return pkt
+}
+
+// unpad removes the padding of a decrypted packet, it fails if the count doesn't fit,
+// or leaves less than a compact kcp header, which the size checks before decryption
+// ensure for packets without padding
+func unpad(data []byte) ([]byte, bool) {
+	if len(data) < padLenSize {
+		return nil, false
+	}
+	size := len(data) - padLenSize
+	n := int(binary.LittleEndian.Uint16(data[size:]))
+	if size-n < compactOverhead {
+		return nil, false
+	}
+	return data[:size-n], true
+}
+
+// unseal decrypts and verifies a packet in place, trying the compact nonce format
+// first if it's accepted, buf is scratch space of mtuLimit+nonceSize bytes for it
+func unseal(block BlockCrypt, tokened, compact bool, data, buf []byte) ([]byte, bool) {
+	if compact && !tokened {
+		if payload, ok := decryptCompact(block, data, buf); ok {
+			return data[:copy(data, payload)], true
+		}
+		if len(data) < cryptHeaderSize { // too short for the random nonce format
+			atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			return nil, false
+		}
+	}
+	return decryptPacket(block, tokened, data)
+}
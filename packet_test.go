@@ -0,0 +1,277 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPacketCodec(t *testing.T) {
+	block, _ := NewAESBlockCrypt(bytes.Repeat([]byte{1}, 32))
+	other, _ := NewAESBlockCrypt(bytes.Repeat([]byte{2}, 32))
+	token := newPacketToken([]byte("token"))
+	otherToken := newPacketToken([]byte("other"))
+	payload := make([]byte, IKCP_OVERHEAD+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	encode := func(block BlockCrypt, token *packetToken, compact bool, padding int) []byte {
+		if block == nil {
+			return append([]byte(nil), payload...)
+		}
+		pkt := make([]byte, cryptHeaderSize+len(payload), mtuLimit)
+		copy(pkt[cryptHeaderSize:], payload)
+		return encodePacket(block, token, compact, 42, new(nonceReader), padding, pkt)
+	}
+
+	const ok = -1
+	tests := []struct {
+		name        string
+		block       BlockCrypt // of the sender
+		token       *packetToken
+		compact     bool // sent in the compact nonce format
+		padding     int  // most bytes of padding sent
+		rxBlock     BlockCrypt
+		rxToken     *packetToken
+		rxCompact   bool // the compact nonce format is accepted
+		rxPadded    bool // packets are padded
+		truncate    int  // bytes cut from the end of the datagram
+		short       bool // cut down to one byte less than the smallest valid packet
+		want        int  // a reject* reason or ok
+		wantGarbage bool // the payload is accepted, but not what was sent
+	}{
+		{name: "plain", want: ok},
+		{name: "plain truncated", truncate: 1, want: ok, wantGarbage: true},
+		{name: "plain short", short: true, want: rejectShort},
+		{name: "plain to encrypted", rxBlock: block, want: rejectChecksum},
+		{name: "encrypted", block: block, rxBlock: block, want: ok},
+		{name: "encrypted truncated", block: block, rxBlock: block, truncate: 1, want: rejectChecksum},
+		{name: "encrypted short", block: block, rxBlock: block, short: true, want: rejectShort},
+		{name: "wrong key", block: block, rxBlock: other, want: rejectChecksum},
+		{name: "encrypted to plain", block: block, want: ok, wantGarbage: true},
+		{name: "token", block: block, token: token, rxBlock: block, rxToken: token, want: ok},
+		{name: "wrong token", block: block, token: token, rxBlock: block, rxToken: otherToken, want: rejectToken},
+		{name: "missing token", block: block, rxBlock: block, rxToken: token, want: rejectToken},
+		{name: "unexpected token", block: block, token: token, rxBlock: block, want: rejectChecksum},
+		{name: "token truncated", block: block, token: token, rxBlock: block, rxToken: token, truncate: 1, want: rejectChecksum},
+		{name: "compact", block: block, compact: true, rxBlock: block, rxCompact: true, want: ok},
+		{name: "compact truncated", block: block, compact: true, rxBlock: block, rxCompact: true, truncate: 1, want: rejectChecksum},
+		{name: "compact short", block: block, compact: true, rxBlock: block, rxCompact: true, short: true, want: rejectShort},
+		{name: "compact not accepted", block: block, compact: true, rxBlock: block, want: rejectChecksum},
+		{name: "compact wrong key", block: block, compact: true, rxBlock: other, rxCompact: true, want: rejectChecksum},
+		{name: "random nonce, compact accepted", block: block, rxBlock: block, rxCompact: true, want: ok},
+		{name: "compact with token", block: block, token: token, compact: true, rxBlock: block, rxToken: token, rxCompact: true, want: ok},
+		{name: "padded", block: block, padding: 300, rxBlock: block, rxPadded: true, want: ok},
+		{name: "padded compact", block: block, compact: true, padding: 300, rxBlock: block, rxCompact: true, rxPadded: true, want: ok},
+		{name: "padded truncated", block: block, padding: 300, rxBlock: block, rxPadded: true, truncate: 1, want: rejectChecksum},
+		{name: "padding not expected", block: block, padding: 300, rxBlock: block, want: ok, wantGarbage: true},
+		{name: "padding missing", block: block, rxBlock: block, rxPadded: true, want: rejectChecksum},
+	}
+	for _, tt := range tests {
+		data := encode(tt.block, tt.token, tt.compact, tt.padding)
+		headerSize := 0
+		if tt.rxBlock != nil {
+			headerSize = cryptHeaderSize
+		}
+		if tt.short {
+			data = data[:minPacketSize(headerSize, tt.rxCompact && tt.rxToken == nil)-1]
+		}
+		data = data[:len(data)-tt.truncate]
+
+		got, reason, accepted := decodePacket(tt.rxBlock, tt.rxToken, tt.rxCompact, tt.rxPadded, headerSize, data, make([]byte, mtuLimit+nonceSize))
+		switch {
+		case tt.want != ok && (accepted || reason != tt.want):
+			t.Errorf("%v: accepted %v, reason %v, want reason %v", tt.name, accepted, reason, tt.want)
+		case tt.want == ok && !accepted:
+			t.Errorf("%v: rejected for %v", tt.name, reason)
+		case tt.want == ok && bytes.Equal(got, payload) == tt.wantGarbage:
+			t.Errorf("%v: got %v bytes, payload mismatch %v", tt.name, len(got), tt.wantGarbage)
+		}
+	}
+}
+
+func TestPacketChecksum(t *testing.T) {
+	payload := make([]byte, IKCP_OVERHEAD+100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := appendChecksum(append(make([]byte, 0, len(payload)+crcSize), payload...))
+	if got, summed := stripChecksum(pkt); !summed || !bytes.Equal(got, payload) {
+		t.Fatal("checksum not stripped")
+	}
+	if got, summed := stripChecksum(payload); summed || !bytes.Equal(got, payload) {
+		t.Fatal("packet without checksum changed")
+	}
+	if _, summed := stripChecksum(pkt[:len(pkt)-1]); summed {
+		t.Fatal("truncated packet accepted")
+	}
+	for i := range pkt {
+		corrupted := append([]byte(nil), pkt...)
+		corrupted[i] ^= 0x10
+		if _, summed := stripChecksum(corrupted); summed {
+			t.Fatal("corrupted byte", i, "accepted")
+		}
+	}
+}
+
+func TestDecodePacketForDebug(t *testing.T) {
+	block, _ := NewAESBlockCrypt(bytes.Repeat([]byte{1}, 32))
+	other, _ := NewAESBlockCrypt(bytes.Repeat([]byte{2}, 32))
+	segs := []Segment{
+		{conv: 7, cmd: IKCP_CMD_ACK, wnd: 128, ts: 1000, sn: 3, una: 4},
+		{conv: 7, cmd: IKCP_CMD_PUSH, frg: 1, wnd: 128, ts: 1001, sn: 4, una: 4, data: []byte("hello")},
+	}
+	var kcpData []byte
+	for _, seg := range segs {
+		buf := make([]byte, IKCP_OVERHEAD)
+		seg.encode(buf)
+		kcpData = append(append(kcpData, buf...), seg.data...)
+	}
+
+	// packet builds a datagram of kcpData
+	packet := func(block BlockCrypt, token *packetToken, compact, fec, checksum bool, padding int) []byte {
+		pkt := make([]byte, 0, mtuLimit)
+		if block != nil {
+			pkt = pkt[:cryptHeaderSize]
+		}
+		if fec {
+			var hdr [fecHeaderSizePlus2]byte
+			binary.LittleEndian.PutUint32(hdr[:], 9)
+			binary.LittleEndian.PutUint16(hdr[4:], typeData)
+			binary.LittleEndian.PutUint16(hdr[6:], uint16(len(kcpData)+2))
+			pkt = append(pkt, hdr[:]...)
+		}
+		pkt = append(pkt, kcpData...)
+		if block != nil {
+			return encodePacket(block, token, compact, 42, new(nonceReader), padding, pkt)
+		}
+		if checksum {
+			pkt = appendChecksum(pkt)
+		}
+		return pkt
+	}
+
+	tests := []struct {
+		name         string
+		block        BlockCrypt
+		token        *packetToken
+		compact, fec bool
+		checksum     bool
+		padding      int
+	}{
+		{name: "plain"},
+		{name: "checksum", checksum: true},
+		{name: "plain fec", fec: true},
+		{name: "random nonce", block: block},
+		{name: "compact nonce", block: block, compact: true},
+		{name: "token", block: block, token: newPacketToken([]byte("token"))},
+		{name: "padding", block: block, padding: 64},
+		{name: "fec", block: block, compact: true, fec: true, padding: 16},
+	}
+	for _, tt := range tests {
+		datagram := packet(tt.block, tt.token, tt.compact, tt.fec, tt.checksum, tt.padding)
+		clone := append([]byte(nil), datagram...)
+		info, err := DecodePacketForDebug(tt.block, tt.fec, datagram)
+		if err != nil {
+			t.Fatal(tt.name, err)
+		}
+		if !bytes.Equal(datagram, clone) {
+			t.Fatal(tt.name, "datagram changed")
+		}
+		if info.Encrypted != (tt.block != nil) || info.Compact != tt.compact || info.Tokened != (tt.token != nil) ||
+			info.Checksummed != tt.checksum || info.FEC != tt.fec || tt.fec && info.FECSeqID != 9 ||
+			(info.Padding > 0) != (tt.padding > 0) {
+			t.Fatalf("%v: %+v", tt.name, info)
+		}
+		if len(info.Segments) != len(segs) {
+			t.Fatal(tt.name, len(info.Segments), "segments")
+		}
+		for k, seg := range segs {
+			got := info.Segments[k]
+			want := SegmentInfo{seg.conv, uint8(seg.cmd), uint8(seg.frg), uint16(seg.wnd), seg.ts, seg.sn, seg.una, uint32(len(seg.data)), got.Data}
+			if !reflect.DeepEqual(got, want) || !bytes.Equal(got.Data, seg.data) {
+				t.Fatalf("%v: segment %v: %+v", tt.name, k, got)
+			}
+		}
+	}
+
+	// a wrong key, a keep-alive packet of random bytes, and a FEC parity shard
+	datagram := packet(block, nil, false, false, false, 0)
+	if _, err := DecodePacketForDebug(other, false, datagram); err == nil {
+		t.Fatal("decoded with a wrong key")
+	}
+	ping := make([]byte, 200)
+	io.ReadFull(rand.Reader, ping)
+	if _, err := DecodePacketForDebug(nil, false, ping); err == nil {
+		t.Fatal("decoded random bytes")
+	}
+	parity := []byte{1, 0, 0, 0, typeFEC, 0, 1, 2, 3}
+	if info, err := DecodePacketForDebug(nil, true, parity); err != nil || !info.FECParity || info.FECSeqID != 1 {
+		t.Fatal(info, err)
+	}
+	if !strings.Contains(WireFormat(), "sequence number") {
+		t.Fatal(WireFormat())
+	}
+}
+
+// countReader counts the reads of crypto/rand
+type countReader struct{ reads int }
+
+func (r *countReader) Read(b []byte) (int, error) {
+	r.reads++
+	return rand.Read(b)
+}
+
+func TestNonceReader(t *testing.T) {
+	none, _ := NewNoneBlockCrypt(nil)
+	for _, raw := range []bool{false, true} {
+		var src countReader
+		nonces := &nonceReader{raw: raw, source: &src}
+		seen := make(map[[nonceSize]byte]bool)
+		pkt := make([]byte, cryptHeaderSize+IKCP_OVERHEAD, mtuLimit)
+		for i := 0; i < 10000; i++ {
+			if i == 5000 {
+				nonces.batches = nonceReseed
+			}
+			if i%100 == 0 { // padding takes a nonce of its own
+				pad(pkt, 10, nonces)
+			}
+			var nonce [nonceSize]byte
+			copy(nonce[:], encodePacket(none, nil, false, 0, nonces, 0, pkt))
+			if seen[nonce] {
+				t.Fatalf("raw %v: nonce of packet %v repeated", raw, i)
+			}
+			seen[nonce] = true
+		}
+		want := 2 // the first seed, and the reseed
+		if raw {
+			want = (10000 + 100 + nonceBatch/nonceSize - 1) / (nonceBatch / nonceSize)
+		}
+		if src.reads != want {
+			t.Fatalf("raw %v: %v reads of crypto/rand", raw, src.reads)
+		}
+	}
+}
+
+func BenchmarkNonceReader(b *testing.B) {
+	for _, raw := range []bool{false, true} {
+		name := "DRBG"
+		if raw {
+			name = "CryptoRand"
+		}
+		b.Run(name, func(b *testing.B) {
+			var src countReader
+			nonces := &nonceReader{raw: raw, source: &src}
+			var nonce [nonceSize]byte
+			for i := 0; i < b.N; i++ {
+				nonces.read(nonce[:])
+			}
+			b.ReportMetric(float64(src.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
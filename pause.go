@@ -0,0 +1,99 @@
+package kcp
+
+import (
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Pause freezes the transmission of the connection, for a live migration of the
+// application behind it: no data and no retransmissions are sent until Resume, while
+// acknowledgements and window probes still are, advertising a zero receive window.
+// The peer stops sending new data then, rather than seeing silence, so its timers
+// keep running as usual. Writes queue data for the send window as usual. The pause
+// doesn't count toward the dead link or grow the retransmission timeouts, keep it
+// short all the same, the peer probes the window after IKCP_PROBE_INIT ms.
+// It fails with ErrClosed once the connection is closed.
+func (c *KCPConn) Pause() error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.kcp.current = currentMs()
+	c.kcp.Pause(c.kcp.current)
+	c.kcp.flush()
+	c.uncork()
+	return nil
+}
+
+// Resume sends the data held back by Pause, and tells the peer the receive window.
+// It fails with ErrClosed once the connection is closed.
+func (c *KCPConn) Resume() error {
+	c.mu.Lock()
+	if c.isClosed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.kcp.current = currentMs()
+	c.kcp.Resume(c.kcp.current)
+	c.kcp.flush()
+	c.notifyWriteEvent()
+	c.uncork()
+	return nil
+}
+
+// pauseRequest asks the monitor to pause or resume all sessions
+type pauseRequest struct {
+	pause bool
+	done  chan struct{}
+}
+
+// PauseAll pauses all sessions of the listener like UDPSession.Pause, sessions
+// accepted until ResumeAll start paused. The sessions of a listener of
+// NewManualListener are paused one by one, it fails for them.
+func (l *Listener) PauseAll() error {
+	return l.pauseAll(true)
+}
+
+// ResumeAll resumes all sessions of the listener, those paused one by one included
+func (l *Listener) ResumeAll() error {
+	return l.pauseAll(false)
+}
+
+// pauseAll pauses or resumes all sessions, in the monitor, so no session is created
+// in between
+func (l *Listener) pauseAll(pause bool) error {
+	if l.manual != nil {
+		return errors.New(errInvalidOperation)
+	}
+	req := pauseRequest{pause: pause, done: make(chan struct{})}
+	select {
+	case l.chPause <- req:
+	case <-l.die:
+		return errors.New(errBrokenPipe)
+	}
+	select {
+	case <-req.done:
+		return nil
+	case <-l.die:
+		return errors.New(errBrokenPipe)
+	}
+}
+
+// pauseSessions applies a pause request, in the monitor
+func (l *Listener) pauseSessions(req pauseRequest) {
+	if req.pause {
+		atomic.StoreInt32(&l.paused, 1)
+	} else {
+		atomic.StoreInt32(&l.paused, 0)
+	}
+	for _, s := range l.sessions {
+		if req.pause {
+			s.Pause()
+		} else {
+			s.Resume()
+		}
+	}
+	close(req.done)
+}
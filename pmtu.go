@@ -0,0 +1,142 @@
+package kcp
+
+import "time"
+
+// mtuSteps are the datagram mtus a session falls back to, largest first, when the path
+// loses its large datagrams, see SetMtuFallback
+var mtuSteps = []int{1400, 1200, 1024}
+
+const (
+	mtuFallbackFailures = 8           // failures of large datagrams from the peer in a burst
+	mtuFallbackBurst    = time.Second // the burst
+	mtuFallbackXmit     = 4           // transmissions of the oldest segment before the path is probed
+)
+
+// pmtuState detects a path losing large datagrams, protected by mu
+type pmtuState struct {
+	disabled  bool
+	fails     int       // datagrams of the peer failing the checks in the burst
+	failSize  int       // the smallest of them
+	failSince time.Time // start of the burst
+	probed    time.Time // a window probe was sent for the oldest segment, zero if none
+	wins      uint32    // window probes answered by the peer at the probe
+	sn        uint32    // the oldest segment at the probe
+	inflight  int       // segments in flight at the probe
+}
+
+// mtuStep returns the largest step of mtuSteps below mtu and up to limit, 0 if none
+func mtuStep(mtu, limit int) int {
+	for _, step := range mtuSteps {
+		if step < mtu && step <= limit {
+			return step
+		}
+	}
+	return 0
+}
+
+// SetMtuFallback enables or disables the mtu fallback, enabled by default. A middlebox
+// truncating or dropping datagrams above some size hangs transfers, as every full size
+// datagram is lost while small packets pass. The session detects it from datagrams of
+// the peer failing the checks at a similar size, or from the oldest segment in flight
+// lost again in large datagrams while the peer answers a window probe, and steps the
+// mtu down through 1400, 1200 and 1024, see SessionTrace.MtuFallback. The segments in
+// flight are split again for the smaller mtu once the answer shows none of them got
+// through, see KCP.resplit. The mtu doesn't step up again.
+func (s *UDPSession) SetMtuFallback(enable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pmtu = pmtuState{disabled: !enable}
+}
+
+// mtuFailed counts a datagram of size bytes from the peer that failed the checks,
+// s.mu must be held. Datagrams truncated by the path fail at about the same size, so a
+// burst of them means the datagrams of the session don't get through either.
+func (s *UDPSession) mtuFailed(size int) {
+	p := &s.pmtu
+	if p.disabled || size <= mtuSteps[len(mtuSteps)-1] {
+		return
+	}
+	now := time.Now()
+	if p.fails == 0 || now.Sub(p.failSince) > mtuFallbackBurst {
+		p.fails, p.failSize, p.failSince = 0, size, now
+	}
+	p.fails++
+	if size < p.failSize {
+		p.failSize = size
+	}
+	if p.fails >= mtuFallbackFailures {
+		p.fails = 0
+		if mtu := mtuStep(s.mtu, p.failSize); mtu > 0 {
+			s.fallback(mtu)
+		}
+	}
+}
+
+// mtuPassed notes a valid datagram of size bytes from the peer, s.mu must be held,
+// failures at its size weren't due to the size
+func (s *UDPSession) mtuPassed(size int) {
+	if s.pmtu.fails > 0 && size >= s.pmtu.failSize {
+		s.pmtu.fails = 0
+	}
+}
+
+// probeMtu checks whether the path loses the datagrams of the segments in flight,
+// s.mu must be held. Once the oldest segment was sent mtuFallbackXmit times, a window
+// probe asks the peer for an answer in a datagram of its own. If the peer answers and
+// acknowledges none of the segments in flight, the session falls back to the step of
+// mtuSteps below the datagrams the oldest one was lost in, unless it was sent with a
+// larger mtu already, and splits them again.
+func (s *UDPSession) probeMtu() {
+	p := &s.pmtu
+	if p.disabled || len(s.kcp.snd_buf) == 0 || s.kcp.snd_buf[0].xmit < mtuFallbackXmit {
+		p.probed = time.Time{}
+		return
+	}
+	head := &s.kcp.snd_buf[0]
+	mtu := s.mtu
+	if len(head.data) <= int(s.kcp.mss) { // it was sent with the current mtu
+		overhead := s.wireMtu() - int(s.kcp.mtu)
+		if mtu = mtuStep(s.mtu, int(head.dgram)+overhead-1); mtu == 0 {
+			p.probed = time.Time{}
+			return
+		}
+	}
+
+	now := time.Now()
+	rto := time.Duration(s.kcp.rx_rto) * time.Millisecond
+	switch {
+	case p.probed.IsZero() || p.sn != head.sn || len(s.kcp.snd_buf) < p.inflight:
+		// probe anew: not probed yet, or segments were acknowledged since
+	case s.kcp.rmt_wins != p.wins:
+		// the answer follows the acknowledgements of every segment received before
+		if mtu < s.mtu {
+			s.fallback(mtu)
+		}
+		s.kcp.resplit()
+		p.probed = time.Time{}
+		return
+	case now.Sub(p.probed) < 2*rto:
+		return
+	}
+	p.probed, p.wins, p.sn, p.inflight = now, s.kcp.rmt_wins, head.sn, len(s.kcp.snd_buf)
+	s.kcp.probe |= IKCP_ASK_SEND | IKCP_ASK_ALONE
+}
+
+// fallback lowers the datagram mtu of the session, s.mu must be held. The peer keeps
+// the mtu announced to it, the fallback is about the datagrams of this end.
+func (s *UDPSession) fallback(mtu int) {
+	if s.fixedSize > 0 { // the size is the mtu
+		return
+	}
+	announced, old := s.kcp.hello_mtu, s.mtu
+	s.mtu = mtu
+	if err := s.updateMtu(); err != nil { // no room for a segment
+		s.mtu = old
+		return
+	}
+	s.kcp.hello_mtu = announced
+	s.softError(SoftMtuFallback, mtu, "mtu fell back to %v", mtu)
+	if s.kcp.trace != nil {
+		s.kcp.trace.mtuFallback(mtu)
+	}
+}
@@ -0,0 +1,55 @@
+package kcp
+
+import "fmt"
+
+// Profile is a named tuning of the retransmission, the parameters of SetNoDelay as
+// one value, so it's passed around, logged and applied to dialed and accepted sessions
+// alike, see SessionConfig.SetProfile and KCPConn.SetProfile. Define your own like the
+// presets below.
+type Profile struct {
+	NoDelay  int // 1 for the nodelay mode, see SetNoDelay
+	Interval int // update interval in ms
+	Resend   int // fast resend after that many later segments acknowledged, 0 for none
+	NC       int // 1 disables the congestion window
+}
+
+// presets, the defaults of ikcp and the speed modes of kcptun
+var (
+	ProfileDefault = Profile{NoDelay: 0, Interval: IKCP_INTERVAL, Resend: 0, NC: 0} // what sessions start with
+	ProfileNormal  = Profile{NoDelay: 0, Interval: 40, Resend: 2, NC: 1}
+	ProfileFast    = Profile{NoDelay: 0, Interval: 30, Resend: 2, NC: 1}
+	ProfileFast2   = Profile{NoDelay: 1, Interval: 20, Resend: 2, NC: 1}
+	ProfileFast3   = Profile{NoDelay: 1, Interval: 10, Resend: 2, NC: 1}
+)
+
+func (p Profile) String() string {
+	return fmt.Sprintf("nodelay %v, interval %vms, resend %v, nc %v", p.NoDelay, p.Interval, p.Resend, p.NC)
+}
+
+// SetProfile sets the SetNoDelay parameters of the configuration to p
+func (cfg *SessionConfig) SetProfile(p Profile) {
+	cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion = p.NoDelay, p.Interval, p.Resend, p.NC
+}
+
+// Profile returns the SetNoDelay parameters of the configuration
+func (cfg *SessionConfig) Profile() Profile {
+	return Profile{NoDelay: cfg.NoDelay, Interval: cfg.Interval, Resend: cfg.Resend, NC: cfg.NoCongestion}
+}
+
+// SetProfile is SetNoDelay with the parameters of p, it's safe at any time
+func (c *KCPConn) SetProfile(p Profile) {
+	c.SetNoDelay(p.NoDelay, p.Interval, p.Resend, p.NC)
+}
+
+// Profile returns the SetNoDelay parameters the connection runs with, the fast resend
+// as set rather than as tuned, see SetFastResendTuning
+func (c *KCPConn) Profile() Profile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Profile{
+		NoDelay:  int(c.kcp.nodelay),
+		Interval: int(c.kcp.interval),
+		Resend:   int(c.kcp.reorder.base),
+		NC:       int(c.kcp.nocwnd),
+	}
+}
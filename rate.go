@@ -0,0 +1,43 @@
+package kcp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateTau is the time constant of the throughput rates, they follow changes
+// and decay when idle within a few of it
+const rateTau = time.Second
+
+// ewmaRate is an exponentially weighted moving average of bytes per second,
+// every sample decays with time, so the rate drops to zero when idle
+type ewmaRate struct {
+	mu   sync.Mutex
+	rate float64 // bytes per second at last
+	last time.Time
+}
+
+// add counts n bytes at now
+func (r *ewmaRate) add(n int, now time.Time) {
+	r.mu.Lock()
+	r.rate = r.decayed(now) + float64(n)/rateTau.Seconds()
+	r.last = now
+	r.mu.Unlock()
+}
+
+// value returns the rate at now
+func (r *ewmaRate) value(now time.Time) float64 {
+	r.mu.Lock()
+	rate := r.decayed(now)
+	r.mu.Unlock()
+	return rate
+}
+
+func (r *ewmaRate) decayed(now time.Time) float64 {
+	dt := now.Sub(r.last)
+	if dt <= 0 {
+		return r.rate
+	}
+	return r.rate * math.Exp(-dt.Seconds()/rateTau.Seconds())
+}
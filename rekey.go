@@ -0,0 +1,326 @@
+package kcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	rekeyOverlap = 30 * time.Second // the key of the previous epoch still decrypts for it
+	rekeyKeySize = 32               // bytes of the keys of the epochs by default
+	rekeyInfo    = "kcp-go epoch"   // HKDF info of the keys of the epochs, followed by the epoch
+)
+
+// RekeyConfig rotates the key of an encrypted session, see SetRekey
+type RekeyConfig struct {
+	Secret    []byte                               // the keys of the epochs derive from it, the same on both ends
+	NewCipher func(key []byte) (BlockCrypt, error) // the cipher of a key, like NewAESBlockCrypt
+	KeySize   int                                  // bytes of the keys, 32 if 0
+	Bytes     int64                                // the most bytes sent under one key, 0 for no limit
+	Interval  time.Duration                        // the longest time under one key, 0 for no limit
+}
+
+// validate checks cfg and returns a copy with the defaults filled in
+func (cfg *RekeyConfig) validate() (*RekeyConfig, error) {
+	if len(cfg.Secret) == 0 || cfg.NewCipher == nil || cfg.KeySize < 0 || cfg.Bytes < 0 || cfg.Interval < 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	c := *cfg
+	c.Secret = append([]byte(nil), cfg.Secret...)
+	if c.KeySize == 0 {
+		c.KeySize = rekeyKeySize
+	}
+	if _, err := c.epochKey(0, 1); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// epochKey derives the cipher of epoch of conversation conv, HKDF-SHA256 of the secret
+// with conv as salt
+func (cfg *RekeyConfig) epochKey(conv, epoch uint32) (BlockCrypt, error) {
+	var salt [4]byte
+	binary.LittleEndian.PutUint32(salt[:], conv)
+	info := make([]byte, len(rekeyInfo)+4)
+	binary.LittleEndian.PutUint32(info[copy(info, rekeyInfo):], epoch)
+	key := make([]byte, cfg.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, cfg.Secret, salt[:], info), key); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cfg.NewCipher(key)
+}
+
+// epochKeys are the ciphers of a session past its first epoch, or announcing the
+// next one, immutable once published
+type epochKeys struct {
+	cur       BlockCrypt // of the packets sent
+	next      BlockCrypt // of the epoch announced to the peer, nil if none
+	prev      BlockCrypt // of the epoch before, nil if none
+	nextEpoch uint32     // the epoch of next
+	until     time.Time  // prev decrypts until then
+}
+
+// blocks appends the ciphers to try at now to dst, the likely one first
+func (k *epochKeys) blocks(now time.Time, dst []BlockCrypt) []BlockCrypt {
+	dst = append(dst, k.cur)
+	if k.next != nil {
+		dst = append(dst, k.next)
+	}
+	if k.prev != nil && now.Before(k.until) {
+		dst = append(dst, k.prev)
+	}
+	return dst
+}
+
+// openEpochs is openPacket trying the ciphers of k, then fallback if not nil: the key
+// of the first epoch, for a new conversation from the address. block is the cipher the
+// packet decrypted with. spare keeps a copy of data for the next try, it's allocated
+// on demand.
+func openEpochs(k *epochKeys, fallback BlockCrypt, tokened, compact, padded bool, data, buf []byte, spare *[]byte) (payload []byte, block BlockCrypt, ok bool) {
+	var tries [4]BlockCrypt
+	blocks := k.blocks(time.Now(), tries[:0])
+	if fallback != nil && fallback != k.cur && fallback != k.prev {
+		blocks = append(blocks, fallback)
+	}
+	if len(blocks) == 1 {
+		payload, ok = openPacket(blocks[0], tokened, compact, padded, data, buf)
+		return payload, blocks[0], ok
+	}
+	if *spare == nil {
+		*spare = make([]byte, mtuLimit)
+	}
+	orig := (*spare)[:copy(*spare, data)]
+	for i, block := range blocks {
+		if i > 0 {
+			copy(data, orig)
+		}
+		if payload, ok = openPacket(block, tokened, compact, padded, data, buf); ok {
+			return payload, block, true
+		}
+	}
+	return nil, nil, false
+}
+
+// openFrom is openPacket of a datagram from addr, with the keys of the epochs of its
+// session if it rotates them, see openEpochs, and with the key of the generation of
+// its session with a CryptoContext. block is the cipher it decrypted with, the one of
+// the session of a new conversation.
+func (l *Listener) openFrom(addr net.Addr, tokened, compact, padded bool, data, buf []byte, spare *[]byte) (payload []byte, block BlockCrypt, ok bool) {
+	var keys *cryptoKeys
+	fallback := l.block
+	if l.crypto != nil {
+		keys = l.crypto.current()
+		fallback = keys.block
+	}
+	if atomic.LoadInt32(&l.rekeying) != 0 || keys != nil {
+		if v, found := l.epochs.Load(addr.String()); found {
+			s := v.(*UDPSession)
+			k := s.epochKeys()
+			if k == nil && keys != nil {
+				k = &epochKeys{cur: s.block}
+			}
+			if k != nil {
+				payload, block, ok = openEpochs(k, fallback, tokened, compact, padded, data, buf, spare)
+				if ok && block == k.next {
+					atomic.StoreUint32(&s.heardEpoch, k.nextEpoch)
+				}
+				return payload, block, ok
+			}
+		}
+	}
+	if keys != nil { // a new conversation, under the generation before within the overlap too
+		gens := epochKeys{cur: keys.block, prev: keys.prev, until: keys.until}
+		return openEpochs(&gens, nil, tokened, compact, padded, data, buf, spare)
+	}
+	payload, ok = openPacket(l.block, tokened, compact, padded, data, buf)
+	return payload, l.block, ok
+}
+
+// rekeyState is the key rotation of a session, protected by mu
+type rekeyState struct {
+	cfg     *RekeyConfig
+	epoch   uint32    // of the packets sent
+	pending uint32    // announced to the peer and not answered yet, 0 for none
+	sent    int64     // bytes sent in the epoch
+	since   time.Time // start of the epoch
+}
+
+// SetRekey rotates the key of the session, so no key encrypts more than cfg.Bytes or
+// for longer than cfg.Interval. The key of every epoch after the first derives from
+// cfg.Secret and conv with HKDF-SHA256; the first epoch is of the cipher the session
+// was made with. The end reaching a limit first announces the next epoch with
+// IKCP_CMD_REKEY, encrypted with the current key, and switches once the peer answers.
+// The previous key still decrypts for 30 seconds, for the packets in flight. Both ends
+// set it alike, like the key, an announcement the peer doesn't answer is given up and
+// tried again after the next limit. nil stops rotating, in the current epoch. Accepted
+// sessions follow the Listener.
+func (s *UDPSession) SetRekey(cfg *RekeyConfig) error {
+	if s.block == nil || s.l != nil {
+		return errors.New(errInvalidOperation)
+	}
+	if cfg != nil {
+		var err error
+		if cfg, err = cfg.validate(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setRekey(cfg)
+	return nil
+}
+
+// setRekey applies a validated configuration, s.mu must be held
+func (s *UDPSession) setRekey(cfg *RekeyConfig) {
+	s.rekey.cfg = cfg
+	s.rekey.sent, s.rekey.since = 0, time.Now()
+	if cfg == nil && s.rekey.pending != 0 {
+		s.abandonEpoch()
+	}
+}
+
+// SetRekey rotates the keys of the sessions accepted from now on, see
+// UDPSession.SetRekey
+func (l *Listener) SetRekey(cfg *RekeyConfig) error {
+	if l.block == nil {
+		return errors.New(errInvalidOperation)
+	}
+	if cfg != nil {
+		var err error
+		if cfg, err = cfg.validate(); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&l.rekeying, 1)
+	}
+	l.rekey.Store(cfg)
+	return nil
+}
+
+// epochKeys returns the ciphers of the epochs, nil while the session is in the first
+// epoch and announces none
+func (s *UDPSession) epochKeys() *epochKeys {
+	k, _ := s.keys.Load().(*epochKeys)
+	return k
+}
+
+// sendBlock returns the cipher of the packets sent
+func (s *UDPSession) sendBlock() BlockCrypt {
+	if k := s.epochKeys(); k != nil {
+		return k.cur
+	}
+	return s.block
+}
+
+// publishKeys makes k the ciphers of the reader of the packets, and of the listener,
+// s.mu must be held
+func (s *UDPSession) publishKeys(k *epochKeys) {
+	s.keys.Store(k)
+	if s.l != nil && !s.isClosed {
+		s.l.epochs.Store(s.remote.String(), s)
+	}
+}
+
+// checkRekey announces the next epoch once the current one reached a limit, or gives
+// up an announcement left unanswered, s.mu must be held
+func (s *UDPSession) checkRekey() {
+	r := &s.rekey
+	if r.pending != 0 {
+		if s.kcp.rekey_xmit == 0 && _itimediff(s.kcp.current, s.kcp.rekey_ts) >= 0 {
+			s.abandonEpoch()
+		}
+		return
+	}
+	if r.cfg == nil || s.isClosed ||
+		!(r.cfg.Bytes > 0 && r.sent >= r.cfg.Bytes || r.cfg.Interval > 0 && time.Since(r.since) >= r.cfg.Interval) {
+		return
+	}
+	k := epochKeys{cur: s.sendBlock(), nextEpoch: r.epoch + 1}
+	if old := s.epochKeys(); old != nil {
+		k.prev, k.until = old.prev, old.until
+		if old.nextEpoch == k.nextEpoch {
+			k.next = old.next // announced before
+		}
+	}
+	if k.next == nil {
+		next, err := r.cfg.epochKey(s.kcp.conv, k.nextEpoch)
+		if err != nil {
+			r.sent, r.since = 0, time.Now()
+			return
+		}
+		k.next = next
+	}
+	s.publishKeys(&k)
+	r.pending = k.nextEpoch
+	s.kcp.SetEpoch(r.pending)
+}
+
+// abandonEpoch gives up announcing the next epoch, the limits count anew. Its key
+// still decrypts: the peer may have switched, with its answers lost. s.mu must be held
+func (s *UDPSession) abandonEpoch() {
+	s.rekey.pending, s.rekey.sent, s.rekey.since = 0, 0, time.Now()
+	s.kcp.rekey_xmit = 0
+}
+
+// rekeyInput follows the epoch announcements and answers of the peer after an input,
+// s.mu must be held. A packet of the peer in the next epoch answers as well.
+func (s *UDPSession) rekeyInput() {
+	r := &s.rekey
+	if k := s.epochKeys(); k != nil && k.next != nil && k.nextEpoch == r.epoch+1 &&
+		(s.kcp.EpochAnswered() && s.kcp.rekey_epoch == k.nextEpoch || atomic.LoadUint32(&s.heardEpoch) == k.nextEpoch) {
+		s.switchEpoch(k.nextEpoch, k.next)
+	}
+	epoch := s.kcp.RemoteEpoch()
+	if epoch == 0 || r.cfg == nil { // unanswered, the peer gives up
+		return
+	}
+	switch epoch {
+	case r.epoch: // announced again, the answer was lost
+		s.kcp.AnswerEpoch(epoch)
+	case r.epoch + 1: // also when both ends announced it
+		next, err := r.cfg.epochKey(s.kcp.conv, epoch)
+		if k := s.epochKeys(); k != nil && k.next != nil && k.nextEpoch == epoch {
+			next, err = k.next, nil
+		}
+		if err != nil {
+			return
+		}
+		s.switchEpoch(epoch, next)
+		s.kcp.AnswerEpoch(epoch)
+	}
+}
+
+// switchEpoch sends with the cipher of epoch from now on, the previous one still
+// decrypts for rekeyOverlap, s.mu must be held
+func (s *UDPSession) switchEpoch(epoch uint32, block BlockCrypt) {
+	now := time.Now()
+	s.publishKeys(&epochKeys{cur: block, prev: s.sendBlock(), until: now.Add(rekeyOverlap)})
+	s.rekey.epoch, s.rekey.pending, s.rekey.sent, s.rekey.since = epoch, 0, 0, now
+	s.kcp.rekey_xmit = 0
+}
+
+// openPacket is decodePacket of a client session, with the keys of the epochs once it
+// rotates them, owned by the reader of the packets
+func (s *UDPSession) openPacket(token *packetToken, compact, padded bool, pkt, scratch []byte) ([]byte, int, bool) {
+	k := s.epochKeys()
+	if k == nil {
+		return decodePacket(s.block, token, compact, padded, s.headerSize, pkt, scratch)
+	}
+	if reason, ok := checkPacket(s.block, token, compact, s.headerSize, pkt); !ok {
+		return nil, reason, false
+	}
+	data, block, ok := openEpochs(k, nil, token != nil, compact, padded, pkt, scratch, &s.spare)
+	if !ok {
+		return nil, rejectChecksum, false
+	}
+	if block == k.next {
+		atomic.StoreUint32(&s.heardEpoch, k.nextEpoch)
+	}
+	return data, 0, true
+}
@@ -0,0 +1,101 @@
+package kcp
+
+import "sync"
+
+// RelayStats tells what a relay moved, and the stats of both legs once it ended
+type RelayStats struct {
+	AToB, BToA int64        // bytes relayed each way
+	A, B       SessionStats // of the legs
+}
+
+// Relay relays the data of two sessions both ways until they close, see RelayWithStats
+func Relay(a, b *UDPSession) error {
+	_, err := RelayWithStats(a, b)
+	return err
+}
+
+// RelayWithStats reads each session and writes the data to the other one, through a
+// pooled buffer in stream mode, and message by message in message mode. A leg slow to
+// take the data holds the Reads of the other back, so its receive window closes and
+// its peer waits in turn. Sessions have no half-close: when one leg ends, the other is
+// closed after the data received before, with the code and the reason the peer closed
+// the first with, see CloseWithError, or the reason of its close otherwise. It returns
+// once both ways are done, nil if the legs were closed by their peers or locally, or
+// the CloseError of the first leg that broke, a dead link or a transport failure.
+func RelayWithStats(a, b *UDPSession) (RelayStats, error) {
+	var stats RelayStats
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs <- relay(b, a, &stats.AToB)
+	}()
+	go func() {
+		defer wg.Done()
+		errs <- relay(a, b, &stats.BToA)
+	}()
+	wg.Wait()
+	close(errs)
+	var err error
+	for e := range errs {
+		if err == nil {
+			err = e
+		}
+	}
+	stats.A, stats.B = a.Stats(), b.Stats()
+	return stats, err
+}
+
+// relay copies src to dst, counting the bytes in n, and closes the leg left once
+// either ends. It returns the CloseError of a leg that broke, nil if it ended orderly.
+func relay(dst, src *UDPSession, n *int64) error {
+	var buf []byte
+	src.mu.Lock()
+	stream := src.kcp.stream != 0
+	src.mu.Unlock()
+	if stream {
+		buf = getXmitBuf()
+		defer putXmitBuf(buf)
+	} else {
+		buf = make([]byte, src.MaxMessageSize())
+	}
+
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if _, werr := dst.Write(buf[:nr]); werr != nil {
+				return relayClosed(src, dst, werr)
+			}
+			*n += int64(nr)
+		}
+		if err != nil {
+			return relayClosed(dst, src, err)
+		}
+	}
+}
+
+// relayClosed closes to as from failed with err, and returns the CloseError of from if
+// it broke. A failure of from while still open, a deadline or a stream checksum
+// mismatch, closes both and is returned.
+func relayClosed(to, from *UDPSession, err error) error {
+	if code, reason, ok := from.CloseStatus(); ok {
+		to.CloseWithError(code, reason)
+		return nil
+	}
+	from.mu.Lock()
+	closed, cerr := from.isClosed, from.closeError()
+	from.mu.Unlock()
+	if !closed {
+		from.Close()
+		to.Close()
+		return err
+	}
+	switch cerr.Kind {
+	case ClosedLocally, ClosedByPeer:
+		to.Close()
+		return nil
+	}
+	to.CloseWithError(0, cerr.Reason)
+	return cerr
+}
@@ -0,0 +1,133 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// punchInterval is the cadence of the punches of DialRendezvous
+const punchInterval = 100 * time.Millisecond
+
+// DialRendezvous establishes a session with a peer doing the same from its end, both
+// behind NATs, once a matchmaking server told each the address of the other. There's no
+// dialer: both ends send a window probe to peerAddr every 100ms, which opens their NAT
+// to the peer, until a valid packet of the peer gets through. The ends pick conversations
+// of their own, and settle on the smaller: an end hearing a smaller one takes it over,
+// one hearing a larger one waits for the peer to take its own. It returns once a packet
+// of the peer in the conversation arrived, or fails when ctx is done first. Datagrams
+// from other addresses are ignored. cfg, nil for the defaults, configures the session,
+// both ends must agree on the key and the FEC like for a dial. The session takes conn
+// over, and closes it on Close.
+func DialRendezvous(ctx context.Context, conn net.PacketConn, peerAddr string, block BlockCrypt, dataShards, parityShards int, cfg *SessionConfig) (*UDPSession, error) {
+	peer, err := net.ResolveUDPAddr("udp", peerAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
+	}
+	if cfg != nil {
+		headerSize := OverheadPerPacket(&PacketFormat{Encrypted: block != nil, FEC: dataShards > 0 && parityShards > 0})
+		if err := cfg.validate(headerSize); err != nil {
+			return nil, err
+		}
+	}
+
+	s := newUDPSession(ConvSource(), dataShards, parityShards, nil, &rendezvousConn{conn, peer}, peer, block)
+	if cfg != nil {
+		s.configure(cfg)
+	}
+	if err := s.punch(ctx); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// punch probes the peer every punchInterval until a valid packet of the peer arrives,
+// the session takes the conversation of the peer while it's smaller, see meet
+func (s *UDPSession) punch(ctx context.Context) error {
+	heard := make(chan struct{})
+	s.mu.Lock()
+	s.meeting = true
+	if atomic.LoadInt64(&s.lastRecv) == 0 {
+		s.chHeard = heard
+	} else {
+		close(heard)
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.meeting = false
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		s.kcp.probe |= IKCP_ASK_SEND
+		s.kcp.current = currentMs()
+		s.kcp.flush()
+		s.uncork()
+
+		select {
+		case <-heard:
+			return nil
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.die:
+			return ErrClosed
+		}
+	}
+}
+
+// meet tells whether a kcp packet of the peer goes on to the kcp input, s.mu must be
+// held. While the ends meet, a smaller conversation of the peer is taken over, and a
+// larger one dropped: the peer takes this one once it hears it.
+func (s *UDPSession) meet(pkt []byte) bool {
+	if !s.meeting {
+		return true
+	}
+	conv, ok := plainPacket(pkt, false)
+	if !ok {
+		return true // it fails the input
+	}
+	if conv > s.kcp.conv {
+		return false
+	}
+	s.kcp.conv = conv // nothing was sent in the conversation yet but probes
+	return true
+}
+
+// rendezvousConn is the socket of a session of DialRendezvous, it sends to the peer
+// only and drops the datagrams of other addresses
+type rendezvousConn struct {
+	net.PacketConn
+	peer *net.UDPAddr
+}
+
+// readPacket is the readPacket of the socket, skipping datagrams of other addresses
+func (c *rendezvousConn) readPacket(buf []byte) (n int, from net.Addr, truncated bool, err error) {
+	for {
+		n, from, truncated, err = readPacket(c.PacketConn, buf)
+		if err != nil {
+			return
+		}
+		if ua, ok := from.(*net.UDPAddr); ok && ua.Port == c.peer.Port && ua.IP.Equal(c.peer.IP) {
+			return
+		}
+	}
+}
+
+func (c *rendezvousConn) ReadFrom(buf []byte) (int, net.Addr, error) {
+	n, from, _, err := c.readPacket(buf)
+	return n, from, err
+}
+
+// WriteTo writes b to the peer, addr is ignored
+func (c *rendezvousConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(b, c.peer)
+}
@@ -0,0 +1,145 @@
+package kcp
+
+import "math/bits"
+
+const (
+	reorderBuckets = 32  // of reorderHist, distances up to 7 exactly, then one per doubling
+	reorderWindow  = 256 // segments per window of reorderState
+	fastResendMax  = 64  // the most fast resend tuning raises the threshold to
+)
+
+// reorderHist counts reordering distances
+type reorderHist struct {
+	n       uint32
+	max     uint32
+	buckets [reorderBuckets]uint32
+}
+
+// reorderBucket returns the bucket of distance d
+func reorderBucket(d uint32) int {
+	if d < 8 {
+		return int(d)
+	}
+	k := bits.Len32(d) + 4
+	if k >= reorderBuckets {
+		k = reorderBuckets - 1
+	}
+	return k
+}
+
+// reorderBound returns the largest distance of bucket k
+func reorderBound(k int) uint32 {
+	if k < 8 {
+		return uint32(k)
+	}
+	return 1<<uint(k-4) - 1
+}
+
+func (h *reorderHist) add(d uint32) {
+	h.n++
+	if d > h.max {
+		h.max = d
+	}
+	h.buckets[reorderBucket(d)]++
+}
+
+// reorderState measures how far data segments arrive behind the highest sequence
+// number received, over the current and the previous window of reorderWindow segments.
+// Retransmissions, sent after the highest segment, aren't reordered and not counted.
+type reorderState struct {
+	top, topTs uint32 // one past the highest sn received, and the ts it was sent with
+	started    bool   // a segment was received, top is set
+	cur, prev  reorderHist
+	late       uint64 // segments behind by the fast resend threshold or more
+	tune       bool   // the fast resend threshold follows the reordering, see tuned
+	base       int32  // the fast resend threshold as configured
+}
+
+// add records a new data segment sn sent at ts, resend is the fast resend threshold.
+// It returns true when a window is complete.
+func (r *reorderState) add(sn, ts uint32, resend int32) bool {
+	var d uint32
+	if !r.started || _itimediff(sn, r.top) >= 0 {
+		r.top, r.topTs, r.started = sn+1, ts, true
+	} else if _itimediff(ts, r.topTs) <= 0 {
+		d = r.top - 1 - sn
+		if resend <= 0 {
+			resend = IKCP_ACK_FAST
+		}
+		if d >= uint32(resend) {
+			r.late++
+		}
+	} else { // a retransmission
+		return false
+	}
+	r.cur.add(d)
+	if r.cur.n < reorderWindow {
+		return false
+	}
+	r.prev, r.cur = r.cur, reorderHist{}
+	return true
+}
+
+// stats returns the largest distance and the 99th percentile over both windows
+func (r *reorderState) stats() (max, p99 uint32) {
+	n := r.cur.n + r.prev.n
+	if n == 0 {
+		return 0, 0
+	}
+	max = r.cur.max
+	if r.prev.max > max {
+		max = r.prev.max
+	}
+	rank := n - n/100
+	var seen uint32
+	for k := 0; k < reorderBuckets; k++ {
+		if seen += r.cur.buckets[k] + r.prev.buckets[k]; seen >= rank {
+			p99 = reorderBound(k)
+			break
+		}
+	}
+	if p99 > max {
+		p99 = max
+	}
+	return max, p99
+}
+
+// tuned returns the fast resend threshold for the reordering measured: one above the
+// 99th percentile of the distances, so reordered segments aren't resent, and never
+// below the configured threshold
+func (r *reorderState) tuned() int32 {
+	if !r.tune || r.base <= 0 {
+		return r.base
+	}
+	_, p99 := r.stats()
+	resend := int32(p99) + 1
+	if resend > fastResendMax {
+		resend = fastResendMax
+	}
+	if resend < r.base {
+		resend = r.base
+	}
+	return resend
+}
+
+// ReorderStats describes the reordering of the data segments a session received, over
+// its last 256 to 512 new segments: how many sequence numbers a segment arrived behind
+// the highest one received. P99 is rounded up to a power of 2 from 8 on.
+type ReorderStats struct {
+	Max, P99   int
+	Late       uint64 // arrived FastResend or more behind, after the peer presumed them lost
+	FastResend int    // the fast resend threshold, raised above P99 by SetFastResendTuning
+}
+
+// SetFastResendTuning raises the fast resend threshold of SetNoDelay above the
+// reordering of the data received, see ReorderStats, so reordered segments aren't
+// resent: the reordering of the path back is taken for the path out. It follows every
+// 256 segments received, and never drops below the threshold of SetNoDelay, with fast
+// resend disabled it does nothing.
+func (c *KCPConn) SetFastResendTuning(enable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := &c.kcp.reorder
+	r.tune = enable
+	c.kcp.fastresend = r.tuned()
+}
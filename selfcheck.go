@@ -0,0 +1,156 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	selfCheckSize       = 8         // a CRC-64 in the stream
+	streamChecksumEvery = 16 * 1024 // bytes of data per checksum of SetStreamChecksum
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// ErrStreamChecksum is returned by Read once a checksum of SetStreamChecksum mismatched,
+// or the peer announced otherwise, the data past the bytes read can't be trusted
+var ErrStreamChecksum = errors.New("kcp: stream checksum mismatch")
+
+// selfCheck interleaves the byte stream of a connection with a rolling CRC-64 of the
+// data every `every` bytes, so data corrupted, lost or reordered anywhere between the
+// Write and the Read is caught by the receiver, see SetStreamChecksum
+type selfCheck struct {
+	every int
+	crc   uint64 // of the data so far
+	left  int    // bytes of data until the next checksum
+	sum   []byte // bytes of the checksum received so far, receiver only
+	pos   int64  // bytes of data so far
+	err   error  // the first mismatch, receiver only
+}
+
+func newSelfCheck(every int) *selfCheck {
+	return &selfCheck{every: every, left: every}
+}
+
+// insert returns the data of v with the checksums due in it, and its size
+func (s *selfCheck) insert(v [][]byte) (out [][]byte, size int) {
+	for _, b := range v {
+		for len(b) > 0 {
+			n := len(b)
+			if n > s.left {
+				n = s.left
+			}
+			s.crc = crc64.Update(s.crc, crc64Table, b[:n])
+			s.left -= n
+			s.pos += int64(n)
+			out = append(out, b[:n])
+			size += n
+			b = b[n:]
+			if s.left == 0 {
+				sum := make([]byte, selfCheckSize)
+				binary.LittleEndian.PutUint64(sum, s.crc)
+				out = append(out, sum)
+				size += selfCheckSize
+				s.left = s.every
+			}
+		}
+	}
+	return out, size
+}
+
+// strip verifies and removes the checksums in p in place, it returns the size of the
+// data left. Once a checksum mismatched, it keeps failing.
+func (s *selfCheck) strip(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for k := 0; k < len(p); {
+		if s.left > 0 {
+			m := len(p) - k
+			if m > s.left {
+				m = s.left
+			}
+			s.crc = crc64.Update(s.crc, crc64Table, p[k:k+m])
+			s.left -= m
+			s.pos += int64(m)
+			n += copy(p[n:], p[k:k+m])
+			k += m
+			continue
+		}
+		s.sum = append(s.sum, p[k])
+		k++
+		if len(s.sum) == selfCheckSize {
+			if binary.LittleEndian.Uint64(s.sum) != s.crc {
+				atomic.AddUint64(&DefaultSnmp.StreamCsumErrors, 1)
+				s.err = errors.Wrapf(ErrStreamChecksum, "at byte %v", s.pos)
+				return 0, s.err
+			}
+			s.sum, s.left = s.sum[:0], s.every
+		}
+	}
+	return n, nil
+}
+
+// setSelfCheck checksums the byte stream of the connection every `every` bytes, 0
+// disables it. The peer must check alike, both are set before any data is written.
+// Reads fail once a checksum mismatched. High priority writes overtake queued data, and
+// messages of SetReadCallback skip Read, neither may be used with it.
+func (c *KCPConn) setSelfCheck(every int) {
+	c.bufmu.Lock()
+	c.mu.Lock()
+	c.txCheck, c.rxCheck = nil, nil
+	if every > 0 {
+		c.txCheck, c.rxCheck = newSelfCheck(every), newSelfCheck(every)
+	}
+	c.mu.Unlock()
+	c.bufmu.Unlock()
+}
+
+// SetStreamChecksum interleaves a CRC-64 of the data written every 16 KB into the data
+// stream, which the Read of the peer verifies and strips. The checksums of the packets
+// cover a hop, a relay decrypting and encrypting again may corrupt the data unseen; this
+// one covers the way from Write to Read. A mismatch fails Read with ErrStreamChecksum for
+// good, and counts in Snmp.StreamCsumErrors. The ends announce it with CapStreamChecksum
+// and must both enable it before any data is exchanged, Read fails with ErrStreamChecksum
+// too once the peer announced otherwise. It fails once the session exchanged packets,
+// and for accepted sessions, which follow the Listener. High priority writes and
+// SetReadCallback can't be used with it.
+func (s *UDPSession) SetStreamChecksum(enable bool) error {
+	s.mu.Lock()
+	if s.l != nil || s.started() {
+		s.mu.Unlock()
+		return errors.New(errInvalidOperation)
+	}
+	s.announce(CapStreamChecksum, enable)
+	s.mu.Unlock()
+	every := 0
+	if enable {
+		every = streamChecksumEvery
+	}
+	s.setSelfCheck(every)
+	return nil
+}
+
+// SetStreamChecksum lets sessions accepted afterwards checksum their data stream like
+// UDPSession.SetStreamChecksum, the peers must enable it alike
+func (l *Listener) SetStreamChecksum(enable bool) {
+	if enable {
+		atomic.StoreInt32(&l.streamChecksum, 1)
+	} else {
+		atomic.StoreInt32(&l.streamChecksum, 0)
+	}
+}
+
+// checkStreamPeer fails the Reads once the peer announced the stream checksum otherwise,
+// s.mu must be held
+func (s *UDPSession) checkStreamPeer() {
+	if s.kcp.rmt_hello == 0 || (s.kcp.hello^s.kcp.rmt_hello)&CapStreamChecksum == 0 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&s.streamMismatch, 0, 1) {
+		atomic.AddUint64(&DefaultSnmp.StreamCsumErrors, 1)
+	}
+}
@@ -1,19 +1,22 @@
 package kcp
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/klauspost/crc32"
-
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type errTimeout struct {
@@ -27,51 +30,132 @@ func (errTimeout) Error() string   { return "i/o timeout" }
 const (
 	defaultWndSize           = 128 // default window size, in packet
 	nonceSize                = 16  // magic number
+	compactNonceSize         = 8   // packet counter replacing the nonce with CapCompactNonce
 	crcSize                  = 4   // 4bytes packet checksum
 	cryptHeaderSize          = nonceSize + crcSize
 	mtuLimit                 = 2048
 	txQueueLimit             = 8192
-	rxFECMulti               = 3 // FEC keeps rxFECMulti* (dataShard+parityShard) ordered packets in memory
+	rxFECMulti               = 3                // FEC keeps rxFECMulti* (dataShard+parityShard) ordered packets in memory
+	closeLinger              = 30 * time.Second // a closed session sends unacknowledged data for up to it
 	defaultKeepAliveInterval = 10 * time.Second
+	takeoverIdle             = 3 * defaultKeepAliveInterval // a session hearing nothing for it yields its address at once
+	takeoverTimeout          = 10 * time.Second             // a new conversation waiting to take an address over gives up then
+	defaultBacklog           = 1024                         // new sessions waiting to be accepted
+	rxQueueLimit             = 512                          // datagrams a client session reads ahead of their input
+	clientReadBuffer         = 4 << 20                      // socket read buffer of DialWithOptions, the kernel may cap it
+)
+
+const (
+	// ProtocolVersion is the wire protocol version negotiated between peers,
+	// version 0 stands for legacy peers without negotiation
+	ProtocolVersion = 1
+
+	// CapCompactNonce sends an 8 byte packet counter in place of the 16 byte random nonce
+	// of encrypted packets, see SetCompactNonce
+	CapCompactNonce = 1 << 0
+
+	// CapChecksum appends a CRC-32 of the datagram to unencrypted packets, so packets
+	// corrupted on the way are dropped rather than fed to kcp, see SetChecksum
+	CapChecksum = 1 << 1
+
+	// CapCloseStatus tells the peer why a session closes, see CloseWithError
+	CapCloseStatus = 1 << 2
+
+	// CapStreamChecksum interleaves a CRC-64 of the data every 16 KB into the data
+	// stream, see SetStreamChecksum
+	CapStreamChecksum = 1 << 3
+
+	// CapCompactHeader shortens the header of the segments from 24 to 12 bytes, see
+	// SetCompactHeader
+	CapCompactHeader = 1 << 4
+
+	// CapElideConv leaves the conversation id out of the datagrams with
+	// CapCompactHeader, see SetCompactHeader
+	CapElideConv = 1 << 5
+
+	// capabilities announced along with ProtocolVersion by default
+	localCapabilities = CapCloseStatus
 )
 
 const (
 	errBrokenPipe       = "broken pipe"
 	errInvalidOperation = "invalid operation"
+	errInvalidPacket    = "invalid packet"
 )
 
 var (
+	// xmitBuf holds *[mtuLimit]byte, pointers don't allocate when put in the pool
 	xmitBuf sync.Pool
 )
 
 func init() {
 	xmitBuf.New = func() interface{} {
-		return make([]byte, mtuLimit)
+		return new([mtuLimit]byte)
 	}
 }
 
+// getXmitBuf returns a buffer of mtuLimit bytes from xmitBuf
+func getXmitBuf() []byte {
+	return xmitBuf.Get().(*[mtuLimit]byte)[:]
+}
+
+// putXmitBuf recycles a buffer obtained from getXmitBuf
+func putXmitBuf(b []byte) {
+	xmitBuf.Put((*[mtuLimit]byte)(b[:mtuLimit]))
+}
+
 type (
 	// UDPSession defines a KCP session implemented by UDP
 	UDPSession struct {
-		kcp               *KCP           // the core ARQ
+		rejects           rejectCounters // packets from the peer rejected, first for 64bit atomic alignment
+		KCPConn                          // the transport independent part
 		l                 *Listener      // point to server listener if it's a server socket
 		fec               *FEC           // forward error correction
 		conn              net.PacketConn // the underlying packet socket
 		block             BlockCrypt
+		token             atomic.Value // *packetToken, optional packet token
 		remote            net.Addr
-		rd                time.Time // read deadline
-		wd                time.Time // write deadline
-		sockbuff          []byte    // kcp receiving is based on packet, I turn it into stream
-		die               chan struct{}
-		chReadEvent       chan struct{}
-		chWriteEvent      chan struct{}
-		chTicker          chan time.Time
-		chUDPOutput       chan []byte
+		gso               gsoState // UDP segmentation offload, platform specific
 		headerSize        int
-		ackNoDelay        bool
-		isClosed          bool
+		mtu               int           // datagram mtu
+		peerMtu           int           // datagram mtu announced by the peer, 0 if unknown, see PeerMtu
+		compact           bool          // packets are sent with CapCompactNonce
+		acceptCompact     int32         // CapCompactNonce has been announced, packets may come with it
+		counter           uint64        // packet counter of the compact nonce format
+		checksum          bool          // packets are sent with CapChecksum
+		acceptChecksum    int32         // CapChecksum has been announced, packets may come with it
+		checksummed       bool          // a packet came with CapChecksum, owned by the reader of the packets
+		padding           int32         // most bytes of padding of a packet, 0 for none, see SetPadding
+		fixedSize         int32         // size of every datagram, 0 for none, see SetFixedPacketSize
+		nonces            *nonceReader  // random nonces of encrypted packets, protected by mu
+		txpending         [][]byte      // packets waiting for the output scheduler of the listener, protected by its mutex
+		txscheduled       bool          // the session has its turn in the output scheduler
+		deficit           int           // bytes the session may still send in its turns
+		released          int32         // the socket has been released
+		convDraws         int           // conversation ids drawn again for a collision, see collided
+		pmtu              pmtuState     // mtu fallback, see SetMtuFallback
+		replays           replayState   // bursts of segments received again, see SoftErrors
+		mismatch          mismatchState // diagnosis of a misconfigured peer, see SessionStats.Mismatch
+		rekey             rekeyState    // key rotation, see SetRekey
+		keys              atomic.Value  // *epochKeys, nil in the first epoch
+		heardEpoch        uint32        // the next epoch a packet of the peer decrypted in
+		spare             []byte        // copy of a datagram for another key, owned by the reader of the packets
+		manual            *manualState  // driven by the application, see NewManualSession
+		txWire, rxWire    ewmaRate      // datagrams sent and received
+		txPad, rxPad      ewmaRate      // padding of the datagrams sent and received
 		keepAliveInterval time.Duration
-		mu                sync.Mutex
+		lastPing          time.Time
+		padIdle           time.Duration // a packet is sent once the session was idle for it, 0 for never, protected by mu
+		queued            time.Time     // it was queued to be accepted, see PreAccept
+		meeting           bool          // the conversation is yet to be settled with the peer, see DialRendezvous, protected by mu
+		preAccept         AcceptStats   // protected by mu
+		contending        time.Time     // since it waits to take its address over, zero for never, see Listener.packetInput, protected by mu
+
+		// fec encoding state
+		fecOffset  int // offset of fec header in packet
+		fecGroup   [][]byte
+		fecCnt     int
+		fecMaxSize int
 	}
 
 	setReadBuffer interface {
@@ -85,43 +169,102 @@ type (
 
 // newUDPSession create a new udp session for client or server
 func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn net.PacketConn, remote net.Addr, block BlockCrypt) *UDPSession {
+	sess := makeUDPSession(conv, dataShards, parityShards, l, conn, remote, block)
+	// the shared updater drives all sessions, only a client needs its own reader
+	updater.addSession(sess)
+	if sess.l == nil {
+		go sess.readLoop()
+	}
+	return sess
+}
+
+// makeUDPSession is newUDPSession without anything driving the session
+func makeUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn net.PacketConn, remote net.Addr, block BlockCrypt) *UDPSession {
 	sess := new(UDPSession)
-	sess.chTicker = make(chan time.Time, 1)
-	sess.chUDPOutput = make(chan []byte, txQueueLimit)
-	sess.die = make(chan struct{})
-	sess.chReadEvent = make(chan struct{}, 1)
-	sess.chWriteEvent = make(chan struct{}, 1)
 	sess.remote = remote
 	sess.conn = conn
 	sess.keepAliveInterval = defaultKeepAliveInterval
 	sess.l = l
 	sess.block = block
+	if l != nil {
+		if token, ok := l.token.Load().(*packetToken); ok {
+			sess.token.Store(token)
+		}
+		sess.budget = &l.budget
+		sess.padding = atomic.LoadInt32(&l.padding)
+		sess.padIdle = time.Duration(atomic.LoadInt64(&l.padIdle))
+		sess.fixedSize = atomic.LoadInt32(&l.fixedSize)
+		sess.holdLimit = int(atomic.LoadInt64(&l.holdLimit))
+		sess.onEvent = func(typ int) { l.emit(typ, sess, "") }
+	}
 	sess.fec = newFEC(rxFECMulti*(dataShards+parityShards), dataShards, parityShards)
-	// calculate header size
+	sess.headerSize = OverheadPerPacket(&PacketFormat{Encrypted: block != nil, FEC: sess.fec != nil})
 	if sess.block != nil {
-		sess.headerSize += cryptHeaderSize
+		sess.nonces = &nonceReader{raw: !NonceDRBG}
 	}
 	if sess.fec != nil {
-		sess.headerSize += fecHeaderSizePlus2
+		if sess.block != nil {
+			sess.fecOffset = cryptHeaderSize
+		}
+		cacheLine := make([]byte, sess.fec.shardSize*mtuLimit)
+		sess.fecGroup = make([][]byte, sess.fec.shardSize)
+		for k := range sess.fecGroup {
+			sess.fecGroup[k] = cacheLine[k*mtuLimit : (k+1)*mtuLimit]
+		}
 	}
 
-	sess.kcp = NewKCP(conv, func(buf []byte, size int) {
-		if size >= IKCP_OVERHEAD {
-			ext := xmitBuf.Get().([]byte)[:sess.headerSize+size]
-			copy(ext[sess.headerSize:], buf)
-			select {
-			case sess.chUDPOutput <- ext:
-			case <-sess.die:
-			}
+	transmit := sess.tx
+	if l != nil && l.manual == nil && l.sched != nil { // sessions sharing the listener socket take turns
+		transmit = func(txqueue [][]byte) { l.sched.enqueue(sess, txqueue) }
+	}
+	sess.init(NewKCP(conv, func(buf []byte, size int) {
+		if size >= compactOverhead {
+			sess.output(buf[:size])
+		}
+	}), transmit)
+	sess.lingers = true
+	sess.mtu = IKCP_MTU_DEF
+	if sess.fixedSize > 0 {
+		sess.mtu = int(sess.fixedSize)
+	}
+	sess.updateMtu()
+	caps := uint8(localCapabilities)
+	if l != nil && atomic.LoadInt32(&l.compact) != 0 {
+		caps |= CapCompactNonce
+	}
+	if l != nil && atomic.LoadInt32(&l.checksum) != 0 {
+		caps |= CapChecksum
+	}
+	if l != nil {
+		switch atomic.LoadInt32(&l.compactHeader) {
+		case HeaderCompact:
+			caps |= CapCompactHeader
+		case HeaderElided:
+			caps |= CapCompactHeader | CapElideConv
+		}
+	}
+	if l != nil && atomic.LoadInt32(&l.streamChecksum) != 0 {
+		caps |= CapStreamChecksum
+		sess.txCheck, sess.rxCheck = newSelfCheck(streamChecksumEvery), newSelfCheck(streamChecksumEvery)
+	}
+	binary.Read(rand.Reader, binary.LittleEndian, &sess.counter)
+	sess.kcp.SetHello(ProtocolVersion, caps, sess.l == nil)
+	sess.kcp.SetHeaderProfile(headerProfile(caps), HeaderLegacy)
+
+	if l != nil {
+		atomic.StoreInt32(&l.served, 1)
+		if cfg, ok := l.config.Load().(*SessionConfig); ok {
+			sess.configure(cfg)
+		}
+		if cfg, _ := l.rekey.Load().(*RekeyConfig); cfg != nil {
+			sess.setRekey(cfg)
+		}
+		if atomic.LoadInt32(&l.paused) != 0 {
+			sess.kcp.Pause(currentMs())
 		}
-	})
-	sess.kcp.WndSize(defaultWndSize, defaultWndSize)
-	sess.kcp.SetMtu(IKCP_MTU_DEF - sess.headerSize)
+	}
 
-	go sess.updateTask()
-	go sess.outputTask()
 	if sess.l == nil { // it's a client connection
-		go sess.readLoop()
 		atomic.AddUint64(&DefaultSnmp.ActiveOpens, 1)
 	} else {
 		atomic.AddUint64(&DefaultSnmp.PassiveOpens, 1)
@@ -135,207 +278,310 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	return sess
 }
 
-// Read implements the Conn Read method.
-func (s *UDPSession) Read(b []byte) (n int, err error) {
-	for {
-		s.mu.Lock()
-		if len(s.sockbuff) > 0 { // copy from buffer
-			n = copy(b, s.sockbuff)
-			s.sockbuff = s.sockbuff[n:]
-			s.mu.Unlock()
-			return n, nil
-		}
+// Close closes the connection like KCPConn.Close. The data written before, writes
+// held back by SetWriteDelay included, is still sent until it's acknowledged.
+func (s *UDPSession) Close() error {
+	return s.closeWith(closeLocal)
+}
 
-		if s.isClosed {
-			s.mu.Unlock()
-			return 0, errors.New(errBrokenPipe)
-		}
+// CloseWithError is Close telling the peer why: an application defined code, and a
+// reason, cut to fit a packet. They follow the data written before, and the peer
+// closes on them, see CloseStatus. Peers without CapCloseStatus aren't told.
+func (s *UDPSession) CloseWithError(code uint32, reason string) error {
+	s.mu.Lock()
+	if !s.isClosed && s.kcp.hello&s.kcp.rmt_hello&CapCloseStatus != 0 {
+		s.kcp.SetCloseStatus(code, reason)
+	}
+	s.mu.Unlock()
+	return s.closeWith(closeLocal)
+}
 
-		if !s.rd.IsZero() {
-			if time.Now().After(s.rd) { // timeout
-				s.mu.Unlock()
-				return 0, errTimeout{}
-			}
-		}
+// CloseStatus returns the code and the reason the peer closed the session with, see
+// CloseWithError. The session is closed then, Read returns the data received before,
+// then io.EOF. ok is false while the peer hasn't told any.
+func (s *UDPSession) CloseStatus() (code uint32, reason string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.RemoteCloseStatus()
+}
 
-		if n := s.kcp.PeekSize(); n > 0 { // data arrived
-			if len(b) >= n {
-				s.kcp.Recv(b)
-			} else {
-				buf := make([]byte, n)
-				s.kcp.Recv(buf)
-				n = copy(b, buf)
-				s.sockbuff = buf[n:] // store remaining bytes into sockbuff for next read
-			}
-			s.mu.Unlock()
-			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
-			return n, nil
-		}
+// closeWith closes the connection for reason. Data written and not acknowledged yet is
+// still sent after a local close, the session lingers until it's acknowledged, for up to
+// closeLinger or until the dead link limit, and releases the socket then.
+func (s *UDPSession) closeWith(reason string) error {
+	if !s.close(reason) {
+		return ErrClosed
+	}
+	s.mu.Lock()
+	contending := !s.contending.IsZero() // it never joined the listener
+	s.mu.Unlock()
+	if s.l != nil && !contending {
+		s.l.emit(closeEvent(reason), s, reason)
+	}
+	s.notifyState()
+	s.mu.Lock()
+	lingering := s.lingering
+	s.mu.Unlock()
+	if lingering {
+		return nil
+	}
+	return s.release()
+}
 
-		var timeout *time.Timer
-		var c <-chan time.Time
-		if !s.rd.IsZero() {
-			delay := s.rd.Sub(time.Now())
-			timeout = time.NewTimer(delay)
-			c = timeout.C
-		}
-		s.mu.Unlock()
+// release releases the socket of a closed session, once: a lingering session may be
+// done before closeWith checks it
+func (s *UDPSession) release() error {
+	if !atomic.CompareAndSwapInt32(&s.released, 0, 1) {
+		return nil
+	}
+	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
 
-		// wait for read event or timeout
-		select {
-		case <-s.chReadEvent:
-		case <-c:
-		case <-s.die:
+	if s.l == nil { // client socket close
+		if s.manual != nil { // the socket belongs to the application
+			return nil
 		}
+		return s.conn.Close()
+	}
+	if s.l.manual != nil { // the listener has no monitor
+		s.l.manual.release(s)
+		return nil
+	}
 
-		if timeout != nil {
-			timeout.Stop()
-		}
+	// the listener acquires s.mu while dispatching, so notify it without holding the lock
+	select {
+	case s.l.chDeadlinks <- s:
+	case <-s.l.die:
 	}
+	return nil
 }
 
-// Write implements the Conn Write method.
-func (s *UDPSession) Write(b []byte) (n int, err error) {
-	for {
-		s.mu.Lock()
-		if s.isClosed {
-			s.mu.Unlock()
-			return 0, errors.New(errBrokenPipe)
-		}
-
-		if !s.wd.IsZero() {
-			if time.Now().After(s.wd) { // timeout
-				s.mu.Unlock()
-				return 0, errTimeout{}
-			}
-		}
-
-		if s.kcp.WaitSnd() < int(s.kcp.snd_wnd) {
-			n = len(b)
-			max := s.kcp.mss << 8
-			for {
-				if len(b) <= int(max) { // in most cases
-					s.kcp.Send(b)
-					break
-				} else {
-					s.kcp.Send(b[:max])
-					b = b[max:]
-				}
-			}
-			s.kcp.current = currentMs()
-			s.kcp.flush()
-			s.mu.Unlock()
-			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
-			return n, nil
-		}
+// LocalAddr returns the local network address. The Addr returned is shared by all invocations of LocalAddr, so do not modify it.
+func (s *UDPSession) LocalAddr() net.Addr { return s.conn.LocalAddr() }
 
-		var timeout *time.Timer
-		var c <-chan time.Time
-		if !s.wd.IsZero() {
-			delay := s.wd.Sub(time.Now())
-			timeout = time.NewTimer(delay)
-			c = timeout.C
+// RemoteAddr returns the remote network address, the one settled on for sessions of
+// DialHost. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
+func (s *UDPSession) RemoteAddr() net.Addr {
+	if h, ok := s.conn.(*hostConn); ok {
+		if addr := h.RemoteAddr(); addr != nil {
+			return addr
 		}
-		s.mu.Unlock()
+	}
+	return s.remote
+}
 
-		// wait for write event or timeout
-		select {
-		case <-s.chWriteEvent:
-		case <-c:
-		case <-s.die:
-		}
+// String identifies the session for logging, like
+// "kcp conv=3735928559 127.0.0.1:20001 -> 10.0.0.2:4000 age=42s"
+func (s *UDPSession) String() string {
+	s.mu.Lock()
+	closed, reason, mismatch := s.isClosed, s.closeReason, s.mismatched()
+	s.mu.Unlock()
 
-		if timeout != nil {
-			timeout.Stop()
-		}
+	str := fmt.Sprintf("kcp conv=%v %v -> %v age=%v", s.GetConv(), s.LocalAddr(), s.RemoteAddr(), time.Since(s.created).Round(time.Second))
+	if closed {
+		str += " closed=" + strconv.Quote(reason)
+	} else if mismatch != "" {
+		str += " mismatch=" + strconv.Quote(mismatch)
 	}
+	return str
 }
 
-// Close closes the connection.
-func (s *UDPSession) Close() error {
+// SetMtu sets the maximum transmission unit of datagrams, it must leave room for
+// IKCP_MTU_MIN bytes behind the crypto and FEC headers and be at most mtuLimit.
+// It's safe at any time: queued data is split again for a smaller MTU, but segments
+// in flight keep their size until acknowledged, as the peer holds them under their
+// numbers. Accepted sessions take it from Listener.SetSessionConfig before any traffic.
+// Datagrams also stay within the mtu the peer announces, see PeerMtu. With a fixed
+// packet size, the mtu is the size.
+func (s *UDPSession) SetMtu(mtu int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.isClosed {
-		return errors.New(errBrokenPipe)
+	if fixed := int(atomic.LoadInt32(&s.fixedSize)); fixed > 0 && mtu != fixed ||
+		mtu > mtuLimit || mtu-s.headerSize-s.padRoom() < IKCP_MTU_MIN {
+		return errors.New(errInvalidOperation)
 	}
-	close(s.die)
-	s.isClosed = true
-	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
-	if s.l == nil { // client socket close
-		return s.conn.Close()
+	old := s.mtu
+	s.mtu = mtu
+	if err := s.updateMtu(); err != nil {
+		s.mtu = old
+		return err
 	}
+	return nil
+}
 
+// updateMtu sets the mtu of kcp from the datagram mtu, and announces it to the peer.
+// It fails and leaves both as they were if the packets have no room for a segment,
+// s.mu must be held.
+func (s *UDPSession) updateMtu() error {
+	f := s.packetFormat()
+	overhead := OverheadPerPacket(&f)
+	if s.kcp.SetMtu(s.wireMtu()-overhead+s.kcp.HeaderSaving()) < 0 {
+		return errors.New(errInvalidOperation)
+	}
+	s.kcp.SetHelloMtu(s.mtu, overhead)
 	return nil
 }
 
-// LocalAddr returns the local network address. The Addr returned is shared by all invocations of LocalAddr, so do not modify it.
-func (s *UDPSession) LocalAddr() net.Addr { return s.conn.LocalAddr() }
+// wireMtu returns the size of the largest datagram sent, the smaller of the datagram
+// mtu and the one of the peer, s.mu must be held
+func (s *UDPSession) wireMtu() int {
+	if s.peerMtu > 0 && s.peerMtu < s.mtu {
+		return s.peerMtu
+	}
+	return s.mtu
+}
 
-// RemoteAddr returns the remote network address. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
-func (s *UDPSession) RemoteAddr() net.Addr { return s.remote }
+// padRoom is the room the padding takes in a packet
+func (s *UDPSession) padRoom() int {
+	if atomic.LoadInt32(&s.fixedSize) > 0 {
+		return padLenSize
+	}
+	if padding := int(atomic.LoadInt32(&s.padding)); padding > 0 {
+		return padding + padLenSize
+	}
+	return 0
+}
 
-// SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
-func (s *UDPSession) SetDeadline(t time.Time) error {
+// SetPadding pads encrypted packets with a random number of bytes up to max, so the
+// sizes of datagrams tell less about the data they carry, and sends a packet whenever
+// the session was idle for idle, 0 for never. Padding isn't negotiated, the peer must
+// pad alike: it's set on both ends before use, like the key. The padding and its 2 byte
+// length are taken from the room for data in every packet. Accepted sessions follow
+// the Listener. A fixed packet size rules out the padding, idle still applies.
+func (s *UDPSession) SetPadding(max int, idle time.Duration) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.rd = t
-	s.wd = t
+	if s.block == nil || s.l != nil || max < 0 || idle < 0 ||
+		max > 0 && (s.mtu-s.headerSize-padLenSize-max < IKCP_MTU_MIN || atomic.LoadInt32(&s.fixedSize) > 0) {
+		return errors.New(errInvalidOperation)
+	}
+	if err := strictLate(s.started(), "SetPadding"); err != nil {
+		return err
+	}
+	old := atomic.LoadInt32(&s.padding)
+	atomic.StoreInt32(&s.padding, int32(max))
+	if err := s.updateMtu(); err != nil {
+		atomic.StoreInt32(&s.padding, old)
+		return err
+	}
+	s.padIdle = idle
 	return nil
 }
 
-// SetReadDeadline implements the Conn SetReadDeadline method.
-func (s *UDPSession) SetReadDeadline(t time.Time) error {
+// SetFixedPacketSize pads every encrypted datagram to exactly size bytes, so their
+// sizes tell nothing about the data they carry, 0 disables it and keeps the mtu. The
+// padding and its 2 byte length are encrypted along with the data, like those of
+// SetPadding, which it replaces. The size becomes the datagram mtu, the room for data
+// in every packet follows from it, see EffectiveMSS, and the mtu fallback no longer
+// applies. It isn't negotiated, the peer must pad alike, see SetPadding. It fails for
+// a size without room for the headers and a segment. Accepted sessions follow the
+// Listener.
+func (s *UDPSession) SetFixedPacketSize(size int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.rd = t
+	if s.block == nil || s.l != nil || !validFixedSize(size, s.headerSize) {
+		return errors.New(errInvalidOperation)
+	}
+	if err := strictLate(s.started(), "SetFixedPacketSize"); err != nil {
+		return err
+	}
+	fixed, padding, mtu := atomic.LoadInt32(&s.fixedSize), atomic.LoadInt32(&s.padding), s.mtu
+	atomic.StoreInt32(&s.fixedSize, int32(size))
+	if size > 0 {
+		atomic.StoreInt32(&s.padding, 0)
+		s.mtu = size
+	}
+	if err := s.updateMtu(); err != nil {
+		atomic.StoreInt32(&s.fixedSize, fixed)
+		atomic.StoreInt32(&s.padding, padding)
+		s.mtu = mtu
+		return err
+	}
 	return nil
 }
 
-// SetWriteDeadline implements the Conn SetWriteDeadline method.
-func (s *UDPSession) SetWriteDeadline(t time.Time) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.wd = t
-	return nil
+// validFixedSize tells whether datagrams of size bytes, 0 for none, hold headerSize
+// bytes of headers, the padding length and a segment. The compact nonce format pads
+// the plain packet to 8 bytes more, so it must fit the buffers too.
+func validFixedSize(size, headerSize int) bool {
+	return size == 0 || size-headerSize-padLenSize >= IKCP_MTU_MIN && size+nonceSize-compactNonceSize <= mtuLimit
 }
 
-// SetWindowSize set maximum window size
-func (s *UDPSession) SetWindowSize(sndwnd, rcvwnd int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.kcp.WndSize(sndwnd, rcvwnd)
+// padded tells whether the datagrams of the peer are padded
+func (s *UDPSession) padded() bool {
+	return atomic.LoadInt32(&s.padding) > 0 || atomic.LoadInt32(&s.fixedSize) > 0
 }
 
-// SetMtu sets the maximum transmission unit
-func (s *UDPSession) SetMtu(mtu int) {
+// SetCompactNonce announces CapCompactNonce to the peer, once both ends announced it
+// encrypted packets carry an 8 byte packet counter instead of the 16 byte random nonce,
+// 8 bytes more for data in every packet. Packet tokens keep the random nonce.
+// Accepted sessions follow the Listener.
+func (s *UDPSession) SetCompactNonce(enable bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.kcp.SetMtu(mtu - s.headerSize)
+	if s.block == nil || s.l != nil {
+		return errors.New(errInvalidOperation)
+	}
+	s.announce(CapCompactNonce, enable)
+	if enable {
+		atomic.StoreInt32(&s.acceptCompact, 1)
+	} else {
+		atomic.StoreInt32(&s.acceptCompact, 0)
+	}
+	s.negotiate()
+	return nil
 }
 
-// SetStreamMode toggles the stream mode on/off
-func (s *UDPSession) SetStreamMode(enable bool) {
+// SetChecksum announces CapChecksum to the peer, once both ends announced it
+// unencrypted packets carry a CRC-32 of the datagram behind the data, and packets
+// corrupted on the way are dropped and counted in SessionStats.Checksum instead of
+// desynchronizing kcp. Packets without the checksum are accepted until the first one
+// with it arrives, as the peer may not have switched yet. Encrypted packets are
+// checksummed already. Accepted sessions follow the Listener.
+func (s *UDPSession) SetChecksum(enable bool) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.block != nil || s.l != nil {
+		return errors.New(errInvalidOperation)
+	}
+	s.announce(CapChecksum, enable)
 	if enable {
-		s.kcp.stream = 1
+		atomic.StoreInt32(&s.acceptChecksum, 1)
 	} else {
-		s.kcp.stream = 0
+		atomic.StoreInt32(&s.acceptChecksum, 0)
 	}
+	s.negotiate()
+	return nil
 }
 
-// SetACKNoDelay changes ack flush option, set true to flush ack immediately,
-func (s *UDPSession) SetACKNoDelay(nodelay bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.ackNoDelay = nodelay
+// announce adds or removes a capability announced to the peer, s.mu must be held
+func (s *UDPSession) announce(capability uint8, enable bool) {
+	caps := uint8(s.kcp.hello) &^ capability
+	if enable {
+		caps |= capability
+	}
+	s.kcp.SetHello(ProtocolVersion, caps, true)
 }
 
-// SetNoDelay calls nodelay() of kcp
-func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.kcp.NoDelay(nodelay, interval, resend, nc)
+// negotiate switches to the compact nonce format, to CapChecksum or to the compact
+// header when both ends announced it, and keeps the datagrams within the mtu the peer announced, s.mu must
+// be held
+func (s *UDPSession) negotiate() {
+	compact := s.block != nil && s.kcp.hello&s.kcp.rmt_hello&CapCompactNonce != 0
+	checksum := s.block == nil && s.kcp.hello&s.kcp.rmt_hello&CapChecksum != 0
+	peerMtu, _ := s.kcp.RemoteMtu()
+	if peerMtu < IKCP_MTU_MIN+s.headerSize+s.padRoom() { // too small to carry a segment
+		peerMtu = 0
+	}
+	saving := s.kcp.HeaderSaving()
+	s.kcp.SetHeaderProfile(headerProfile(uint8(s.kcp.hello)), headerProfile(uint8(s.kcp.hello&s.kcp.rmt_hello)))
+	if compact != s.compact || checksum != s.checksum || peerMtu != s.peerMtu || saving != s.kcp.HeaderSaving() {
+		s.compact, s.checksum, s.peerMtu = compact, checksum, peerMtu
+		if s.updateMtu() != nil && s.peerMtu > 0 { // no room for a segment in datagrams of the peer mtu
+			s.peerMtu = 0
+			s.updateMtu()
+		}
+	}
+	s.checkStreamPeer()
 }
 
 // SetDSCP sets the 6bit DSCP field of IP header, no effect if it's accepted from Listener
@@ -352,6 +598,29 @@ func (s *UDPSession) SetDSCP(dscp int) error {
 	return errors.New(errInvalidOperation)
 }
 
+// SetTTL sets the IPv4 TTL or IPv6 hop limit of outgoing packets, accepted sessions
+// share the socket of the Listener, set it there instead
+func (s *UDPSession) SetTTL(ttl int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l == nil {
+		if nc, ok := s.conn.(*ConnectedUDPConn); ok {
+			return setTTL(nc.Conn, ttl)
+		} else if nc, ok := s.conn.(net.Conn); ok {
+			return setTTL(nc, ttl)
+		}
+	}
+	return errors.New(errInvalidOperation)
+}
+
+// setTTL sets the TTL or hop limit of a socket according to its address family
+func setTTL(nc net.Conn, ttl int) error {
+	if addr, ok := nc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len {
+		return ipv6.NewConn(nc).SetHopLimit(ttl)
+	}
+	return ipv4.NewConn(nc).SetTTL(ttl)
+}
+
 // SetReadBuffer sets the socket read buffer, no effect if it's accepted from Listener
 func (s *UDPSession) SetReadBuffer(bytes int) error {
 	s.mu.Lock()
@@ -376,6 +645,20 @@ func (s *UDPSession) SetWriteBuffer(bytes int) error {
 	return errors.New(errInvalidOperation)
 }
 
+// SetInterval is KCPConn.SetInterval, a session of NewManualSession or
+// NewManualListener is due for Drive at once
+func (s *UDPSession) SetInterval(d time.Duration) error {
+	if err := s.KCPConn.SetInterval(d); err != nil {
+		return err
+	}
+	if s.manual != nil {
+		s.mu.Lock()
+		s.manual.next = time.Time{}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
 // SetKeepAlive changes per-connection NAT keepalive interval; 0 to disable, default to 10s
 func (s *UDPSession) SetKeepAlive(interval int) {
 	s.mu.Lock()
@@ -383,174 +666,210 @@ func (s *UDPSession) SetKeepAlive(interval int) {
 	s.keepAliveInterval = time.Duration(interval) * time.Second
 }
 
-func (s *UDPSession) outputTask() {
-	// offset pre-compute
-	fecOffset := 0
-	if s.block != nil {
-		fecOffset = cryptHeaderSize
-	}
-	szOffset := fecOffset + fecHeaderSize
+// SetStateCallback calls fn with the new state whenever the session is suspended,
+// resumed or closed, see SetDeadLinkMode. fn is called in order from the updater or
+// the input path without holding the session lock, it must not block; nil removes it.
+func (s *UDPSession) SetStateCallback(fn func(state int)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onState = fn
+}
 
-	// fec data group
-	var cacheLine []byte
-	var fecGroup [][]byte
-	var fecCnt int
-	var fecMaxSize int
-	if s.fec != nil {
-		cacheLine = make([]byte, s.fec.shardSize*mtuLimit)
-		fecGroup = make([][]byte, s.fec.shardSize)
-		for k := range fecGroup {
-			fecGroup[k] = cacheLine[k*mtuLimit : (k+1)*mtuLimit]
-		}
+// SetMemoryBudget caps the memory held by all sessions of the listener: the segments
+// in their send and receive queues, and the unread rest of messages. The windows the
+// sessions advertise are capped so that, with what they hold, they stay within the
+// budget, and no session takes more than an equal share of it. Sessions below their
+// share always get a small window, so the budget may be exceeded by that much.
+// A session over its share, as others came, advertises a zero window while its
+// application leaves data unread, and its Writes wait until the data written before
+// has been acknowledged. 0 removes the cap.
+func (l *Listener) SetMemoryBudget(bytes int64) error {
+	if bytes < 0 {
+		return errors.New(errInvalidOperation)
 	}
+	atomic.StoreInt64(&l.budget.limit, bytes)
+	return nil
+}
 
-	// keepalive
-	var lastPing time.Time
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case ext := <-s.chUDPOutput:
-			var ecc [][]byte
-			if s.fec != nil {
-				s.fec.markData(ext[fecOffset:])
-				// explicit size
-				binary.LittleEndian.PutUint16(ext[szOffset:], uint16(len(ext[szOffset:])))
-
-				// copy data to fec group
-				sz := len(ext)
-				fecGroup[fecCnt] = fecGroup[fecCnt][:sz]
-				copy(fecGroup[fecCnt], ext)
-				fecCnt++
-				if sz > fecMaxSize {
-					fecMaxSize = sz
-				}
+// SetPacketToken enables a 4 byte token derived from key on every encrypted packet,
+// packets with a bad token are dropped before decryption, nil key disables it.
+// Both ends must agree, so set it right after dialing, before any Write.
+func (s *UDPSession) SetPacketToken(key []byte) error {
+	if s.block == nil {
+		return errors.New(errInvalidOperation)
+	}
+	s.mu.Lock()
+	if err := strictLate(s.started(), "SetPacketToken"); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.token.Store(newPacketToken(key))
+	s.updateMtu() // a packet token rules out the compact nonce format
+	s.mu.Unlock()
+	return nil
+}
 
-				//  calculate Reed-Solomon Erasure Code
-				if fecCnt == s.fec.dataShards {
-					for i := 0; i < s.fec.dataShards; i++ {
-						shard := fecGroup[i]
-						slen := len(shard)
-						xorBytes(shard[slen:fecMaxSize], shard[slen:fecMaxSize], shard[slen:fecMaxSize])
-					}
-					ecc = s.fec.calcECC(fecGroup, szOffset, fecMaxSize)
-					for k := range ecc {
-						s.fec.markFEC(ecc[k][fecOffset:])
-						ecc[k] = ecc[k][:fecMaxSize]
-					}
-					fecCnt = 0
-					fecMaxSize = 0
-				}
-			}
+// output is the KCP output callback, it wraps a KCP packet with FEC and
+// encryption headers and queues it for transmission, s.mu must be held
+func (s *UDPSession) output(buf []byte) {
+	if len(s.txqueue) >= s.txQueueLen { // never block the state machine on a slow socket
+		atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+		strictFail(strictTxDrop, "session %v to %v: transmit queue of %v packets full", s.ID(), s.remote, s.txQueueLen)
+		return
+	}
 
-			if s.block != nil {
-				io.ReadFull(rand.Reader, ext[:nonceSize])
-				checksum := crc32.ChecksumIEEE(ext[cryptHeaderSize:])
-				binary.LittleEndian.PutUint32(ext[nonceSize:], checksum)
-				s.block.Encrypt(ext, ext)
-
-				if ecc != nil {
-					for k := range ecc {
-						io.ReadFull(rand.Reader, ecc[k][:nonceSize])
-						checksum := crc32.ChecksumIEEE(ecc[k][cryptHeaderSize:])
-						binary.LittleEndian.PutUint32(ecc[k][nonceSize:], checksum)
-						s.block.Encrypt(ecc[k], ecc[k])
-					}
-				}
-			}
+	ext := getXmitBuf()[:s.headerSize+len(buf)]
+	copy(ext[s.headerSize:], buf)
 
-			//if rand.Intn(100) < 80 {
-			if n, err := s.conn.WriteTo(ext, s.remote); err == nil {
-				atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
-				atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
-			}
-			//}
+	var ecc [][]byte
+	if s.fec != nil {
+		szOffset := s.fecOffset + fecHeaderSize
+		s.fec.markData(ext[s.fecOffset:])
+		// explicit size
+		binary.LittleEndian.PutUint16(ext[szOffset:], uint16(len(ext[szOffset:])))
+
+		// copy data to fec group
+		sz := len(ext)
+		s.fecGroup[s.fecCnt] = s.fecGroup[s.fecCnt][:sz]
+		copy(s.fecGroup[s.fecCnt], ext)
+		s.fecCnt++
+		if sz > s.fecMaxSize {
+			s.fecMaxSize = sz
+		}
 
-			if ecc != nil {
-				for k := range ecc {
-					if n, err := s.conn.WriteTo(ecc[k], s.remote); err == nil {
-						atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
-						atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
-					}
-				}
+		//  calculate Reed-Solomon Erasure Code
+		if s.fecCnt == s.fec.dataShards {
+			for i := 0; i < s.fec.dataShards; i++ {
+				shard := s.fecGroup[i]
+				slen := len(shard)
+				xorBytes(shard[slen:s.fecMaxSize], shard[slen:s.fecMaxSize], shard[slen:s.fecMaxSize])
 			}
-			xmitBuf.Put(ext)
-		case <-ticker.C: // NAT keep-alive
-			if len(s.chUDPOutput) == 0 {
-				s.mu.Lock()
-				interval := s.keepAliveInterval
-				s.mu.Unlock()
-				if interval > 0 && time.Now().After(lastPing.Add(interval)) {
-					var rnd uint16
-					binary.Read(rand.Reader, binary.LittleEndian, &rnd)
-					sz := int(rnd)%(IKCP_MTU_DEF-s.headerSize-IKCP_OVERHEAD) + s.headerSize + IKCP_OVERHEAD
-					ping := make([]byte, sz) // randomized ping packet
-					io.ReadFull(rand.Reader, ping)
-					s.conn.WriteTo(ping, s.remote)
-					lastPing = time.Now()
-				}
+			ecc = s.fec.calcECC(s.fecGroup, szOffset, s.fecMaxSize)
+			for k := range ecc {
+				s.fec.markFEC(ecc[k][s.fecOffset:])
+				ecc[k] = ecc[k][:s.fecMaxSize]
 			}
-		case <-s.die:
-			return
+			s.fecCnt = 0
+			s.fecMaxSize = 0
 		}
 	}
-}
 
-// kcp update, input loop
-func (s *UDPSession) updateTask() {
-	var tc <-chan time.Time
-	if s.l == nil { // client
-		ticker := time.NewTicker(10 * time.Millisecond)
-		tc = ticker.C
-		defer ticker.Stop()
-	} else {
-		tc = s.chTicker
+	if s.block != nil {
+		ext = s.seal(ext)
+	} else if s.checksum {
+		ext = appendChecksum(ext)
 	}
-
-	for {
-		select {
-		case <-tc:
-			s.mu.Lock()
-			current := currentMs()
-			s.kcp.Update(current)
-			if s.kcp.WaitSnd() < 2*int(s.kcp.snd_wnd) {
-				s.notifyWriteEvent()
-			}
-			s.mu.Unlock()
-		case <-s.die:
-			if s.l != nil { // has listener
-				select {
-				case s.l.chDeadlinks <- s.remote:
-				case <-s.l.die:
-				}
-			}
-			return
+	if mtu := int(s.kcp.hello_mtu >> 16); len(ext) > mtu {
+		strictFail(strictOversized, "session %v to %v: datagram of %v bytes above the mtu of %v", s.ID(), s.remote, len(ext), mtu)
+	}
+	s.txqueue = append(s.txqueue, ext)
+
+	// the fec group is reused by the next packets, so parity shards are copied out
+	for k := range ecc {
+		pkt := getXmitBuf()[:len(ecc[k])]
+		copy(pkt, ecc[k])
+		if s.block != nil {
+			pkt = s.seal(pkt)
+		} else if s.checksum {
+			pkt = appendChecksum(pkt)
 		}
+		s.txqueue = append(s.txqueue, pkt)
 	}
 }
 
-// GetConv gets conversation id of a session
-func (s *UDPSession) GetConv() uint32 {
-	return s.kcp.conv
+// seal encrypts a packet with the packet token and the nonce format of the session
+func (s *UDPSession) seal(pkt []byte) []byte {
+	token, _ := s.token.Load().(*packetToken)
+	compact := s.compact && token == nil
+	size := len(pkt)
+	if fixed := int(atomic.LoadInt32(&s.fixedSize)); fixed > 0 {
+		if compact { // the first ciphertext block shrinks to the counter
+			fixed += nonceSize - compactNonceSize
+		}
+		pkt = padTo(pkt, fixed)
+	} else if padding := int(atomic.LoadInt32(&s.padding)); padding > 0 {
+		pkt = pad(pkt, padding, s.nonces)
+	}
+	if len(pkt) > size {
+		s.txPad.add(len(pkt)-size, time.Now())
+	}
+	pkt = encodePacket(s.sendBlock(), token, compact, s.counter, s.nonces, 0, pkt)
+	if compact {
+		s.counter++
+	}
+	if s.rekey.cfg != nil {
+		s.rekey.sent += int64(len(pkt))
+	}
+	return pkt
 }
 
-func (s *UDPSession) notifyReadEvent() {
-	select {
-	case s.chReadEvent <- struct{}{}:
-	default:
+// update is called by the updater, it returns the delay before the next
+// update, or false if the session has been closed
+func (s *UDPSession) update() (interval time.Duration, ok bool) {
+	s.mu.Lock()
+	if s.isClosed {
+		return s.linger()
+	}
+	if !s.kcp.paused {
+		s.probeMtu() // ahead of the update, so the probe follows the segments sent so far
+	}
+	s.checkRekey()
+	if !s.contending.IsZero() && s.kcp.rmt_wins == 0 {
+		s.kcp.probe |= IKCP_ASK_SEND // until the peer answers, see Listener.contenderInput
+	}
+	if s.padIdle > 0 && time.Since(s.LastSend()) >= s.padIdle {
+		s.kcp.probe |= IKCP_ASK_TELL // a window update, so idle times don't show either
+	}
+	interval, dead := s.updateKCP()
+	reason := closeDeadLink
+	if mismatch := s.mismatched(); dead && mismatch != "" {
+		reason += ", " + mismatch // it never heard the peer
+	}
+	if !s.contending.IsZero() && time.Since(s.contending) >= takeoverTimeout {
+		dead = true // the new conversation never answered
+	}
+
+	// NAT keep-alive, random data of a random size, sealed like any packet so the peer
+	// tells it from a mangled one
+	if s.keepAliveInterval > 0 && time.Now().After(s.lastPing.Add(s.keepAliveInterval)) {
+		var rnd uint16
+		binary.Read(rand.Reader, binary.LittleEndian, &rnd)
+		ping := getXmitBuf()[:int(rnd)%(int(s.kcp.mtu)-IKCP_OVERHEAD)]
+		io.ReadFull(rand.Reader, ping)
+		s.kcp.ping(ping)
+		putXmitBuf(ping)
+		s.lastPing = time.Now()
 	}
+	s.uncork()
+	if dead {
+		s.closeWith(reason)
+		return 0, false
+	}
+	return interval, true
 }
 
-func (s *UDPSession) notifyWriteEvent() {
-	select {
-	case s.chWriteEvent <- struct{}{}:
-	default:
+// linger keeps sending the data of a closed session until it's acknowledged,
+// s.mu must be held and is released
+func (s *UDPSession) linger() (interval time.Duration, ok bool) {
+	if !s.lingering {
+		s.mu.Unlock()
+		return 0, false
 	}
+	if (s.kcp.WaitSnd() > 0 || s.kcp.close_xmit > 0) && s.kcp.state != 0xFFFFFFFF && time.Since(s.closedAt) < closeLinger {
+		interval, _ = s.updateKCP()
+		s.uncork()
+		return interval, true
+	}
+	s.lingering = false
+	s.mu.Unlock()
+	s.release()
+	return 0, false
 }
 
-func (s *UDPSession) kcpInput(data []byte) {
-	current := currentMs()
+// kcpInput feeds a verified packet to kcp, size is the size of its datagram
+func (s *UDPSession) kcpInput(data []byte, size int) {
+	arrival := time.Since(epoch)
+	current := uint32(arrival/time.Millisecond) + chaosJitter()
 	if s.fec != nil {
 		f := s.fec.decode(data)
 		if f.flag == typeData || f.flag == typeFEC {
@@ -560,12 +879,18 @@ func (s *UDPSession) kcpInput(data []byte) {
 
 			if recovers := s.fec.input(f); recovers != nil {
 				s.mu.Lock()
-				s.kcp.current = current
+				s.kcp.current, s.kcp.arrival = current, arrival
 				for k := range recovers {
 					sz := binary.LittleEndian.Uint16(recovers[k])
 					if int(sz) <= len(recovers[k]) && sz >= 2 {
+						if !s.meet(recovers[k][2:sz]) {
+							continue
+						}
 						if ret := s.kcp.Input(recovers[k][2:sz], false); ret != 0 {
 							atomic.AddUint64(&DefaultSnmp.KCPInErrors, 1)
+						} else {
+							s.heard()
+							s.notifyReadable()
 						}
 					} else {
 						atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
@@ -574,196 +899,950 @@ func (s *UDPSession) kcpInput(data []byte) {
 				s.mu.Unlock()
 				atomic.AddUint64(&DefaultSnmp.FECRecovered, uint64(len(recovers)))
 			}
+		} else {
+			s.mu.Lock()
+			s.peerFailed(false)
+			s.mu.Unlock()
 		}
 		if f.flag == typeData {
 			s.mu.Lock()
-			s.kcp.current = current
-			if ret := s.kcp.Input(data[fecHeaderSizePlus2:], true); ret != 0 {
+			s.kcp.current, s.kcp.arrival = current, arrival
+			switch pkt := data[fecHeaderSizePlus2:]; {
+			case !s.meet(pkt): // a larger conversation of the peer, see DialRendezvous
+			case s.kcp.Input(pkt, true) != 0:
 				atomic.AddUint64(&DefaultSnmp.KCPInErrors, 1)
+				s.mtuFailed(size)
+				s.peerFailed(false)
+			default:
+				s.heard()
+				s.notifyReadable()
+				s.mtuPassed(size)
 			}
 			s.mu.Unlock()
 		}
 	} else {
 		s.mu.Lock()
-		s.kcp.current = current
-		if ret := s.kcp.Input(data, true); ret != 0 {
+		s.kcp.current, s.kcp.arrival = current, arrival
+		switch {
+		case !s.meet(data): // a larger conversation of the peer, see DialRendezvous
+		case s.kcp.Input(data, true) != 0:
 			atomic.AddUint64(&DefaultSnmp.KCPInErrors, 1)
+			s.mtuFailed(size)
+			s.peerFailed(false)
+		default:
+			s.heard()
+			s.notifyReadable()
+			s.mtuPassed(size)
 		}
 		s.mu.Unlock()
 	}
 
 	// notify reader
 	s.mu.Lock()
-	if n := s.kcp.PeekSize(); n > 0 {
-		s.notifyReadEvent()
-	}
-	if s.ackNoDelay {
-		s.kcp.current = current
-		s.kcp.flush()
+	s.negotiate()
+	s.rekeyInput()
+	s.checkReplays(time.Now())
+	_, _, peerClosed := s.kcp.RemoteCloseStatus()
+	peerClosed = peerClosed && !s.isClosed
+	convInUse := s.kcp.foreign && !s.collided() && !s.isClosed
+	if peerClosed {
+		s.kcp.flush() // the answer, the session is released at once
 	}
-	s.mu.Unlock()
+	s.inputDone(current)
 	atomic.AddUint64(&DefaultSnmp.InSegs, 1)
 	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
-}
-
-func (s *UDPSession) receiver(ch chan []byte) {
-	for {
-		data := xmitBuf.Get().([]byte)[:mtuLimit]
-		if n, _, err := s.conn.ReadFrom(data); err == nil && n >= s.headerSize+IKCP_OVERHEAD {
-			select {
-			case ch <- data[:n]:
-			case <-s.die:
-			}
-		} else if err != nil {
-			return
-		} else {
-			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+	now := time.Now()
+	s.rxWire.add(size, now)
+	if s.block != nil && s.padded() { // the rest of the datagram behind the crypto header
+		header := cryptHeaderSize
+		if s.compact {
+			header -= nonceSize - compactNonceSize
+		}
+		if padding := size - header - len(data); padding > 0 {
+			s.rxPad.add(padding, now)
 		}
 	}
+	if peerClosed {
+		s.closeWith(closePeer)
+	} else if convInUse {
+		s.closeWith(closeConvInUse)
+	}
 }
 
-// read loop for client session
-func (s *UDPSession) readLoop() {
-	chPacket := make(chan []byte, txQueueLimit)
-	go s.receiver(chPacket)
+// rejectFrom counts a datagram of size bytes rejected for reason if it comes from the
+// peer, plain tells it's a plain kcp packet of the session
+func (s *UDPSession) rejectFrom(from net.Addr, reason, size int, plain bool) {
+	if from != nil && from.String() == s.RemoteAddr().String() {
+		s.rejected(reason, size)
+		s.mu.Lock()
+		s.peerFailed(plain)
+		s.mu.Unlock()
+	}
+}
 
-	for {
-		select {
-		case data := <-chPacket:
-			raw := data
-			dataValid := false
-			if s.block != nil {
-				s.block.Decrypt(data, data)
-				data = data[nonceSize:]
-				checksum := crc32.ChecksumIEEE(data[crcSize:])
-				if checksum == binary.LittleEndian.Uint32(data) {
-					data = data[crcSize:]
-					dataValid = true
-				} else {
-					atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
-				}
-			} else if s.block == nil {
-				dataValid = true
-			}
+// checkSummed tells whether an unencrypted packet is accepted, summed tells it came
+// with CapChecksum. Once one did, the peer has switched, and packets without it are
+// corrupted, or reordered behind the switch. It's called by the reader of the packets.
+func (s *UDPSession) checkSummed(summed bool) bool {
+	if summed {
+		s.checksummed = true
+	} else if s.checksummed {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		return false
+	}
+	return true
+}
+
+// rejected counts a datagram of size bytes from the peer rejected for reason
+func (s *UDPSession) rejected(reason, size int) {
+	s.rejects.add(reason)
+	if reason == rejectChecksum {
+		strictFail(strictChecksum, "session %v from %v: checksum mismatch", s.ID(), s.remote)
+		s.mu.Lock()
+		s.softError(SoftChecksum, size, "datagram of %v bytes from %v failed the checksum", size, s.RemoteAddr())
+		s.mtuFailed(size)
+		s.mu.Unlock()
+	}
+}
 
-			if dataValid {
-				s.kcpInput(data)
+// SessionStats counts the packets from the peer of a session that were rejected,
+// they are mostly a sign of a middlebox mangling packets. When the first 8 datagrams of the peer all fail, before any passes, Mismatch tells
+// the likely cause: MismatchKey, MismatchUnencrypted or MismatchEncrypted. A session
+// closing as a dead link then says so in its reason.
+//
+// WriteToWire and WireToRead tell the time spent in the session from the time on
+// the network. WriteToWire runs from a Write to the first transmission of its data,
+// waiting for the window and the update interval, writes held back by SetWriteDelay
+// count from their handover; in stream mode, a Write appended to a segment still
+// queued isn't measured. The packets then wait for the socket,
+// see DebugState.TxQueue. WireToRead runs from the arrival of the datagram completing
+// a message to the Read returning it, in stream mode of every segment.
+type SessionStats struct {
+	Short       RejectStats    // shorter than the headers
+	Token       RejectStats    // bad packet token
+	Checksum    RejectStats    // checksum mismatch after decryption, or of CapChecksum
+	Truncated   RejectStats    // larger than the buffers, truncated by the socket, see Truncation
+	Buffered    int64          // bytes held in the queues of the session
+	State       int            // StateActive, StateSuspended or StateClosed
+	WriteToWire LatencyStats   // from Write to the first transmission
+	WireToRead  LatencyStats   // from the arrival to Read
+	Sent        TrafficStats   // data segments sent
+	Received    TrafficStats   // data segments received, retransmissions are duplicates
+	Congestion  bool           // the congestion window is enabled, see SetCongestionControl
+	Reorder     ReorderStats   // reordering of the data segments received
+	RTT         LatencyStats   // round trips measured from the acknowledgements, in ms steps
+	Mismatch    string         // a Mismatch diagnosis while the datagrams of the peer all fail the checks, "" if none
+	Epoch       uint32         // key epoch of the packets sent, see SetRekey
+	RTOs        uint64         // retransmission timeouts, those during the recovery from one not counted
+	Recovery    time.Duration  // spent recovering from them, until what was in flight at the rto is acknowledged, see SetRecoveryBurst
+	Seq         SeqStats       // sequence numbers taken by the data segments
+	SoftErrors  SoftErrorStats // anomalies that didn't close the session, see SoftErrors
+	DeadLink    DeadLinkStats  // the limits of the dead link, and the segments in flight against them
+}
+
+// Stats returns the rejection counters, the memory usage, the latencies, the traffic,
+// the congestion control, the reordering, the round trips, the diagnosis of the peer,
+// the key epoch, the recoveries from retransmission timeouts, the sequence numbers, the
+// soft errors and the dead link
+func (s *UDPSession) Stats() SessionStats {
+	s.mu.Lock()
+	buffered := int64(s.kcp.nsegs)*mtuLimit + atomic.LoadInt64(&s.sockbytes)
+	state := s.state
+	tx, rx := s.kcp.txLat.stats(), s.kcp.rxLat.stats()
+	sent, rcvd := s.kcp.tx, s.kcp.rx
+	congestion := s.kcp.nocwnd == 0
+	maxReorder, p99Reorder := s.kcp.reorder.stats()
+	reorder := ReorderStats{int(maxReorder), int(p99Reorder), s.kcp.reorder.late, int(s.kcp.fastresend)}
+	rtt := s.kcp.rtt.stats()
+	mismatch := s.mismatched()
+	epoch := s.rekey.epoch
+	rtos, recovery := s.kcp.rtos, time.Duration(s.kcp.rto_time)*time.Millisecond
+	seq := s.kcp.seqStats()
+	soft := s.softStats()
+	deadLink := s.deadLinkStats()
+	s.mu.Unlock()
+	return SessionStats{
+		Short:       s.rejects.stats(rejectShort),
+		Token:       s.rejects.stats(rejectToken),
+		Checksum:    s.rejects.stats(rejectChecksum),
+		Truncated:   s.rejects.stats(rejectTruncated),
+		Buffered:    buffered,
+		State:       state,
+		WriteToWire: tx,
+		WireToRead:  rx,
+		Sent:        sent,
+		Received:    rcvd,
+		Congestion:  congestion,
+		Reorder:     reorder,
+		RTT:         rtt,
+		Mismatch:    mismatch,
+		Epoch:       epoch,
+		RTOs:        rtos,
+		Recovery:    recovery,
+		Seq:         seq,
+		SoftErrors:  soft,
+		DeadLink:    deadLink,
+	}
+}
+
+// TrafficStats counts the data segments of one direction of a session, and their
+// payload bytes. A segment is either new, or a retransmission of one sent before.
+// Spurious retransmissions were not needed, the peer acknowledged an earlier
+// transmission; they're detected from the timestamps the acknowledgements echo.
+type TrafficStats struct {
+	Segments, Bytes               uint64 // new segments
+	RetransSegments, RetransBytes uint64 // retransmissions
+	Spurious                      uint64 // spurious retransmissions, of Sent only
+	Lost                          uint64 // retransmissions after the rto expired, of Sent only
+}
+
+// SeqStats counts the sequence numbers the data segments of a session took, in 64 bits.
+// Sequence numbers have 32 bits on the wire and wrap after 4G segments, which the
+// protocol handles; the counts go on past the wrap. An imported session counts from the
+// import.
+type SeqStats struct {
+	Sent, Received uint64 // taken by the segments sent, and by those received in order
+	ToWrap         uint64 // sequence numbers left before the next wrap in either direction, the smaller
+}
+
+func (t *TrafficStats) add(fresh bool, bytes int) {
+	if fresh {
+		t.Segments++
+		t.Bytes += uint64(bytes)
+	} else {
+		t.RetransSegments++
+		t.RetransBytes += uint64(bytes)
+	}
+}
+
+// RetransRatio returns the share of the bytes sent or received that were retransmissions
+func (t TrafficStats) RetransRatio() float64 {
+	if t.Bytes+t.RetransBytes == 0 {
+		return 0
+	}
+	return float64(t.RetransBytes) / float64(t.Bytes+t.RetransBytes)
+}
+
+// SessionState is a snapshot of the internals of a session, to find out why a transfer
+// stalled. It has only plain fields, it can be marshaled to JSON.
+type SessionState struct {
+	Conv                         uint32
+	State                        int       // StateActive, StateSuspended or StateClosed
+	SndQueue, SndBuf             int       // segments waiting for the window, and sent and not acknowledged
+	RcvQueue, RcvBuf             int       // segments ready for Read, and received out of order
+	SockBuf                      int       // bytes taken from the receive queue and not read yet
+	SndUna, SndNxt, RcvNxt       uint32    // sequence numbers
+	Cwnd, SndWnd, RcvWnd, RmtWnd uint32    // in segments, RmtWnd is the window advertised by the peer
+	Probe                        uint32    // window probe flags waiting to be sent
+	ProbeWait                    uint32    // ms between probes of a zero remote window, 0 if not probing
+	SRTT, RTO                    uint32    // ms
+	DeadLink                     bool      // a segment reached the retry limit
+	Paused                       bool      // see Pause
+	LastSend, LastRecv           time.Time // zero if nothing was sent or received
+	TxQueue                      int       // packets waiting to be written to the socket
+	TxPending                    int       // packets waiting for the output scheduler of the listener
+}
+
+// DebugState returns a snapshot of the queues, sequence numbers, windows and timers of
+// the session, all taken at once, except TxPending taken right after
+func (s *UDPSession) DebugState() SessionState {
+	s.mu.Lock()
+	st := SessionState{
+		Conv:      s.kcp.conv,
+		State:     s.state,
+		SndQueue:  len(s.kcp.snd_queue) + len(s.kcp.snd_queue_hi),
+		SndBuf:    len(s.kcp.snd_buf),
+		RcvQueue:  len(s.kcp.rcv_queue),
+		RcvBuf:    len(s.kcp.rcv_buf),
+		SockBuf:   int(atomic.LoadInt64(&s.sockbytes)),
+		SndUna:    s.kcp.snd_una,
+		SndNxt:    s.kcp.snd_nxt,
+		RcvNxt:    s.kcp.rcv_nxt,
+		Cwnd:      s.kcp.cwnd,
+		SndWnd:    s.kcp.snd_wnd,
+		RcvWnd:    s.kcp.rcv_wnd,
+		RmtWnd:    s.kcp.rmt_wnd,
+		Probe:     s.kcp.probe,
+		ProbeWait: s.kcp.probe_wait,
+		SRTT:      s.kcp.rx_srtt,
+		RTO:       s.kcp.rx_rto,
+		DeadLink:  s.kcp.state == 0xFFFFFFFF,
+		Paused:    s.kcp.paused,
+		LastSend:  s.LastSend(),
+		LastRecv:  s.LastRecv(),
+		TxQueue:   len(s.txqueue),
+	}
+	s.mu.Unlock()
+	if s.l != nil && s.l.sched != nil {
+		s.l.sched.mu.Lock()
+		st.TxPending = len(s.txpending)
+		s.l.sched.mu.Unlock()
+	}
+	return st
+}
+
+// Throughput returns the rates in bytes per second of the application payload written
+// and read, and of the datagrams sent and received including retransmissions, FEC and
+// headers. They are moving averages over about a second, which decay to zero when idle.
+func (s *UDPSession) Throughput() (txBps, rxBps, txWireBps, rxWireBps float64) {
+	now := time.Now()
+	return s.txRate.value(now), s.rxRate.value(now), s.txWire.value(now), s.rxWire.value(now)
+}
+
+// PaddingThroughput returns the rates in bytes per second of the padding of the
+// datagrams sent and received, see SetPadding and SetFixedPacketSize, along with its
+// length. They are part of the datagram rates of Throughput, and apart from the payload.
+func (s *UDPSession) PaddingThroughput() (txBps, rxBps float64) {
+	now := time.Now()
+	return s.txPad.value(now), s.rxPad.value(now)
+}
+
+// read loop for client session, it only reads, into pooled buffers, so a burst drains
+// from the socket while inputLoop verifies the datagrams and feeds them to kcp
+func (s *UDPSession) readLoop() {
+	ch := make(chan packet, rxQueueLimit)
+	defer close(ch)
+	go s.inputLoop(ch)
+	for {
+		buf := getXmitBuf()
+		n, from, truncated, err := readPacket(s.conn, buf)
+		if err != nil {
+			putXmitBuf(buf)
+			if isConnReset(err) { // the peer isn't up yet, or restarting
+				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				continue
 			}
-			xmitBuf.Put(raw)
-		case <-s.die:
+			s.closeWith(err.Error()) // unless the session closed the socket
 			return
+		} else if truncated {
+			putXmitBuf(buf)
+			s.truncated(from, n)
+			continue
+		}
+		ch <- packet{from: from, data: buf[:n], raw: buf, size: n}
+	}
+}
+
+// inputLoop feeds the datagrams read by readLoop to the session, until ch is closed
+func (s *UDPSession) inputLoop(ch chan packet) {
+	scratch := make([]byte, mtuLimit+nonceSize)
+	for p := range ch {
+		s.packetInput(p.data, p.from, scratch)
+		putXmitBuf(p.raw)
+	}
+}
+
+// packetInput verifies a datagram from the socket of a client session and feeds it
+// to kcp, scratch is the scratch space of decodePacket. It returns false if the
+// datagram was rejected.
+func (s *UDPSession) packetInput(pkt []byte, from net.Addr, scratch []byte) bool {
+	token, _ := s.token.Load().(*packetToken)
+	compact := atomic.LoadInt32(&s.acceptCompact) != 0
+	padded := s.padded()
+	var plain bool
+	if s.block != nil && s.LastRecv().IsZero() { // ahead of the decryption in place
+		conv, ok := plainPacket(pkt, s.fec != nil)
+		plain = ok && conv == s.GetConv()
+	}
+	data, reason, ok := s.openPacket(token, compact, padded, pkt, scratch)
+	if ok && s.block == nil && atomic.LoadInt32(&s.acceptChecksum) != 0 {
+		var summed bool
+		data, summed = stripChecksum(data)
+		if ok = s.checkSummed(summed); !ok {
+			reason = rejectChecksum
+		}
+	}
+	if ok {
+		if h, isHost := s.conn.(*hostConn); isHost {
+			h.heard(from)
 		}
+		s.kcpInput(data, len(pkt))
+	} else {
+		s.rejectFrom(from, reason, len(pkt), plain)
 	}
+	return ok
 }
 
 type (
 	// Listener defines a server listening for connections
 	Listener struct {
+		rejects                  rejectCounters // first for 64bit atomic alignment
+		budget                   memoryBudget   // shared by the sessions, 64bit aligned behind rejects
+		replaced                 uint64         // sessions taken over by a new conversation, 64bit aligned behind budget
+		eventsDropped            uint64         // see ListenerStats.EventsDropped, 64bit aligned behind replaced
+		mismatches               peerMismatches // diagnoses of addresses without a session
+		truncations              truncations    // addresses sending truncated datagrams
+		epochs                   sync.Map       // remote address → *UDPSession past its first key epoch
+		sched                    *txScheduler   // output scheduler of the sessions
 		block                    BlockCrypt
 		dataShards, parityShards int
 		fec                      *FEC // for fec init test
 		conn                     net.PacketConn
 		sessions                 map[string]*UDPSession
-		chAccepts                chan *UDPSession
-		chDeadlinks              chan net.Addr
+		contenders               map[string]*UDPSession // new conversations waiting to take the address of a live session over
+		accepts                  []*UDPSession          // sessions waiting to be accepted, oldest first
+		chAccept                 chan struct{}          // signaled when a session is queued to accepts
+		backlog                  int                    // the most sessions waiting to be accepted
+		chDeadlinks              chan *UDPSession
+		chImports                chan importRequest // sessions created by Import
+		chPause                  chan pauseRequest  // see PauseAll
+		manual                   *manualListener    // driven by the application, see NewManualListener
 		headerSize               int
+		cryptoWorkers            int32 // number of decryption goroutines
 		die                      chan struct{}
-		rxbuf                    sync.Pool
+		closed                   int32             // Close has been called
+		wg                       sync.WaitGroup    // goroutines of the listener, see CloseContext
+		token                    atomic.Value      // *packetToken, inherited by new sessions
+		config                   atomic.Value      // *SessionConfig of new sessions, optional
+		rekey                    atomic.Value      // *RekeyConfig of new sessions, see SetRekey
+		rekeying                 int32             // SetRekey has been called, l.epochs may hold sessions
+		crypto                   *CryptoContext    // the keys of new conversations, see ServeConnWithCrypto
+		compact                  int32             // CapCompactNonce is announced by new sessions
+		checksum                 int32             // CapChecksum is announced by new sessions
+		streamChecksum           int32             // CapStreamChecksum is announced by new sessions
+		compactHeader            int32             // the most compact header profile of new sessions, see SetCompactHeader
+		padding                  int32             // padding of the packets of the sessions, see SetPadding
+		padIdle                  int64             // idle time of the sessions before they send a packet, a time.Duration
+		fixedSize                int32             // size of the datagrams of the sessions, see SetFixedPacketSize
+		holdLimit                int64             // bytes a session holds until it's accepted, see SetPreAcceptBuffer
+		paused                   int32             // new sessions start paused, see PauseAll
+		served                   int32             // a session was created, see SetStrictMode
+		events                   atomic.Value      // chan SessionEvent, see Events
+		eventsOnce               sync.Once         // creates events
+		onAccept                 func(*UDPSession) // accept callback, replaces Accept
+		acceptCalled             bool              // Accept has been used
+		acceptMu                 sync.Mutex        // protects onAccept, acceptCalled, accepts and backlog
 		rd                       atomic.Value
 		wd                       atomic.Value
 	}
 
 	packet struct {
-		from net.Addr
-		data []byte
+		from     net.Addr
+		data     []byte
+		raw      []byte     // the buffer data points into, for recycling
+		size     int        // size of the datagram, data shrinks on decryption
+		summed   bool       // unencrypted, it came with CapChecksum
+		rejected bool       // for the monitor to count it for the session of from
+		reason   int        // why it was rejected
+		plain    bool       // a rejected plain kcp packet for an encrypting listener, see peerMismatches
+		block    BlockCrypt // the cipher it decrypted with, see openFrom
 	}
 )
 
+// reasons to reject a packet
+const (
+	rejectShort     = iota // shorter than the headers
+	rejectToken            // bad packet token
+	rejectChecksum         // checksum mismatch after decryption
+	rejectConv             // the first packet from an address has no conversation id
+	rejectBacklog          // a new session while the accept backlog is full
+	rejectTruncated        // larger than the buffer, truncated by the socket
+	numRejects
+)
+
+type rejectCounters [numRejects]struct {
+	count uint64
+	last  int64 // unix nanoseconds of the last rejection
+}
+
+func (r *rejectCounters) add(reason int) {
+	atomic.AddUint64(&r[reason].count, 1)
+	atomic.StoreInt64(&r[reason].last, time.Now().UnixNano())
+}
+
+func (r *rejectCounters) stats(reason int) (stats RejectStats) {
+	stats.Count = atomic.LoadUint64(&r[reason].count)
+	if last := atomic.LoadInt64(&r[reason].last); last != 0 {
+		stats.Last = time.Unix(0, last)
+	}
+	return stats
+}
+
+// RejectStats counts packets rejected for one reason
+type RejectStats struct {
+	Count uint64
+	Last  time.Time // zero if none rejected
+}
+
+// ListenerStats counts the packets a listener rejected, before they reach any session,
+// and the memory held by its sessions
+type ListenerStats struct {
+	Short         RejectStats // shorter than the headers
+	Token         RejectStats // bad packet token
+	Checksum      RejectStats // checksum mismatch after decryption, or of CapChecksum
+	Conv          RejectStats // the first packet from an address has no conversation id
+	Backlog       RejectStats // a new session while the accept backlog is full, see SetBacklog
+	Truncated     RejectStats // larger than the buffers, truncated by the socket, see Truncation
+	Buffered      int64       // bytes held in the queues of all sessions, see SetMemoryBudget
+	Replaced      uint64      // sessions whose address a new conversation took over, see EventKicked
+	TxQueued      int64       // bytes of the packets of all sessions waiting for the socket
+	EventsDropped uint64      // session events dropped as the consumer of Events was behind
+
+	// the latest addresses without a session whose first 8 datagrams all failed the
+	// checks, oldest first, up to 8: their ends are likely configured differently
+	Mismatches []PeerMismatch
+
+	// the latest addresses sending truncated datagrams, oldest first, up to 8
+	Truncations []Truncation
+}
+
+func (l *Listener) reject(reason int) {
+	l.rejects.add(reason)
+}
+
+// rejectFrom counts a packet rejected for reason, then hands it to the monitor to count
+// it for the session of its source address as well, unless the monitor is busy
+func (l *Listener) rejectFrom(ch chan packet, p packet, reason int) {
+	l.reject(reason)
+	p.rejected, p.reason = true, reason
+	select {
+	case ch <- p:
+	default:
+		putXmitBuf(p.raw)
+	}
+}
+
+// Stats returns the rejection counters of the listener
+func (l *Listener) Stats() ListenerStats {
+	return ListenerStats{
+		Short:         l.rejects.stats(rejectShort),
+		Token:         l.rejects.stats(rejectToken),
+		Checksum:      l.rejects.stats(rejectChecksum),
+		Conv:          l.rejects.stats(rejectConv),
+		Backlog:       l.rejects.stats(rejectBacklog),
+		Truncated:     l.rejects.stats(rejectTruncated),
+		Buffered:      atomic.LoadInt64(&l.budget.held),
+		Replaced:      atomic.LoadUint64(&l.replaced),
+		TxQueued:      l.txQueued(),
+		EventsDropped: atomic.LoadUint64(&l.eventsDropped),
+
+		Mismatches:  l.mismatches.latest(),
+		Truncations: l.truncations.latest(),
+	}
+}
+
+// txQueued returns the bytes pending in the output scheduler, none without one
+func (l *Listener) txQueued() int64 {
+	if l.sched == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.sched.pending)
+}
+
 // monitor incoming data for all connections of server
 func (l *Listener) monitor() {
 	chPacket := make(chan packet, txQueueLimit)
-	go l.receiver(chPacket)
-	ticker := time.NewTicker(10 * time.Millisecond)
-	defer ticker.Stop()
+	l.spawn(func() { l.receiver(chPacket) })
 	for {
 		select {
 		case p := <-chPacket:
-			raw := p.data
-			data := p.data
-			from := p.from
-			dataValid := false
-			if l.block != nil {
-				l.block.Decrypt(data, data)
-				data = data[nonceSize:]
-				checksum := crc32.ChecksumIEEE(data[crcSize:])
-				if checksum == binary.LittleEndian.Uint32(data) {
-					data = data[crcSize:]
-					dataValid = true
-				} else {
-					atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			if !p.rejected {
+				l.packetInput(p.data, p.from, p.size, p.summed, p.block)
+			} else if p.reason == rejectTruncated {
+				l.truncations.add(p.from, p.size)
+				if s, ok := l.sessions[p.from.String()]; ok {
+					s.truncated(p.from, p.size)
 				}
-			} else if l.block == nil {
-				dataValid = true
+			} else if s, ok := l.sessions[p.from.String()]; ok {
+				s.rejected(p.reason, p.size)
+			} else {
+				l.mismatches.failed(p.from, p.plain, l.block != nil)
 			}
+			putXmitBuf(p.raw)
+		case s := <-l.chDeadlinks:
+			l.forget(s)
+		case req := <-l.chImports:
+			req.reply <- l.importSession(req)
+		case req := <-l.chPause:
+			l.pauseSessions(req)
+		case <-l.die:
+			return
+		}
+	}
+}
 
-			if dataValid {
-				addr := from.String()
-				s, ok := l.sessions[addr]
-				if !ok { // new session
-					var conv uint32
-					convValid := false
-					if l.fec != nil {
-						isfec := binary.LittleEndian.Uint16(data[4:])
-						if isfec == typeData {
-							conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
-							convValid = true
-						}
-					} else {
-						conv = binary.LittleEndian.Uint32(data)
-						convValid = true
-					}
-
-					if convValid {
-						s := newUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, from, l.block)
-						s.kcpInput(data)
-						l.sessions[addr] = s
-						l.chAccepts <- s
-					}
-				} else {
-					s.kcpInput(data)
-				}
+// packetInput dispatches a verified packet to its session, creating the session on first contact,
+// size is the size of its datagram, summed tells it came with CapChecksum, block is the cipher
+// it decrypted with. It returns false if the packet was rejected.
+func (l *Listener) packetInput(data []byte, from net.Addr, size int, summed bool, block BlockCrypt) bool {
+	addr := from.String()
+	s, ok := l.sessions[addr]
+	conv, convValid, first := l.packetConv(data, s)
+	if c := l.contenders[addr]; c != nil && convValid && conv == c.kcp.conv {
+		return l.contenderInput(addr, c, data, size, summed)
+	}
+	if ok && first && conv != s.kcp.conv { // a client restarted on the same address
+		if l.manual == nil && !s.replaceable() {
+			// the session may be alive, the new conversation takes over once its peer
+			// proved to hear the listener, see contenderInput
+			if !l.acceptRoom() {
+				l.reject(rejectBacklog)
+				return false
 			}
+			c := l.newSession(conv, from, block)
+			l.bindKeys(addr, s) // the session keeps its keys until then
+			c.mu.Lock()
+			c.contending = time.Now()
+			c.kcp.probe |= IKCP_ASK_SEND
+			c.mu.Unlock()
+			l.contenders[addr] = c
+			return l.contenderInput(addr, c, data, size, summed)
+		}
+		l.kick(s)
+		ok = false
+	}
+	if !ok { // new session
+		if !convValid {
+			l.reject(rejectConv)
+			return false
+		} else if !l.acceptRoom() {
+			l.reject(rejectBacklog)
+			return false
+		}
+		l.mismatches.forget(addr)
+		l.epochs.Delete(addr) // the new conversation starts in the first epoch
+		s := l.newSession(conv, from, block)
+		s.checkSummed(summed)
+		s.kcpInput(data, size)
+		l.sessions[addr] = s
+		l.pushAccept(s)
+		l.emit(EventAccepted, s, "")
+	} else if s.checkSummed(summed) {
+		s.kcpInput(data, size)
+	} else {
+		l.reject(rejectChecksum)
+		s.rejected(rejectChecksum, size)
+		return false
+	}
+	return true
+}
 
-			l.rxbuf.Put(raw)
-		case deadlink := <-l.chDeadlinks:
-			delete(l.sessions, deadlink.String())
-		case <-l.die:
+// contenderInput feeds a packet to c, the session of a new conversation waiting to take
+// addr over. It does once the peer answered the window probes of c, which the peer of
+// a stray or replayed packet doesn't: the session at addr is closed, and c is
+// queued for Accept.
+func (l *Listener) contenderInput(addr string, c *UDPSession, data []byte, size int, summed bool) bool {
+	if !c.checkSummed(summed) {
+		l.reject(rejectChecksum)
+		c.rejected(rejectChecksum, size)
+		return false
+	}
+	c.kcpInput(data, size)
+	c.mu.Lock()
+	answered := c.kcp.rmt_wins != 0 && !c.isClosed
+	if answered {
+		c.contending = time.Time{}
+	}
+	c.mu.Unlock()
+	if !answered {
+		return true
+	}
+	delete(l.contenders, addr)
+	if s, ok := l.sessions[addr]; ok {
+		l.kick(s)
+	}
+	l.mismatches.forget(addr)
+	l.epochs.Delete(addr) // the new conversation starts in the first epoch
+	l.bindKeys(addr, c)
+	l.sessions[addr] = c
+	l.pushAccept(c)
+	l.emit(EventAccepted, c, "")
+	return true
+}
+
+// replaceable tells whether a new conversation may take the address of s over at once:
+// s is closed, its link is dead, or it heard nothing for takeoverIdle
+func (s *UDPSession) replaceable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isClosed || s.state == StateSuspended || time.Since(s.LastRecv()) >= takeoverIdle
+}
+
+// kick takes the address of s over for a new conversation and closes s, so it sends
+// nothing more to the peer of the new one. Its application may still read the data
+// received.
+func (l *Listener) kick(s *UDPSession) {
+	atomic.AddUint64(&l.replaced, 1)
+	delete(l.sessions, s.remote.String())
+	// closing notifies the monitor through chDeadlinks, so it can't wait here
+	go s.closeWith(closeReplaced)
+}
+
+// forget drops the closed session s from its address, unless a new conversation took
+// the address over already
+func (l *Listener) forget(s *UDPSession) {
+	addr := s.remote.String()
+	if l.sessions[addr] == s {
+		delete(l.sessions, addr)
+		l.epochs.Delete(addr)
+	}
+	if l.contenders[addr] == s {
+		delete(l.contenders, addr)
+	}
+}
+
+// newSession creates the session of a new peer at from, with the cipher block of its first packet
+func (l *Listener) newSession(conv uint32, from net.Addr, block BlockCrypt) *UDPSession {
+	if l.manual != nil {
+		s := makeUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, from, block)
+		s.manual = &manualState{scratch: make([]byte, mtuLimit+nonceSize)}
+		l.bindKeys(from.String(), s)
+		return s
+	}
+	s := newUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, from, block)
+	l.bindKeys(from.String(), s)
+	return s
+}
+
+// packetConv returns the conversation id of a verified packet, ok is false for FEC parity
+// packets. first tells it starts a conversation: its first segment announces the
+// capabilities of the peer, or pushes the first data for peers without negotiation.
+// s is the session of the address, nil for none, the packets of which may leave the
+// conversation id out.
+func (l *Listener) packetConv(data []byte, s *UDPSession) (conv uint32, ok, first bool) {
+	if l.fec != nil {
+		if binary.LittleEndian.Uint16(data[4:]) != typeData {
+			return 0, false, false
+		}
+		data = data[fecHeaderSizePlus2:]
+	}
+	if s != nil && len(data) > 0 && l.elided(s, data) {
+		return s.kcp.conv, true, false
+	}
+	if len(data) < IKCP_OVERHEAD {
+		return binary.LittleEndian.Uint32(data), true, false
+	}
+	conv = binary.LittleEndian.Uint32(data)
+	length := binary.LittleEndian.Uint32(data[20:])
+	switch data[4] {
+	case IKCP_CMD_HELLO: // the size tells it from the random bytes of a keepalive ping
+		first = data[5] != IKCP_HELLO_REPLY && (length == 2 || length == 6) && uint64(length) <= uint64(len(data)-IKCP_OVERHEAD)
+	case IKCP_CMD_PUSH:
+		first = binary.LittleEndian.Uint32(data[12:]) == 0 && uint64(length) <= uint64(len(data)-IKCP_OVERHEAD)
+	}
+	return conv, true, first
+}
+
+// cryptoWorker decrypts packets from in and forwards valid ones to out,
+// packets from the same address always go to the same worker, so their order is kept
+func (l *Listener) cryptoWorker(in chan packet, out chan packet) {
+	scratch := make([]byte, mtuLimit+nonceSize)
+	var spare []byte // see openEpochs
+	for p := range in {
+		select {
+		case <-l.die: // abandon the packets in flight
 			return
-		case <-ticker.C:
-			now := time.Now()
-			for _, s := range l.sessions {
-				select {
-				case s.chTicker <- now:
-				default:
-				}
+		default:
+		}
+		token, _ := l.token.Load().(*packetToken)
+		compact := atomic.LoadInt32(&l.compact) != 0
+		padded := l.padded()
+		_, plain := plainPacket(p.data, l.fec != nil) // ahead of the decryption in place
+		if data, block, ok := l.openFrom(p.from, token != nil, compact, padded, p.data, scratch, &spare); ok {
+			p.data, p.block = data, block
+			select {
+			case out <- p:
+			case <-l.die:
+				return
 			}
+		} else {
+			p.plain = plain
+			l.rejectFrom(out, p, rejectChecksum)
 		}
 	}
 }
 
 func (l *Listener) receiver(ch chan packet) {
+	var workers []chan packet
+	var pool sync.WaitGroup // the workers of the current pool
+	defer func() {
+		for k := range workers {
+			close(workers[k])
+		}
+	}()
+
 	for {
-		data := l.rxbuf.Get().([]byte)[:mtuLimit]
-		if n, from, err := l.conn.ReadFrom(data); err == nil && n >= l.headerSize+IKCP_OVERHEAD {
-			ch <- packet{from, data[:n]}
-		} else if err != nil {
+		select {
+		case <-l.die:
+			return
+		default:
+		}
+		data := getXmitBuf()
+		n, from, truncated, err := readPacket(l.conn, data)
+		if err != nil {
+			if isConnReset(err) { // an ICMP error of a datagram sent to some peer
+				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				putXmitBuf(data)
+				continue
+			}
+			return
+		}
+
+		// the checks before decryption are cheap, so garbage is dropped before it reaches the workers
+		token, _ := l.token.Load().(*packetToken)
+		compact := atomic.LoadInt32(&l.compact) != 0
+		p := packet{from: from, data: data[:n], raw: data, size: n}
+		if truncated {
+			l.rejectFrom(ch, p, rejectTruncated)
+			continue
+		}
+		if reason, ok := checkPacket(l.block, token, compact, l.headerSize, p.data); !ok {
+			if l.block != nil {
+				_, p.plain = plainPacket(p.data, l.fec != nil)
+			}
+			l.rejectFrom(ch, p, reason)
+			continue
+		}
+		if l.block == nil {
+			if atomic.LoadInt32(&l.checksum) != 0 {
+				p.data, p.summed = stripChecksum(p.data)
+			}
+			select {
+			case ch <- p:
+			case <-l.die:
+				return
+			}
+			continue
+		}
+
+		// the receiver is the only sender to the workers, so it's safe to resize the pool here,
+		// the old workers forward the packets they hold first, so those of an address stay in order
+		if nworkers := int(atomic.LoadInt32(&l.cryptoWorkers)); nworkers != len(workers) {
+			for k := range workers {
+				close(workers[k])
+			}
+			pool.Wait()
+			workers = make([]chan packet, nworkers)
+			for k := range workers {
+				in := make(chan packet, txQueueLimit/nworkers)
+				workers[k] = in
+				pool.Add(1)
+				l.spawn(func() {
+					defer pool.Done()
+					l.cryptoWorker(in, ch)
+				})
+			}
+		}
+
+		select {
+		case workers[addrHash(from)%uint32(len(workers))] <- p:
+		case <-l.die:
 			return
-		} else {
-			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
 		}
 	}
 }
 
+// addrHash computes FNV-1a of a remote address
+func addrHash(addr net.Addr) uint32 {
+	const prime = 16777619
+	h := uint32(2166136261)
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		for _, b := range ua.IP {
+			h = (h ^ uint32(b)) * prime
+		}
+		h = (h ^ uint32(ua.Port&0xff)) * prime
+		h = (h ^ uint32(ua.Port>>8)) * prime
+		return h
+	}
+
+	str := addr.String()
+	for i := 0; i < len(str); i++ {
+		h = (h ^ uint32(str[i])) * prime
+	}
+	return h
+}
+
+// SetCryptoWorkers sets the number of goroutines decrypting incoming packets, default to runtime.NumCPU()
+func (l *Listener) SetCryptoWorkers(n int) error {
+	if n <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	atomic.StoreInt32(&l.cryptoWorkers, int32(n))
+	return nil
+}
+
+// SetCompactNonce lets sessions accepted afterwards use CapCompactNonce with peers
+// announcing it, see UDPSession.SetCompactNonce. Packets of other peers then cost
+// a second decryption attempt.
+func (l *Listener) SetCompactNonce(enable bool) error {
+	if l.block == nil {
+		return errors.New(errInvalidOperation)
+	}
+	if enable {
+		atomic.StoreInt32(&l.compact, 1)
+	} else {
+		atomic.StoreInt32(&l.compact, 0)
+	}
+	return nil
+}
+
+// SetPadding pads the packets of the sessions like UDPSession.SetPadding, the
+// listener verifies them before dispatching, so it applies to all sessions: set it
+// before any is accepted.
+func (l *Listener) SetPadding(max int, idle time.Duration) error {
+	if l.block == nil || max < 0 || idle < 0 ||
+		max > 0 && (IKCP_MTU_DEF-l.headerSize-padLenSize-max < IKCP_MTU_MIN || atomic.LoadInt32(&l.fixedSize) > 0) {
+		return errors.New(errInvalidOperation)
+	}
+	if err := strictLate(atomic.LoadInt32(&l.served) != 0, "Listener.SetPadding"); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.padding, int32(max))
+	atomic.StoreInt64(&l.padIdle, int64(idle))
+	return nil
+}
+
+// SetFixedPacketSize pads the datagrams of the sessions to size bytes like
+// UDPSession.SetFixedPacketSize, it applies to all sessions like SetPadding: set it
+// before any is accepted.
+func (l *Listener) SetFixedPacketSize(size int) error {
+	if l.block == nil || !validFixedSize(size, l.headerSize) {
+		return errors.New(errInvalidOperation)
+	}
+	if err := strictLate(atomic.LoadInt32(&l.served) != 0, "Listener.SetFixedPacketSize"); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.fixedSize, int32(size))
+	if size > 0 {
+		atomic.StoreInt32(&l.padding, 0)
+	}
+	return nil
+}
+
+// padded tells whether the datagrams of the peers are padded
+func (l *Listener) padded() bool {
+	return atomic.LoadInt32(&l.padding) > 0 || atomic.LoadInt32(&l.fixedSize) > 0
+}
+
+// SetChecksum lets sessions accepted afterwards use CapChecksum with peers
+// announcing it, see UDPSession.SetChecksum. Only unencrypted listeners may
+// enable it, corrupted packets are counted in ListenerStats.Checksum as well.
+func (l *Listener) SetChecksum(enable bool) error {
+	if l.block != nil {
+		return errors.New(errInvalidOperation)
+	}
+	if enable {
+		atomic.StoreInt32(&l.checksum, 1)
+	} else {
+		atomic.StoreInt32(&l.checksum, 0)
+	}
+	return nil
+}
+
+// SetPacketToken enables a 4 byte token derived from key on every encrypted packet,
+// packets with a bad token are dropped before decryption, nil key disables it.
+// It applies to sessions accepted afterwards.
+func (l *Listener) SetPacketToken(key []byte) error {
+	if l.block == nil {
+		return errors.New(errInvalidOperation)
+	}
+	if err := strictLate(atomic.LoadInt32(&l.served) != 0, "Listener.SetPacketToken"); err != nil {
+		return err
+	}
+	l.token.Store(newPacketToken(key))
+	return nil
+}
+
 // SetReadBuffer sets the socket read buffer for the Listener
 func (l *Listener) SetReadBuffer(bytes int) error {
 	if nc, ok := l.conn.(setReadBuffer); ok {
@@ -788,6 +1867,14 @@ func (l *Listener) SetDSCP(dscp int) error {
 	return errors.New(errInvalidOperation)
 }
 
+// SetTTL sets the IPv4 TTL or IPv6 hop limit of outgoing packets for all accepted sessions
+func (l *Listener) SetTTL(ttl int) error {
+	if nc, ok := l.conn.(net.Conn); ok {
+		return setTTL(nc, ttl)
+	}
+	return errors.New(errInvalidOperation)
+}
+
 // Accept implements the Accept method in the Listener interface; it waits for the next call and returns a generic Conn.
 func (l *Listener) Accept() (net.Conn, error) {
 	return l.AcceptKCP()
@@ -795,18 +1882,191 @@ func (l *Listener) Accept() (net.Conn, error) {
 
 // AcceptKCP accepts a KCP connection
 func (l *Listener) AcceptKCP() (*UDPSession, error) {
+	l.acceptMu.Lock()
+	if l.onAccept != nil {
+		l.acceptMu.Unlock()
+		return nil, errors.New(errInvalidOperation)
+	}
+	l.acceptCalled = true
+	l.acceptMu.Unlock()
+
 	var timeout <-chan time.Time
 	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
 		timeout = time.After(tdeadline.Sub(time.Now()))
 	}
 
+	for {
+		if s := l.popAccept(); s != nil {
+			return s, nil
+		}
+		select {
+		case <-timeout:
+			return nil, &errTimeout{}
+		case <-l.chAccept:
+		case <-l.die:
+			return nil, errors.New(errBrokenPipe)
+		}
+	}
+}
+
+// AcceptWithPreface accepts a KCP connection along with up to maxBytes of the first
+// message it received, so the message can be checked, an authentication token say,
+// before anything is set up for the session. The preface is consumed, Read returns
+// the data after it. Sessions are taken in order and wait for their first message
+// until the listener deadline, on timeout the session waiting is closed. Sessions
+// closed by the peer before sending anything are skipped.
+func (l *Listener) AcceptWithPreface(maxBytes int) (*UDPSession, []byte, error) {
+	if maxBytes <= 0 {
+		return nil, nil, errors.New(errInvalidOperation)
+	}
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return nil, nil, err
+		}
+		tdeadline, _ := l.rd.Load().(time.Time)
+		s.SetReadDeadline(tdeadline)
+		preface := make([]byte, maxBytes)
+		n, err := s.Read(preface)
+		s.SetReadDeadline(time.Time{})
+		if err == nil {
+			return s, preface[:n], nil
+		}
+		s.Close()
+		if err != io.EOF {
+			return nil, nil, err
+		}
+	}
+}
+
+// OnAccept delivers new sessions to fn instead of Accept, sessions already waiting
+// to be accepted are delivered first. fn runs on a dedicated goroutine, one session
+// at a time. It fails once Accept has been used or if a callback is already set.
+func (l *Listener) OnAccept(fn func(*UDPSession)) error {
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+	if fn == nil || l.acceptCalled || l.onAccept != nil {
+		return errors.New(errInvalidOperation)
+	}
+	l.onAccept = fn
+	go l.dispatch(fn)
+	return nil
+}
+
+// dispatch hands accepted sessions to the accept callback
+func (l *Listener) dispatch(fn func(*UDPSession)) {
+	for {
+		for s := l.popAccept(); s != nil; s = l.popAccept() {
+			fn(s)
+		}
+		select {
+		case <-l.chAccept:
+		case <-l.die:
+			return
+		}
+	}
+}
+
+// SetBacklog sets the most new sessions waiting to be accepted, 1024 by default.
+// While the backlog is full, the packets of new clients are dropped and counted in
+// ListenerStats.Backlog; the clients retransmit and get in once Accept made room.
+// Established sessions are not affected. Lowering it keeps the sessions already waiting.
+func (l *Listener) SetBacklog(n int) error {
+	if n <= 0 {
+		return errors.New(errInvalidOperation)
+	}
+	l.acceptMu.Lock()
+	l.backlog = n
+	l.acceptMu.Unlock()
+	return nil
+}
+
+// PendingAccepts returns the number of new sessions waiting to be accepted
+func (l *Listener) PendingAccepts() int {
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+	return len(l.accepts)
+}
+
+// acceptRoom reports if the backlog has room for a new session; the monitor is the only
+// one to queue sessions, so the room can't be taken before it calls pushAccept
+func (l *Listener) acceptRoom() bool {
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+	return len(l.accepts) < l.backlog
+}
+
+// pushAccept queues a new session to be accepted
+func (l *Listener) pushAccept(s *UDPSession) {
+	l.acceptMu.Lock()
+	s.queued = time.Now()
+	l.accepts = append(l.accepts, s)
+	l.acceptMu.Unlock()
+	l.notifyAccept()
+}
+
+// popAccept takes the session waiting longest to be accepted, nil if none
+func (l *Listener) popAccept() *UDPSession {
+	l.acceptMu.Lock()
+	if len(l.accepts) == 0 {
+		l.acceptMu.Unlock()
+		return nil
+	}
+	s := l.accepts[0]
+	l.accepts[0] = nil
+	l.accepts = l.accepts[1:]
+	if len(l.accepts) > 0 { // pass the signal on to the next waiting Accept
+		l.notifyAccept()
+	}
+	l.acceptMu.Unlock()
+	s.accepted()
+	return s
+}
+
+// SetPreAcceptBuffer caps the data a session holds until it's accepted to about bytes,
+// 0 for no cap, the default. A client may send as soon as its session exists, long
+// before Accept: once the session holds bytes, it advertises a closed window, so the
+// client waits, and the window reopens on Accept. It applies to sessions created
+// afterwards, see UDPSession.PreAccept.
+func (l *Listener) SetPreAcceptBuffer(bytes int) error {
+	if bytes < 0 {
+		return errors.New(errInvalidOperation)
+	}
+	atomic.StoreInt64(&l.holdLimit, int64(bytes))
+	return nil
+}
+
+// AcceptStats tells what a session of a listener received before it was accepted
+type AcceptStats struct {
+	Segments, Bytes uint64        // new data segments received, and their data
+	Waited          time.Duration // in the accept queue
+}
+
+// PreAccept returns what the session received before Accept, or the OnAccept callback,
+// took it, so the application can apply its policy to a client sending at once. It's
+// zero for sessions of a dial, and for sessions imported or yet to be accepted.
+func (s *UDPSession) PreAccept() AcceptStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.preAccept
+}
+
+// accepted notes the session left the accept queue, the cap of SetPreAcceptBuffer
+// no longer applies
+func (s *UDPSession) accepted() {
+	s.mu.Lock()
+	s.preAccept = AcceptStats{s.kcp.rx.Segments, s.kcp.rx.Bytes, time.Since(s.queued)}
+	if s.holdLimit > 0 {
+		s.holdLimit = 0
+		s.account() // the window reopens
+	}
+	s.mu.Unlock()
+}
+
+func (l *Listener) notifyAccept() {
 	select {
-	case <-timeout:
-		return nil, &errTimeout{}
-	case c := <-l.chAccepts:
-		return c, nil
-	case <-l.die:
-		return nil, errors.New(errBrokenPipe)
+	case l.chAccept <- struct{}{}:
+	default:
 	}
 }
 
@@ -831,10 +2091,43 @@ func (l *Listener) SetWriteDeadline(t time.Time) error {
 
 // Close stops listening on the UDP address. Already Accepted connections are not closed.
 func (l *Listener) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return errors.New(errBrokenPipe)
+	}
 	close(l.die)
+	if l.manual != nil { // the socket belongs to the application
+		return nil
+	}
+	l.conn.SetReadDeadline(time.Now()) // unblocks the receiver, even if Close doesn't on this conn
 	return l.conn.Close()
 }
 
+// CloseContext closes the listener like Close, then waits until its goroutines have exited
+// or ctx is done. An OnAccept callback still running is not waited for.
+func (l *Listener) CloseContext(ctx context.Context) error {
+	err := l.Close()
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// spawn runs f on a goroutine CloseContext waits for
+func (l *Listener) spawn(f func()) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		f()
+	}()
+}
+
 // Addr returns the listener's network address, The Addr returned is shared by all invocations of Addr, so do not modify it.
 func (l *Listener) Addr() net.Addr {
 	return l.conn.LocalAddr()
@@ -856,36 +2149,58 @@ func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards
 	if err != nil {
 		return nil, errors.Wrap(err, "net.ListenUDP")
 	}
+	tuneSocket(conn)
+
+	return ServeConn(block, dataShards, parityShards, conn)
+}
+
+// ListenWithConfig is ListenWithOptions with the socket created by lc, for Control hooks
+// setting socket options before bind, like SO_BINDTODEVICE or SO_MARK. ctx bounds the
+// resolution of laddr, a nil lc is the zero ListenConfig.
+func ListenWithConfig(ctx context.Context, lc *net.ListenConfig, laddr string, block BlockCrypt, dataShards, parityShards int) (*Listener, error) {
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+	conn, err := lc.ListenPacket(ctx, "udp", laddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "net.ListenConfig.ListenPacket")
+	}
+	if udpconn, ok := conn.(*net.UDPConn); ok {
+		tuneSocket(udpconn)
+	}
 
 	return ServeConn(block, dataShards, parityShards, conn)
 }
 
 // ServeConn serves KCP protocol for a single packet connection.
 func ServeConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	l := newListener(block, dataShards, parityShards, conn)
+	l.spawn(l.sched.run)
+	l.spawn(l.monitor)
+	return l, nil
+}
+
+// newListener is ServeConn without the goroutines of the listener
+func newListener(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) *Listener {
 	l := new(Listener)
 	l.conn = conn
 	l.sessions = make(map[string]*UDPSession)
-	l.chAccepts = make(chan *UDPSession, 1024)
-	l.chDeadlinks = make(chan net.Addr, 1024)
+	l.contenders = make(map[string]*UDPSession)
+	l.chAccept = make(chan struct{}, 1)
+	l.backlog = defaultBacklog
+	l.chDeadlinks = make(chan *UDPSession, 1024)
+	l.chImports = make(chan importRequest)
+	l.chPause = make(chan pauseRequest)
 	l.die = make(chan struct{})
+	l.sched = newTxScheduler(l.die)
 	l.dataShards = dataShards
 	l.parityShards = parityShards
 	l.block = block
+	l.cryptoWorkers = int32(runtime.NumCPU())
 	l.fec = newFEC(rxFECMulti*(dataShards+parityShards), dataShards, parityShards)
-	l.rxbuf.New = func() interface{} {
-		return make([]byte, mtuLimit)
-	}
-
-	// calculate header size
-	if l.block != nil {
-		l.headerSize += cryptHeaderSize
-	}
-	if l.fec != nil {
-		l.headerSize += fecHeaderSizePlus2
-	}
 
-	go l.monitor()
-	return l, nil
+	l.headerSize = OverheadPerPacket(&PacketFormat{Encrypted: block != nil, FEC: l.fec != nil})
+	return l
 }
 
 // Dial connects to the remote address "raddr" on the network "udp"
@@ -904,10 +2219,71 @@ func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards in
 	if err != nil {
 		return nil, errors.Wrap(err, "net.DialUDP")
 	}
+	tuneSocket(udpconn)
+	udpconn.SetReadBuffer(clientReadBuffer)
 
 	return NewConn(raddr, block, dataShards, parityShards, &ConnectedUDPConn{udpconn, udpconn})
 }
 
+// DialAndVerify is DialWithOptions making sure the server answers: the session sends
+// window probes, and waits up to timeout for a valid packet from raddr. A wrong
+// address, a wrong key, as no packet of the server decrypts, or a dead server fail at
+// dial time then, rather than once writes time out. On timeout the session is closed
+// and a timeout error, see net.Error, is returned. DialWithOptions starts at once.
+func DialAndVerify(raddr string, block BlockCrypt, dataShards, parityShards int, timeout time.Duration) (*UDPSession, error) {
+	if timeout <= 0 {
+		return nil, errors.New(errInvalidOperation)
+	}
+	s, err := DialWithOptions(raddr, block, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.verify(timeout); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// verify waits up to timeout for a valid packet from the peer, it sends a window probe,
+// answered by every peer, four times over the timeout in case it's lost
+func (s *UDPSession) verify(timeout time.Duration) error {
+	heard := make(chan struct{})
+	s.mu.Lock()
+	if atomic.LoadInt64(&s.lastRecv) == 0 {
+		s.chHeard = heard
+	} else {
+		close(heard)
+	}
+	s.mu.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	every := timeout / 4
+	if every <= 0 {
+		every = timeout
+	}
+	probe := time.NewTicker(every)
+	defer probe.Stop()
+	for {
+		s.mu.Lock()
+		s.kcp.probe |= IKCP_ASK_SEND
+		s.kcp.current = currentMs()
+		s.kcp.flush()
+		s.uncork()
+
+		select {
+		case <-heard:
+			return nil
+		case <-probe.C:
+		case <-deadline.C:
+			return errTimeout{}
+		case <-s.die:
+			return ErrClosed
+		}
+	}
+}
+
 // NewConn establishes a session and talks KCP protocol over a packet connection.
 func NewConn(raddr string, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
@@ -915,13 +2291,50 @@ func NewConn(raddr string, block BlockCrypt, dataShards, parityShards int, conn
 		return nil, errors.Wrap(err, "net.ResolveUDPAddr")
 	}
 
-	var convid uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	return newUDPSession(convid, dataShards, parityShards, nil, conn, udpaddr, block), nil
+	return newUDPSession(ConvSource(), dataShards, parityShards, nil, conn, udpaddr, block), nil
+}
+
+// ConvSource generates the conversation ids of client sessions, default to crypto/rand.
+// Tests may replace it to pin convs, it must not be changed while dialing. A session
+// whose id the peer has in use already at the address draws another, see collided.
+var ConvSource = randomConv
+
+func randomConv() uint32 {
+	var conv uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &conv)
+	return conv
 }
 
+// convDrawLimit is how often a session draws another conversation id for collisions
+const convDrawLimit = 3
+
+// collided handles a collision of the conversation id: the peer acknowledged sequence
+// numbers the session never sent, it has a conversation of the id at the address
+// already, like the one of a client restarted on the same port. While nothing was
+// exchanged but probes, a client session draws another id from ConvSource and
+// announces its capabilities again, so the listener takes it for a new conversation,
+// see packetInput. It returns false if the session must close instead, s.mu must be
+// held.
+func (s *UDPSession) collided() bool {
+	s.kcp.foreign = false
+	if s.l != nil || s.kcp.snd_seq != 0 || s.kcp.rcv_seq != 0 || s.convDraws >= convDrawLimit {
+		return false
+	}
+	s.convDraws++
+	s.kcp.conv = ConvSource() // nothing was sent in the conversation yet but probes
+	if s.kcp.hello != 0 {
+		s.kcp.SetHello(uint8(s.kcp.hello>>8), uint8(s.kcp.hello), true)
+		s.kcp.hello_ts = 0
+	}
+	return true
+}
+
+// epoch is the origin of KCP timestamps, relative to the process start the 32bit
+// millisecond clock only wraps after 49.7 days of uptime, and never jumps with the wall clock
+var epoch = time.Now()
+
 func currentMs() uint32 {
-	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
+	return uint32(time.Since(epoch)/time.Millisecond) + chaosJitter()
 }
 
 // ConnectedUDPConn is a wrapper for net.UDPConn which converts WriteTo syscalls
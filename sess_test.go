@@ -1,15 +1,32 @@
 package kcp
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const port = "127.0.0.1:9999"
@@ -78,6 +95,9 @@ func server() {
 }
 
 func init() {
+	if os.Getenv(listenFDEnv) != "" { // the child of TestListenFD, port is taken
+		return
+	}
 	go server()
 }
 
@@ -197,13 +217,21 @@ func client2(wg *sync.WaitGroup) {
 	const N = 10
 	buf := make([]byte, 1024*512)
 	msg := make([]byte, 1024*512)
-	for i := 0; i < N; i++ {
-		cli.Write(msg)
-	}
-	println("total written:", len(msg)*N)
+	// the receive window holds the echo back until it's read, so read while writing
+	cli.SetDeadline(time.Now().Add(3 * time.Second))
+	werr := make(chan error, 1)
+	go func() {
+		for i := 0; i < N; i++ {
+			if _, err := cli.Write(msg); err != nil {
+				werr <- err
+				return
+			}
+		}
+		println("total written:", len(msg)*N)
+		werr <- nil
+	}()
 
 	nrecv := 0
-	cli.SetReadDeadline(time.Now().Add(3 * time.Second))
 	for {
 		n, err := cli.Read(buf)
 		if err != nil {
@@ -217,6 +245,9 @@ func client2(wg *sync.WaitGroup) {
 	}
 
 	println("total recv:", nrecv)
+	if err := <-werr; err != nil {
+		panic(err)
+	}
 	cli.Close()
 	wg.Done()
 }
@@ -300,3 +331,5730 @@ func client4(wg *sync.WaitGroup) {
 	cli.Close()
 	wg.Done()
 }
+
+func BenchmarkCryptoWorkers1(b *testing.B) {
+	benchmarkCryptoWorkers(b, 1)
+}
+
+func BenchmarkCryptoWorkers4(b *testing.B) {
+	benchmarkCryptoWorkers(b, 4)
+}
+
+func BenchmarkCryptoWorkersNumCPU(b *testing.B) {
+	benchmarkCryptoWorkers(b, runtime.NumCPU())
+}
+
+// multiple sessions sending AES encrypted data to one listener
+func benchmarkCryptoWorkers(b *testing.B, workers int) {
+	const sessions = 16
+	const msgSize = 4096
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReadBuffer(16 * 1024 * 1024)
+	l.SetCryptoWorkers(workers)
+
+	perSession := b.N/sessions + 1
+	var wg sync.WaitGroup
+	wg.Add(sessions)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func(s *UDPSession) {
+				defer wg.Done()
+				defer s.Close()
+				s.SetWindowSize(1024, 1024)
+				s.SetNoDelay(1, 20, 2, 1)
+				buf := make([]byte, 65536)
+				for nrecv := 0; nrecv < perSession*msgSize; {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					nrecv += n
+				}
+			}(s)
+		}
+	}()
+
+	b.SetBytes(msgSize)
+	b.ResetTimer()
+	for i := 0; i < sessions; i++ {
+		go func() {
+			block, _ := NewAESBlockCrypt(pass)
+			cli, err := DialWithOptions(l.Addr().String(), block, 0, 0)
+			if err != nil {
+				panic(err)
+			}
+			cli.SetStreamMode(true)
+			cli.SetWindowSize(1024, 1024)
+			cli.SetNoDelay(1, 20, 2, 1)
+			msg := make([]byte, msgSize)
+			for j := 0; j < perSession; j++ {
+				cli.Write(msg)
+			}
+			wg.Wait()
+			cli.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+// resizeConn delivers its datagrams from one address, and resizes the crypto worker
+// pool of l ahead of each, then nothing until it's closed
+type resizeConn struct {
+	helloConn
+	l *Listener
+	n int
+}
+
+func (c *resizeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.n++
+	c.l.SetCryptoWorkers(1 + c.n%4)
+	return c.helloConn.ReadFrom(p)
+}
+
+// the packets of an address leave the crypto workers in order while the pool is resized
+func TestCryptoWorkersResize(t *testing.T) {
+	const packets = 2000
+	block, _ := NewAESBlockCrypt(make([]byte, 32))
+	conn := &resizeConn{helloConn: helloConn{die: make(chan struct{})}}
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	nonces := &nonceReader{raw: true}
+	for sn := 0; sn < packets; sn++ {
+		pkt := make([]byte, cryptHeaderSize+IKCP_OVERHEAD, mtuLimit)
+		(&Segment{conv: 1, cmd: IKCP_CMD_PUSH, sn: uint32(sn)}).encode(pkt[cryptHeaderSize:])
+		conn.hellos = append(conn.hellos, encodePacket(block, nil, false, 0, nonces, 0, pkt))
+		conn.addrs = append(conn.addrs, from)
+	}
+	l := newListener(block, 0, 0, conn)
+	conn.l = l
+	defer l.Close()
+	ch := make(chan packet, packets)
+	l.spawn(func() { l.receiver(ch) })
+	for sn := 0; sn < packets; sn++ {
+		select {
+		case p := <-ch:
+			if p.rejected {
+				t.Fatal("packet rejected", p.reason)
+			}
+			if got := binary.LittleEndian.Uint32(p.data[12:]); got != uint32(sn) {
+				t.Fatal("packet", got, "arrived as", sn)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("packet", sn, "lost")
+		}
+	}
+}
+
+// sessionGoroutines counts the goroutines started by newUDPSession
+func sessionGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	n := 0
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.HasPrefix(line, "created by ") && strings.Contains(line, ".newUDPSession") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSessionGoroutines(t *testing.T) {
+	// sessions closed by earlier tests may still be lingering or leaving
+	base := sessionGoroutines()
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		n := sessionGoroutines()
+		if n == base {
+			break
+		}
+		base = n
+	}
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const N = 20
+	var clients []*UDPSession
+	for i := 0; i < N; i++ {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte("hello"))
+		clients = append(clients, cli)
+	}
+
+	var servers []*UDPSession
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < N; i++ {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+
+	// one reader per client, nothing for accepted sessions
+	if n := sessionGoroutines() - base; n != N {
+		t.Fatalf("%v goroutines for %v client and %v server sessions", n, N, N)
+	}
+
+	// every connection in the heap knows its place, for reschedule
+	updater.mu.Lock()
+	for k, e := range updater.entries {
+		if e.c.heapIndex != k {
+			updater.mu.Unlock()
+			t.Fatal("heap index", e.c.heapIndex, "at", k)
+		}
+	}
+	updater.mu.Unlock()
+
+	for k := range clients {
+		clients[k].Close()
+	}
+	for k := range servers {
+		servers[k].Close()
+	}
+
+	// closed sessions leave the updater on their next schedule
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		found := false
+		updater.mu.Lock()
+		for _, e := range updater.entries {
+			for k := range clients {
+				if e.s == clients[k] || e.s == servers[k] {
+					found = true
+				}
+			}
+		}
+		updater.mu.Unlock()
+		if !found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("closed sessions are still scheduled")
+}
+
+// full duplex echo on one session, run with -mutexprofile to inspect contention on s.mu
+func BenchmarkEchoContention(b *testing.B) {
+	cli, err := DialTest()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 20, 2, 1)
+	cli.SetACKNoDelay(true)
+
+	const msgSize = 1024
+	b.SetBytes(2 * msgSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		msg := make([]byte, msgSize)
+		for i := 0; i < b.N; i++ {
+			cli.Write(msg)
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for nrecv := 0; nrecv < b.N*msgSize; {
+		n, err := cli.Read(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+		nrecv += n
+	}
+}
+
+// slowConn delays every write, like a rate limited or congested socket
+type slowConn struct {
+	net.PacketConn
+	delay time.Duration
+}
+
+func (c *slowConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	time.Sleep(c.delay)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestSlowConnRead(t *testing.T) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const delay = 50 * time.Millisecond
+	cli, err := NewConn(port, nil, 0, 0, &slowConn{conn, delay})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetTxQueueLen(16)
+
+	go func() {
+		msg := make([]byte, 4096)
+		for {
+			if _, err := cli.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		cli.SetReadDeadline(start.Add(time.Millisecond))
+		cli.Read(buf)
+		if elapsed := time.Since(start); elapsed > delay/2 {
+			t.Fatalf("Read stalled for %v behind a slow socket", elapsed)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if v, _ := cli.Capabilities(); v != 0 {
+		t.Fatal("negotiated before talking to the server", v)
+	}
+	cli.Write([]byte("hello"))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if _, err := cli.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// announcements are retried until answered
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if v, f := cli.Capabilities(); v == ProtocolVersion && f == localCapabilities {
+			return
+		}
+	}
+	t.Fatal(cli.Capabilities())
+}
+
+func TestAcceptWithPreface(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, _, err := l.AcceptWithPreface(0); err == nil {
+		t.Fatal("accepted without room for the preface")
+	}
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("token:secret"))
+	cli.Write([]byte("hello"))
+
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, preface, err := l.AcceptWithPreface(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if string(preface) != "token:" {
+		t.Fatalf("preface %q", preface)
+	}
+	// the rest of the stream follows the preface
+	buf := make([]byte, 64)
+	for _, want := range []string{"secret", "hello"} {
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := s.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q %v, want %q", buf[:n], err, want)
+		}
+	}
+
+	l.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := l.AcceptWithPreface(6); err == nil {
+		t.Fatal("accepted without a client")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+}
+
+func TestOnAccept(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const N = 10
+	var clients []*UDPSession
+	dial := func() {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte("hello"))
+		clients = append(clients, cli)
+	}
+	defer func() {
+		for k := range clients {
+			clients[k].Close()
+		}
+	}()
+
+	// sessions queued before the callback is set are delivered through it
+	for i := 0; i < N/2; i++ {
+		dial()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	accepted := make(chan *UDPSession, N)
+	if err := l.OnAccept(func(s *UDPSession) { accepted <- s }); err != nil {
+		t.Fatal(err)
+	}
+	for i := N / 2; i < N; i++ {
+		dial()
+	}
+	for i := 0; i < N; i++ {
+		select {
+		case s := <-accepted:
+			s.Close()
+		case <-time.After(5 * time.Second):
+			t.Fatal("accepted", i, "sessions")
+		}
+	}
+
+	if _, err := l.AcceptKCP(); err == nil {
+		t.Fatal("accept with a callback set")
+	}
+	if err := l.OnAccept(func(*UDPSession) {}); err == nil {
+		t.Fatal("callback set twice")
+	}
+
+	l2, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	l2.SetReadDeadline(time.Now())
+	l2.Accept()
+	if err := l2.OnAccept(func(*UDPSession) {}); err == nil {
+		t.Fatal("callback set after accept")
+	}
+}
+
+func TestSessionString(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(cli.CreatedAt()) > time.Second {
+		t.Fatal("bad creation time", cli.CreatedAt())
+	}
+	cli2, err := DialTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	if cli.ID() == cli2.ID() {
+		t.Fatal("duplicated id", cli.ID())
+	}
+
+	prefix := fmt.Sprintf("kcp conv=%v %v -> %v age=", cli.GetConv(), cli.LocalAddr(), cli.RemoteAddr())
+	if str := cli.String(); !strings.HasPrefix(str, prefix) || strings.Contains(str, "closed") {
+		t.Fatal(str)
+	}
+	cli.Close()
+	if str := cli.String(); !strings.HasSuffix(str, ` closed="closed locally"`) {
+		t.Fatal(str)
+	}
+}
+
+func TestListenerStats(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lfec, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lfec.Close()
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	garbage := make([]byte, 100)
+	for i := range garbage {
+		garbage[i] = byte(i)
+	}
+
+	waitFor := func(what string, got func() RejectStats) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if s := got(); s.Count == 1 && !s.Last.Before(start) {
+				return
+			}
+		}
+		t.Fatal(what, got())
+	}
+
+	conn.WriteTo(garbage[:10], l.Addr())
+	waitFor("short", func() RejectStats { return l.Stats().Short })
+	conn.WriteTo(garbage, l.Addr())
+	waitFor("checksum", func() RejectStats { return l.Stats().Checksum })
+	l.SetPacketToken([]byte("token"))
+	conn.WriteTo(garbage, l.Addr())
+	waitFor("token", func() RejectStats { return l.Stats().Token })
+	conn.WriteTo(garbage, lfec.Addr()) // neither data nor a parity shard
+	waitFor("conv", func() RejectStats { return lfec.Stats().Conv })
+}
+
+func TestConvSource(t *testing.T) {
+	defer func(f func() uint32) { ConvSource = f }(ConvSource)
+	ConvSource = func() uint32 { return 0xdeadbeef }
+	cli, err := DialTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if conv := cli.GetConv(); conv != 0xdeadbeef {
+		t.Fatalf("conv %x", conv)
+	}
+}
+
+// a client restarted on the same port with the conversation id of its last run draws
+// another while it only probed, and closes once it sent data, or drew too often
+func TestConvCollision(t *testing.T) {
+	defer func(f func() uint32) { ConvSource = f }(ConvSource)
+	var draws int32
+	ConvSource = func() uint32 {
+		if atomic.AddInt32(&draws, 1) <= 2 {
+			return 7
+		}
+		return 8
+	}
+
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 4)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+		}
+	}()
+	read := func(s *UDPSession, want string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if n, err := s.Read(buf); err != nil || string(buf[:n]) != want {
+			t.Fatal(string(buf[:n]), err)
+		}
+	}
+
+	// run starts a client at addr, the previous run on it ends without a word
+	var conn net.PacketConn
+	run := func(addr string) *UDPSession {
+		t.Helper()
+		if conn != nil {
+			conn.Close()
+		}
+		if conn, err = net.ListenPacket("udp", addr); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewConn(l.Addr().String(), nil, 0, 0, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	first := run("127.0.0.1:0")
+	first.Write([]byte("first"))
+	s1 := <-accepted
+	read(s1, "first")
+
+	second := run(conn.LocalAddr().String())
+	if err := second.verify(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if conv := second.GetConv(); conv != 8 {
+		t.Fatal("conv", conv)
+	}
+	s2 := <-accepted
+	for _, msg := range []string{"second", "more", "and more"} {
+		second.Write([]byte(msg))
+		read(s2, msg)
+	}
+	if s2.GetConv() != 8 {
+		t.Fatal("accepted conv", s2.GetConv())
+	}
+	closed := func(s *UDPSession, kind int) {
+		t.Helper()
+		select {
+		case <-s.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("session", s.GetConv(), "goes on")
+		}
+		if err := context.Cause(s.Context()).(*CloseError); err.Kind != kind {
+			t.Fatal(err)
+		}
+	}
+	closed(s1, ClosedReplaced)
+
+	third := run(conn.LocalAddr().String())
+	third.Write([]byte("third"))
+	closed(third, ClosedConvInUse)
+	conn.Close()
+}
+
+func TestSetTTL(t *testing.T) {
+	for _, laddr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		l, err := ListenWithOptions(laddr, nil, 0, 0)
+		if err != nil {
+			t.Log("skipping", laddr, err)
+			continue
+		}
+		defer l.Close()
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+
+		if err := l.SetTTL(3); err != nil {
+			t.Fatal(laddr, err)
+		}
+		if err := cli.SetTTL(5); err != nil {
+			t.Fatal(laddr, err)
+		}
+		ttl := func(nc net.Conn) int {
+			if strings.HasPrefix(laddr, "[") {
+				n, _ := ipv6.NewConn(nc).HopLimit()
+				return n
+			}
+			n, _ := ipv4.NewConn(nc).TTL()
+			return n
+		}
+		if n := ttl(l.conn.(net.Conn)); n != 3 {
+			t.Fatal(laddr, "listener ttl", n)
+		}
+		if n := ttl(cli.conn.(*ConnectedUDPConn).Conn); n != 5 {
+			t.Fatal(laddr, "session ttl", n)
+		}
+
+		cli.Write([]byte("hello"))
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := s.SetTTL(1); err == nil {
+			t.Fatal("ttl set on an accepted session")
+		}
+	}
+}
+
+func TestSessionStats(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewConn(l.Addr().String(), block, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetKeepAlive(0)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetKeepAlive(0)
+
+	// keepalive pings pass the checks, and are skipped
+	inErrors := atomic.LoadUint64(&DefaultSnmp.KCPInErrors)
+	cli.mu.Lock()
+	cli.keepAliveInterval = time.Millisecond
+	cli.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	cli.SetKeepAlive(0)
+	time.Sleep(50 * time.Millisecond)
+	if st := s.Stats(); st.Checksum.Count != 0 {
+		t.Fatal(st.Checksum.Count, "pings failed the checksum")
+	}
+	if n := atomic.LoadUint64(&DefaultSnmp.KCPInErrors) - inErrors; n != 0 {
+		t.Fatal(n, "pings failed the input")
+	}
+	var base uint64
+
+	waitFor := func(what string, got func() SessionStats, short, checksum uint64) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if s := got(); s.Short.Count == short && s.Checksum.Count == checksum {
+				return
+			}
+		}
+		t.Fatal(what, got())
+	}
+	garbage := make([]byte, 100)
+
+	// mangled packets from the client are counted for its session on the listener
+	conn.WriteTo(garbage[:10], l.Addr())
+	conn.WriteTo(garbage, l.Addr())
+	waitFor("server", s.Stats, 1, base+1)
+
+	// and mangled packets from the listener for the client, but not packets from elsewhere
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	base = cli.Stats().Checksum.Count
+	other.WriteTo(garbage, conn.LocalAddr())
+	l.conn.WriteTo(garbage, conn.LocalAddr())
+	waitFor("client", cli.Stats, 0, base+1)
+	if last := cli.Stats().Checksum.Last; time.Since(last) > 5*time.Second {
+		t.Fatal("bad timestamp", last)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1) // no congestion window, writes leave at once
+
+	const msgs = 20
+	for i := 0; i < msgs; i++ {
+		cli.Write(make([]byte, 100))
+		time.Sleep(5 * time.Millisecond)
+	}
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	time.Sleep(200 * time.Millisecond) // the messages wait for Read
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1000)
+	for i := 0; i < msgs; i++ {
+		if _, err := s.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(what string, st LatencyStats, min, max time.Duration) {
+		if st.Count != msgs || st.Min < min || st.Max > max ||
+			st.Avg < st.Min || st.Avg > st.Max || st.P99 < st.Min || st.P99 > st.Max {
+			t.Fatalf("%v: %+v", what, st)
+		}
+	}
+	check("write to wire", cli.Stats().WriteToWire, 0, time.Second)
+	check("wire to read", s.Stats().WireToRead, 100*time.Millisecond, 5*time.Second)
+	if st := cli.Stats().WireToRead; st.Count != 0 {
+		t.Fatal("nothing was read", st)
+	}
+}
+
+func TestLatencyHist(t *testing.T) {
+	var h latencyHist
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Millisecond)
+	}
+	st := h.stats()
+	if st.Count != 1000 || st.Min != time.Millisecond || st.Max != time.Second || st.Avg != 500500*time.Microsecond {
+		t.Fatalf("%+v", st)
+	}
+	if st.P99 < 990*time.Millisecond || st.P99 > time.Second {
+		t.Fatal("p99", st.P99)
+	}
+	for d := time.Microsecond; d < time.Minute; d = d * 9 / 8 {
+		k := latencyBucket(d)
+		if bound := latencyBound(k); k < latencyBuckets-1 && (d >= bound || k >= 4 && d < bound*4/5) {
+			t.Fatal(d, k, bound)
+		}
+	}
+}
+
+// compactEcho echoes data between a client and a listener enabling CapCompactNonce
+// as told, it returns whether both ends sent in the compact nonce format
+func compactEcho(t *testing.T, client, server bool) bool {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCompactNonce(server)
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetCompactNonce(client)
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	msg := make([]byte, 64*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go cli.Write(msg)
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(client, server, err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal(client, server, "data mismatch")
+	}
+
+	s := <-accepted
+	defer s.Close()
+	cli.mu.Lock()
+	compact, mss := cli.compact, cli.kcp.mss
+	cli.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.compact != compact {
+		t.Fatal(client, server, "compact nonce on one end only")
+	}
+	if want := uint32(IKCP_MTU_DEF - cli.headerSize - IKCP_OVERHEAD); compact && mss != want+nonceSize-compactNonceSize || !compact && mss != want {
+		t.Fatal(client, server, "mss", mss)
+	}
+	return compact
+}
+
+func TestCompactNonce(t *testing.T) {
+	if !compactEcho(t, true, true) {
+		t.Fatal("compact nonce not negotiated")
+	}
+	if compactEcho(t, true, false) || compactEcho(t, false, true) || compactEcho(t, false, false) {
+		t.Fatal("compact nonce used with a peer not announcing it")
+	}
+}
+
+// corruptConn flips a byte of the kcp header in every fifth datagram written once corrupt is set
+type corruptConn struct {
+	net.PacketConn
+	corrupt, n int32
+}
+
+func (c *corruptConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.corrupt) != 0 && atomic.AddInt32(&c.n, 1)%5 == 0 {
+		q := append([]byte(nil), p...)
+		q[12] ^= 0xff // sn
+		return c.PacketConn.WriteTo(q, addr)
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestChecksum(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	el, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	if err := el.SetChecksum(true); err == nil {
+		t.Fatal("checksum enabled with encryption")
+	}
+
+	echo := func(client, server bool) {
+		l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.SetChecksum(server)
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted := make(chan *UDPSession, 1)
+		go func() {
+			for {
+				s, err := l.AcceptKCP()
+				if err != nil {
+					return
+				}
+				// stray packets of an earlier test to the reused port start sessions too
+				if s.RemoteAddr().String() != conn.LocalAddr().String() {
+					s.Close()
+					continue
+				}
+				accepted <- s
+				io.Copy(s, s)
+				return
+			}
+		}()
+
+		cc := &corruptConn{PacketConn: conn}
+		cli, err := NewConn(l.Addr().String(), nil, 0, 0, cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetChecksum(client)
+		cli.SetStreamMode(true)
+		cli.SetNoDelay(1, 10, 2, 1)
+
+		// a round trip completes the negotiation
+		buf := make([]byte, 5)
+		cli.Write([]byte("hello"))
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatal(client, server, err)
+		}
+		s := <-accepted
+		defer s.Close()
+		cli.mu.Lock()
+		checksum, mss := cli.checksum, cli.kcp.mss
+		cli.mu.Unlock()
+		s.mu.Lock()
+		if s.checksum != checksum {
+			t.Fatal(client, server, "checksum on one end only")
+		}
+		s.mu.Unlock()
+		if checksum != (client && server) {
+			t.Fatal(client, server, "checksum negotiated", checksum)
+		}
+		if !checksum {
+			return
+		}
+		if mss != IKCP_MTU_DEF-crcSize-IKCP_OVERHEAD {
+			t.Fatal("mss", mss)
+		}
+
+		// corrupted headers are dropped, the segments are sent again
+		atomic.StoreInt32(&cc.corrupt, 1)
+		msg := make([]byte, 64*1024)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		go cli.Write(msg)
+		got := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("data mismatch")
+		}
+		if s.Stats().Checksum.Count == 0 || l.Stats().Checksum.Count == 0 {
+			t.Fatal("corrupted packets not counted")
+		}
+	}
+	echo(true, true)
+	echo(true, false)
+	echo(false, true)
+}
+
+// sizeConn records the sizes of the datagrams written
+type sizeConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (c *sizeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sizes = append(c.sizes, len(p))
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *sizeConn) written() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.sizes...)
+}
+
+func TestPadding(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+
+	// the share of the datagrams of the most common size, in a ping-pong of equal messages
+	pingPong := func(padding int, idle time.Duration) float64 {
+		l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if err := l.SetPadding(padding, idle); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := &sizeConn{PacketConn: conn}
+		cli, err := NewConn(l.Addr().String(), block, 0, 0, cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.SetPadding(padding, idle); err != nil {
+			t.Fatal(err)
+		}
+		cli.SetNoDelay(1, 10, 2, 1)
+		msg := make([]byte, 100)
+		buf := make([]byte, len(msg))
+		for i := 0; i < 200; i++ {
+			cli.Write(msg)
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(cli, buf); err != nil {
+				t.Fatal(padding, err)
+			}
+		}
+
+		counts := make(map[int]int)
+		top := 0
+		sizes := cc.written()
+		for _, size := range sizes {
+			if counts[size]++; counts[size] > top {
+				top = counts[size]
+			}
+		}
+		if padding > 0 && idle > 0 { // the session keeps sending while idle
+			time.Sleep(10 * idle)
+			if n := len(cc.written()) - len(sizes); n < 3 {
+				t.Fatal(n, "datagrams while idle")
+			}
+		}
+		return float64(top) / float64(len(sizes))
+	}
+
+	plain := pingPong(0, 0)
+	padded := pingPong(256, 30*time.Millisecond)
+	if plain < 0.2 || padded > 0.05 {
+		t.Fatalf("most common size: %.3f of the datagrams without padding, %.3f with", plain, padded)
+	}
+
+	cli, err := DialWithOptions("127.0.0.1:1", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SetPadding(IKCP_MTU_DEF, 0) == nil || cli.SetPadding(-1, 0) == nil {
+		t.Fatal("invalid padding accepted")
+	}
+	cli.SetPadding(1000, 0)
+	if cli.SetMtu(1000) == nil {
+		t.Fatal("mtu without room for the padding accepted")
+	}
+}
+
+// every datagram of both ends has the fixed size, FEC parity shards and the compact
+// nonce format included, and the padding shows apart from the payload
+func TestFixedPacketSize(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	const size = 512
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := &sizeConn{PacketConn: conn}
+	l, err := ServeConn(block, 10, 3, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.SetFixedPacketSize(size) != nil || l.SetCompactNonce(true) != nil {
+		t.Fatal("fixed size refused")
+	}
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := &sizeConn{PacketConn: conn}
+	cli, err := NewConn(l.Addr().String(), block, 10, 3, cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetFixedPacketSize(size); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetCompactNonce(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	msg := make([]byte, 3000) // both full and short segments
+	buf := make([]byte, len(msg))
+	for i := 0; i < 50; i++ {
+		rand.Read(msg)
+		cli.Write(msg)
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil || !bytes.Equal(buf, msg) {
+			t.Fatal(i, err)
+		}
+	}
+	if f := cli.PacketFormat(); !f.Compact || EffectiveMSS(&f, IKCP_MTU_DEF) != cli.MaxMessageSize()/255 {
+		t.Fatal("format", f, "max message", cli.MaxMessageSize())
+	}
+	for _, sizes := range [][]int{cc.written(), lc.written()} {
+		for _, n := range sizes {
+			if n != size {
+				t.Fatal("datagram of", n, "bytes")
+			}
+		}
+	}
+	txPad, rxPad := cli.PaddingThroughput()
+	_, _, txWire, rxWire := cli.Throughput()
+	if txPad <= 0 || rxPad <= 0 || txPad >= txWire || rxPad >= rxWire {
+		t.Fatal("padding", txPad, rxPad, "datagrams", txWire, rxWire)
+	}
+
+	if cli.SetMtu(1000) == nil || cli.SetPadding(100, 0) == nil {
+		t.Fatal("mtu or padding accepted with a fixed size")
+	}
+	if cli.SetFixedPacketSize(cryptHeaderSize+fecHeaderSizePlus2+IKCP_OVERHEAD) == nil ||
+		cli.SetFixedPacketSize(mtuLimit) == nil || cli.SetFixedPacketSize(-1) == nil {
+		t.Fatal("invalid size accepted")
+	}
+	plain, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if plain.SetFixedPacketSize(size) == nil {
+		t.Fatal("fixed size without encryption")
+	}
+}
+
+func TestDialAndVerify(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	start := time.Now()
+	cli, err := DialAndVerify(l.Addr().String(), block, 0, 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("verified in", elapsed)
+	}
+
+	// a wrong key, and a server that doesn't answer
+	wrong, _ := NewAESBlockCrypt(pass[:16])
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	for _, c := range []struct {
+		addr  string
+		block BlockCrypt
+	}{{l.Addr().String(), wrong}, {dead.LocalAddr().String(), block}} {
+		cli, err := DialAndVerify(c.addr, c.block, 0, 0, 200*time.Millisecond)
+		if ne, ok := err.(net.Error); cli != nil || !ok || !ne.Timeout() {
+			t.Fatal(c.addr, cli, err)
+		}
+	}
+	if _, err := DialAndVerify(l.Addr().String(), block, 0, 0, 0); err == nil {
+		t.Fatal("zero timeout accepted")
+	}
+}
+
+// the session settles on the address that answers, after the stagger of the one that doesn't
+// natConn is a socket behind a NAT, which lets datagrams in from the addresses the
+// socket sent to before they arrived only if it filters, and counts the others
+type natConn struct {
+	*net.UDPConn
+	filter  bool
+	mu      sync.Mutex
+	opened  map[string]bool
+	dropped int
+	in      chan natPacket
+}
+
+type natPacket struct {
+	data []byte
+	from net.Addr
+}
+
+func newNATConn(t *testing.T, filter bool) *natConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &natConn{UDPConn: conn, filter: filter, opened: make(map[string]bool), in: make(chan natPacket, 1024)}
+	go c.pump()
+	return c
+}
+
+// pump filters the datagrams as they arrive
+func (c *natConn) pump() {
+	defer close(c.in)
+	for {
+		buf := make([]byte, mtuLimit)
+		n, from, err := c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		open := !c.filter || c.opened[from.String()]
+		if !open {
+			c.dropped++
+		}
+		c.mu.Unlock()
+		if open {
+			c.in <- natPacket{buf[:n], from}
+		}
+	}
+}
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.opened[addr.String()] = true
+	c.mu.Unlock()
+	return c.UDPConn.WriteTo(b, addr)
+}
+
+func (c *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p, ok := <-c.in
+	if !ok {
+		return 0, nil, io.EOF
+	}
+	return copy(b, p.data), p.from, nil
+}
+
+func TestDialRendezvous(t *testing.T) {
+	natA, natB := newNATConn(t, false), newNATConn(t, true)
+	strayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stray session has the smallest conversation, A would take it over
+	var convs = []uint32{1, 7, 5}
+	var next int32
+	defer func(f func() uint32) { ConvSource = f }(ConvSource)
+	ConvSource = func() uint32 { return convs[atomic.AddInt32(&next, 1)-1] }
+	stray, err := NewConn(natA.LocalAddr().String(), nil, 0, 0, strayConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stray.Close()
+	stray.Write([]byte("stray"))
+
+	type result struct {
+		s   *UDPSession
+		err error
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	chA := make(chan result, 1)
+	go func() {
+		s, err := DialRendezvous(ctx, natA, natB.LocalAddr().String(), nil, 0, 0, nil)
+		chA <- result{s, err}
+	}()
+	// B's NAT drops the punches of A until B punches too
+	for atomic.LoadInt32(&next) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cfg := DefaultSessionConfig()
+	cfg.NoDelay, cfg.Interval = 1, 10
+	b, err := DialRendezvous(ctx, natB, natA.LocalAddr().String(), nil, 0, 0, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	r := <-chA
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	a := r.s
+	defer a.Close()
+
+	natB.mu.Lock()
+	dropped := natB.dropped
+	natB.mu.Unlock()
+	if dropped == 0 {
+		t.Fatal("no punch dropped by the NAT of B")
+	}
+	if a.GetConv() != 5 || b.GetConv() != 5 {
+		t.Fatal("conversations", a.GetConv(), b.GetConv())
+	}
+	if a.RemoteAddr().String() != natB.LocalAddr().String() {
+		t.Fatal("remote", a.RemoteAddr())
+	}
+
+	buf := make([]byte, 4)
+	for _, pair := range [][2]*UDPSession{{a, b}, {b, a}} {
+		if _, err := pair[0].Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		pair[1].SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(pair[1], buf); err != nil || string(buf) != "ping" {
+			t.Fatal(string(buf), err)
+		}
+	}
+
+	// a peer that never shows up
+	lonely := newNATConn(t, true)
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	ConvSource = randomConv
+	if _, err := DialRendezvous(ctx, lonely, "127.0.0.1:1", nil, 0, 0, nil); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := lonely.WriteTo([]byte("x"), strayConn.LocalAddr()); err == nil {
+		t.Fatal("socket left open")
+	}
+}
+
+func TestDialHost(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+	echo := func(s *UDPSession) {
+		s.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		if _, err := s.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "hello" {
+			t.Fatal(string(buf), err)
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	cli, err := DialHost(net.JoinHostPort("localhost", port), block, 0, 0, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.RemoteAddr().String() != l.Addr().String() {
+		t.Fatal("settled on", cli.RemoteAddr())
+	}
+	echo(cli)
+	if err := cli.Rebind(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if cli.RemoteAddr().String() != l.Addr().String() {
+		t.Fatal("rebound to", cli.RemoteAddr())
+	}
+	echo(cli)
+	cli.Close()
+
+	// an address that doesn't answer, probed first
+	dead, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	udpconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := []*net.UDPAddr{dead.LocalAddr().(*net.UDPAddr), l.Addr().(*net.UDPAddr)}
+	h := &hostConn{conn: udpconn, host: l.Addr().String()}
+	cli = newUDPSession(ConvSource(), 0, 0, nil, h, addrs[0], block)
+	defer cli.Close()
+	start := time.Now()
+	if err := cli.race(h, addrs, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < happyEyeballsDelay || elapsed > time.Second {
+		t.Fatal("settled in", elapsed)
+	}
+	if cli.RemoteAddr().String() != l.Addr().String() {
+		t.Fatal("settled on", cli.RemoteAddr())
+	}
+	echo(cli)
+
+	// the host moved to an address that doesn't answer, the session stays
+	h.host = dead.LocalAddr().String()
+	if err := cli.Rebind(300 * time.Millisecond); err == nil {
+		t.Fatal("rebound to", cli.RemoteAddr())
+	}
+	if cli.RemoteAddr().String() != l.Addr().String() {
+		t.Fatal("moved to", cli.RemoteAddr())
+	}
+	echo(cli)
+
+	plain, err := DialWithOptions(l.Addr().String(), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if plain.Rebind(time.Second) == nil {
+		t.Fatal("rebind of DialWithOptions accepted")
+	}
+	if _, err := DialHost(l.Addr().String(), block, 0, 0, 0); err == nil {
+		t.Fatal("zero timeout accepted")
+	}
+}
+
+func TestSessionConfig(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := &sizeConn{PacketConn: conn}
+	l, err := ServeConn(nil, 0, 0, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.Mtu = mtuLimit + 1
+	if l.SetSessionConfig(cfg) == nil || l.SetSessionConfig(SessionConfig{}) == nil {
+		t.Fatal("invalid config accepted")
+	}
+	cfg.Mtu = 600
+	cfg.RcvWnd = 512
+	cfg.StreamMode = true
+	cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion = 1, 10, 2, 1
+	if err := l.SetSessionConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the accepted session writes at once, without setting anything
+	msg := make([]byte, 64*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer s.Close()
+		s.mu.Lock()
+		rcvwnd, stream := s.kcp.rcv_wnd, s.kcp.stream
+		s.mu.Unlock()
+		if rcvwnd != 512 || stream != 1 {
+			errs <- fmt.Errorf("rcvwnd %v stream %v", rcvwnd, stream)
+			return
+		}
+		s.Write(msg)
+		errs <- nil
+		io.Copy(ioutil.Discard, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	max := 0
+	for _, size := range sc.written() {
+		if size > max {
+			max = size
+		}
+	}
+	if max != 600 {
+		t.Fatal("largest datagram", max)
+	}
+
+	// the mode can't change while data is queued, behind the congestion window
+	lost, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lost.Close()
+	lost.Write([]byte("hello"))
+	lost.Write([]byte("world"))
+	if lost.SetStreamMode(true) == nil {
+		t.Fatal("stream mode changed with data queued")
+	}
+	if err := lost.SetStreamMode(false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	custom := Profile{NoDelay: 1, Interval: 15, Resend: 3, NC: 1}
+	cfg := DefaultSessionConfig()
+	cfg.SetProfile(custom)
+	if cfg.Profile() != custom {
+		t.Fatal("config profile", cfg.Profile())
+	}
+	if err := l.SetSessionConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		buf := make([]byte, 16)
+		s.Read(buf)
+		accepted <- s
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.Profile() != ProfileDefault {
+		t.Fatal("initial profile", cli.Profile())
+	}
+	cli.SetProfile(custom)
+	cli.Write([]byte("hello"))
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	defer s.Close()
+	if p := cli.Profile(); p != custom {
+		t.Fatal("dialed session runs with", p)
+	}
+	if p := s.Profile(); p != custom {
+		t.Fatal("accepted session runs with", p)
+	}
+	cli.SetProfile(ProfileFast3)
+	if p := cli.Profile(); p != ProfileFast3 {
+		t.Fatal("dialed session runs with", p)
+	}
+}
+
+func TestSessionConfigSnapshot(t *testing.T) {
+	block, _ := NewAESBlockCrypt(make([]byte, 32))
+	s, err := DialWithOptions("127.0.0.1:1", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cfg := s.Config()
+	if cfg.Cipher != "aes" || cfg.DataShards != 10 || cfg.ParityShards != 3 || cfg.StreamMode {
+		t.Fatalf("%+v", cfg)
+	}
+	if cfg.Mtu != IKCP_MTU_DEF || cfg.MSS <= 0 || cfg.MSS >= cfg.Mtu {
+		t.Fatalf("mtu %v mss %v", cfg.Mtu, cfg.MSS)
+	}
+
+	// the setters show in the next snapshot, not in the copies taken before
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetWindowSize(256, 512)
+	s.SetStreamMode(true)
+	s.SetMtu(1000)
+	s.SetKeepAlive(5)
+	now := s.Config()
+	if now.NoDelay != 1 || now.Interval != 10*time.Millisecond || now.Resend != 2 || now.NoCongestion != 1 {
+		t.Fatalf("nodelay %+v", now)
+	}
+	if now.SndWnd != 256 || now.RcvWnd != 512 || !now.StreamMode || now.Mtu != 1000 || now.MSS >= cfg.MSS {
+		t.Fatalf("windows %+v", now)
+	}
+	if now.KeepAlive != 5*time.Second {
+		t.Fatal("keepalive", now.KeepAlive)
+	}
+	if cfg.SndWnd == 256 || cfg.StreamMode {
+		t.Fatal("snapshot changed")
+	}
+
+	// the JSON names are stable
+	b, err := json.Marshal(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(b, &fields)
+	for _, name := range []string{"mtu", "mss", "snd_wnd", "rcv_wnd", "interval_ns", "resend", "no_congestion", "stream_mode", "cipher", "data_shards", "parity_shards", "rate", "keepalive_ns"} {
+		if _, ok := fields[name]; !ok {
+			t.Fatal("missing", name)
+		}
+	}
+	if fields["cipher"] != "aes" || fields["interval_ns"] != float64(10*time.Millisecond) {
+		t.Fatal(string(b))
+	}
+
+	plain, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if cfg := plain.Config(); cfg.Cipher != "" || cfg.DataShards != 0 || cfg.Rate != 0 {
+		t.Fatalf("%+v", cfg)
+	}
+}
+
+func TestSoftErrors(t *testing.T) {
+	s, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := s.SoftErrors()
+	s.rejected(rejectChecksum, 100)
+	s.mu.Lock()
+	s.fallback(1200)
+	s.checkReplays(time.Now())
+	s.kcp.rx.RetransSegments += replayBurst
+	s.checkReplays(time.Now())
+	s.kcp.rx.RetransSegments += replayBurst
+	s.checkReplays(time.Now()) // the same burst
+	s.mu.Unlock()
+	for _, want := range []SoftError{{Type: SoftChecksum, Value: 100}, {Type: SoftMtuFallback, Value: 1200}, {Type: SoftReplay, Value: replayBurst}} {
+		select {
+		case e := <-ch:
+			if e.Type != want.Type || e.Value != want.Value || e.Time.IsZero() || e.Error() == "" {
+				t.Fatalf("got %+v, want %+v", e, want)
+			}
+		default:
+			t.Fatal("missing", want.Type)
+		}
+	}
+
+	// the oldest are dropped, and all are counted
+	s.mu.Lock()
+	for i := 0; i < softErrorBacklog+10; i++ {
+		s.fallback(1024)
+	}
+	s.mu.Unlock()
+	if e := <-ch; e.Type != SoftMtuFallback || len(ch) != softErrorBacklog-1 {
+		t.Fatal("queued", len(ch))
+	}
+	st := s.Stats().SoftErrors
+	if st.Checksum != 1 || st.Replay != 1 || st.MtuFallback != softErrorBacklog+11 || st.Dropped != 10 {
+		t.Fatalf("%+v", st)
+	}
+
+	s.Close()
+	for range ch {
+	}
+	if _, ok := <-s.SoftErrors(); ok {
+		t.Fatal("channel open after close")
+	}
+
+	// the rate limit of a group, once per stretch of waiting Writes
+	g, err := NewSessionGroup(&GroupConfig{Session: DefaultSessionConfig(), Rate: 10 << 10, Burst: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	m, err := g.Dial("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soft := m.SoftErrors()
+	for i := 0; i < 3; i++ {
+		if _, err := m.Write(make([]byte, 1<<10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e := <-soft; e.Type != SoftRateLimited || len(soft) != 0 {
+		t.Fatalf("%+v, %v more", e, len(soft))
+	}
+}
+
+func TestStreamChecksum(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetStreamChecksum(true)
+	got := make(chan []byte, 1)
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				buf := make([]byte, 40*1024)
+				s.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.ReadFull(s, buf); err != nil {
+					errs <- err
+					return
+				}
+				got <- buf
+			}()
+		}
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetStreamChecksum(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.WriteWithPriority([]byte("x"), PriorityHigh); err == nil {
+		t.Fatal("high priority write accepted")
+	}
+	if cli.SetReadCallback(func([]byte) {}) == nil {
+		t.Fatal("read callback accepted")
+	}
+	cli.SetStreamMode(true)
+	msg := make([]byte, 40*1024)
+	rand.Read(msg)
+	cli.Write(msg)
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, msg) {
+			t.Fatal("data mismatch")
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	if cli.SetStreamChecksum(false) == nil {
+		t.Fatal("set after traffic")
+	}
+
+	// a peer without it fails the reads of the listener
+	before := DefaultSnmp.Copy().StreamCsumErrors
+	plain, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.SetStreamMode(true)
+	plain.Write(msg)
+	select {
+	case <-got:
+		t.Fatal("unchecked stream accepted")
+	case err := <-errs:
+		if !errors.Is(err, ErrStreamChecksum) {
+			t.Fatal(err)
+		}
+	}
+	if DefaultSnmp.Copy().StreamCsumErrors == before {
+		t.Fatal("mismatch not counted")
+	}
+}
+
+func TestLANMode(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.Interval = 100
+	l.SetSessionConfig(cfg)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetLANMode(true, 0)
+		io.Copy(s, s)
+	}()
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(0, 100, 0, 0)
+	if cli.SetLANMode(true, -time.Millisecond) == nil {
+		t.Fatal("negative gap accepted")
+	}
+	if err := cli.SetLANMode(true, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// every round trip would wait for the 100ms interval at either end
+	buf := make([]byte, 8)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		cli.Write(buf)
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("20 round trips took", d)
+	}
+
+	cli.SetLANMode(false, 0)
+	cli.mu.Lock()
+	interval, nodelay, ackNoDelay := cli.kcp.interval, cli.kcp.nodelay, cli.ackNoDelay
+	cli.mu.Unlock()
+	if interval != 100 || nodelay != 0 || ackNoDelay {
+		t.Fatal("settings not restored", interval, nodelay, ackNoDelay)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	// the echo server behind the relay
+	srv, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	status := make(chan string, 2)
+	go func() {
+		for {
+			s, err := srv.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				s.SetNoDelay(1, 10, 2, 1)
+				io.Copy(s, s)
+				code, reason, _ := s.CloseStatus()
+				status <- fmt.Sprintf("%v %v", code, reason)
+			}()
+		}
+	}()
+
+	// the relay, losing more on the leg to the server
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ServeConn(nil, 0, 0, &lossyConn{PacketConn: conn, rnd: rand.New(rand.NewSource(1)), loss: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type result struct {
+		stats RelayStats
+		err   error
+	}
+	type leg struct {
+		link *cutConn
+		s    *UDPSession
+	}
+	legs := make(chan leg, 2)
+	results := make(chan result, 2)
+	go func() {
+		for {
+			a, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			a.SetNoDelay(1, 10, 2, 1)
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			link := &cutConn{PacketConn: conn}
+			b, err := NewConn(srv.Addr().String(), nil, 0, 0, &lossyConn{PacketConn: link, rnd: rand.New(rand.NewSource(2)), loss: 0.2})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			b.SetNoDelay(1, 10, 2, 1)
+			legs <- leg{link, b}
+			go func() {
+				stats, err := RelayWithStats(a, b)
+				results <- result{stats, err}
+			}()
+		}
+	}()
+	wait := func() result {
+		t.Helper()
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(10 * time.Second):
+			t.Fatal("relay not done")
+		}
+		return result{}
+	}
+
+	// echo through the relay, then close orderly
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	data := make([]byte, 128*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	go func() {
+		for k := 0; k < len(data); k += 4096 {
+			cli.Write(data[k : k+4096])
+		}
+	}()
+	got := make([]byte, len(data))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo mismatch")
+	}
+	cli.CloseWithError(7, "bye")
+	r := wait()
+	if r.err != nil || r.stats.AToB != int64(len(data)) || r.stats.BToA != int64(len(data)) {
+		t.Fatal(r.stats.AToB, r.stats.BToA, r.err)
+	}
+	if r.stats.A.State != StateClosed || r.stats.B.State != StateClosed || r.stats.B.Sent.Segments == 0 {
+		t.Fatalf("%+v", r.stats)
+	}
+	select {
+	case s := <-status:
+		if s != "7 bye" {
+			t.Fatal("close status", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not closed")
+	}
+	<-legs
+
+	// the leg to the server dies, the client learns why
+	cli, err = DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	if _, err := io.ReadFull(cli, got[:5]); err != nil {
+		t.Fatal(err)
+	}
+	b := <-legs
+	b.s.SetDeadLinkMode(DeadLinkClose, 0, 0)
+	b.s.SetRetries(5)
+	b.s.SetDeadLinkTime(0)
+	atomic.StoreInt32(&b.link.cut, 1)
+	cli.Write([]byte("lost"))
+	r = wait()
+	var ce *CloseError
+	if !errors.As(r.err, &ce) || ce.Kind != ClosedDeadLink {
+		t.Fatal(r.err)
+	}
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(got); err == nil {
+		t.Fatal("read after the relay ended")
+	}
+	if _, reason, ok := cli.CloseStatus(); !ok || reason != ce.Reason {
+		t.Fatal("close status", reason, ok)
+	}
+}
+
+// listenFDEnv tells the test binary it's the child of TestListenFD, holding the
+// socket handed over as fd 3
+const listenFDEnv = "KCP_TEST_LISTEN_FD"
+
+func TestListenFD(t *testing.T) {
+	if os.Getenv(listenFDEnv) != "" {
+		// the new process: echo one session, then exit
+		l, err := ListenFD(3, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(s, s)
+		return
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be passed as files")
+	}
+	ml, _ := NewManualListener(nil, 0, 0, nil)
+	if _, err := ml.File(); err == nil {
+		t.Fatal("manual listener has a file")
+	}
+
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+	echo := func() error {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer cli.CloseWithError(0, "done") // the child exits on it
+		cli.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "hello" {
+			return fmt.Errorf("echo %q %v", buf, err)
+		}
+		return nil
+	}
+	if err := echo(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver has exited once Handoff returns, the child is the only reader
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	f, err := l.Handoff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenFD$")
+	cmd.Env = append(os.Environ(), listenFDEnv+"=1")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	if err := echo(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("child", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("child not done")
+	}
+}
+
+// smallestConn records the smallest datagram written
+type smallestConn struct {
+	net.PacketConn
+	smallest int32
+}
+
+func (c *smallestConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	for {
+		n := atomic.LoadInt32(&c.smallest)
+		if n != 0 && int(n) <= len(p) || atomic.CompareAndSwapInt32(&c.smallest, n, int32(len(p))) {
+			break
+		}
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestCompactHeader(t *testing.T) {
+	enable := func(profile int) (bool, bool) { return profile != HeaderLegacy, profile == HeaderElided }
+	for _, c := range []struct{ client, server, want int }{
+		{HeaderElided, HeaderElided, HeaderElided},
+		{HeaderElided, HeaderCompact, HeaderCompact},
+		{HeaderCompact, HeaderElided, HeaderCompact},
+		{HeaderElided, HeaderLegacy, HeaderLegacy},
+		{HeaderLegacy, HeaderElided, HeaderLegacy},
+	} {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire := &smallestConn{PacketConn: conn}
+		l, err := ServeConn(nil, 0, 0, wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.SetCompactHeader(enable(c.server))
+		accepted := make(chan *UDPSession, 1)
+		go func() {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			io.Copy(s, s)
+		}()
+
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cli.SetCompactHeader(enable(c.client)); err != nil {
+			t.Fatal(err)
+		}
+		want := c.want
+		if want == HeaderElided && isCompactCmd(byte(cli.GetConv())) {
+			want = HeaderCompact
+		}
+		cli.SetStreamMode(true)
+		cli.SetNoDelay(1, 10, 2, 1)
+		msg := make([]byte, 64*1024)
+		rand.Read(msg)
+		go cli.Write(msg)
+		got := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil {
+			t.Fatal(c, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal(c, "data mismatch")
+		}
+		if cli.SetCompactHeader(true, true) == nil {
+			t.Fatal("set after traffic")
+		}
+
+		s := <-accepted
+		if s.SetCompactHeader(true, false) == nil {
+			t.Fatal("set on an accepted session")
+		}
+		for _, sess := range []*UDPSession{cli, s} {
+			f := sess.PacketFormat()
+			if cfg := sess.Config(); cfg.HeaderProfile != want || f.Header != want || cfg.MSS != EffectiveMSS(&f, IKCP_MTU_DEF) {
+				t.Fatal(c, "profile", cfg.HeaderProfile, f.Header, "mss", cfg.MSS)
+			}
+			sess.SetWindowSize(65535, 65535)
+			if want != HeaderLegacy {
+				if cfg := sess.Config(); cfg.SndWnd != compactMaxWnd || cfg.RcvWnd != compactMaxWnd {
+					t.Fatal(c, "windows", cfg.SndWnd, cfg.RcvWnd)
+				}
+			}
+		}
+		// the acknowledgements of the server
+		if n := atomic.LoadInt32(&wire.smallest); int(n) != IKCP_OVERHEAD-headerSaving(want) {
+			t.Fatal(c, "smallest datagram", n)
+		}
+		cli.Close()
+		s.Close()
+		l.Close()
+	}
+}
+
+func TestCryptoContext(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	if _, err := NewCryptoContext(nil); err == nil {
+		t.Fatal("a context without a key")
+	}
+	if _, err := NewCryptoContext(pass[:10]); err == nil {
+		t.Fatal("a context with a key AES doesn't take")
+	}
+	cc, err := NewCryptoContext(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two listeners sharing it
+	var addrs []string
+	for k := 0; k < 2; k++ {
+		l, err := ListenWithCrypto("127.0.0.1:0", cc, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				s, err := l.AcceptKCP()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer s.Close()
+					io.Copy(s, s)
+				}()
+			}
+		}()
+		addrs = append(addrs, l.Addr().String())
+	}
+	echo := func(s *UDPSession) error {
+		msg := make([]byte, 1024)
+		rand.Read(msg)
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.Write(msg); err != nil {
+			return err
+		}
+		got := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, got); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, msg) {
+			return errors.New("data mismatch")
+		}
+		return nil
+	}
+	dial := func(addr string, block BlockCrypt) *UDPSession {
+		s, err := DialAndVerify(addr, block, 0, 0, 2*time.Second)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		if err := echo(s); err != nil {
+			t.Fatal(addr, err)
+		}
+		return s
+	}
+
+	// the first generation is of the key itself
+	plain, _ := NewAESBlockCrypt(pass)
+	var before []*UDPSession
+	for _, addr := range addrs {
+		s, err := DialWithCrypto(addr, cc, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if err := echo(s); err != nil {
+			t.Fatal(err)
+		}
+		before = append(before, s, dial(addr, plain))
+		defer before[len(before)-1].Close()
+	}
+
+	if err := cc.Rotate(); err != nil || cc.Generation() != 1 {
+		t.Fatal("rotated to", cc.Generation(), err)
+	}
+	for _, s := range before { // the sessions keep their key
+		if err := echo(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the peer of another process rotated alike, and one that didn't yet
+	peer, err := NewCryptoContext(pass, WithGeneration(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		dial(addr, peer.Block()).Close()
+		dial(addr, plain).Close()
+	}
+
+	// past the overlap the key before is refused
+	strict, err := NewCryptoContext(pass, WithRotateOverlap(0), WithPacketToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithCrypto("127.0.0.1:0", strict, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+		}
+	}()
+	strict.Rotate()
+	s, err := DialWithCrypto(l.Addr().String(), strict, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.verify(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	old, err := DialWithOptions(l.Addr().String(), plain, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	old.SetPacketToken(pass)
+	if err := old.verify(500 * time.Millisecond); err == nil {
+		t.Fatal("the key of the generation before was taken")
+	}
+}
+
+// strictLog collects the errors of strict mode
+type strictLog struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *strictLog) Errorf(format string, args ...interface{}) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+	l.mu.Unlock()
+}
+
+func (l *strictLog) logged(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.msgs {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStrictMode(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logs := &strictLog{}
+	SetLogger(logs)
+	defer SetLogger(nil)
+	SetStrictMode(true)
+	defer SetStrictMode(false)
+	before := StrictCounts()
+
+	// settings before any traffic pass
+	if err := l.SetSessionConfig(DefaultSessionConfig()); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := DialWithOptions(l.Addr().String(), block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetPacketToken(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a message mode Write is never split
+	if _, err := cli.Write(make([]byte, cli.MaxMessageSize()+1)); err != ErrMessageTooLarge {
+		t.Fatal("oversized Write:", err)
+	}
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same settings after traffic fail
+	if cli.SetPacketToken(nil) == nil || l.SetSessionConfig(DefaultSessionConfig()) == nil {
+		t.Fatal("setting accepted after traffic")
+	}
+
+	// a transmit queue too short for a window of segments drops packets
+	lost, err := DialWithOptions("127.0.0.1:1", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lost.Close()
+	lost.SetNoDelay(1, 10, 2, 1)
+	lost.SetTxQueueLen(1)
+	lost.SetStreamMode(true)
+	lost.Write(make([]byte, 64*1024))
+	for deadline := time.Now().Add(time.Second); StrictCounts().TxDrops == before.TxDrops && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	after := StrictCounts()
+	if after.Fragments-before.Fragments != 1 || after.LateConfig-before.LateConfig != 2 || after.TxDrops == before.TxDrops {
+		t.Fatalf("counts %+v, before %+v", after, before)
+	}
+	for _, prefix := range []string{"fragments: ", "late config: ", "tx drop: "} {
+		if !logs.logged(prefix) {
+			t.Fatal("nothing logged for", prefix)
+		}
+	}
+
+	// the default is permissive
+	SetStrictMode(false)
+	if err := cli.SetPacketToken(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write(make([]byte, cli.MaxMessageSize()+1)); err != nil {
+		t.Fatal(err)
+	}
+	if c := StrictCounts(); c.Fragments != after.Fragments || c.LateConfig != after.LateConfig {
+		t.Fatal("counted while disabled")
+	}
+}
+
+func TestSessionSetMtu(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetMtu(cli.headerSize + IKCP_MTU_MIN - 1); err == nil {
+		t.Fatal("mtu without room for the headers accepted")
+	}
+	if err := cli.SetMtu(mtuLimit + 1); err == nil {
+		t.Fatal("mtu above mtuLimit accepted")
+	}
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	// the mtu shrinks while data is queued and in flight
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		for p := msg; len(p) > 0; p = p[65536:] {
+			cli.Write(p[:65536])
+			if len(p) == len(msg)/2 {
+				if err := cli.SetMtu(500); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+}
+
+// captureConn keeps a copy of the datagrams written
+type captureConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	pkts [][]byte
+}
+
+func (c *captureConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.pkts = append(c.pkts, append([]byte(nil), p...))
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *captureConn) reset() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pkts := c.pkts
+	c.pkts = nil
+	return pkts
+}
+
+func TestPacketOverhead(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	aes, _ := NewAESBlockCrypt(pass)
+	cases := []struct {
+		block     BlockCrypt
+		shards    int  // data shards, with 3 parity shards
+		negotiate bool // the compact nonce format, or the checksum unencrypted
+		token     bool
+	}{
+		{nil, 0, false, false},
+		{nil, 0, true, false},
+		{nil, 10, false, false},
+		{nil, 10, true, false},
+		{aes, 0, false, false},
+		{aes, 0, true, false},
+		{aes, 10, false, false},
+		{aes, 10, true, false},
+		{aes, 0, true, true},
+		{aes, 10, false, true},
+	}
+	for _, c := range cases {
+		parity := 0
+		if c.shards > 0 {
+			parity = 3
+		}
+		l, err := ListenWithOptions("127.0.0.1:0", c.block, c.shards, parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.block != nil {
+			l.SetCompactNonce(c.negotiate)
+		} else {
+			l.SetChecksum(c.negotiate)
+		}
+		if c.token {
+			l.SetPacketToken(key)
+		}
+		cfg := DefaultSessionConfig()
+		cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion = 1, 10, 2, 1
+		l.SetSessionConfig(cfg)
+		go func() {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			defer s.Close()
+			io.Copy(s, s)
+		}()
+
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc := &captureConn{PacketConn: conn}
+		cli, err := NewConn(l.Addr().String(), c.block, c.shards, parity, cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.block != nil {
+			cli.SetCompactNonce(c.negotiate)
+		} else {
+			cli.SetChecksum(c.negotiate)
+		}
+		if c.token {
+			cli.SetPacketToken(key)
+		}
+		cli.SetStreamMode(true)
+		cli.SetNoDelay(1, 10, 2, 1)
+
+		echo := func(n int) {
+			msg := make([]byte, n)
+			go cli.Write(msg)
+			cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(cli, msg); err != nil {
+				t.Fatal(c, err)
+			}
+		}
+		echo(1) // the capabilities are negotiated with the first packets
+
+		f := cli.PacketFormat()
+		want := PacketFormat{
+			Encrypted:   c.block != nil,
+			Compact:     c.block != nil && c.negotiate && !c.token,
+			Checksummed: c.block == nil && c.negotiate,
+			FEC:         c.shards > 0,
+		}
+		if f != want {
+			t.Fatalf("%+v: packet format %+v", c, f)
+		}
+		cli.mu.Lock()
+		mss := int(cli.kcp.mss)
+		cli.mu.Unlock()
+		if mss != EffectiveMSS(&f, IKCP_MTU_DEF) {
+			t.Fatalf("%+v: mss %v, EffectiveMSS %v", c, mss, EffectiveMSS(&f, IKCP_MTU_DEF))
+		}
+
+		// full segments fill the mtu, and the rest of every datagram is overhead
+		cc.reset()
+		echo(16 * mss)
+		full := false
+		for _, pkt := range cc.reset() {
+			info, err := DecodePacketForDebug(c.block, c.shards > 0, pkt)
+			if err != nil {
+				t.Fatal(c, err)
+			}
+			if info.FECParity {
+				continue
+			}
+			size := 0
+			for _, seg := range info.Segments {
+				size += IKCP_OVERHEAD + len(seg.Data)
+			}
+			if overhead := len(pkt) - size; overhead != OverheadPerPacket(&f) {
+				t.Fatalf("%+v: %v bytes of overhead, OverheadPerPacket %v", c, overhead, OverheadPerPacket(&f))
+			}
+			if len(pkt) > IKCP_MTU_DEF {
+				t.Fatalf("%+v: datagram of %v bytes", c, len(pkt))
+			}
+			full = full || len(pkt) == IKCP_MTU_DEF
+		}
+		if !full {
+			t.Fatalf("%+v: no datagram fills the mtu", c)
+		}
+		cli.Close()
+		l.Close()
+	}
+
+	f := PacketFormat{Encrypted: true, Padding: 100, FEC: true}
+	if n := OverheadPerPacket(&f); n != CryptHeaderSize+100+PaddingLengthSize+FECHeaderSize {
+		t.Fatal("overhead with padding", n)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.SndWnd, cfg.RcvWnd = 512, 512 // a window for all fragments of a message
+	cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion = 1, 10, 2, 1
+	if err := l.SetSessionConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		buf := make([]byte, 512*1024)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := s.WriteMessage(buf[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(512, 512)
+	cli.SetNoDelay(1, 10, 2, 1)
+	plain := (IKCP_MTU_DEF - IKCP_OVERHEAD) * 255
+	if max := cli.MaxMessageSize(); max >= plain {
+		t.Fatal("max message size", max, "without the overhead of crypto and FEC")
+	}
+
+	buf := make([]byte, 512*1024)
+	echo := func(size int) {
+		t.Helper()
+		msg := make([]byte, size)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		if n, err := cli.WriteMessage(msg); n != size || err != nil {
+			t.Fatal(size, n, err)
+		}
+		cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := cli.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatal("echoed", n, "bytes of", size)
+		}
+	}
+	for _, mtu := range []int{IKCP_MTU_DEF, 600} {
+		before := cli.MaxMessageSize()
+		if err := cli.SetMtu(mtu); err != nil {
+			t.Fatal(err)
+		}
+		max := cli.MaxMessageSize()
+		if want := before - (IKCP_MTU_DEF-mtu)*255; max != want {
+			t.Fatal("mtu", mtu, "max message size", max, "want", want)
+		}
+		echo(max)
+		if n, err := cli.WriteMessage(make([]byte, max+1)); n != 0 || err != ErrMessageTooLarge {
+			t.Fatal(n, err)
+		}
+	}
+
+	cli.SetStreamMode(true)
+	if _, err := cli.WriteMessage([]byte{1}); err == nil {
+		t.Fatal("message written in stream mode")
+	}
+}
+
+// sessions whose applications don't read stop taking data once the listener
+// is over budget, while a session being read keeps going
+func TestMemoryBudget(t *testing.T) {
+	const budget = 4 << 20
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetMemoryBudget(-1); err == nil {
+		t.Fatal("negative budget accepted")
+	}
+	l.SetMemoryBudget(budget)
+
+	const stalled = 16
+	reader := make(chan *UDPSession, 1)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetWindowSize(1024, 1024)
+			s.SetNoDelay(1, 10, 2, 1)
+			if s.GetConv() == 0 {
+				reader <- s
+			}
+		}
+	}()
+
+	defer func(f func() uint32) { ConvSource = f }(ConvSource)
+	var clients []*UDPSession
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	for i := 1; i <= stalled; i++ {
+		conv := uint32(i)
+		ConvSource = func() uint32 { return conv }
+		cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, cli)
+		cli.SetWindowSize(1024, 1024)
+		cli.SetNoDelay(1, 10, 2, 1)
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				if _, err := cli.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// nobody reads, so the sessions fill up to the budget and stop there. The
+	// first ones may take more than their final share before the others arrive,
+	// and each may hold IKCP_WND_RCV segments plus the rest of a started message
+	time.Sleep(2 * time.Second)
+	used := l.Stats().Buffered
+	t.Log("buffered by stalled sessions:", used)
+	if used < budget/2 || used > 2*budget+stalled*(64+IKCP_WND_RCV)*mtuLimit {
+		t.Fatal("buffered", used, "with a budget of", budget)
+	}
+
+	// a session whose application reads still gets its data through
+	ConvSource = func() uint32 { return 0 }
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients = append(clients, cli)
+	cli.SetNoDelay(1, 10, 2, 1)
+	msg := make([]byte, 1<<20)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		for p := msg; len(p) > 0; p = p[65536:] {
+			cli.Write(p[:65536])
+		}
+	}()
+	var s *UDPSession
+	select {
+	case s = <-reader:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session accepted")
+	}
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	// the stalled sessions only take the rest of a message they started,
+	// up to 64 segments of a 64KB write, and the reader adds its window
+	if now := l.Stats().Buffered; now > used+(stalled*64+IKCP_WND_RCV)*mtuLimit {
+		t.Fatal("buffered", now, "after", used, "with a budget of", budget)
+	}
+}
+
+// preAcceptRun sends 10 MB to a session of a listener holding at most limit bytes
+// before Accept, accepts it once 1 MB arrived or after a second, and reads the data
+func preAcceptRun(t *testing.T, limit int) AcceptStats {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.SndWnd, cfg.RcvWnd = 1024, 1024
+	cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NoCongestion = 1, 10, 2, 1
+	if err := l.SetSessionConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetPreAcceptBuffer(limit); err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+	msg := make([]byte, 10<<20)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		for p := msg; len(p) > 0; p = p[65536:] {
+			if _, err := cli.Write(p[:65536]); err != nil {
+				return
+			}
+		}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); l.PendingAccepts() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a second in the queue, and without a cap until 1MB came, however slow the runner
+	wait := time.Second
+	if limit == 0 {
+		wait = 10 * time.Second
+	}
+	for start := time.Now(); time.Since(start) < time.Second || l.Stats().Buffered < 1<<20 && time.Since(start) < wait; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	stats := s.PreAccept()
+
+	got := make([]byte, len(msg))
+	s.SetReadDeadline(time.Now().Add(20 * time.Second))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	if cli.PreAccept() != (AcceptStats{}) {
+		t.Fatal("pre-accept stats of a dial")
+	}
+	return stats
+}
+
+func TestPreAcceptBuffer(t *testing.T) {
+	const limit = 256 << 10
+	stats := preAcceptRun(t, 0)
+	t.Logf("without a cap: %+v", stats)
+	if stats.Bytes < 2*limit {
+		t.Fatalf("%+v", stats)
+	}
+
+	stats = preAcceptRun(t, limit)
+	t.Logf("capped at %v: %+v", limit, stats)
+	if stats.Bytes == 0 || stats.Bytes > limit+mtuLimit || stats.Waited < time.Second {
+		t.Fatalf("%+v", stats)
+	}
+
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.SetPreAcceptBuffer(-1) == nil {
+		t.Fatal("negative cap accepted")
+	}
+}
+
+// linkConn is a packet socket on a link sending a datagram per interval,
+// writes block while the link is busy, and fail once it's down
+type linkConn struct {
+	net.PacketConn
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+	down     bool
+}
+
+func (c *linkConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return 0, net.ErrClosed
+	}
+	now := time.Now()
+	if c.next.Before(now) {
+		c.next = now
+	}
+	c.next = c.next.Add(c.interval)
+	time.Sleep(c.next.Sub(now))
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// fairOutputRun returns the average echo time of small messages on a session while
+// another session of the listener saturates the link, without fair the sessions bypass
+// the output scheduler and write to the socket in order of arrival
+func fairOutputRun(t *testing.T, fair bool) time.Duration {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &linkConn{PacketConn: conn, interval: 100 * time.Microsecond}
+	l := newListener(nil, 0, 0, link)
+	if fair {
+		l.spawn(l.sched.run)
+	} else {
+		l.sched = nil
+	}
+	l.spawn(l.monitor)
+	defer l.Close()
+	defer func() { // without the scheduler, the lingering sessions would block the updater on it
+		link.mu.Lock()
+		link.down = true
+		link.mu.Unlock()
+	}()
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			s.SetWindowSize(1024, 1024)
+			s.SetNoDelay(1, 10, 2, 1)
+			go func() {
+				defer s.Close()
+				buf := make([]byte, 65536)
+				n, err := s.Read(buf)
+				if err != nil {
+					return
+				}
+				if string(buf[:n]) == "bulk" {
+					for {
+						if _, err := s.Write(buf); err != nil {
+							return
+						}
+					}
+				}
+				s.Write(buf[:n])
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	bulk, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bulk.Close()
+	bulk.SetWindowSize(1024, 1024)
+	bulk.SetNoDelay(1, 10, 2, 1)
+	bulk.Write([]byte("bulk"))
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			if _, err := bulk.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Second)
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	buf := make([]byte, 64)
+	var sum time.Duration
+	const pings = 20
+	for i := 0; i < pings; i++ {
+		start := time.Now()
+		cli.Write([]byte("ping"))
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := cli.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		sum += time.Since(start)
+		time.Sleep(10 * time.Millisecond)
+	}
+	return sum / pings
+}
+
+// the echo time of small messages under load is a fraction of what it is when the
+// sessions write to the socket in order of arrival
+func TestFairOutput(t *testing.T) {
+	fifo := fairOutputRun(t, false)
+	fair := fairOutputRun(t, true)
+	t.Logf("echo time under load: %v fifo, %v fair", fifo, fair)
+	if fair*3 > fifo {
+		t.Fatalf("echo time under load: %v fifo, %v fair", fifo, fair)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	// a steady 10KB/s, then idle
+	var r ewmaRate
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		now = now.Add(10 * time.Millisecond)
+		r.add(100, now)
+	}
+	if rate := r.value(now); rate < 9500 || rate > 10500 {
+		t.Fatal("steady rate", rate)
+	}
+	if rate := r.value(now.Add(10 * time.Second)); rate > 10 {
+		t.Fatal("idle rate", rate)
+	}
+
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetWindowSize(1024, 1024)
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+	msg := make([]byte, 1<<20)
+	go func() {
+		for p := msg; len(p) > 0; p = p[65536:] {
+			cli.Write(p[:65536])
+		}
+	}()
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+
+	// FEC and headers come on top of the payload
+	tx, rx, txWire, rxWire := cli.Throughput()
+	t.Log("payload", tx, rx, "wire", txWire, rxWire)
+	if tx == 0 || rx == 0 || txWire <= tx || rxWire <= rx {
+		t.Fatal("payload", tx, rx, "wire", txWire, rxWire)
+	}
+}
+
+// cutConn is a packet socket whose link can be cut in both directions
+type cutConn struct {
+	net.PacketConn
+	cut int32
+}
+
+func (c *cutConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if atomic.LoadInt32(&c.cut) != 0 {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *cutConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || atomic.LoadInt32(&c.cut) == 0 {
+			return n, addr, err
+		}
+	}
+}
+
+func TestDeadLinkSuspend(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetWindowSize(1024, 1024)
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &cutConn{PacketConn: conn}
+	cli, err := NewConn(l.Addr().String(), nil, 0, 0, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetDeadLinkMode(DeadLinkSuspend+1, 0, 0); err == nil {
+		t.Fatal("invalid mode accepted")
+	}
+	states := make(chan int, 8)
+	cli.SetStateCallback(func(state int) { states <- state })
+	cli.SetDeadLinkMode(DeadLinkSuspend, 0, 1<<20)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.mu.Lock()
+	cli.kcp.dead_link, cli.kcp.dead_time = 5, 0
+	cli.mu.Unlock()
+	expect := func(want int) {
+		select {
+		case state := <-states:
+			if state != want {
+				t.Fatal("state", state, "want", want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no state change to", want)
+		}
+	}
+
+	// the link goes down, Writes buffer beyond the window while suspended
+	atomic.StoreInt32(&link.cut, 1)
+	cli.Write([]byte("x"))
+	expect(StateSuspended)
+	if state := cli.Stats().State; state != StateSuspended {
+		t.Fatal("stats state", state)
+	}
+	msg := make([]byte, 512*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	cli.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	for p := msg; len(p) > 0; p = p[65536:] {
+		if _, err := cli.Write(p[:65536]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cli.SetWriteDeadline(time.Time{})
+
+	// and the session resumes with it
+	atomic.StoreInt32(&link.cut, 0)
+	expect(StateActive)
+	got := make([]byte, 1+len(msg))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 'x' || !bytes.Equal(got[1:], msg) {
+		t.Fatal("data mismatch")
+	}
+
+	// a suspended session is closed after the timeout
+	cli.SetDeadLinkMode(DeadLinkSuspend, 200*time.Millisecond, 1<<20)
+	atomic.StoreInt32(&link.cut, 1)
+	cli.Write([]byte("x"))
+	expect(StateSuspended)
+	expect(StateClosed)
+	if !strings.Contains(cli.String(), closeDeadLink) {
+		t.Fatal(cli.String())
+	}
+}
+
+// a 3 second outage under fast timers survives with the dead link time, and kills the
+// session counting retransmissions only
+func TestDeadLinkTime(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &cutConn{PacketConn: conn}
+	cli, err := NewConn(l.Addr().String(), nil, 0, 0, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SetDeadLinkTime(-1) == nil {
+		t.Fatal("negative dead link time accepted")
+	}
+	closed := make(chan struct{})
+	cli.SetStateCallback(func(state int) {
+		if state == StateClosed {
+			close(closed)
+		}
+	})
+	cli.SetDeadLinkMode(DeadLinkClose, 0, 0)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetRetries(10)
+	cli.SetBackoff(1, false) // the rto stays at its minimum, 10 transmissions take 300ms
+
+	echo := func(msg string) {
+		t.Helper()
+		if _, err := cli.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != msg {
+			t.Fatal(string(buf), err)
+		}
+	}
+	echo("before")
+
+	atomic.StoreInt32(&link.cut, 1)
+	go cli.Write([]byte("during"))
+	select {
+	case <-closed:
+		t.Fatal("closed by a short outage")
+	case <-time.After(3 * time.Second):
+	}
+	atomic.StoreInt32(&link.cut, 0)
+	buf := make([]byte, 6)
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "during" {
+		t.Fatal(string(buf), err)
+	}
+	echo("after")
+
+	// the transmissions alone, like before the dead link time
+	cli.SetDeadLinkTime(0)
+	atomic.StoreInt32(&link.cut, 1)
+	go cli.Write([]byte("x"))
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("alive after the retries")
+	}
+}
+
+// a listener paused for 2 seconds under timers which would declare the link dead in
+// 300ms of silence: the client sees a zero window, no end closes and no data is lost
+func TestPause(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed := make(chan struct{}, 2)
+	fast := func(s *UDPSession) {
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetDeadLinkMode(DeadLinkClose, 0, 0)
+		s.SetRetries(10)
+		s.SetDeadLinkTime(0)
+		s.SetBackoff(1, false)
+		s.SetStateCallback(func(state int) {
+			if state == StateClosed {
+				closed <- struct{}{}
+			}
+		})
+	}
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		fast(s)
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast(cli)
+	const N = 1 << 20
+	go func() { // a counter of about 1MB/s, echoed all along
+		buf := make([]byte, 1024)
+		for off := 0; off < N; off += len(buf) {
+			for k := range buf {
+				buf[k] = byte((off + k) / 4)
+			}
+			if _, err := cli.Write(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	echoed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		cli.SetReadDeadline(time.Now().Add(30 * time.Second))
+		for off := 0; off < N; {
+			n, err := cli.Read(buf)
+			if err != nil {
+				echoed <- err
+				return
+			}
+			for k := 0; k < n; k++ {
+				if buf[k] != byte((off+k)/4) {
+					echoed <- fmt.Errorf("byte %v differs", off+k)
+					return
+				}
+			}
+			off += n
+		}
+		echoed <- nil
+	}()
+
+	s := <-accepted
+	defer s.Close()
+	defer cli.Close()
+	time.Sleep(200 * time.Millisecond)
+	if err := l.PauseAll(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if st := s.DebugState(); !st.Paused {
+		t.Fatal("not paused")
+	}
+	if st := cli.DebugState(); st.RmtWnd != 0 {
+		t.Fatal("window", st.RmtWnd, "advertised while paused")
+	}
+	sent := s.Stats().Sent
+	time.Sleep(1800 * time.Millisecond)
+	if now := s.Stats().Sent; now != sent {
+		t.Fatal("sent while paused", sent, now)
+	}
+	if err := l.ResumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-echoed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("closed by the pause")
+	default:
+	}
+}
+
+// a slow reader holds at most its receive window and throttles the sender
+func TestRecvQueueLen(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var written int64
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetStreamMode(true)
+		s.SetNoDelay(1, 10, 2, 1)
+		buf := make([]byte, 65536)
+		for {
+			n, err := s.Write(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&written, int64(n))
+		}
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(32, 32)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("go"))
+	buf := make([]byte, 4096)
+	read := 0
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if n := cli.RecvQueueLen(); n > 32 {
+			t.Fatal("holding", n, "segments")
+		}
+		n, err := cli.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += n
+	}
+
+	// the sender is ahead of the reader by the receive window, the send window
+	// it fills before a Write, that Write, and a segment left over by Read
+	ahead := atomic.LoadInt64(&written) - int64(read)
+	t.Log("read", read, "sender ahead by", ahead)
+	if ahead > int64((32+defaultWndSize+1)*IKCP_MTU_DEF+65536) {
+		t.Fatal("sender ahead by", ahead)
+	}
+}
+
+func TestListenWithConfig(t *testing.T) {
+	var controlled int32
+	lc := &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		atomic.StoreInt32(&controlled, 1)
+		return nil
+	}}
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithConfig(context.Background(), lc, "127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if atomic.LoadInt32(&controlled) == 0 {
+		t.Fatal("Control hook not called")
+	}
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	buf := make([]byte, 64)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := cli.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal(string(buf[:n]), err)
+	}
+}
+
+// lossyConn drops a fifth of the datagrams written, or the share of loss, at random,
+// so that no retransmission is dropped every time
+type lossyConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rnd.Intn(5) == 0
+	if c.loss > 0 {
+		drop = c.rnd.Float64() < c.loss
+	}
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func TestCloseAfterResponse(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ServeConn(nil, 0, 0, &lossyConn{PacketConn: conn, rnd: rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	resp := make([]byte, 256*1024)
+	for i := range resp {
+		resp[i] = byte(i * 7)
+	}
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetStreamMode(true)
+		s.SetNoDelay(1, 10, 2, 1)
+		req := make([]byte, 3)
+		if _, err := io.ReadFull(s, req); err != nil {
+			s.Close()
+			return
+		}
+		// the response is mostly unacknowledged when the session is closed, and its
+		// end is held back by the write delay
+		s.SetWriteDelay(time.Minute)
+		s.Write(resp[:len(resp)-3])
+		s.Write(resp[len(resp)-3:])
+		s.Close()
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("get"))
+	got := make([]byte, len(resp))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatalf("%v %+v", err, cli.DebugState())
+	}
+	if !bytes.Equal(got, resp) {
+		t.Fatal("response mismatch")
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const total = 1 << 20
+	received := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetStreamMode(true)
+		s.SetNoDelay(1, 10, 2, 1)
+		io.CopyN(ioutil.Discard, s, total)
+		received <- s
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewConn(l.Addr().String(), nil, 0, 0, &lossyConn{PacketConn: conn, rnd: rand.New(rand.NewSource(1)), loss: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(32, 32) // no bursts the socket buffers would drop
+	go cli.Write(make([]byte, total))
+
+	var s *UDPSession
+	select {
+	case s = <-received:
+		defer s.Close()
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%+v", cli.DebugState())
+	}
+	sent, rcvd := cli.Stats().Sent, s.Stats().Received
+	if sent.Bytes < total || rcvd.Bytes != total || sent.Spurious > sent.RetransSegments {
+		t.Fatalf("sent %+v received %+v", sent, rcvd)
+	}
+	// about 5% of the segments are lost, and sent again
+	if ratio := sent.RetransRatio(); ratio < 0.03 || ratio > 0.15 {
+		t.Fatalf("retransmission ratio %v: %+v %+v", ratio, sent, rcvd)
+	}
+	if rcvd.RetransRatio() > sent.RetransRatio() {
+		t.Fatalf("more duplicates than retransmissions: sent %+v received %+v", sent, rcvd)
+	}
+}
+
+func BenchmarkThroughputPlain(b *testing.B) {
+	benchmarkThroughput(b, func() BlockCrypt { return nil }, false)
+}
+
+func BenchmarkThroughputAES(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	benchmarkThroughput(b, func() BlockCrypt {
+		block, _ := NewAESBlockCrypt(pass)
+		return block
+	}, false)
+}
+
+// the overhead of SetStreamChecksum, compare with BenchmarkThroughputAES
+func BenchmarkThroughputStreamChecksum(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	benchmarkThroughput(b, func() BlockCrypt {
+		block, _ := NewAESBlockCrypt(pass)
+		return block
+	}, true)
+}
+
+// bulk transfer over loopback from a dialed session to an accepted one, checked with
+// SetStreamChecksum if check is set
+func benchmarkThroughput(b *testing.B, newBlock func() BlockCrypt, check bool) {
+	const msgSize = 4096
+	l, err := ListenWithOptions("127.0.0.1:0", newBlock(), 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReadBuffer(16 * 1024 * 1024)
+	l.SetStreamChecksum(check)
+
+	done := make(chan error, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer s.Close()
+		s.SetStreamMode(true)
+		s.SetWindowSize(1024, 1024)
+		s.SetNoDelay(1, 20, 2, 1)
+		_, err = io.CopyN(ioutil.Discard, s, int64(b.N)*msgSize)
+		done <- err
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), newBlock(), 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamChecksum(check)
+	cli.SetStreamMode(true)
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 20, 2, 1)
+
+	msg := make([]byte, msgSize)
+	b.SetBytes(msgSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cli.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatal(err)
+	}
+}
+
+// a small request and its response per op, tuned with SetNoDelay and SetACKNoDelay
+func BenchmarkEchoLatency(b *testing.B) {
+	benchmarkEcho(b, func(s *UDPSession) {
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetACKNoDelay(true)
+	})
+}
+
+// the default settings, the acknowledgements wait for the 100ms interval
+func BenchmarkEchoLatencyDefault(b *testing.B) {
+	benchmarkEcho(b, func(s *UDPSession) {})
+}
+
+func BenchmarkEchoLatencyLAN(b *testing.B) {
+	benchmarkEcho(b, func(s *UDPSession) { s.SetLANMode(true, 0) })
+}
+
+// a small request and its response per op, between a dialed session and an accepted
+// one, both set up by tune
+func benchmarkEcho(b *testing.B, tune func(s *UDPSession)) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		tune(s)
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cli.Close()
+	tune(cli)
+
+	msg := make([]byte, 64)
+	buf := make([]byte, len(msg))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cli.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(cli, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// burstConn delivers the datagrams of a peer kcp queued to in, and keeps what the
+// session writes for the peer
+type burstConn struct {
+	net.PacketConn
+	in   chan []byte
+	mu   sync.Mutex
+	out  [][]byte
+	die  chan struct{}
+	once sync.Once
+}
+
+func newBurstConn() *burstConn {
+	return &burstConn{in: make(chan []byte, 256), die: make(chan struct{})}
+}
+
+func (c *burstConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, nil
+	case <-c.die:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (c *burstConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.out = append(c.out, append([]byte(nil), p...))
+	c.mu.Unlock()
+	return len(p), nil
+}
+
+// written returns the datagrams written since the last call
+func (c *burstConn) written() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := c.out
+	c.out = nil
+	return out
+}
+
+func (c *burstConn) LocalAddr() net.Addr           { return &net.UDPAddr{} }
+func (c *burstConn) SetReadBuffer(bytes int) error { return nil }
+func (c *burstConn) Close() error {
+	c.once.Do(func() { close(c.die) })
+	return nil
+}
+
+// burstPeer sends bursts of messages of a datagram each to a session over a burstConn
+type burstPeer struct {
+	conn    *burstConn
+	kcp     *KCP
+	current uint32
+	pending [][]byte // datagrams of the burst
+}
+
+func newBurstPeer(t testing.TB) (*burstPeer, *UDPSession) {
+	conn := newBurstConn()
+	s, err := NewConn("127.0.0.1:1", nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetWindowSize(defaultWndSize, 256)
+	s.SetACKNoDelay(true)
+	p := &burstPeer{conn: conn}
+	p.kcp = NewKCP(s.GetConv(), func(buf []byte, size int) { p.pending = append(p.pending, append([]byte(nil), buf[:size]...)) })
+	p.kcp.NoDelay(1, 10, 2, 1)
+	p.kcp.WndSize(256, 256)
+	p.kcp.rmt_wnd = 256 // ahead of the first ack
+	// acks are held until the first update
+	for {
+		s.mu.Lock()
+		updated := s.kcp.updated != 0
+		s.mu.Unlock()
+		if updated {
+			return p, s
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// burst prepares the datagrams of n messages, after the acks of the previous ones
+func (p *burstPeer) burst(n int, msg []byte) {
+	for _, pkt := range p.conn.written() {
+		p.kcp.Input(pkt, true)
+	}
+	for i := 0; i < n; i++ {
+		p.kcp.Send(msg)
+	}
+	p.current += 10
+	p.kcp.Update(p.current)
+}
+
+// deliver hands the datagrams of the burst to the session at once
+func (p *burstPeer) deliver() {
+	for _, pkt := range p.pending {
+		p.conn.in <- pkt
+	}
+	p.pending = p.pending[:0]
+}
+
+// the first message of a burst reaches Read before the rest of the burst arrives
+func TestReadDuringBurst(t *testing.T) {
+	p, s := newBurstPeer(t)
+	defer s.Close()
+	msg := make([]byte, 1000)
+	buf := make([]byte, len(msg))
+	p.burst(1, msg)
+	p.deliver()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal("first message of the burst:", err)
+	}
+	p.burst(49, msg)
+	p.deliver()
+	for i := 0; i < 49; i++ {
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+// a burst of 50 datagrams per op, first-ns is the time until Read returns the first
+// message, last-ns until it returns the last one
+func BenchmarkBurstFirstByte(b *testing.B) {
+	p, s := newBurstPeer(b)
+	defer s.Close()
+	msg := make([]byte, 1000)
+	buf := make([]byte, len(msg))
+	var first, last time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.burst(50, msg)
+		start := time.Now()
+		s.SetReadDeadline(start.Add(5 * time.Second))
+		p.deliver()
+		for k := 0; k < 50; k++ {
+			if _, err := io.ReadFull(s, buf); err != nil {
+				b.Fatal(err)
+			}
+			if k == 0 {
+				first += time.Since(start)
+			}
+		}
+		last += time.Since(start)
+	}
+	b.ReportMetric(float64(first.Nanoseconds())/float64(b.N), "first-ns")
+	b.ReportMetric(float64(last.Nanoseconds())/float64(b.N), "last-ns")
+}
+
+// helloConn delivers one datagram from each of its addresses, then nothing until
+// it's closed, and drops everything written to it
+type helloConn struct {
+	net.PacketConn
+	hellos [][]byte
+	addrs  []net.Addr
+	die    chan struct{}
+	once   sync.Once
+}
+
+func newHelloConn(sessions int) *helloConn {
+	c := &helloConn{die: make(chan struct{})}
+	for i := 0; i < sessions; i++ {
+		var hello []byte
+		kcp := NewKCP(uint32(i), func(buf []byte, size int) {
+			hello = append([]byte(nil), buf[:size]...)
+		})
+		kcp.NoDelay(0, 10, 0, 1)
+		kcp.Send([]byte("hello"))
+		kcp.Update(0)
+		c.hellos = append(c.hellos, hello)
+		c.addrs = append(c.addrs, &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1})
+	}
+	return c
+}
+
+func (c *helloConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if len(c.hellos) > 0 {
+		n := copy(p, c.hellos[0])
+		addr := c.addrs[0]
+		c.hellos, c.addrs = c.hellos[1:], c.addrs[1:]
+		return n, addr, nil
+	}
+	<-c.die
+	return 0, nil, errors.New("closed")
+}
+
+func (c *helloConn) WriteTo(p []byte, addr net.Addr) (int, error) { return len(p), nil }
+func (c *helloConn) LocalAddr() net.Addr                          { return &net.UDPAddr{} }
+func (c *helloConn) SetReadBuffer(bytes int) error                { return nil }
+func (c *helloConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c *helloConn) Close() error {
+	c.once.Do(func() { close(c.die) })
+	return nil
+}
+
+// the cost of one update of every idle session, like the updater runs them
+func BenchmarkManySessions(b *testing.B) {
+	sessions := 10000
+	if testing.Short() {
+		sessions = 1000
+	}
+	l, err := ServeConn(nil, 0, 0, newHelloConn(sessions))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	var accepted []*UDPSession
+	for len(accepted) < sessions {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			b.Fatal(err)
+		}
+		accepted = append(accepted, s)
+	}
+	defer func() {
+		for _, s := range accepted {
+			s.Close()
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for _, s := range accepted {
+			s.update()
+		}
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*sessions), "ns/session")
+}
+
+func TestRestartedClient(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// two clients in turn on the same local address
+	var laddr *net.UDPAddr
+	dial := func(msg string) *UDPSession {
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		laddr = conn.LocalAddr().(*net.UDPAddr)
+		cli, err := NewConn(l.Addr().String(), nil, 10, 3, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte(msg))
+		return cli
+	}
+	accept := func(msg string) *UDPSession {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(s, buf); err != nil || string(buf) != msg {
+			t.Fatal(string(buf), err)
+		}
+		s.Write(buf)
+		return s
+	}
+
+	cli := dial("first")
+	s1 := accept("first")
+	defer s1.Close()
+	buf := make([]byte, 5)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stray first packet of another conversation, nobody answers for it
+	stray := make([]byte, fecHeaderSizePlus2+IKCP_OVERHEAD+5)
+	binary.LittleEndian.PutUint16(stray[4:], typeData)
+	binary.LittleEndian.PutUint16(stray[6:], uint16(len(stray)-fecHeaderSizePlus2+2))
+	seg := stray[fecHeaderSizePlus2:]
+	binary.LittleEndian.PutUint32(seg, s1.GetConv()+1)
+	seg[4] = IKCP_CMD_PUSH
+	binary.LittleEndian.PutUint16(seg[6:], 128)
+	binary.LittleEndian.PutUint32(seg[20:], 5)
+	copy(seg[IKCP_OVERHEAD:], "stray")
+	if _, err := cli.conn.WriteTo(stray, l.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	cli.Write([]byte("still"))
+	if _, err := io.ReadFull(s1, buf); err != nil || string(buf) != "still" {
+		t.Fatal("live session after a stray packet:", string(buf), err)
+	}
+	s1.Write(buf) // the client closes once its data is acknowledged
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := l.Stats().Replaced; n != 0 {
+		t.Fatal(n, "sessions replaced by a stray packet")
+	}
+	cli.Close()
+
+	// the restarted client gets a new session, the old one closes
+	cli = dial("again")
+	defer cli.Close()
+	s2 := accept("again")
+	defer s2.Close()
+	if s2.GetConv() == s1.GetConv() {
+		t.Fatal("same conv")
+	}
+	ctx := s1.Context()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("replaced session open")
+	}
+	var ce *CloseError
+	if !errors.As(context.Cause(ctx), &ce) || ce.Kind != ClosedReplaced {
+		t.Fatal("replaced session closed by", context.Cause(ctx))
+	}
+	if _, err := s1.Read(buf); err != io.EOF {
+		t.Fatal("replaced session read:", err)
+	}
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "again" {
+		t.Fatal(string(buf), err)
+	}
+	if n := l.Stats().Replaced; n != 1 {
+		t.Fatal(n, "sessions replaced")
+	}
+}
+
+func TestListenerEvents(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	events := l.Events()
+	next := func(typ int) SessionEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			if ev.Type != typ {
+				t.Fatal("event", ev, "instead of", typ)
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event", typ)
+		}
+		return SessionEvent{}
+	}
+	accept := func() *UDPSession {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := next(EventAccepted)
+		if ev.ID != s.ID() || ev.Conv != s.GetConv() || ev.Remote.String() != s.RemoteAddr().String() {
+			t.Fatal("accepted", ev)
+		}
+		return s
+	}
+
+	// closed by the peer
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	s := accept()
+	s.Write([]byte("hi")) // the client knows the capabilities of the server then
+	buf := make([]byte, 2)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	cli.CloseWithError(1, "bye")
+	if ev := next(EventClosed); ev.ID != s.ID() || ev.Reason != closePeer {
+		t.Fatal("closed", ev)
+	}
+
+	// by the dead link mode, once the client is gone
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &cutConn{PacketConn: conn}
+	cli, err = NewConn(l.Addr().String(), nil, 0, 0, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	s = accept()
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetRetries(3)
+	s.SetDeadLinkTime(0)
+	s.SetDeadLinkMode(DeadLinkClose, 0, 0)
+	atomic.StoreInt32(&link.cut, 1)
+	s.Write([]byte("anybody there"))
+	if ev := next(EventClosed); ev.ID != s.ID() || ev.Reason != closeDeadLink {
+		t.Fatal("closed", ev)
+	}
+
+	// by a new conversation from the same address
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	first, err := NewConn(l.Addr().String(), nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Write([]byte("hello"))
+	s = accept()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi")) // the hello is acknowledged then, the client closes at once
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(first, buf); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	conn, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewConn(l.Addr().String(), nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	again.Write([]byte("hello"))
+	var kicked, accepted bool
+	for !kicked || !accepted { // in either order
+		select {
+		case ev := <-events:
+			kicked = kicked || ev.Type == EventKicked && ev.ID == s.ID() && ev.Reason == closeReplaced
+			accepted = accepted || ev.Type == EventAccepted && ev.Conv == again.GetConv()
+		case <-time.After(5 * time.Second):
+			t.Fatal("kicked", kicked, "accepted", accepted)
+		}
+	}
+
+	// a consumer behind loses the newest events
+	for i := 0; i < eventBacklog+1; i++ {
+		l.emit(EventRateLimited, s, "")
+	}
+	if n := l.Stats().EventsDropped; n == 0 {
+		t.Fatal("no event dropped")
+	}
+}
+
+func TestDebugState(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(32, 4)
+
+	// the server doesn't read, its window fills up
+	msg := make([]byte, 1024)
+	for i := 0; i < 16; i++ {
+		cli.Write(msg)
+	}
+	var st SessionState
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if st = cli.DebugState(); st.RmtWnd == 0 {
+			break
+		}
+	}
+	if st.RmtWnd != 0 || st.SndUna != 4 || st.SndQueue+st.SndBuf != 13 || int(st.SndNxt-st.SndUna) != st.SndBuf {
+		t.Fatalf("%+v", st)
+	}
+	if st.Conv != s.GetConv() || st.LastSend.IsZero() || st.LastRecv.IsZero() {
+		t.Fatalf("%+v", st)
+	}
+	ss := s.DebugState()
+	if ss.RcvQueue != 4 || ss.RcvNxt != 4 || ss.RcvWnd != 4 {
+		t.Fatalf("%+v", ss)
+	}
+	if _, err := json.Marshal(st); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.SetBacklog(0) == nil {
+		t.Fatal("zero backlog accepted")
+	}
+	l.SetBacklog(2)
+
+	var clients []*UDPSession
+	for i := 0; i < 3; i++ {
+		cli, err := DialWithOptions(l.Addr().String(), nil, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.Write([]byte{byte(i)})
+		clients = append(clients, cli)
+	}
+
+	// the third client is refused until Accept makes room
+	deadline := time.Now().Add(5 * time.Second)
+	for l.PendingAccepts() < 2 || l.Stats().Backlog.Count == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("pending", l.PendingAccepts(), "refused", l.Stats().Backlog.Count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l.PendingAccepts(); n != 2 {
+		t.Fatal("pending", n)
+	}
+
+	l.SetReadDeadline(time.Now().Add(10 * time.Second))
+	seen := make(map[byte]bool)
+	for i := 0; i < 3; i++ {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			t.Fatal(err)
+		}
+		seen[buf[0]] = true
+	}
+	if len(seen) != 3 {
+		t.Fatal("accepted", seen)
+	}
+	if n := l.PendingAccepts(); n != 0 {
+		t.Fatal("pending", n)
+	}
+}
+
+func listenerGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), "created by github.com/xtaci/kcp-go.(*Listener)")
+}
+
+func TestListenerCloseGoroutines(t *testing.T) {
+	base := listenerGoroutines()
+	for i := 0; i < 10; i++ {
+		l, err := ListenWithOptions("127.0.0.1:0", nil, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.SetBacklog(4) // some clients are refused, some wait to be accepted
+
+		// clients keep connecting while the listener closes
+		die := make(chan struct{})
+		var wg sync.WaitGroup
+		for k := 0; k < 8; k++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-die:
+						return
+					default:
+					}
+					cli, err := DialWithOptions(l.Addr().String(), nil, 10, 3)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					time.Sleep(5 * time.Millisecond) // for its hello to go out
+					cli.Close()
+				}
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = l.CloseContext(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err == nil {
+			t.Fatal("closed twice")
+		}
+		close(die)
+		wg.Wait()
+	}
+
+	// the goroutines are done, they may take a moment to leave the stack dump
+	n := listenerGoroutines()
+	for i := 0; i < 50 && n > base; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = listenerGoroutines()
+	}
+	if n > base {
+		t.Fatal(n-base, "listener goroutines left")
+	}
+}
+
+// discardConn swallows the datagrams written to it, nothing arrives on it
+type discardConn struct {
+	net.PacketConn
+	die chan struct{}
+}
+
+func (c *discardConn) WriteTo(p []byte, addr net.Addr) (int, error) { return len(p), nil }
+func (c *discardConn) LocalAddr() net.Addr                          { return &net.UDPAddr{} }
+func (c *discardConn) Close() error                                 { close(c.die); return nil }
+
+func (c *discardConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	<-c.die
+	return 0, nil, io.EOF
+}
+
+// packetAllocs returns the allocations per packet of a session sending messages that
+// are acknowledged at once, and receiving messages from a peer
+func packetAllocs(t *testing.T, block BlockCrypt) (send, recv float64) {
+	s, err := NewConn("127.0.0.1:1", block, 0, 0, &discardConn{die: make(chan struct{})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	s.mu.Lock()
+	s.kcp.Update(currentMs())
+	s.mu.Unlock()
+	msg := make([]byte, 1000)
+	buf := make([]byte, mtuLimit+nonceSize)
+
+	ack := make([]byte, IKCP_OVERHEAD)
+	sendOne := func() {
+		s.Write(msg)
+		s.mu.Lock()
+		seg := Segment{conv: s.kcp.conv, cmd: IKCP_CMD_ACK, wnd: 128, sn: s.kcp.snd_nxt - 1, una: s.kcp.snd_nxt, ts: s.kcp.current}
+		s.mu.Unlock()
+		seg.encode(ack)
+		s.kcpInput(ack, len(ack))
+	}
+
+	var pkt []byte
+	var nonces nonceReader
+	peer := NewKCP(s.kcp.conv, func(data []byte, size int) {
+		pkt = append(pkt[:s.headerSize], data[:size]...)
+	})
+	peer.NoDelay(1, 10, 2, 1)
+	peer.Update(currentMs())
+	pkt = make([]byte, s.headerSize, mtuLimit)
+	recvOne := func() {
+		peer.Send(msg)
+		peer.flush()
+		peer.parse_una(peer.snd_nxt) // acknowledged at once
+		peer.shrink_buf()
+		if block != nil {
+			pkt = encodePacket(block, nil, false, 0, &nonces, 0, pkt)
+		}
+		data, _, ok := decodePacket(block, nil, false, false, s.headerSize, pkt, buf)
+		if !ok {
+			t.Fatal("packet rejected")
+		}
+		s.kcpInput(data, len(pkt))
+		if _, err := s.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the queues and pools grow to their steady state first
+	for i := 0; i < 1000; i++ {
+		sendOne()
+		recvOne()
+	}
+	return testing.AllocsPerRun(1000, sendOne), testing.AllocsPerRun(1000, recvOne)
+}
+
+func TestPacketAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random with the race detector")
+	}
+	aes, _ := NewAESBlockCrypt(make([]byte, 32))
+	for _, block := range []BlockCrypt{nil, aes} {
+		if send, recv := packetAllocs(t, block); send > 0 || recv > 0 {
+			t.Errorf("%T: %v allocations per packet sent, %v per packet received", block, send, recv)
+		}
+	}
+}
+
+// balancedConn sends to the address a load balancer picked, whatever the session asks for
+type balancedConn struct {
+	net.PacketConn
+	target atomic.Value // net.Addr
+}
+
+func (c *balancedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.PacketConn.WriteTo(p, c.target.Load().(net.Addr))
+}
+
+func TestSessionMigration(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	conn1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &cutConn{PacketConn: conn1}
+	l1, err := ServeConn(block, 10, 3, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	l2, err := ListenWithOptions("127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &balancedConn{PacketConn: conn}
+	lb.target.Store(l1.Addr())
+	cli, err := NewConn(l1.Addr().String(), block, 10, 3, lb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	cli.Write([]byte("hello"))
+	l1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s1, err := l1.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1.SetNoDelay(1, 10, 2, 1)
+	s1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s1, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(string(buf), err)
+	}
+	s1.Write([]byte("world"))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "world" {
+		t.Fatal(string(buf), err)
+	}
+
+	// the process of l1 goes away with data on the way in both directions
+	atomic.StoreInt32(&link.cut, 1)
+	up := make([]byte, 64*1024)
+	down := make([]byte, 64*1024)
+	for i := range up {
+		up[i], down[i] = byte(i), byte(i*7)
+	}
+	cli.Write(up)
+	s1.Write(down)
+	cli.Write([]byte("tail"))
+	time.Sleep(50 * time.Millisecond)
+	state, err := s1.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1.Close()
+	if _, err := s1.Export(); err == nil {
+		t.Fatal("closed session exported")
+	}
+
+	if _, err := l2.Import(state[:len(state)-1], conn.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Fatal("truncated state imported")
+	}
+	s2, err := l2.Import(state, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if _, err := l2.Import(state, conn.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Fatal("address imported twice")
+	}
+
+	// a datagram mtu without room for a segment behind the padding of the importer
+	l3, err := ListenWithOptions("127.0.0.1:0", block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l3.Close()
+	l3.SetPadding(200, 0)
+	small := append([]byte(nil), state...)
+	binary.LittleEndian.PutUint32(small[22:], uint32(l3.headerSize+IKCP_MTU_MIN))
+	if _, err := l3.Import(small, conn.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Fatal("state without room for a segment imported")
+	}
+	if s2.GetConv() != cli.GetConv() {
+		t.Fatal("conv", s2.GetConv(), cli.GetConv())
+	}
+	lb.target.Store(l2.Addr())
+
+	// the stream goes on from the new listener
+	got := make([]byte, len(down))
+	if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, down) {
+		t.Fatal("downstream mismatch", err)
+	}
+	s2.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got = make([]byte, len(up)+4)
+	if _, err := io.ReadFull(s2, got); err != nil || !bytes.Equal(got[:len(up)], up) || string(got[len(up):]) != "tail" {
+		t.Fatal("upstream mismatch", err)
+	}
+	s2.Write([]byte("again"))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "again" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+// truncConn is a packet socket behind a middlebox truncating datagrams above limit bytes
+type truncConn struct {
+	net.PacketConn
+	limit int
+}
+
+func (c *truncConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > c.limit {
+		c.PacketConn.WriteTo(p[:c.limit], addr)
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *truncConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if n > c.limit {
+		n = c.limit
+	}
+	return n, addr, err
+}
+
+func TestMtuFallback(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a bulk transfer, every segment of the full mss
+	msg := make([]byte, 256*1024)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	// write sends msg in a single Write in stream mode, in messages of the mss otherwise
+	var stream int32
+	write := func(s *UDPSession) {
+		mss := len(msg)
+		if atomic.LoadInt32(&stream) == 0 {
+			mss = s.Config().MSS
+		}
+		for p := msg; len(p) > 0; {
+			n := mss
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := s.Write(p[:n]); err != nil {
+				return
+			}
+			p = p[n:]
+		}
+	}
+	type result struct {
+		conv uint32
+		n    int
+	}
+	received := make(chan result, 2)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer s.Close()
+				s.SetNoDelay(1, 10, 2, 1)
+				s.SetStreamMode(atomic.LoadInt32(&stream) != 0)
+				buf := make([]byte, len(msg))
+				s.SetReadDeadline(time.Now().Add(20 * time.Second))
+				n, _ := io.ReadFull(s, buf)
+				if !bytes.Equal(buf[:n], msg[:n]) {
+					n = -1
+				}
+				received <- result{s.GetConv(), n}
+				if n == len(buf) {
+					write(s)
+				}
+				io.Copy(ioutil.Discard, s)
+			}()
+		}
+	}()
+
+	dial := func(fallback bool) (*UDPSession, chan int) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli, err := NewConn(l.Addr().String(), block, 0, 0, &truncConn{PacketConn: conn, limit: 1250})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetMtuFallback(fallback)
+		cli.SetNoDelay(1, 10, 2, 1)
+		cli.SetStreamMode(atomic.LoadInt32(&stream) != 0)
+		fallbacks := make(chan int, 4)
+		cli.SetTrace(&SessionTrace{MtuFallback: func(mtu int) { fallbacks <- mtu }})
+		go write(cli)
+		return cli, fallbacks
+	}
+
+	if cfg := DefaultSessionConfig(); !cfg.MtuFallback {
+		t.Fatal("disabled by default")
+	}
+
+	// without the fallback the transfer hangs
+	cli, fallbacks := dial(false)
+	select {
+	case r := <-received:
+		t.Fatal("received", r.n)
+	case <-time.After(3 * time.Second):
+	}
+	cli.Close()
+	if len(fallbacks) != 0 {
+		t.Fatal("fell back while disabled")
+	}
+
+	// with it, the segments in flight are split again and the transfer recovers in both
+	// directions, the accepted session falling back by default
+	for _, mode := range []int32{1, 0} {
+		atomic.StoreInt32(&stream, mode)
+		cli, fallbacks = dial(true)
+		timeout := time.After(20 * time.Second)
+		for done := false; !done; {
+			select {
+			case r := <-received:
+				if r.conv == cli.GetConv() {
+					if r.n != len(msg) {
+						t.Fatal("stream mode", mode, "received", r.n)
+					}
+					done = true
+				}
+			case <-timeout:
+				t.Fatal("stream mode", mode, "upload hangs", cli.DebugState())
+			}
+		}
+		got := make([]byte, len(msg))
+		cli.SetReadDeadline(time.Now().Add(20 * time.Second))
+		if _, err := io.ReadFull(cli, got); err != nil || !bytes.Equal(got, msg) {
+			t.Fatal("stream mode", mode, "download", err)
+		}
+		if mtu := <-fallbacks; mtu != 1200 {
+			t.Fatal("fell back to", mtu)
+		}
+		cli.Close()
+	}
+}
+
+// one goroutine runs the event loop of 200 pairs of manual sessions, over two sockets
+// shared by the sessions and demultiplexed by conv
+func TestManualSession(t *testing.T) {
+	const N = 200
+	var conns [2]*net.UDPConn
+	for k := range conns {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[k] = conn
+	}
+	if _, err := (&UDPSession{}).Drive(time.Now()); err == nil {
+		t.Fatal("a session not created by NewManualSession driven")
+	}
+
+	// both ends of a pair share the conv
+	defer func(source func() uint32) { ConvSource = source }(ConvSource)
+	goroutines := runtime.NumGoroutine()
+	var sessions [2]map[uint32]*UDPSession
+	type pair struct {
+		cli, srv *UDPSession
+		sent     bool
+		got      []byte
+	}
+	pairs := make([]pair, N)
+	for k := range sessions {
+		sessions[k] = make(map[uint32]*UDPSession)
+	}
+	for i := range pairs {
+		conv := uint32(i + 1)
+		ConvSource = func() uint32 { return conv }
+		cli, err := NewManualSession(conns[1].LocalAddr().String(), nil, 0, 0, conns[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv, err := NewManualSession(conns[0].LocalAddr().String(), nil, 0, 0, conns[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		defer srv.Close()
+		sessions[0][conv], sessions[1][conv] = cli, srv
+		pairs[i] = pair{cli: cli, srv: srv}
+	}
+	if n := runtime.NumGoroutine() - goroutines; n >= N {
+		t.Fatal(n, "goroutines started")
+	}
+
+	msg := []byte("hello from a manual session")
+	buf := make([]byte, mtuLimit)
+	deadline := time.Now().Add(20 * time.Second)
+	for done := 0; done < N; {
+		if time.Now().After(deadline) {
+			t.Fatal(done, "sessions echoed")
+		}
+		// the socket readers of the event loop
+		for k, conn := range conns {
+			for {
+				conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				if s, ok := sessions[k][binary.LittleEndian.Uint32(buf)]; ok {
+					s.InjectPacket(buf[:n])
+				}
+			}
+		}
+
+		now := time.Now()
+		done = 0
+		for i := range pairs {
+			p := &pairs[i]
+			p.cli.Drive(now)
+			p.srv.Drive(now)
+			if !p.sent {
+				_, err := p.cli.TryWrite(msg)
+				p.sent = err == nil
+			}
+			if n, err := p.srv.TryRead(buf); err == nil {
+				if _, err := p.srv.TryWrite(buf[:n]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n, err := p.cli.TryRead(buf); err == nil {
+				p.got = append(p.got, buf[:n]...)
+			} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				t.Fatal(err)
+			}
+			if bytes.Equal(p.got, msg) {
+				done++
+			}
+		}
+	}
+}
+
+// one goroutine runs the event loop of a manual listener and its clients
+func TestManualListener(t *testing.T) {
+	const N = 10
+	srvConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvConn.Close()
+	goroutines := runtime.NumGoroutine()
+	l, err := NewManualListener(nil, 0, 0, srvConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Listener{}).Dispatch(srvConn.LocalAddr(), []byte("datagram")); err == nil {
+		t.Fatal("a listener not created by NewManualListener dispatched")
+	}
+
+	var conns [N]*net.UDPConn
+	var clients [N]*UDPSession
+	for k := range clients {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		cli, err := NewManualSession(srvConn.LocalAddr().String(), nil, 0, 0, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		conns[k], clients[k] = conn, cli
+	}
+	if !clients[0].NextUpdate().IsZero() {
+		t.Fatal("a session not driven yet scheduled")
+	}
+
+	// the event loop: the socket readers, then the sessions due
+	buf := make([]byte, mtuLimit)
+	var accepted []*UDPSession
+	defer func() {
+		for _, s := range accepted {
+			s.Close()
+		}
+	}()
+	drive := func(sessions []*UDPSession) {
+		now := time.Now()
+		for _, s := range sessions {
+			if !now.Before(s.NextUpdate()) {
+				if next, err := s.Drive(now); err == nil && !next.Equal(s.NextUpdate()) {
+					t.Fatal("next update", s.NextUpdate(), "want", next)
+				}
+			}
+		}
+	}
+	loop := func() {
+		for {
+			srvConn.SetReadDeadline(time.Now().Add(time.Millisecond))
+			n, from, err := srvConn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			l.Dispatch(from, buf[:n])
+		}
+		for k, conn := range conns {
+			for {
+				conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					break
+				}
+				clients[k].InjectPacket(buf[:n])
+			}
+		}
+		for l.PendingAccepts() > 0 {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				t.Fatal(err)
+			}
+			accepted = append(accepted, s)
+		}
+		drive(clients[:])
+		drive(accepted)
+	}
+
+	msg := []byte("hello from a manual listener")
+	var sent [N]bool
+	var got [N][]byte
+	deadline := time.Now().Add(20 * time.Second)
+	for done := 0; done < N; {
+		if time.Now().After(deadline) {
+			t.Fatal(done, "sessions echoed")
+		}
+		loop()
+		for _, s := range accepted {
+			if n, err := s.TryRead(buf); err == nil {
+				if _, err := s.TryWrite(buf[:n]); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		done = 0
+		for k, cli := range clients {
+			if !sent[k] {
+				_, err := cli.TryWrite(msg)
+				sent[k] = err == nil
+			}
+			if n, err := cli.TryRead(buf); err == nil {
+				got[k] = append(got[k], buf[:n]...)
+			}
+			if bytes.Equal(got[k], msg) {
+				done++
+			}
+		}
+	}
+	if n := runtime.NumGoroutine() - goroutines; n >= N {
+		t.Fatal(n, "goroutines started")
+	}
+
+	// a closed session leaves the listener once done, with the next datagram
+	var srv *UDPSession
+	for _, s := range accepted {
+		if s.RemoteAddr().String() == conns[0].LocalAddr().String() {
+			srv = s
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); srv.kcp.WaitSnd() > 0; loop() { // the echo is acknowledged
+		if time.Now().After(deadline) {
+			t.Fatal("echo not acknowledged")
+		}
+	}
+	srv.Close()
+	clients[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; loop() {
+		_, srvErr := srv.Drive(time.Now())
+		_, cliErr := clients[0].Drive(time.Now())
+		if srvErr != nil && cliErr != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed sessions still driven")
+		}
+	}
+	if err := l.Dispatch(srv.RemoteAddr(), []byte("garbage")); err == nil {
+		t.Fatal("garbage dispatched")
+	}
+	if _, ok := l.sessions[srv.RemoteAddr().String()]; ok || len(l.sessions) != N-1 {
+		t.Fatal(len(l.sessions), "sessions")
+	}
+
+	// the socket belongs to the application
+	l.Close()
+	if err := l.Dispatch(srv.RemoteAddr(), buf[:IKCP_OVERHEAD]); err == nil {
+		t.Fatal("dispatched after close")
+	}
+	if _, err := srvConn.WriteTo([]byte("ping"), conns[0].LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetInterval(t *testing.T) {
+	c := NewKCPConn(1, func([]byte) {})
+	defer c.Close()
+	if c.SetInterval(0) == nil {
+		t.Fatal("interval 0 accepted")
+	}
+
+	// the flushes of kcp over d
+	flushes := func(d time.Duration) int {
+		c.mu.Lock()
+		last := c.kcp.ts_flush
+		c.mu.Unlock()
+		n := 0
+		for end := time.Now().Add(d); time.Now().Before(end); time.Sleep(100 * time.Microsecond) {
+			c.mu.Lock()
+			if c.kcp.ts_flush != last {
+				last = c.kcp.ts_flush
+				n++
+			}
+			c.mu.Unlock()
+		}
+		return n
+	}
+	if n := flushes(300 * time.Millisecond); n > 4 {
+		t.Fatal(n, "flushes at the default interval")
+	}
+	// below the 10ms floor of SetNoDelay
+	c.SetInterval(4 * time.Millisecond)
+	if n := flushes(300 * time.Millisecond); n < 40 || n > 76 {
+		t.Fatal(n, "flushes at 4ms")
+	}
+	c.SetNoDelay(0, 1, -1, -1)
+	if n := flushes(300 * time.Millisecond); n > 31 {
+		t.Fatal(n, "flushes after SetNoDelay")
+	}
+
+	// a manual session is due at once, then every interval
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := NewManualSession("127.0.0.1:1", nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	next, _ := s.Drive(now)
+	if d := next.Sub(now); d < 50*time.Millisecond {
+		t.Fatal("next update in", d)
+	}
+	s.SetInterval(5 * time.Millisecond)
+	if !s.NextUpdate().IsZero() {
+		t.Fatal("not due after SetInterval")
+	}
+	for i := 0; i < 20; i++ {
+		now = time.Now()
+		next, _ := s.Drive(now)
+		if d := next.Sub(now); d <= 0 || d > 5*time.Millisecond {
+			t.Fatal("next update in", d)
+		}
+		time.Sleep(next.Sub(time.Now()))
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultSessionConfig()
+	cfg.NoDelay, cfg.Interval, cfg.StreamMode = 1, 10, true
+	l.SetSessionConfig(cfg)
+	served := make(chan error, 1)
+	go func() { served <- RunEchoServer(l) }()
+
+	s, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetNoDelay(1, 10, 2, 1)
+	s.SetStreamMode(true)
+	s.SetDeadline(time.Now().Add(10 * time.Second))
+	r := RunBench(s, 1<<20+123)
+	if r.Error != "" || r.Bytes != 1<<20+123 {
+		t.Fatal(r.Bytes, "bytes echoed:", r.Error)
+	}
+	if r.Throughput <= 0 || r.RTTSamples == 0 || r.RTTMax < r.RTTMin || r.Segments < (1<<20)/IKCP_MTU_DEF {
+		t.Fatalf("%+v", r)
+	}
+	if text := r.String(); !strings.Contains(text, "bytes: 1048699\n") || strings.Contains(text, "error") {
+		t.Fatal(text)
+	}
+	out, err := json.Marshal(&r)
+	if err != nil || !bytes.Contains(out, []byte(`"throughput_bytes_per_sec":`)) || bytes.Contains(out, []byte(`"error"`)) {
+		t.Fatal(string(out), err)
+	}
+
+	l.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Fatal("the echo server returned no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the echo server outlived the listener")
+	}
+}
+
+func TestUpdateUnderLoad(t *testing.T) {
+	// the updater waits for the lock of a busy session rather than skipping its tick
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go RunEchoServer(l)
+	s, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const interval = 20 * time.Millisecond
+	s.SetNoDelay(0, int(interval/time.Millisecond), 2, 1)
+	s.SetWindowSize(1024, 1024)
+
+	var mu sync.Mutex
+	var ticks, control []time.Time
+	s.SetTrace(&SessionTrace{UpdateTick: func() {
+		mu.Lock()
+		ticks = append(ticks, time.Now())
+		mu.Unlock()
+	}})
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg := make([]byte, 1000)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					s.Write(msg)
+				}
+			}
+		}()
+	}
+	// a ticker of the same interval shows the delays of the runner
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				control = append(control, time.Now())
+			}
+		}
+	}()
+	go io.Copy(ioutil.Discard, s)
+	time.Sleep(time.Second)
+	close(done)
+	wg.Wait()
+	end := time.Now()
+
+	// skipped counts the intervals skipped by the gaps above 1.5 intervals over the run,
+	// a starved session skips about one a tick
+	skipped := func(ticks []time.Time) (n int, max time.Duration) {
+		ticks = append(append([]time.Time{start}, ticks...), end)
+		for k := 1; k < len(ticks); k++ {
+			d := ticks[k].Sub(ticks[k-1])
+			if d > interval*3/2 {
+				n += int((d+interval/2)/interval) - 1
+			}
+			if d > max {
+				max = d
+			}
+		}
+		return n, max
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	n, max := skipped(ticks)
+	delayed, _ := skipped(control)
+	if n > delayed+int(end.Sub(start)/interval)/10 {
+		t.Fatalf("%v updates, %v intervals skipped, %v by the ticker, at most %v apart", len(ticks), n, delayed, max)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.NoDelay, cfg.Interval = 1, 10
+	l.SetSessionConfig(cfg)
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- s
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cli.Write([]byte("hello"))
+	s := <-accepted
+	if s == nil {
+		t.Fatal("nothing accepted")
+	}
+	buf := make([]byte, 100)
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := cli.CloseStatus(); ok {
+		t.Fatal("close status before the close")
+	}
+
+	// the data written before is read first
+	msg := make([]byte, 10000)
+	s.Write(msg)
+	if err := s.CloseWithError(401, "authentication failed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseWithError(401, "again"); !errors.Is(err, ErrClosed) {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(cli)
+	if len(got) != len(msg) || err != nil && !errors.Is(err, ErrClosed) {
+		t.Fatal(len(got), "bytes read:", err)
+	}
+	if code, reason, ok := cli.CloseStatus(); !ok || code != 401 || reason != "authentication failed" {
+		t.Fatal(code, reason, ok)
+	}
+	if _, err := cli.Write(msg); !errors.Is(err, ErrClosed) {
+		t.Fatal("write after the peer closed:", err)
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.NoDelay, cfg.Interval = 1, 10
+	l.SetSessionConfig(cfg)
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			accepted <- s
+		}
+	}()
+	cause := func(t *testing.T, ctx context.Context, kind int, reason string) {
+		t.Helper()
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("context not cancelled")
+		}
+		var ce *CloseError
+		if err := context.Cause(ctx); !errors.As(err, &ce) || ce.Kind != kind || ce.Reason != reason || !errors.Is(err, ErrClosed) {
+			t.Fatal("want", kind, reason, "got", err)
+		}
+	}
+
+	// closed by the peer, and locally
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	s := <-accepted
+	buf := make([]byte, 100)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte("hi")) // the client heard the server, CapCloseStatus is negotiated
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	ctx := s.Context()
+	if ctx.Err() != nil {
+		t.Fatal("cancelled while open")
+	}
+	cli.CloseWithError(0, "done")
+	cause(t, ctx, ClosedByPeer, closePeer)
+	cause(t, cli.Context(), ClosedLocally, closeLocal) // after the close
+
+	// the context of DialContext closes the session
+	parent, cancel := context.WithCancel(context.Background())
+	cli, err = DialContext(parent, l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	cause(t, cli.Context(), ClosedLocally, closeContext)
+	if _, err := DialContext(parent, l.Addr().String(), nil, 0, 0); err != context.Canceled {
+		t.Fatal("dialed with a cancelled context:", err)
+	}
+
+	// the socket fails under the session
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err = NewConn(l.Addr().String(), nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = cli.Context()
+	conn.Close()
+	select {
+	case <-ctx.Done():
+		if ce := context.Cause(ctx).(*CloseError); ce.Kind != ClosedTransport {
+			t.Fatal(ce)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not cancelled")
+	}
+
+	// a dead link, which may tell a mismatch
+	a, _ := kcpConnPair()
+	ctx = a.Context()
+	a.close(closeDeadLink + ", " + MismatchKey)
+	cause(t, ctx, ClosedDeadLink, closeDeadLink+", "+MismatchKey)
+}
+
+func TestSessionChurn(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short mode")
+	}
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.NoDelay, cfg.Interval, cfg.NoCongestion = 1, 10, 1
+	l.SetSessionConfig(cfg)
+	go RunEchoServer(l)
+
+	// connect, echo and close, the server side closes on the close status
+	cycle := func() {
+		s, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := make([]byte, 4096)
+		s.Write(msg)
+		if _, err := io.ReadFull(s, msg); err != nil {
+			t.Error(err)
+		}
+		s.CloseWithError(0, "done")
+	}
+	churn := func(cycles int) {
+		var wg sync.WaitGroup
+		for w := 0; w < 16; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < cycles/16; i++ {
+					cycle()
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	established := atomic.LoadUint64(&DefaultSnmp.CurrEstab)
+	heap := func() uint64 {
+		var ms runtime.MemStats
+		for i := 0; l.Stats().TxQueued != 0 || atomic.LoadUint64(&DefaultSnmp.CurrEstab) > established; i++ {
+			if i == 500 {
+				t.Fatal(l.Stats().TxQueued, "bytes queued,", atomic.LoadUint64(&DefaultSnmp.CurrEstab)-established, "sessions left")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapInuse
+	}
+
+	churn(1000) // pools and caches reach their steady state
+	before := heap()
+	churn(10000)
+	if after := heap(); after > before+4<<20 {
+		t.Fatal("heap grew from", before, "to", after)
+	}
+}
+
+func TestPeerMtu(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cfg := DefaultSessionConfig()
+	cfg.Mtu = 1000
+	if err := l.SetSessionConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	msg := make([]byte, 64*1024)
+	go cli.Write(msg)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, msg); err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	defer s.Close()
+
+	// both send datagrams of the smaller mtu
+	if mtu, overhead := cli.PeerMtu(); mtu != 1000 || overhead != 0 {
+		t.Fatal("client got", mtu, overhead)
+	}
+	if mtu, overhead := s.PeerMtu(); mtu != IKCP_MTU_DEF || overhead != 0 {
+		t.Fatal("server got", mtu, overhead)
+	}
+	for _, sess := range []*UDPSession{cli, s} {
+		sess.mu.Lock()
+		mtu := sess.kcp.mtu
+		sess.mu.Unlock()
+		if mtu != 1000 {
+			t.Fatal("kcp mtu", mtu)
+		}
+	}
+}
+
+func TestPeerMismatch(t *testing.T) {
+	keyA, _ := NewAESBlockCrypt(pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New))
+	keyB, _ := NewAESBlockCrypt(pbkdf2.Key([]byte("another key"), []byte(salt), 4096, 32, sha1.New))
+	dial := func(l *Listener, block BlockCrypt) (*UDPSession, net.Addr) {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli, err := NewConn(l.Addr().String(), block, 0, 0, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetNoDelay(1, 10, 2, 1)
+		for i := 0; i < 8; i++ {
+			cli.Write([]byte("hello"))
+		}
+		return cli, conn.LocalAddr()
+	}
+
+	// an encrypting listener diagnoses the address without a session
+	for _, c := range []struct {
+		block     BlockCrypt
+		diagnosis string
+	}{{keyB, MismatchKey}, {nil, MismatchUnencrypted}} {
+		l, err := ListenWithOptions("127.0.0.1:0", keyA, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli, addr := dial(l, c.block)
+		for i := 0; ; i++ {
+			if m := l.Stats().Mismatches; len(m) > 0 && m[0].Addr.String() == addr.String() {
+				if m[0].Diagnosis != c.diagnosis {
+					t.Fatal(m[0].Diagnosis, "for", c.diagnosis)
+				}
+				break
+			}
+			if i == 500 {
+				t.Fatal("no diagnosis for", c.diagnosis)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cli.Close()
+		l.Close()
+	}
+
+	// an unencrypted listener takes the datagrams for a session, which diagnoses the peer
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, addr := dial(l, keyA)
+	defer cli.Close()
+	for {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if s.RemoteAddr().String() != addr.String() {
+			continue // stray packets of an earlier test to the reused port
+		}
+		for i := 0; s.Stats().Mismatch != MismatchEncrypted; i++ {
+			if i == 500 {
+				t.Fatal("diagnosed", s.Stats().Mismatch)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !strings.Contains(s.String(), MismatchEncrypted) {
+			t.Fatal(s)
+		}
+		break
+	}
+}
+
+func TestRekey(t *testing.T) {
+	block, _ := NewAESBlockCrypt(pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New))
+	cfg := &RekeyConfig{Secret: []byte("rekey secret"), NewCipher: NewAESBlockCrypt, Bytes: 64 << 10}
+	sconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ServeConn(block, 0, 0, &lossyConn{PacketConn: sconn, rnd: rand.New(rand.NewSource(1)), loss: 0.1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetRekey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		s.SetStreamMode(true)
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetWindowSize(32, 32)
+		io.Copy(s, s)
+	}()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capture := &captureConn{PacketConn: &lossyConn{PacketConn: conn, rnd: rand.New(rand.NewSource(2)), loss: 0.1}}
+	cli, err := NewConn(l.Addr().String(), block, 0, 0, capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetRekey(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(32, 32)
+
+	msg := make([]byte, 1<<20)
+	for i := range msg {
+		msg[i] = byte(i * 13)
+	}
+	go cli.Write(msg)
+	// the datagrams of the client in the second and the third epoch
+	var late [][]byte
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for capture.reset(); cli.Stats().Epoch < 1; time.Sleep(time.Millisecond) {
+			capture.reset()
+		}
+		for cli.Stats().Epoch < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, p := range capture.reset() {
+			if _, err := DecodePacketForDebug(block, false, p); err != nil {
+				late = append(late, p) // not of the first epoch, sent before the switch
+			}
+		}
+	}()
+	got := make([]byte, len(msg))
+	cli.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatalf("%v %+v", err, cli.Stats())
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data mismatch")
+	}
+	<-done
+	s := <-accepted
+	defer s.Close()
+	if e, se := cli.Stats().Epoch, s.Stats().Epoch; e < 4 || se < 4 {
+		t.Fatal("epochs", e, se)
+	}
+
+	if len(late) == 0 {
+		t.Fatal("no datagram of the second epoch")
+	}
+	// the keys of the epochs before the previous one no longer decrypt
+	rejected := l.Stats().Checksum.Count
+	for _, p := range late {
+		conn.WriteTo(p, l.Addr())
+		time.Sleep(time.Millisecond) // within the socket buffers
+	}
+	for i := 0; l.Stats().Checksum.Count < rejected+uint64(len(late)); i++ {
+		if i == 500 {
+			t.Fatal("rejected", l.Stats().Checksum.Count-rejected, "of", len(late))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cli.Write([]byte("after"))
+	if _, err := io.ReadFull(cli, got[:5]); err != nil || string(got[:5]) != "after" {
+		t.Fatal(err, string(got[:5]))
+	}
+}
+
+func TestReadBurst(t *testing.T) {
+	if max, err := ioutil.ReadFile("/proc/sys/net/core/rmem_max"); err == nil {
+		if n, _ := strconv.Atoi(strings.TrimSpace(string(max))); n < clientReadBuffer {
+			t.Skip("the read buffer is capped to", n)
+		}
+	}
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const burst = 2000
+	msg := make([]byte, burst*(IKCP_MTU_DEF-IKCP_OVERHEAD))
+	sent := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.AcceptKCP()
+		if err != nil {
+			return
+		}
+		s.SetStreamMode(true)
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetWindowSize(burst, burst)
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(s, buf); err != nil {
+			return
+		}
+		s.Write(msg) // in one flush, the window of the client is open
+		sent <- s
+	}()
+
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(burst, burst)
+	cli.Write([]byte("go"))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, make([]byte, len(msg))); err != nil {
+		t.Fatal(err)
+	}
+	s := <-sent
+	defer s.Close()
+	// on loopback only the receive buffer of the client drops datagrams
+	if st := s.Stats().Sent; st.RetransSegments > burst/100 {
+		t.Fatalf("%v of %v segments sent again", st.RetransSegments, st.Segments)
+	}
+}
@@ -15,11 +15,15 @@ type Snmp struct {
 	CurrEstab        uint64 // count of connections for now
 	InErrs           uint64 // udp read errors
 	InCsumErrors     uint64 // checksum errors from CRC32
+	InTokenErrors    uint64 // packets rejected by the packet token before decryption
+	StreamCsumErrors uint64 // stream checksum mismatches, see SetStreamChecksum
 	KCPInErrors      uint64 // packet iput errors from kcp
+	KCPUnknownCmds   uint64 // segments with an unknown command, dropped
 	InSegs           uint64
 	OutSegs          uint64
 	InBytes          uint64 // udp bytes received
 	OutBytes         uint64 // udp bytes sent
+	OutDrops         uint64 // packets dropped because the transmit queue is full
 	RetransSegs      uint64
 	FastRetransSegs  uint64
 	EarlyRetransSegs uint64
@@ -44,11 +48,15 @@ func (s *Snmp) Header() []string {
 		"CurrEstab",
 		"InErrs",
 		"InCsumErrors",
+		"InTokenErrors",
+		"StreamCsumErrors",
 		"KCPInErrors",
+		"KCPUnknownCmds",
 		"InSegs",
 		"OutSegs",
 		"InBytes",
 		"OutBytes",
+		"OutDrops",
 		"RetransSegs",
 		"FastRetransSegs",
 		"EarlyRetransSegs",
@@ -71,11 +79,15 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.CurrEstab),
 		fmt.Sprint(snmp.InErrs),
 		fmt.Sprint(snmp.InCsumErrors),
+		fmt.Sprint(snmp.InTokenErrors),
+		fmt.Sprint(snmp.StreamCsumErrors),
 		fmt.Sprint(snmp.KCPInErrors),
+		fmt.Sprint(snmp.KCPUnknownCmds),
 		fmt.Sprint(snmp.InSegs),
 		fmt.Sprint(snmp.OutSegs),
 		fmt.Sprint(snmp.InBytes),
 		fmt.Sprint(snmp.OutBytes),
+		fmt.Sprint(snmp.OutDrops),
 		fmt.Sprint(snmp.RetransSegs),
 		fmt.Sprint(snmp.FastRetransSegs),
 		fmt.Sprint(snmp.EarlyRetransSegs),
@@ -98,11 +110,15 @@ func (s *Snmp) Copy() *Snmp {
 	d.CurrEstab = atomic.LoadUint64(&s.CurrEstab)
 	d.InErrs = atomic.LoadUint64(&s.InErrs)
 	d.InCsumErrors = atomic.LoadUint64(&s.InCsumErrors)
+	d.InTokenErrors = atomic.LoadUint64(&s.InTokenErrors)
+	d.StreamCsumErrors = atomic.LoadUint64(&s.StreamCsumErrors)
 	d.KCPInErrors = atomic.LoadUint64(&s.KCPInErrors)
+	d.KCPUnknownCmds = atomic.LoadUint64(&s.KCPUnknownCmds)
 	d.InSegs = atomic.LoadUint64(&s.InSegs)
 	d.OutSegs = atomic.LoadUint64(&s.OutSegs)
 	d.InBytes = atomic.LoadUint64(&s.InBytes)
 	d.OutBytes = atomic.LoadUint64(&s.OutBytes)
+	d.OutDrops = atomic.LoadUint64(&s.OutDrops)
 	d.RetransSegs = atomic.LoadUint64(&s.RetransSegs)
 	d.FastRetransSegs = atomic.LoadUint64(&s.FastRetransSegs)
 	d.EarlyRetransSegs = atomic.LoadUint64(&s.EarlyRetransSegs)
@@ -124,11 +140,15 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.CurrEstab, 0)
 	atomic.StoreUint64(&s.InErrs, 0)
 	atomic.StoreUint64(&s.InCsumErrors, 0)
+	atomic.StoreUint64(&s.InTokenErrors, 0)
+	atomic.StoreUint64(&s.StreamCsumErrors, 0)
 	atomic.StoreUint64(&s.KCPInErrors, 0)
+	atomic.StoreUint64(&s.KCPUnknownCmds, 0)
 	atomic.StoreUint64(&s.InSegs, 0)
 	atomic.StoreUint64(&s.OutSegs, 0)
 	atomic.StoreUint64(&s.InBytes, 0)
 	atomic.StoreUint64(&s.OutBytes, 0)
+	atomic.StoreUint64(&s.OutDrops, 0)
 	atomic.StoreUint64(&s.RetransSegs, 0)
 	atomic.StoreUint64(&s.FastRetransSegs, 0)
 	atomic.StoreUint64(&s.EarlyRetransSegs, 0)
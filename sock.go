@@ -0,0 +1,66 @@
+package kcp
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// isConnReset reports whether err is a socket error reporting an ICMP error of an
+// earlier datagram, like WSAECONNRESET on windows, the socket remains usable
+func isConnReset(err error) bool {
+	errno, ok := sockErrno(err)
+	if !ok {
+		return false
+	}
+	for _, e := range connResetErrnos {
+		if errno == e {
+			return true
+		}
+	}
+	return false
+}
+
+// sockErrno returns the errno of a socket error
+func sockErrno(err error) (syscall.Errno, bool) {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return errno, ok
+}
+
+// readPacket reads a datagram like ReadFrom, truncated tells it was larger than buf
+// and cut, where the socket tells: with MSG_TRUNC, or the error of windows
+func readPacket(conn net.PacketConn, buf []byte) (n int, from net.Addr, truncated bool, err error) {
+	var uc *net.UDPConn
+	switch c := conn.(type) {
+	case *net.UDPConn:
+		uc = c
+	case *ConnectedUDPConn:
+		uc = c.UDPConn
+	case *hostConn:
+		return c.readPacket(buf)
+	case *rendezvousConn:
+		return c.readPacket(buf)
+	default:
+		n, from, err = conn.ReadFrom(buf)
+		return n, from, false, err
+	}
+	n, _, flags, addr, err := uc.ReadMsgUDP(buf, nil)
+	truncated = flags&msgTrunc != 0
+	if errno, ok := sockErrno(err); ok && truncErrno != 0 && errno == truncErrno && addr != nil {
+		n, truncated, err = len(buf), true, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if truncated {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+	}
+	return n, addr, truncated, nil
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+)
+
+// connResetErrnos are the errors of a connected UDP socket receiving an ICMP port unreachable
+var connResetErrnos = []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET}
+
+const (
+	msgTrunc   = syscall.MSG_TRUNC // flag of a datagram larger than the buffer of the read
+	truncErrno = syscall.Errno(0)  // the reads of a truncated datagram succeed here
+)
+
+// tuneSocket prepares a socket created by the package, the defaults are fine here
+func tuneSocket(conn *net.UDPConn) {}
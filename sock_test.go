@@ -0,0 +1,129 @@
+package kcp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsConnReset(t *testing.T) {
+	reset := connResetErrnos[0]
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{reset, true},
+		{os.NewSyscallError("recvfrom", reset), true},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", reset)}, true},
+		{&net.OpError{Op: "read", Net: "udp", Err: reset}, true},
+		{&net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}, false},
+		{&net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.EINVAL)}, false},
+		{io.EOF, false},
+		{errors.New("connection reset"), false},
+		{nil, false},
+	}
+	for k, c := range cases {
+		if got := isConnReset(c.err); got != c.want {
+			t.Error(k, c.err, "got", got)
+		}
+	}
+}
+
+// a client session survives the ICMP port unreachable of datagrams sent before
+// the listener is up
+func TestDialBeforeListen(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.Write([]byte("hello"))
+	time.Sleep(200 * time.Millisecond) // the datagrams bounce
+
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := l.AcceptKCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	buf := make([]byte, 64)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatal("got", string(buf[:n]))
+	}
+	s.Write(buf[:n])
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// datagrams larger than the buffers are counted and reported, not taken for corrupted ones
+func TestTruncated(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	big := make([]byte, 3000)
+	for i := 0; i < 2; i++ {
+		peer.WriteTo(big, l.Addr())
+	}
+	for i := 0; l.Stats().Truncated.Count < 2; i++ {
+		if i == 200 {
+			t.Fatalf("%+v", l.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := l.Stats()
+	if len(st.Truncations) != 1 || st.Truncations[0].Addr.String() != peer.LocalAddr().String() ||
+		st.Truncations[0].Size != mtuLimit || st.Checksum.Count != 0 || st.Conv.Count != 0 {
+		t.Fatalf("%+v", st)
+	}
+
+	// a client session
+	cli, err := DialWithOptions(peer.LocalAddr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	traced := make(chan int, 2)
+	cli.SetTrace(&SessionTrace{Truncated: func(size int) { traced <- size }})
+	for i := 0; i < 2; i++ {
+		peer.WriteTo(big, cli.LocalAddr())
+	}
+	for i := 0; cli.Stats().Truncated.Count < 2; i++ {
+		if i == 200 {
+			t.Fatalf("%+v", cli.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := <-traced; size != mtuLimit || len(traced) != 0 {
+		t.Fatal("traced", size, len(traced))
+	}
+}
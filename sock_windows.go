@@ -0,0 +1,41 @@
+//go:build windows
+// +build windows
+
+package kcp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// sioUDPConnReset is SIO_UDP_CONNRESET of winsock
+	sioUDPConnReset = syscall.IOC_IN | syscall.IOC_VENDOR | 12
+
+	// sockBuffer replaces the tiny default socket buffers of windows
+	sockBuffer = 4 << 20
+
+	// msgTrunc isn't reported by winsock, truncErrno is: WSAEMSGSIZE fails the read of a
+	// datagram larger than the buffer, which holds its start
+	msgTrunc   = 0
+	truncErrno = syscall.Errno(10040)
+)
+
+// connResetErrnos are the errors winsock reports for an ICMP error of an earlier datagram
+var connResetErrnos = []syscall.Errno{syscall.WSAECONNRESET, syscall.Errno(10052)} // WSAENETRESET
+
+// tuneSocket prepares a socket created by the package: an ICMP port unreachable
+// must not fail the following reads, and the socket buffers are enlarged
+func tuneSocket(conn *net.UDPConn) {
+	if rc, err := conn.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			enable := uint32(0)
+			var ret uint32
+			syscall.WSAIoctl(syscall.Handle(fd), sioUDPConnReset, (*byte)(unsafe.Pointer(&enable)),
+				uint32(unsafe.Sizeof(enable)), nil, 0, &ret, nil, 0)
+		})
+	}
+	conn.SetReadBuffer(sockBuffer)
+	conn.SetWriteBuffer(sockBuffer)
+}
@@ -0,0 +1,137 @@
+package kcp
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// softErrorBacklog is the number of soft errors waiting for the consumer of SoftErrors
+const softErrorBacklog = 64
+
+const (
+	replayBurst  = 64          // segments received again in a burst, for a SoftReplay
+	replayWindow = time.Second // the burst
+)
+
+// soft error types, see SoftError
+const (
+	SoftChecksum        = iota // a datagram of the peer failed the checksum, unencrypted only
+	SoftReplay                 // a burst of data segments received again
+	SoftMtuFallback            // the mtu fell back, see SetMtuFallback
+	SoftAddressMigrated        // the session moved to another address, by Rebind or Import
+	SoftRateLimited            // the memory budget or the rate limit started holding the Writes back
+	numSoft
+)
+
+// SoftError is an anomaly of a session that doesn't close it, see SoftErrors
+type SoftError struct {
+	Type   int       // Soft*
+	Time   time.Time // when it happened
+	Value  int       // the datagram size for SoftChecksum, the segments of the burst for SoftReplay, the new mtu for SoftMtuFallback
+	Detail string    // what happened, like "mtu fell back to 1200"
+}
+
+func (e SoftError) Error() string { return "kcp: " + e.Detail }
+
+// SoftErrorStats counts the soft errors of a session per type, including those dropped
+// from the channel of SoftErrors or never read from it
+type SoftErrorStats struct {
+	Checksum        uint64
+	Replay          uint64
+	MtuFallback     uint64
+	AddressMigrated uint64
+	RateLimited     uint64
+	Dropped         uint64 // the oldest dropped from the channel as it was full
+}
+
+// replayState detects bursts of segments received again, protected by mu
+type replayState struct {
+	base     uint64    // duplicates received at the start of the burst
+	since    time.Time // start of the burst
+	reported bool      // the burst was reported
+}
+
+// SoftErrors returns the anomalies of the connection that don't close it, from the first
+// call on: checksum failures, bursts of replayed segments, the mtu fallback, address
+// migrations and the memory budget or the rate limit holding the Writes back. The channel
+// holds up to 64 of them, a new one drops the oldest when it's full. Every soft error is
+// counted in the stats whether it's read or not. The channel is closed with the
+// connection.
+func (c *KCPConn) SoftErrors() <-chan SoftError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.softErrs == nil {
+		c.softErrs = make(chan SoftError, softErrorBacklog)
+		if c.isClosed {
+			close(c.softErrs)
+		}
+	}
+	return c.softErrs
+}
+
+// softError counts a soft error and sends it to the channel of SoftErrors, dropping the
+// oldest if it's full, c.mu must be held
+func (c *KCPConn) softError(typ, value int, format string, args ...interface{}) {
+	c.softCounts[typ]++
+	if c.softErrs == nil || c.isClosed {
+		return
+	}
+	e := SoftError{typ, time.Now(), value, fmt.Sprintf(format, args...)}
+	for { // the only sender, the consumer may take one meanwhile
+		select {
+		case c.softErrs <- e:
+			return
+		default:
+		}
+		select {
+		case <-c.softErrs:
+			c.softDropped++
+		default:
+		}
+	}
+}
+
+// softStats returns the counts of the soft errors, c.mu must be held
+func (c *KCPConn) softStats() SoftErrorStats {
+	return SoftErrorStats{
+		Checksum:        c.softCounts[SoftChecksum],
+		Replay:          c.softCounts[SoftReplay],
+		MtuFallback:     c.softCounts[SoftMtuFallback],
+		AddressMigrated: c.softCounts[SoftAddressMigrated],
+		RateLimited:     c.softCounts[SoftRateLimited],
+		Dropped:         c.softDropped,
+	}
+}
+
+// throttled reports a Write starting to wait for the rate limit, after Writes that
+// didn't, wait tells this one waits
+func (c *KCPConn) throttled(wait bool) {
+	if !wait {
+		if atomic.LoadInt32(&c.limited) != 0 {
+			atomic.StoreInt32(&c.limited, 0)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.limited, 0, 1) {
+		c.mu.Lock()
+		c.softError(SoftRateLimited, 0, "writes wait for the rate limit")
+		c.mu.Unlock()
+	}
+}
+
+// checkReplays reports a burst of data segments received again, s.mu must be held.
+// Duplicates are normal with losses, as the peer retransmits what the acknowledgements
+// lost, only a burst of replayBurst within replayWindow is reported, once.
+func (s *UDPSession) checkReplays(now time.Time) {
+	r := &s.replays
+	dups := s.kcp.rx.RetransSegments
+	if r.since.IsZero() || now.Sub(r.since) > replayWindow {
+		r.base, r.since, r.reported = dups, now, false
+		return
+	}
+	if n := dups - r.base; n >= replayBurst && !r.reported {
+		r.reported = true
+		s.softError(SoftReplay, int(n), "%v segments received again from %v within %v", n, s.RemoteAddr(), now.Sub(r.since).Round(time.Millisecond))
+	}
+}
@@ -0,0 +1,121 @@
+package kcp
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// strict mode categories, see StrictStats
+const (
+	strictTxDrop     = iota // a packet dropped as the transmit queue is full
+	strictFragments         // a Write in message mode split into several messages
+	strictOversized         // a datagram above the mtu
+	strictLateConfig        // a setting applied after the traffic it must precede
+	strictChecksum          // a datagram of the peer failing the checksum
+	numStrict
+)
+
+var strictNames = [numStrict]string{"tx drop", "fragments", "oversized", "late config", "checksum"}
+
+var (
+	strictMode   int32             // see SetStrictMode
+	strictCounts [numStrict]uint64 // reports per category
+	logger       atomic.Value      // loggerHolder, see SetLogger
+)
+
+// Logger receives the errors of strict mode, see SetLogger
+type Logger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// loggerHolder keeps the atomic.Value of a single concrete type
+type loggerHolder struct{ Logger }
+
+// stdLogger is the default Logger, on the standard log package
+type stdLogger struct{}
+
+func (stdLogger) Errorf(format string, args ...interface{}) {
+	log.Output(3, "kcp error: "+fmt.Sprintf(format, args...))
+}
+
+// SetStrictMode enables or disables strict mode, disabled by default. Strict mode is
+// for development: what the package otherwise absorbs silently is logged at error level
+// to the Logger of SetLogger and counted, see StrictCounts. That is packets dropped as
+// the transmit queue is full, datagrams above the mtu, checksum failures of the datagrams
+// of the peer of a session and the mismatch diagnoses of sessions. Mistakes of the
+// application fail instead: a Write in message mode above MaxMessageSize, which would
+// be split into several messages, fails with ErrMessageTooLarge; SetPadding,
+// SetFixedPacketSize and SetPacketToken fail once the session exchanged packets, and
+// the same settings of a Listener, and SetSessionConfig, once it created a session.
+func SetStrictMode(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&strictMode, v)
+}
+
+// strict tells whether strict mode is enabled
+func strict() bool {
+	return atomic.LoadInt32(&strictMode) != 0
+}
+
+// SetLogger sets the Logger of strict mode, nil restores the default, which logs
+// through the standard log package
+func SetLogger(l Logger) {
+	if l == nil {
+		l = stdLogger{}
+	}
+	logger.Store(loggerHolder{l})
+}
+
+// StrictStats counts the reports of strict mode per category, see SetStrictMode
+type StrictStats struct {
+	TxDrops    uint64 // packets dropped as the transmit queue is full
+	Fragments  uint64 // Writes in message mode above MaxMessageSize
+	Oversized  uint64 // datagrams above the mtu
+	LateConfig uint64 // settings applied after the traffic they must precede
+	Checksum   uint64 // datagrams of the peer of a session failing the checksum, and mismatch diagnoses
+}
+
+// StrictCounts returns the reports of strict mode so far
+func StrictCounts() StrictStats {
+	return StrictStats{
+		TxDrops:    atomic.LoadUint64(&strictCounts[strictTxDrop]),
+		Fragments:  atomic.LoadUint64(&strictCounts[strictFragments]),
+		Oversized:  atomic.LoadUint64(&strictCounts[strictOversized]),
+		LateConfig: atomic.LoadUint64(&strictCounts[strictLateConfig]),
+		Checksum:   atomic.LoadUint64(&strictCounts[strictChecksum]),
+	}
+}
+
+// strictFail counts and logs a report of category in strict mode
+func strictFail(category int, format string, args ...interface{}) {
+	if !strict() {
+		return
+	}
+	atomic.AddUint64(&strictCounts[category], 1)
+	l, ok := logger.Load().(loggerHolder)
+	if !ok {
+		l = loggerHolder{stdLogger{}}
+	}
+	l.Errorf(strictNames[category]+": "+format, args...)
+}
+
+// strictLate fails in strict mode for a setting applied once traffic started, it's
+// reported as a strictLateConfig
+func strictLate(started bool, setting string) error {
+	if !started || !strict() {
+		return nil
+	}
+	strictFail(strictLateConfig, "%v after traffic", setting)
+	return errors.Errorf("kcp: %v after traffic", setting)
+}
+
+// started tells whether the session exchanged packets, s.mu must be held
+func (s *UDPSession) started() bool {
+	return s.kcp.snd_seq > 0 || s.kcp.rcv_seq > 0 || !s.LastRecv().IsZero()
+}
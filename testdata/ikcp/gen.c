@@ -0,0 +1,177 @@
+/*
+ * gen.c generates the conformance traces replayed by conformance_test.go
+ * from skywind3000's reference ikcp (https://github.com/skywind3000/kcp).
+ *
+ *   cp /path/to/kcp/ikcp.[ch] . && cc -o gen gen.c ikcp.c && ./gen
+ *
+ * Each trace drives one kcp under test, lines are:
+ *
+ *   conv <conv>
+ *   nodelay <nodelay> <interval> <resend> <nc>
+ *   wndsize <sndwnd> <rcvwnd>
+ *   send <hex>      ikcp_send
+ *   input <hex>     ikcp_input
+ *   update <ms>     ikcp_update
+ *   output <hex>    datagram emitted by the kcp under test, in order
+ *   recv <hex>      message returned by ikcp_recv
+ */
+#include <stdio.h>
+#include <string.h>
+#include "ikcp.h"
+
+static FILE *trace;
+
+static void hexline(const char *tag, const char *buf, int len)
+{
+	int i;
+	fprintf(trace, "%s ", tag);
+	for (i = 0; i < len; i++)
+		fprintf(trace, "%02x", (unsigned char)buf[i]);
+	fprintf(trace, "\n");
+}
+
+static int output_trace(const char *buf, int len, ikcpcb *kcp, void *user)
+{
+	hexline("output", buf, len);
+	return 0;
+}
+
+struct queue {
+	int n;
+	int len[256];
+	char buf[256][2048];
+};
+
+static int output_queue(const char *buf, int len, ikcpcb *kcp, void *user)
+{
+	struct queue *q = (struct queue *)user;
+	memcpy(q->buf[q->n], buf, len);
+	q->len[q->n++] = len;
+	return 0;
+}
+
+static ikcpcb *create(IUINT32 conv, void *user, int nodelay, int interval, int resend, int nc)
+{
+	ikcpcb *kcp = ikcp_create(conv, user);
+	ikcp_nodelay(kcp, nodelay, interval, resend, nc);
+	ikcp_wndsize(kcp, 32, 32);
+	if (trace) {
+		fprintf(trace, "conv %u\n", conv);
+		fprintf(trace, "nodelay %d %d %d %d\n", nodelay, interval, resend, nc);
+		/* the windows in effect, ikcp_wndsize keeps rcv_wnd at IKCP_WND_RCV at least */
+		fprintf(trace, "wndsize %u %u\n", kcp->snd_wnd, kcp->rcv_wnd);
+	}
+	return kcp;
+}
+
+static void update(ikcpcb *kcp, IUINT32 current)
+{
+	fprintf(trace, "update %u\n", current);
+	ikcp_update(kcp, current);
+}
+
+static void input(ikcpcb *kcp, const char *buf, int len)
+{
+	hexline("input", buf, len);
+	ikcp_input(kcp, buf, len);
+}
+
+static void recv_all(ikcpcb *kcp)
+{
+	char buf[65536];
+	int n;
+	while ((n = ikcp_recv(kcp, buf, sizeof(buf))) >= 0)
+		hexline("recv", buf, n);
+}
+
+static void pattern(char *buf, int len, int seed)
+{
+	int i;
+	for (i = 0; i < len; i++)
+		buf[i] = (char)(i * 7 + seed);
+}
+
+/* scripted send: one fragmented message and one small message */
+static void fragment(void)
+{
+	char msg[3000];
+	ikcpcb *kcp;
+
+	trace = fopen("fragment.trace", "w");
+	kcp = create(0x11223344, NULL, 1, 10, 2, 1);
+	ikcp_setoutput(kcp, output_trace);
+
+	pattern(msg, sizeof(msg), 1);
+	hexline("send", msg, sizeof(msg));
+	ikcp_send(kcp, msg, sizeof(msg));
+	hexline("send", msg, 10);
+	ikcp_send(kcp, msg, 10);
+	update(kcp, 0);
+	update(kcp, 10);
+	/* nothing acked, the segments are retransmitted on timeout */
+	update(kcp, 1000);
+
+	ikcp_release(kcp);
+	fclose(trace);
+}
+
+/* out-of-order and duplicated delivery of fragments */
+static void reorder(void)
+{
+	static struct queue q;
+	char msg[2000];
+	ikcpcb *sender, *kcp;
+
+	trace = NULL;
+	sender = create(7, &q, 1, 10, 2, 1);
+	ikcp_setoutput(sender, output_queue);
+	pattern(msg, sizeof(msg), 2);
+	ikcp_send(sender, msg, sizeof(msg));
+	ikcp_send(sender, msg, 100);
+	ikcp_update(sender, 0);
+
+	trace = fopen("reorder.trace", "w");
+	kcp = create(7, NULL, 1, 10, 2, 1);
+	ikcp_setoutput(kcp, output_trace);
+	input(kcp, q.buf[q.n - 1], q.len[q.n - 1]);
+	update(kcp, 0);
+	recv_all(kcp);
+	input(kcp, q.buf[0], q.len[0]);
+	input(kcp, q.buf[0], q.len[0]);
+	update(kcp, 10);
+	recv_all(kcp);
+	if (q.n > 2)
+		input(kcp, q.buf[1], q.len[1]);
+	update(kcp, 20);
+	recv_all(kcp);
+
+	ikcp_release(sender);
+	ikcp_release(kcp);
+	fclose(trace);
+}
+
+/* window probing with IKCP_CMD_WASK and IKCP_CMD_WINS */
+static void probe(void)
+{
+	/* conv 9, cmd WASK, frg 0, wnd 0, ts 0, sn 0, una 0, len 0 */
+	static const char wask[24] = {9, 0, 0, 0, 83};
+	ikcpcb *kcp;
+
+	trace = fopen("probe.trace", "w");
+	kcp = create(9, NULL, 0, 10, 0, 0);
+	ikcp_setoutput(kcp, output_trace);
+	update(kcp, 0);
+	input(kcp, wask, sizeof(wask));
+	update(kcp, 10);
+
+	ikcp_release(kcp);
+	fclose(trace);
+}
+
+int main(void)
+{
+	fragment();
+	reorder();
+	probe();
+	return 0;
+}
@@ -0,0 +1,86 @@
+package kcp
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	tokenSize = 4 // packet token at the head of an encrypted packet, in place of nonce bytes
+	tokenSalt = "kcp-go packet token"
+)
+
+// packetToken is a keyed 32bit tag over the first ciphertext block of a packet,
+// it's checked before decryption so that garbage costs a SipHash instead of a full decrypt
+type packetToken struct {
+	k0, k1 uint64
+}
+
+// newPacketToken derives the SipHash key from a pre-shared key, a nil key gives no token
+func newPacketToken(key []byte) *packetToken {
+	if key == nil {
+		return nil
+	}
+	h := sha1.Sum(append([]byte(tokenSalt), key...))
+	return &packetToken{binary.LittleEndian.Uint64(h[0:]), binary.LittleEndian.Uint64(h[8:])}
+}
+
+// sum computes the token of an encrypted packet
+func (t *packetToken) sum(pkt []byte) uint32 {
+	return uint32(siphash24(t.k0, t.k1, pkt[tokenSize:cryptHeaderSize]))
+}
+
+// verify checks the token of an encrypted packet
+func (t *packetToken) verify(pkt []byte) bool {
+	return binary.LittleEndian.Uint32(pkt) == t.sum(pkt)
+}
+
+// siphash24 implements SipHash-2-4 https://131002.net/siphash/
+func siphash24(k0, k1 uint64, p []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	b := uint64(len(p)) << 56
+	for len(p) >= 8 {
+		m := binary.LittleEndian.Uint64(p)
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+		p = p[8:]
+	}
+	for i := len(p) - 1; i >= 0; i-- {
+		b |= uint64(p[i]) << (8 * uint(i))
+	}
+	v3 ^= b
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= b
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
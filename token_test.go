@@ -0,0 +1,142 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestSipHash(t *testing.T) {
+	// vectors from the SipHash reference implementation, key 00..0f, message 00..len-1
+	vectors := map[int]uint64{
+		0:  0x726fdb47dd0e0e31,
+		1:  0x74f839c593dc67fd,
+		8:  0x93f5f5799a932462,
+		15: 0xa129ca6149be45e5,
+	}
+	k0, k1 := uint64(0x0706050403020100), uint64(0x0f0e0d0c0b0a0908)
+	msg := make([]byte, 16)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	for n, want := range vectors {
+		if got := siphash24(k0, k1, msg[:n]); got != want {
+			t.Fatalf("len %v: got %x, want %x", n, got, want)
+		}
+	}
+}
+
+func TestPacketToken(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions("127.0.0.1:0", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetPacketToken([]byte("token")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			s, err := l.AcceptKCP()
+			if err != nil {
+				return
+			}
+			go func(s *UDPSession) {
+				defer s.Close()
+				io.Copy(s, s)
+			}(s)
+		}
+	}()
+
+	echo := func(token []byte) bool {
+		cli, err := DialWithOptions(l.Addr().String(), block, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetPacketToken(token)
+		cli.SetReadDeadline(time.Now().Add(time.Second))
+		msg := []byte("hello")
+		cli.Write(msg)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(cli, buf)
+		return err == nil && bytes.Equal(buf, msg)
+	}
+
+	if !echo([]byte("token")) {
+		t.Fatal("no echo with the right token")
+	}
+	errs := atomic.LoadUint64(&DefaultSnmp.InTokenErrors)
+	if echo([]byte("wrong")) {
+		t.Fatal("echo with a wrong token")
+	}
+	if echo(nil) {
+		t.Fatal("echo without token")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.InTokenErrors) == errs {
+		t.Fatal("bad tokens not counted")
+	}
+
+	// tokens need encryption
+	cli, err := DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetPacketToken([]byte("token")); err == nil {
+		t.Fatal("token set without encryption")
+	}
+}
+
+// cost of accepting a 1400 byte AES encrypted packet, or rejecting garbage
+func BenchmarkPacketOpen(b *testing.B) {
+	block, _ := NewAESBlockCrypt(pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New))
+	token := newPacketToken([]byte("token"))
+	data := make([]byte, 1400)
+	garbage := make([]byte, len(data))
+	io.ReadFull(rand.Reader, garbage)
+
+	sealed := make([]byte, len(data))
+	s := &UDPSession{block: block}
+	s.token.Store(token)
+	copy(sealed, data)
+	s.seal(sealed)
+
+	b.Run("valid", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			copy(data, sealed)
+			if !token.verify(data) {
+				b.Fatal("bad token")
+			}
+			if _, ok := decryptPacket(block, true, data); !ok {
+				b.Fatal("bad checksum")
+			}
+		}
+	})
+	b.Run("invalid", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if token.verify(garbage) {
+				b.Fatal("garbage accepted")
+			}
+		}
+	})
+	b.Run("invalid-notoken", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			copy(data, garbage)
+			if _, ok := decryptPacket(block, false, data); ok {
+				b.Fatal("garbage accepted")
+			}
+		}
+	})
+}
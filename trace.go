@@ -0,0 +1,79 @@
+package kcp
+
+import "time"
+
+// SessionTrace is a set of hooks for the events of a connection, to find out where the
+// time of a transfer goes, see SetTrace. Any hook may be nil. Hooks are called
+// synchronously with the connection locked: they must be quick, and must not call
+// methods of the connection; time.Now in a hook is the time of the event.
+type SessionTrace struct {
+	SegmentSent          func(sn uint32)                    // a data segment is sent for the first time
+	SegmentRetransmitted func(sn, xmit uint32)              // a data segment is sent again, for the xmit-th time
+	AckReceived          func(sn uint32, rtt time.Duration) // the peer acknowledged a data segment, rtt after its last transmission
+	WindowFull           func()                             // a Write waits, as the send window is full
+	UpdateTick           func()                             // the connection is updated by its timer
+	DeadLink             func()                             // a segment reached the retry limit, see SetDeadLinkMode
+	MtuFallback          func(mtu int)                      // large datagrams are lost on the path, the datagram mtu is lowered, see SetMtuFallback
+	PeerMismatch         func(diagnosis string)             // the first datagrams of the peer all failed the checks, see SessionStats.Mismatch
+	Truncated            func(size int)                     // the first datagram of the peer larger than the buffers, truncated to size bytes, see SessionStats.Truncated
+}
+
+// SetTrace installs the hooks of trace on the connection, nil removes them.
+// Without hooks, tracing costs a nil check per event.
+func (c *KCPConn) SetTrace(trace *SessionTrace) {
+	c.mu.Lock()
+	c.kcp.trace = trace
+	c.mu.Unlock()
+}
+
+func (t *SessionTrace) sent(sn, xmit uint32) {
+	if xmit <= 1 {
+		if t.SegmentSent != nil {
+			t.SegmentSent(sn)
+		}
+	} else if t.SegmentRetransmitted != nil {
+		t.SegmentRetransmitted(sn, xmit)
+	}
+}
+
+func (t *SessionTrace) acked(sn uint32, rtt int32) {
+	if t.AckReceived != nil {
+		t.AckReceived(sn, time.Duration(rtt)*time.Millisecond)
+	}
+}
+
+func (t *SessionTrace) windowFull() {
+	if t.WindowFull != nil {
+		t.WindowFull()
+	}
+}
+
+func (t *SessionTrace) updateTick() {
+	if t.UpdateTick != nil {
+		t.UpdateTick()
+	}
+}
+
+func (t *SessionTrace) deadLink() {
+	if t.DeadLink != nil {
+		t.DeadLink()
+	}
+}
+
+func (t *SessionTrace) mtuFallback(mtu int) {
+	if t.MtuFallback != nil {
+		t.MtuFallback(mtu)
+	}
+}
+
+func (t *SessionTrace) peerMismatch(diagnosis string) {
+	if t.PeerMismatch != nil {
+		t.PeerMismatch(diagnosis)
+	}
+}
+
+func (t *SessionTrace) truncated(size int) {
+	if t.Truncated != nil {
+		t.Truncated(size)
+	}
+}
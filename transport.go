@@ -0,0 +1,182 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Mode defines how KCP packets are framed on an io.ReadWriteCloser
+type Mode int
+
+const (
+	// ModeDatagram is for transports keeping message boundaries, every Write
+	// carries one packet and every Read returns one packet
+	ModeDatagram Mode = iota
+	// ModeStream is for byte streams, every packet is prefixed with its 16bit length
+	ModeStream
+)
+
+const frameHeaderSize = 2 // length prefix in ModeStream
+
+// TransportConn is a KCP connection over an io.ReadWriteCloser
+type TransportConn struct {
+	*KCPConn
+	rwc     io.ReadWriteCloser
+	mode    Mode
+	chFrame chan []byte // framed packets waiting for the writer
+}
+
+// Client starts a KCP connection over rwc, the peer must call Server on its end
+func Client(rwc io.ReadWriteCloser, mode Mode) (*TransportConn, error) {
+	return newTransportConn(ConvSource(), rwc, mode, nil)
+}
+
+// Server accepts a KCP connection over rwc, it waits for the first packet
+// from the client to learn the conversation id
+func Server(rwc io.ReadWriteCloser, mode Mode) (*TransportConn, error) {
+	buf := make([]byte, mtuLimit)
+	n, err := readFrame(rwc, mode, buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "readFrame")
+	}
+	if n < IKCP_OVERHEAD {
+		return nil, errors.New(errInvalidPacket)
+	}
+	return newTransportConn(binary.LittleEndian.Uint32(buf), rwc, mode, buf[:n])
+}
+
+func newTransportConn(conv uint32, rwc io.ReadWriteCloser, mode Mode, first []byte) (*TransportConn, error) {
+	if mode != ModeDatagram && mode != ModeStream {
+		return nil, errors.New(errInvalidOperation)
+	}
+
+	c := new(TransportConn)
+	c.rwc = rwc
+	c.mode = mode
+	c.chFrame = make(chan []byte, txQueueLimit)
+	c.KCPConn = NewKCPConn(conv, c.output)
+	if first != nil {
+		c.Input(first)
+	}
+	go c.readLoop()
+	go c.writeLoop()
+	return c, nil
+}
+
+// output frames a packet and hands it to the writer, a transport
+// blocked on writing must not stall the shared updater
+func (c *TransportConn) output(buf []byte) {
+	if frameHeaderSize+len(buf) > mtuLimit {
+		atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+		strictFail(strictOversized, "transport %v: frame of %v bytes above %v", c.ID(), frameHeaderSize+len(buf), mtuLimit)
+		return
+	}
+
+	frame := getXmitBuf()
+	if c.mode == ModeStream {
+		binary.LittleEndian.PutUint16(frame, uint16(len(buf)))
+		frame = frame[:frameHeaderSize+len(buf)]
+		copy(frame[frameHeaderSize:], buf)
+	} else {
+		frame = frame[:len(buf)]
+		copy(frame, buf)
+	}
+
+	select {
+	case c.chFrame <- frame:
+	default:
+		putXmitBuf(frame)
+		atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+		strictFail(strictTxDrop, "transport %v: writer of %v frames behind", c.ID(), cap(c.chFrame))
+	}
+}
+
+func (c *TransportConn) writeLoop() {
+	for {
+		select {
+		case frame := <-c.chFrame:
+			_, err := c.rwc.Write(frame)
+			putXmitBuf(frame)
+			if err != nil {
+				c.closeWith(err.Error())
+				return
+			}
+			atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
+			atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(len(frame)))
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *TransportConn) readLoop() {
+	buf := make([]byte, mtuLimit)
+	for {
+		n, err := readFrame(c.rwc, c.mode, buf)
+		if err != nil {
+			c.closeWith(err.Error())
+			return
+		}
+		atomic.AddUint64(&DefaultSnmp.InSegs, 1)
+		atomic.AddUint64(&DefaultSnmp.InBytes, uint64(n))
+		c.Input(buf[:n]) // invalid packets are counted by Input
+	}
+}
+
+// readFrame reads one packet from r into buf
+func readFrame(r io.Reader, mode Mode, buf []byte) (int, error) {
+	if mode == ModeDatagram {
+		return r.Read(buf)
+	}
+
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.LittleEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return 0, errors.New(errInvalidPacket)
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// SetMtu sets the maximum transmission unit, leaving room for the length prefix of a frame
+func (c *TransportConn) SetMtu(mtu int) error {
+	if frameHeaderSize+mtu > mtuLimit {
+		return errors.New(errInvalidOperation)
+	}
+	return c.KCPConn.SetMtu(mtu)
+}
+
+// Close closes the connection and the underlying transport.
+func (c *TransportConn) Close() error {
+	return c.closeWith(closeLocal)
+}
+
+// closeWith closes the connection for reason and the underlying transport
+func (c *TransportConn) closeWith(reason string) error {
+	if !c.close(reason) {
+		return ErrClosed
+	}
+	return c.rwc.Close()
+}
+
+// LocalAddr returns the local address of the transport if it's a net.Conn, nil otherwise.
+func (c *TransportConn) LocalAddr() net.Addr {
+	if nc, ok := c.rwc.(net.Conn); ok {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote address of the transport if it's a net.Conn, nil otherwise.
+func (c *TransportConn) RemoteAddr() net.Addr {
+	if nc, ok := c.rwc.(net.Conn); ok {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
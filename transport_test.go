@@ -0,0 +1,84 @@
+package kcp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransportConn(t *testing.T) {
+	for _, mode := range []Mode{ModeDatagram, ModeStream} {
+		testTransportConn(t, mode)
+	}
+}
+
+func testTransportConn(t *testing.T, mode Mode) {
+	p1, p2 := net.Pipe()
+	chServer := make(chan *TransportConn, 1)
+	go func() {
+		s, err := Server(p2, mode)
+		if err != nil {
+			t.Error(err)
+		}
+		chServer <- s
+	}()
+
+	cli, err := Client(p1, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	if err := cli.SetMtu(mtuLimit); err == nil {
+		t.Fatal("mtu without room for the frame header accepted")
+	}
+	msg := []byte("ping")
+	if _, err := cli.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := <-chServer
+	if srv == nil {
+		t.FailNow()
+	}
+	if srv.GetConv() != cli.GetConv() {
+		t.Fatal("conv mismatch", srv.GetConv(), cli.GetConv())
+	}
+	srv.SetNoDelay(1, 10, 2, 1)
+	srv.SetStreamMode(true)
+
+	buf := make([]byte, 64)
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := srv.Read(buf); err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatal(n, err)
+	}
+
+	// bulk transfer back to the client
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		for p := data; len(p) > 0; p = p[65536:] {
+			srv.Write(p[:65536])
+		}
+	}()
+	got := make([]byte, len(data))
+	cli.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(cli, got); err != nil {
+		t.Fatal(mode, err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal(mode, "data mismatch")
+	}
+
+	// closing the transport closes the peer
+	cli.Close()
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := srv.Read(buf); err == nil {
+		t.Fatal(mode, "read after the transport closed")
+	} else if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+		t.Fatal(mode, "transport close not detected")
+	}
+}
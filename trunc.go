@@ -0,0 +1,61 @@
+package kcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// truncHistory is the number of addresses a listener keeps, see ListenerStats.Truncations
+const truncHistory = 8
+
+// Truncation is an address sending datagrams larger than the buffers of the package,
+// mtuLimit bytes, which the socket truncated: its mtu is likely misconfigured
+type Truncation struct {
+	Addr net.Addr
+	Size int       // bytes read of the first datagram, it was larger
+	Time time.Time // of the first datagram
+}
+
+// truncations are the latest addresses of a listener sending truncated datagrams
+type truncations struct {
+	mu      sync.Mutex
+	history []Truncation // oldest first
+}
+
+// add records a datagram from addr truncated to size bytes, once per address
+func (t *truncations) add(addr net.Addr, size int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := addr.String()
+	for _, tr := range t.history {
+		if tr.Addr.String() == key {
+			return
+		}
+	}
+	if len(t.history) == truncHistory {
+		t.history = append(t.history[:0], t.history[1:]...)
+	}
+	t.history = append(t.history, Truncation{addr, size, time.Now()})
+}
+
+// latest returns a copy of the addresses, oldest first
+func (t *truncations) latest() []Truncation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Truncation(nil), t.history...)
+}
+
+// truncated counts a datagram from addr the socket truncated to size bytes, the first
+// one is traced
+func (s *UDPSession) truncated(from net.Addr, size int) {
+	if from == nil || from.String() != s.remote.String() {
+		return
+	}
+	s.rejects.add(rejectTruncated)
+	s.mu.Lock()
+	if s.kcp.trace != nil && s.rejects.stats(rejectTruncated).Count == 1 {
+		s.kcp.trace.truncated(size)
+	}
+	s.mu.Unlock()
+}
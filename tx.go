@@ -0,0 +1,146 @@
+package kcp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultTx writes packets to conn one by one
+func (s *UDPSession) defaultTx(txqueue [][]byte) {
+	nbytes := 0
+	npkts := 0
+	for k := range txqueue {
+		if n, err := s.conn.WriteTo(txqueue[k], s.remote); err == nil {
+			nbytes += n
+			npkts++
+		}
+	}
+	atomic.AddUint64(&DefaultSnmp.OutSegs, uint64(npkts))
+	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(nbytes))
+	s.txWire.add(nbytes, time.Now())
+}
+
+// txQuantum is the bytes a session may send in its turn of the output scheduler
+const txQuantum = 16 * 1024
+
+// txScheduler writes the packets of the sessions sharing a listener socket in deficit
+// round robin, so a bulk transfer can't monopolize the socket. Sessions hand their
+// packets over without blocking, the updater and the input path never wait for the
+// socket on behalf of one session while others are due.
+type txScheduler struct {
+	mu      sync.Mutex
+	active  []*UDPSession // sessions with pending packets, in turn order
+	pending int64         // bytes of the packets pending for all sessions, read atomically
+	stopped bool          // run has returned, packets are dropped
+	wake    chan struct{}
+	die     <-chan struct{}
+}
+
+// newTxScheduler creates a scheduler, run is its goroutine
+func newTxScheduler(die <-chan struct{}) *txScheduler {
+	return &txScheduler{wake: make(chan struct{}, 1), die: die}
+}
+
+// enqueue takes the packets of txqueue over, packets beyond txQueueLimit pending for the
+// session, or after the listener closed, are dropped
+func (sched *txScheduler) enqueue(s *UDPSession, txqueue [][]byte) {
+	sched.mu.Lock()
+	for k := range txqueue {
+		if len(s.txpending) < txQueueLimit && !sched.stopped {
+			s.txpending = append(s.txpending, txqueue[k])
+			atomic.AddInt64(&sched.pending, int64(len(txqueue[k])))
+		} else {
+			putXmitBuf(txqueue[k])
+			atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+			if !sched.stopped {
+				strictFail(strictTxDrop, "session %v to %v: %v packets pending on the listener socket", s.ID(), s.remote, txQueueLimit)
+			}
+		}
+		txqueue[k] = nil
+	}
+	if !s.txscheduled && len(s.txpending) > 0 {
+		s.txscheduled = true
+		sched.active = append(sched.active, s)
+	}
+	sched.mu.Unlock()
+
+	select {
+	case sched.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sched *txScheduler) run() {
+	var batch [][]byte
+	for {
+		select {
+		case <-sched.die:
+			sched.stop()
+			return
+		default:
+		}
+		sched.mu.Lock()
+		if len(sched.active) == 0 {
+			sched.mu.Unlock()
+			select {
+			case <-sched.wake:
+			case <-sched.die:
+			}
+			continue
+		}
+
+		// the session at the head sends up to its deficit, then goes to the tail
+		s := sched.active[0]
+		sched.active[0] = nil
+		sched.active = sched.active[1:]
+		s.deficit += txQuantum
+		n := 0
+		for n < len(s.txpending) && len(s.txpending[n]) <= s.deficit {
+			s.deficit -= len(s.txpending[n])
+			n++
+		}
+		batch = append(batch[:0], s.txpending[:n]...)
+		for k := range batch {
+			atomic.AddInt64(&sched.pending, -int64(len(batch[k])))
+		}
+		rest := copy(s.txpending, s.txpending[n:])
+		for k := rest; k < len(s.txpending); k++ {
+			s.txpending[k] = nil
+		}
+		s.txpending = s.txpending[:rest]
+		if rest > 0 {
+			sched.active = append(sched.active, s)
+		} else {
+			s.txscheduled = false
+			s.deficit = 0
+		}
+		sched.mu.Unlock()
+
+		s.tx(batch)
+		for k := range batch {
+			putXmitBuf(batch[k])
+			batch[k] = nil
+		}
+	}
+}
+
+// stop drops the packets pending once the listener is closed, so the sessions it leaves
+// behind don't hold them until they're collected
+func (sched *txScheduler) stop() {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	sched.stopped = true
+	for k, s := range sched.active {
+		for _, pkt := range s.txpending {
+			putXmitBuf(pkt)
+			atomic.AddUint64(&DefaultSnmp.OutDrops, 1)
+		}
+		s.txpending = nil
+		s.txscheduled = false
+		s.deficit = 0
+		sched.active[k] = nil
+	}
+	sched.active = nil
+	atomic.StoreInt64(&sched.pending, 0)
+}
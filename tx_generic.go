@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package kcp
+
+// gsoState is a placeholder, UDP GSO is only available on linux
+type gsoState struct{}
+
+func (s *UDPSession) tx(txqueue [][]byte) {
+	s.defaultTx(txqueue)
+}
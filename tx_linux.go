@@ -0,0 +1,150 @@
+//go:build linux
+// +build linux
+
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	gsoMaxSegments = 64    // UDP_MAX_SEGMENTS of the kernel
+	gsoMaxBytes    = 65000 // payload limit of one GSO send, below the 64KB IP datagram limit
+)
+
+// gsoState records UDP GSO(generic segmentation offload) support of a session's socket,
+// it's only accessed by the goroutine holding txbusy, or the output scheduler of a listener
+type gsoState struct {
+	probed    bool
+	enabled   bool
+	connected bool // conn is connected, no destination address needed
+	rc        syscall.RawConn
+	sa        unix.Sockaddr
+	oob       []byte // UDP_SEGMENT control message
+}
+
+// probe checks whether the socket accepts UDP_SEGMENT, and prepares the destination address
+func (g *gsoState) probe(conn interface{}, remote net.Addr) {
+	g.probed = true
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	var supported, inet6 bool
+	rc.Control(func(fd uintptr) {
+		if _, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT); err != nil {
+			return
+		}
+		if sa, err := unix.Getsockname(int(fd)); err == nil {
+			_, inet6 = sa.(*unix.SockaddrInet6)
+			supported = true
+		}
+	})
+	if !supported {
+		return
+	}
+
+	if _, ok := conn.(*ConnectedUDPConn); ok {
+		g.connected = true
+	} else if g.sa = udpSockaddr(remote, inet6); g.sa == nil {
+		return
+	}
+
+	g.oob = make([]byte, unix.CmsgSpace(2))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&g.oob[0]))
+	h.Level = unix.SOL_UDP
+	h.Type = unix.UDP_SEGMENT
+	h.SetLen(unix.CmsgLen(2))
+	g.rc = rc
+	g.enabled = true
+}
+
+// send writes pkts in one sendmsg, the kernel splits them into datagrams of size bytes
+func (g *gsoState) send(pkts [][]byte, size int) error {
+	*(*uint16)(unsafe.Pointer(&g.oob[unix.CmsgLen(0)])) = uint16(size)
+	var operr error
+	err := g.rc.Write(func(fd uintptr) bool {
+		_, operr = unix.SendmsgBuffers(int(fd), pkts, g.oob, g.sa, 0)
+		return operr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
+
+// udpSockaddr converts a UDP address for a socket of the given family
+func udpSockaddr(addr net.Addr, inet6 bool) unix.Sockaddr {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || ua.Zone != "" {
+		return nil
+	}
+	if !inet6 {
+		if ip4 := ua.IP.To4(); ip4 != nil {
+			sa := &unix.SockaddrInet4{Port: ua.Port}
+			copy(sa.Addr[:], ip4)
+			return sa
+		}
+		return nil
+	}
+	if ip16 := ua.IP.To16(); ip16 != nil { // IPv4 maps into IPv6 on dual stack sockets
+		sa := &unix.SockaddrInet6{Port: ua.Port}
+		copy(sa.Addr[:], ip16)
+		return sa
+	}
+	return nil
+}
+
+// tx writes packets to conn, runs of equally sized packets are handed to the
+// kernel in one sendmsg when the socket supports GSO; encryption has been
+// applied to each packet already, so the datagrams on the wire are unchanged.
+func (s *UDPSession) tx(txqueue [][]byte) {
+	if !s.gso.probed {
+		s.gso.probe(s.conn, s.remote)
+	}
+	if !s.gso.enabled {
+		s.defaultTx(txqueue)
+		return
+	}
+
+	for len(txqueue) > 0 {
+		// the segments share the size of the first packet, only the last one may be shorter
+		size := len(txqueue[0])
+		n, total := 1, size
+		for n < len(txqueue) && n < gsoMaxSegments {
+			sz := len(txqueue[n])
+			if sz > size || total+sz > gsoMaxBytes {
+				break
+			}
+			n++
+			total += sz
+			if sz < size {
+				break
+			}
+		}
+
+		if n == 1 {
+			s.defaultTx(txqueue[:1])
+		} else if err := s.gso.send(txqueue[:n], size); err == nil {
+			atomic.AddUint64(&DefaultSnmp.OutSegs, uint64(n))
+			atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(total))
+			s.txWire.add(total, time.Now())
+		} else if err == unix.EIO || err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			// the device or route can't segment, fall back permanently
+			s.gso.enabled = false
+			s.defaultTx(txqueue[:n])
+		}
+		txqueue = txqueue[n:]
+	}
+}
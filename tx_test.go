@@ -0,0 +1,103 @@
+package kcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// txTestSession creates a bare session transmitting to a local sink socket
+func txTestSession(t testing.TB) (*UDPSession, *net.UDPConn) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.SetReadBuffer(16 * 1024 * 1024)
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &UDPSession{conn: conn, remote: sink.LocalAddr()}, sink
+}
+
+func TestTx(t *testing.T) {
+	s, sink := txTestSession(t)
+	defer sink.Close()
+	defer s.conn.Close()
+
+	// equally sized packets followed by a short tail, then a size change
+	var pkts [][]byte
+	for i := 0; i < 20; i++ {
+		pkts = append(pkts, bytes.Repeat([]byte{byte(i)}, 1400))
+	}
+	pkts = append(pkts, bytes.Repeat([]byte{20}, 100), bytes.Repeat([]byte{21}, 1000))
+	s.tx(pkts)
+
+	buf := make([]byte, mtuLimit)
+	sink.SetReadDeadline(time.Now().Add(time.Second))
+	for k := range pkts {
+		n, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], pkts[k]) {
+			t.Fatalf("datagram %v: got %v bytes of %v, want %v bytes of %v", k, n, buf[0], len(pkts[k]), pkts[k][0])
+		}
+	}
+}
+
+func BenchmarkTx(b *testing.B) {
+	benchmarkTx(b, func(s *UDPSession, pkts [][]byte) { s.tx(pkts) })
+}
+
+func BenchmarkDefaultTx(b *testing.B) {
+	benchmarkTx(b, func(s *UDPSession, pkts [][]byte) { s.defaultTx(pkts) })
+}
+
+func benchmarkTx(b *testing.B, tx func(*UDPSession, [][]byte)) {
+	s, sink := txTestSession(b)
+	defer sink.Close()
+	defer s.conn.Close()
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			if _, _, err := sink.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	pkts := make([][]byte, 64)
+	for k := range pkts {
+		pkts[k] = make([]byte, IKCP_MTU_DEF)
+	}
+	b.SetBytes(int64(len(pkts) * IKCP_MTU_DEF))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tx(s, pkts)
+	}
+}
+
+func TestTxSchedulerStop(t *testing.T) {
+	s, sink := txTestSession(t)
+	defer sink.Close()
+	defer s.conn.Close()
+	die := make(chan struct{})
+	sched := newTxScheduler(die)
+
+	// the packets wait while the scheduler isn't running
+	txqueue := [][]byte{getXmitBuf()[:100], getXmitBuf()[:200]}
+	sched.enqueue(s, txqueue)
+	if sched.pending != 300 || len(s.txpending) != 2 || txqueue[0] != nil {
+		t.Fatal(sched.pending, "bytes pending in", len(s.txpending), "packets")
+	}
+
+	// closing the listener drops them, and those enqueued later
+	close(die)
+	sched.run()
+	sched.enqueue(s, [][]byte{getXmitBuf()[:100]})
+	if sched.pending != 0 || s.txpending != nil || s.txscheduled || len(sched.active) != 0 {
+		t.Fatal(sched.pending, "bytes pending in", len(s.txpending), "packets")
+	}
+}
@@ -0,0 +1,160 @@
+package kcp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+var updater updateHeap
+
+func init() {
+	updater.init()
+	go updater.updateTask()
+}
+
+// updatable is a connection driven by the updater
+type updatable interface {
+	// update runs the connection and returns the delay before the next
+	// update, or false if the connection has been closed
+	update() (time.Duration, bool)
+	// kcpConn returns the KCPConn of the connection
+	kcpConn() *KCPConn
+}
+
+// entry contains a session update info
+type entry struct {
+	ts time.Time
+	s  updatable
+	c  *KCPConn // s.kcpConn(), keeping its index in the heap
+}
+
+// updateHeap is a global min-heap of sessions ordered by their next update time,
+// a single goroutine drives kcp.Update() for all sessions
+type updateHeap struct {
+	entries  []entry
+	mu       sync.Mutex
+	chWakeUp chan struct{}
+	due      []entry                // popped for an update, reused by updateTask
+	running  map[*KCPConn]time.Time // connections being updated, with the earliest reschedule meanwhile
+}
+
+func (h *updateHeap) Len() int           { return len(h.entries) }
+func (h *updateHeap) Less(i, j int) bool { return h.entries[i].ts.Before(h.entries[j].ts) }
+func (h *updateHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].c.heapIndex = i
+	h.entries[j].c.heapIndex = j
+}
+func (h *updateHeap) Push(x interface{}) {
+	e := x.(entry)
+	e.c.heapIndex = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+func (h *updateHeap) Pop() interface{} {
+	n := len(h.entries)
+	x := h.entries[n-1]
+	x.c.heapIndex = -1
+	h.entries[n-1] = entry{} // dereference
+	h.entries = h.entries[0 : n-1]
+	return x
+}
+
+func (h *updateHeap) init() {
+	h.chWakeUp = make(chan struct{}, 1)
+	h.running = make(map[*KCPConn]time.Time)
+}
+
+// addSession schedules a session for immediate update
+func (h *updateHeap) addSession(s updatable) {
+	h.mu.Lock()
+	heap.Push(h, entry{time.Now(), s, s.kcpConn()})
+	h.mu.Unlock()
+	h.wakeup()
+}
+
+// reschedule updates the connection c at ts, if it's in the heap and not due earlier.
+// A connection being updated takes ts along back to the heap.
+func (h *updateHeap) reschedule(c *KCPConn, ts time.Time) {
+	h.mu.Lock()
+	if r, ok := h.running[c]; ok {
+		if r.IsZero() || ts.Before(r) {
+			h.running[c] = ts
+		}
+		h.mu.Unlock()
+		h.wakeup()
+		return
+	}
+	if k := c.heapIndex; k >= 0 && ts.Before(h.entries[k].ts) {
+		h.entries[k].ts = ts
+		heap.Fix(h, k)
+	}
+	h.mu.Unlock()
+	h.wakeup()
+}
+
+func (h *updateHeap) wakeup() {
+	select {
+	case h.chWakeUp <- struct{}{}:
+	default:
+	}
+}
+
+func (h *updateHeap) updateTask() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		select {
+		case <-timer.C:
+		case <-h.chWakeUp:
+		}
+		chaosDelay()
+
+		// the due connections leave the heap for their update, without h.mu held, so a
+		// connection blocking in a flush delays neither the heap nor its other users
+		h.mu.Lock()
+		now := time.Now()
+		for h.Len() > 0 && !h.entries[0].ts.After(now) {
+			e := heap.Pop(h).(entry)
+			h.running[e.c] = time.Time{}
+			h.due = append(h.due, e)
+		}
+		h.mu.Unlock()
+
+		for k := range h.due {
+			interval, ok := h.due[k].s.update()
+			h.due[k].ts = now.Add(interval)
+			if !ok { // closed sessions leave the heap
+				h.due[k].s = nil
+			}
+		}
+
+		h.mu.Lock()
+		for k, e := range h.due {
+			if e.s != nil {
+				if r := h.running[e.c]; !r.IsZero() && r.Before(e.ts) {
+					e.ts = r
+				}
+				heap.Push(h, e)
+			}
+			h.due[k] = entry{} // dereference
+		}
+		h.due = h.due[:0]
+		for c := range h.running {
+			delete(h.running, c)
+		}
+
+		delay := time.Hour
+		if h.Len() > 0 {
+			delay = h.entries[0].ts.Sub(now)
+		}
+		h.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 const wordSize = int(unsafe.Sizeof(uintptr(0)))
-const supportsUnaligned = runtime.GOARCH == "386" || runtime.GOARCH == "amd64" || runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le" || runtime.GOARCH == "s390x"
+const supportsUnaligned = runtime.GOARCH == "386" || runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64" || runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le" || runtime.GOARCH == "s390x"
 
 // fastXORBytes xors in bulk. It only works on architectures that
 // support unaligned read/writes.
@@ -60,19 +60,45 @@ func safeXORBytes(dst, a, b []byte) int {
 	return n
 }
 
+// alignedXORBytes xors the bytes up to the first word boundary of dst one by one, the
+// words behind it wordwise, and the tail one by one again, so it never accesses a word
+// unaligned. a and b must share the alignment of dst for the words, it falls back to
+// safeXORBytes otherwise.
+func alignedXORBytes(dst, a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 0
+	}
+	pd, pa, pb := uintptr(unsafe.Pointer(&dst[0])), uintptr(unsafe.Pointer(&a[0])), uintptr(unsafe.Pointer(&b[0]))
+	head := int(-pd & uintptr(wordSize-1))
+	if head >= n || ((pd^pa)|(pd^pb))&uintptr(wordSize-1) != 0 {
+		return safeXORBytes(dst, a, b)
+	}
+
+	for i := 0; i < head; i++ {
+		dst[i] = a[i] ^ b[i]
+	}
+	end := head + (n-head)/wordSize*wordSize
+	if end > head {
+		fastXORWords(dst[head:end], a[head:end], b[head:end])
+	}
+	for i := end; i < n; i++ {
+		dst[i] = a[i] ^ b[i]
+	}
+	return n
+}
+
 // xorBytes xors the bytes in a and b. The destination is assumed to have enough
-// space. Returns the number of bytes xor'd.
+// space. Returns the number of bytes xor'd. Architectures without unaligned access
+// xor the words of buffers sharing their alignment, see alignedXORBytes.
 func xorBytes(dst, a, b []byte) int {
 	if supportsUnaligned {
 		return fastXORBytes(dst, a, b)
-	} else {
-		// TODO(hanwen): if (dst, a, b) have common alignment
-		// we could still try fastXORBytes. It is not clear
-		// how often this happens, and it's only worth it if
-		// the block encryption itself is hardware
-		// accelerated.
-		return safeXORBytes(dst, a, b)
 	}
+	return alignedXORBytes(dst, a, b)
 }
 
 // fastXORWords XORs multiples of 4 or 8 bytes (depending on architecture.)
@@ -106,6 +132,6 @@ func xorWords(dst, a, b []byte) {
 	if supportsUnaligned {
 		fastXORWords(dst, a, b)
 	} else {
-		safeXORBytes(dst, a, b)
+		alignedXORBytes(dst, a, b)
 	}
 }
@@ -6,6 +6,7 @@ package kcp
 
 import (
 	"bytes"
+	"math/rand"
 	"testing"
 )
 
@@ -26,3 +27,68 @@ func TestXOR(t *testing.T) {
 		}
 	}
 }
+
+// the word paths against the bytewise one, at random offsets and lengths
+func TestXORRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	buf := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	paths := map[string]func(dst, a, b []byte) int{
+		"xorBytes":        xorBytes,
+		"alignedXORBytes": alignedXORBytes,
+	}
+	if supportsUnaligned {
+		paths["fastXORBytes"] = fastXORBytes
+	}
+	for k := 0; k < 5000; k++ {
+		offD, offA, offB := rng.Intn(2*wordSize), rng.Intn(2*wordSize), rng.Intn(2*wordSize)
+		n := rng.Intn(300)
+		if k%4 == 0 { // offsets alike, for the word path of alignedXORBytes
+			offA, offB = offD, offD
+		}
+		a := buf(offA + n)[offA:]
+		b := buf(offB + n + rng.Intn(4))[offB:]
+		want := make([]byte, offD+n+wordSize)[offD:]
+		safeXORBytes(want, a, b)
+		for name, xor := range paths {
+			got := make([]byte, offD+n+wordSize)[offD:]
+			if m := xor(got, a, b); m != n || !bytes.Equal(got, want) {
+				t.Fatalf("%v: offsets %v %v %v, length %v: xor'd %v\n got %x\nwant %x", name, offD, offA, offB, n, m, got, want)
+			}
+		}
+		if n%wordSize == 0 {
+			got := make([]byte, offD+n+wordSize)[offD:]
+			xorWords(got, a, b[:n])
+			if !bytes.Equal(got, want) {
+				t.Fatalf("xorWords: offsets %v %v %v, length %v", offD, offA, offB, n)
+			}
+		}
+	}
+}
+
+func BenchmarkXOR(b *testing.B) {
+	for _, bench := range []struct {
+		name   string
+		xor    func(dst, a, b []byte) int
+		offset int
+	}{
+		{"safe", safeXORBytes, 0},
+		{"aligned", alignedXORBytes, 0},
+		{"unaligned", alignedXORBytes, 1},
+		{"xorBytes", xorBytes, 0},
+		{"xorBytesUnaligned", xorBytes, 1},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			dst := make([]byte, mtuLimit+bench.offset)[bench.offset:]
+			src := make([]byte, mtuLimit+bench.offset)[bench.offset:]
+			tbl := make([]byte, mtuLimit)
+			b.SetBytes(mtuLimit)
+			for i := 0; i < b.N; i++ {
+				bench.xor(dst, src, tbl)
+			}
+		})
+	}
+}